@@ -1,21 +1,29 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
+	"github.com/dvjn/sorcerer/internal/access"
 	"github.com/dvjn/sorcerer/internal/api"
 	"github.com/dvjn/sorcerer/internal/auth"
 	"github.com/dvjn/sorcerer/internal/config"
 	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/gc"
 	"github.com/dvjn/sorcerer/internal/logger"
+	"github.com/dvjn/sorcerer/internal/proxy"
+	"github.com/dvjn/sorcerer/internal/replication"
 	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/webhook"
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
 	logger.Initialize()
-	log.Info().Msg("starting sorcerer")
 
 	config, err := config.Load()
 	if err != nil {
@@ -30,7 +38,29 @@ func main() {
 		log.Fatal().Errs("errors", errors).Msg("config validations failed")
 	}
 
-	auth, err := auth.New(&config.Auth, &log.Logger)
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		runGC(config, os.Args[2:])
+		return
+	}
+
+	serve(config)
+}
+
+func serve(config *config.Config) {
+	log.Info().Msg("starting sorcerer")
+
+	// Without a policy, authenticated users may do anything
+	var authorizer access.Authorizer
+	if config.Auth.Policy.File != "" {
+		policy, err := access.LoadPolicy(config.Auth.Policy.File)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load access policy")
+		}
+		authorizer = policy
+		log.Debug().Int("rules", len(policy.Rules)).Msg("loaded access policy")
+	}
+
+	auth, err := auth.New(context.Background(), &config.Auth, authorizer, &log.Logger)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize auth")
 	}
@@ -42,10 +72,60 @@ func main() {
 	}
 	log.Debug().Msg("initialized store")
 
-	distribution := distribution.New(store, auth.DistributionMiddleware())
+	if config.Store.UploadTTL > 0 {
+		go gc.ScheduleUploadJanitor(context.Background(), store, config.Store.UploadTTL, &log.Logger)
+		log.Debug().Dur("ttl", config.Store.UploadTTL).Msg("scheduled upload janitor")
+	}
+
+	if config.GC.Interval > 0 {
+		go gc.Schedule(context.Background(), store, gc.OptionsFromConfig(&config.GC), config.GC.Interval, &log.Logger)
+		log.Debug().Dur("interval", config.GC.Interval).Msg("scheduled garbage collection")
+	}
+
+	// The cache is only consulted by the distribution API, garbage collection
+	// and the upload janitor work on the store underneath
+	distributionStore := store
+	if config.Proxy.Upstream != "" {
+		proxy, err := proxy.New(store, &config.Proxy, &log.Logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to initialize proxy")
+		}
+		distributionStore = proxy
+		log.Info().Str("upstream", config.Proxy.Upstream).Msg("serving as a pull-through cache")
+	}
+
+	// Admin endpoints are only served if there is something to administer
+	var admin http.Handler
+	var listeners []distribution.Listener
+	if config.Replication.Rules != "" || config.Replication.RulesFile != "" {
+		replicator, err := replication.New(store, &config.Replication, &log.Logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to initialize replication")
+		}
+		go replicator.Run(context.Background())
+		listeners = append(listeners, replicator)
+
+		router := chi.NewRouter()
+		router.Use(auth.DistributionMiddleware())
+		router.Mount("/replication", replicator.Router())
+		admin = router
+		log.Debug().Msg("initialized replication")
+	}
+
+	if config.Webhooks.Endpoints != "" || config.Webhooks.EndpointsFile != "" {
+		dispatcher, err := webhook.New(&config.Webhooks, &log.Logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to initialize webhooks")
+		}
+		go dispatcher.Run(context.Background())
+		listeners = append(listeners, dispatcher)
+		log.Debug().Msg("initialized webhooks")
+	}
+
+	distribution := distribution.New(distributionStore, auth.DistributionMiddleware(), authorizer, listeners...)
 	log.Debug().Msg("initialized distribution")
 
-	api := api.New(distribution.Router(), auth.Router())
+	api := api.New(distribution.Router(), auth.Router(), admin)
 	log.Debug().Msg("initialized api")
 
 	log.Info().Msgf("listening on port %d", config.Server.Port)
@@ -54,3 +134,34 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
 }
+
+func runGC(config *config.Config, args []string) {
+	opts := gc.OptionsFromConfig(&config.GC)
+
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	flags.BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "only report what would be removed")
+	flags.BoolVar(&opts.DeleteUntagged, "delete-untagged", opts.DeleteUntagged, "also remove manifests not reachable from a tag")
+	flags.DurationVar(&opts.GracePeriod, "grace-period", opts.GracePeriod, "never remove content younger than this")
+	flags.Parse(args)
+
+	store, err := store.New(&config.Store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize store")
+	}
+
+	report, err := gc.Run(context.Background(), store, opts, &log.Logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("garbage collection failed")
+	}
+
+	for _, item := range report.Manifests {
+		log.Info().Str("repository", item.Repository).Str("digest", item.Digest).Int64("size", item.Size).Msg("manifest")
+	}
+	for _, item := range report.Blobs {
+		log.Info().Str("repository", item.Repository).Str("digest", item.Digest).Int64("size", item.Size).Msg("blob")
+	}
+	for _, item := range report.PoolBlobs {
+		log.Info().Str("digest", item.Digest).Int64("size", item.Size).Msg("pooled blob")
+	}
+	gc.LogReport(&log.Logger, report)
+}
@@ -0,0 +1,134 @@
+package access
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Actions on repositories, as named in the scopes of the docker token spec.
+const (
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+)
+
+// Scope is access to a resource, such as "repository:team/app:pull,push".
+// The JSON encoding is the one of access entries in tokens.
+type Scope struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// CatalogScope is needed to list the repositories of the registry.
+var CatalogScope = Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}}
+
+func (s Scope) String() string {
+	return s.Type + ":" + s.Name + ":" + strings.Join(s.Actions, ",")
+}
+
+// Allows reports whether s grants all actions of the other scope.
+func (s Scope) Allows(other Scope) bool {
+	if s.Type != other.Type || s.Name != other.Name {
+		return false
+	}
+	for _, action := range other.Actions {
+		if !slices.Contains(s.Actions, action) && !slices.Contains(s.Actions, "*") {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseScope parses a scope as requested from the token endpoint. Names may
+// hold a port, as in "registry.example.com:5000/app", so the type is split
+// off the front and the actions off the back.
+func ParseScope(s string) (Scope, bool) {
+	typ, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return Scope{}, false
+	}
+	i := strings.LastIndex(rest, ":")
+	if i < 0 || typ == "" || rest[:i] == "" {
+		return Scope{}, false
+	}
+
+	// Types may carry a class, as in "repository(plugin)"
+	typ, _, _ = strings.Cut(typ, "(")
+
+	var actions []string
+	for action := range strings.SplitSeq(rest[i+1:], ",") {
+		if action != "" && !slices.Contains(actions, action) {
+			actions = append(actions, action)
+		}
+	}
+	return Scope{Type: typ, Name: rest[:i], Actions: actions}, true
+}
+
+// Required returns the scopes a request to the distribution API needs. It is
+// empty for the base endpoint, which only needs a client to authenticate,
+// and for requests outside the distribution API.
+func Required(r *http.Request) []Scope {
+	path, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok || path == "" {
+		return nil
+	}
+	if path == "_catalog" {
+		return []Scope{CatalogScope}
+	}
+
+	name, route, ok := SplitRepositoryPath(path)
+	if !ok {
+		return nil
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return []Scope{{Type: "repository", Name: name, Actions: []string{ActionPull}}}
+	case http.MethodDelete:
+		if strings.HasPrefix(route, "/blobs/uploads/") {
+			// Cancelling an upload is part of pushing
+			return []Scope{{Type: "repository", Name: name, Actions: []string{ActionPull, ActionPush}}}
+		}
+		return []Scope{{Type: "repository", Name: name, Actions: []string{ActionDelete}}}
+	default:
+		return []Scope{{Type: "repository", Name: name, Actions: []string{ActionPull, ActionPush}}}
+	}
+}
+
+// MountSource returns the repository a request mounts a blob from. Pulling
+// from it is not required, a blob that cannot be mounted is uploaded instead.
+func MountSource(r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	if r.Method != http.MethodPost || !query.Has("mount") || query.Get("from") == "" {
+		return "", false
+	}
+	return query.Get("from"), true
+}
+
+// SplitRepositoryPath splits a path like "team/platform/base/blobs/uploads/id"
+// into the repository name and the route that follows it. Since repository
+// names may themselves contain components like "blobs" or "manifests", the
+// route is resolved from the end of the path.
+func SplitRepositoryPath(path string) (string, string, bool) {
+	segments := strings.Split(path, "/")
+	n := len(segments)
+
+	if n >= 4 && segments[n-3] == "blobs" && segments[n-2] == "uploads" {
+		return strings.Join(segments[:n-3], "/"), "/" + strings.Join(segments[n-3:], "/"), true
+	}
+
+	if n >= 3 {
+		switch segments[n-2] {
+		case "blobs", "manifests", "referrers":
+			return strings.Join(segments[:n-2], "/"), "/" + strings.Join(segments[n-2:], "/"), true
+		case "tags":
+			if segments[n-1] == "list" {
+				return strings.Join(segments[:n-2], "/"), "/" + strings.Join(segments[n-2:], "/"), true
+			}
+		}
+	}
+
+	return "", "", false
+}
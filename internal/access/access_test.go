@@ -0,0 +1,238 @@
+package access
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSplitRepositoryPath(t *testing.T) {
+	tests := []struct {
+		path      string
+		wantName  string
+		wantRoute string
+		wantOK    bool
+	}{
+		{"app/blobs/sha256:abc", "app", "/blobs/sha256:abc", true},
+		{"team/app/blobs/uploads/", "team/app", "/blobs/uploads/", true},
+		{"team/app/blobs/uploads/id", "team/app", "/blobs/uploads/id", true},
+		{"team/manifests/app/manifests/latest", "team/manifests/app", "/manifests/latest", true},
+		{"team/app/tags/list", "team/app", "/tags/list", true},
+		{"team/app/referrers/sha256:abc", "team/app", "/referrers/sha256:abc", true},
+		{"team/app/tags/other", "", "", false},
+		{"app", "", "", false},
+	}
+
+	for _, tt := range tests {
+		name, route, ok := SplitRepositoryPath(tt.path)
+		if name != tt.wantName || route != tt.wantRoute || ok != tt.wantOK {
+			t.Errorf("SplitRepositoryPath(%q) = %q, %q, %v, want %q, %q, %v", tt.path, name, route, ok, tt.wantName, tt.wantRoute, tt.wantOK)
+		}
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope  string
+		want   string
+		wantOK bool
+	}{
+		{"repository:team/app:pull", "repository:team/app:pull", true},
+		{"repository:team/app:pull,push,pull", "repository:team/app:pull,push", true},
+		{"repository(plugin):app:pull", "repository:app:pull", true},
+		{"repository:localhost:5000/app:pull", "repository:localhost:5000/app:pull", true},
+		{"registry:catalog:*", "registry:catalog:*", true},
+		{"repository:app:", "repository:app:", true},
+		{"repository:app", "", false},
+		{"repository", "", false},
+		{":app:pull", "", false},
+	}
+
+	for _, tt := range tests {
+		scope, ok := ParseScope(tt.scope)
+		if ok != tt.wantOK || (ok && scope.String() != tt.want) {
+			t.Errorf("ParseScope(%q) = %q, %v, want %q, %v", tt.scope, scope, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   []string
+	}{
+		{"GET", "/v2/", nil},
+		{"GET", "/healthz", nil},
+		{"GET", "/v2/_catalog", []string{"registry:catalog:*"}},
+		{"GET", "/v2/team/app/manifests/latest", []string{"repository:team/app:pull"}},
+		{"HEAD", "/v2/team/app/blobs/sha256:abc", []string{"repository:team/app:pull"}},
+		{"GET", "/v2/team/app/tags/list", []string{"repository:team/app:pull"}},
+		{"PUT", "/v2/team/app/manifests/latest", []string{"repository:team/app:pull,push"}},
+		{"POST", "/v2/team/app/blobs/uploads/", []string{"repository:team/app:pull,push"}},
+		{"POST", "/v2/team/app/blobs/uploads/?mount=sha256:abc&from=base", []string{"repository:team/app:pull,push"}},
+		{"PATCH", "/v2/team/app/blobs/uploads/id", []string{"repository:team/app:pull,push"}},
+		{"DELETE", "/v2/team/app/blobs/uploads/id", []string{"repository:team/app:pull,push"}},
+		{"DELETE", "/v2/team/app/manifests/sha256:abc", []string{"repository:team/app:delete"}},
+		{"GET", "/v2/team/app", nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, scope := range Required(httptest.NewRequest(tt.method, tt.path, nil)) {
+			got = append(got, scope.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Required(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	granted := Scope{Type: "repository", Name: "app", Actions: []string{ActionPull, ActionPush}}
+
+	if !granted.Allows(Scope{Type: "repository", Name: "app", Actions: []string{ActionPull}}) {
+		t.Error("Expected pull to be allowed")
+	}
+	if granted.Allows(Scope{Type: "repository", Name: "app", Actions: []string{ActionPull, ActionDelete}}) {
+		t.Error("Expected delete not to be allowed")
+	}
+	if granted.Allows(Scope{Type: "repository", Name: "other", Actions: []string{ActionPull}}) {
+		t.Error("Expected other repositories not to be allowed")
+	}
+	if !CatalogScope.Allows(CatalogScope) {
+		t.Error("Expected wildcard to allow the catalog")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{
+		Groups: map[string][]string{"developers": {"alice"}},
+		Rules: []PolicyRule{
+			{Users: []string{"*"}, Repositories: []string{"public/*"}, Actions: []string{ActionPull}},
+			{Groups: []string{"developers"}, Repositories: []string{"team/*"}, Actions: []string{ActionPull, ActionPush}},
+			{Groups: []string{"ops"}, Repositories: []string{"team/*"}, Actions: []string{ActionDelete}},
+			{Users: []string{"root"}, Repositories: []string{"*", "*/*"}, Actions: []string{"*"}},
+		},
+	}
+
+	tests := []struct {
+		user       User
+		repository string
+		want       []string
+	}{
+		{User{Name: "bob"}, "public/base", []string{ActionPull}},
+		{User{Name: "bob"}, "team/app", nil},
+		{User{Name: "alice"}, "team/app", []string{ActionPull, ActionPush}},
+		{User{Name: "alice"}, "team/app/nested", nil},
+		{User{Name: "bob", Groups: []string{"developers", "ops"}}, "team/app", []string{ActionPull, ActionPush, ActionDelete}},
+		{User{Name: "root"}, "app", []string{ActionPull, ActionPush, ActionDelete}},
+		{User{}, "public/base", nil},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Actions(tt.user, tt.repository); !slices.Equal(got, tt.want) {
+			t.Errorf("Actions(%v, %q) = %v, want %v", tt.user, tt.repository, got, tt.want)
+		}
+	}
+
+	if !Allowed(policy, User{Name: "bob"}, CatalogScope) {
+		t.Error("Expected the catalog to be allowed")
+	}
+	if Allowed(policy, User{Name: "alice"}, Scope{Type: "repository", Name: "team/app", Actions: []string{ActionPull, ActionDelete}}) {
+		t.Error("Expected delete not to be allowed")
+	}
+
+	// Tokens limit users to what both they and the policy grant
+	limited := User{Name: "alice", Token: &Policy{Rules: []PolicyRule{{Users: []string{"*"}, Repositories: []string{"*/*"}, Actions: []string{ActionPull}}}}}
+	if !Allowed(policy, limited, Scope{Type: "repository", Name: "team/app", Actions: []string{ActionPull}}) {
+		t.Error("Expected pull to be allowed with the token")
+	}
+	if Allowed(policy, limited, Scope{Type: "repository", Name: "team/app", Actions: []string{ActionPush}}) {
+		t.Error("Expected push not to be allowed with the token")
+	}
+	if Allowed(nil, limited, Scope{Type: "repository", Name: "app", Actions: []string{ActionPull}}) {
+		t.Error("Expected the token to limit users without a policy")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"rules":[{"users":["*"],"repositories":["*"],"actions":["pull"]}]}`, false},
+		{"invalid json", `{`, true},
+		{"no users", `{"rules":[{"repositories":["*"],"actions":["pull"]}]}`, true},
+		{"no repositories", `{"rules":[{"users":["*"],"actions":["pull"]}]}`, true},
+		{"invalid glob", `{"rules":[{"users":["*"],"repositories":["["],"actions":["pull"]}]}`, true},
+		{"partial double star", `{"rules":[{"users":["*"],"repositories":["team/app**"],"actions":["pull"]}]}`, true},
+		{"invalid action", `{"rules":[{"users":["*"],"repositories":["*"],"actions":["write"]}]}`, true},
+	}
+
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(file, []byte(tt.content), 0o600); err != nil {
+			t.Fatalf("Failed to write policy: %v", err)
+		}
+		if _, err := LoadPolicy(file); (err != nil) != tt.wantErr {
+			t.Errorf("%s: LoadPolicy() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if _, err := LoadPolicy(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected missing policy to fail")
+	}
+}
+
+func TestMatchRepository(t *testing.T) {
+	tests := []struct {
+		glob string
+		name string
+		want bool
+	}{
+		{"app", "app", true},
+		{"app", "team/app", false},
+		{"*", "app", true},
+		{"*", "team/app", false},
+		{"team/*", "team/app", true},
+		{"team/*", "team/app/nested", false},
+		{"**", "app", true},
+		{"**", "team/app/nested", true},
+		{"team/**", "team", true},
+		{"team/**", "team/app", true},
+		{"team/**", "team/app/nested", true},
+		{"team/**", "other/app", false},
+		{"team/**", "teams/app", false},
+		{"**/app", "app", true},
+		{"**/app", "team/sub/app", true},
+		{"**/app", "team/app/nested", false},
+		{"team/**/cache", "team/cache", true},
+		{"team/**/cache", "team/app/build/cache", true},
+		{"team/**/cache", "team/app/build", false},
+		{"team/*/**", "team", false},
+		{"team/*/**", "team/app/nested", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchRepository(tt.glob, tt.name); got != tt.want {
+			t.Errorf("MatchRepository(%q, %q) = %v, want %v", tt.glob, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRepositoryGlob(t *testing.T) {
+	for _, glob := range []string{"app", "team/*", "**", "team/**/cache", "team/app-[0-9]"} {
+		if err := ValidateRepositoryGlob(glob); err != nil {
+			t.Errorf("ValidateRepositoryGlob(%q) = %v, want nil", glob, err)
+		}
+	}
+	for _, glob := range []string{"", "[", "team/[", "team**", "team/**app", "***"} {
+		if err := ValidateRepositoryGlob(glob); err == nil {
+			t.Errorf("ValidateRepositoryGlob(%q) = nil, want an error", glob)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package access
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Repository globs are matched against repository names one component at a
+// time with path.Match, so "*" does not match across slashes. A component
+// of "**" matches any number of components, including none: "team/**"
+// matches "team", "team/app" and "team/app/nested", and "**" matches every
+// repository.
+
+// MatchRepository reports whether the repository name matches glob.
+func MatchRepository(glob, name string) bool {
+	return matchComponents(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+// MatchAnyRepository reports whether the repository name matches any of the
+// globs.
+func MatchAnyRepository(globs []string, name string) bool {
+	for _, glob := range globs {
+		if MatchRepository(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComponents(globs, names []string) bool {
+	for len(globs) > 0 {
+		if globs[0] == "**" {
+			for i := range len(names) + 1 {
+				if matchComponents(globs[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(globs[0], names[0]); !matched {
+			return false
+		}
+		globs, names = globs[1:], names[1:]
+	}
+	return len(names) == 0
+}
+
+// ValidateRepositoryGlob returns an error if glob is empty or malformed.
+func ValidateRepositoryGlob(glob string) error {
+	if glob == "" {
+		return fmt.Errorf("empty repository glob")
+	}
+	for component := range strings.SplitSeq(glob, "/") {
+		if component != "**" && strings.Contains(component, "**") {
+			return fmt.Errorf("invalid repository glob %q: ** must be a whole component", glob)
+		}
+		if _, err := path.Match(component, ""); err != nil {
+			return fmt.Errorf("invalid repository glob %q: %w", glob, err)
+		}
+	}
+	return nil
+}
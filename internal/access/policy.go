@@ -0,0 +1,135 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Authorizer decides which actions users may perform on repositories.
+type Authorizer interface {
+	// Actions returns the actions user may perform on the repository.
+	Actions(user User, repository string) []string
+}
+
+// Allowed reports whether authorizer, if not nil, and the token of user, if
+// any, both grant user all actions of scope. Anonymous users with a token are
+// only granted what it grants, as policies grant anonymous users nothing. The
+// catalog may be listed by anyone, as it only shows the repositories a user
+// may pull from.
+func Allowed(authorizer Authorizer, user User, scope Scope) bool {
+	if scope.Type == CatalogScope.Type && scope.Name == CatalogScope.Name {
+		return true
+	}
+	if scope.Type != "repository" {
+		return false
+	}
+	authorizers := []Authorizer{authorizer, user.Token}
+	if user.Name == "" && user.Token != nil {
+		authorizers = []Authorizer{user.Token}
+	}
+	for _, a := range authorizers {
+		if a == nil {
+			continue
+		}
+		granted := Scope{Type: scope.Type, Name: scope.Name, Actions: a.Actions(user, scope.Name)}
+		if !granted.Allows(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy grants actions on repositories to users, either by name or through
+// the groups they are in. Groups are defined by the policy, and add to those
+// the authentication backend puts users in.
+type Policy struct {
+	Groups map[string][]string `json:"groups"`
+	Rules  []PolicyRule        `json:"rules"`
+}
+
+// PolicyRule grants actions on the repositories matching any of its globs, in
+// which "*" does not match across slashes and "**" matches any number of
+// components. The user "*" is any authenticated user.
+type PolicyRule struct {
+	Users        []string `json:"users"`
+	Groups       []string `json:"groups"`
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+}
+
+// LoadPolicy reads a policy from a JSON file.
+func LoadPolicy(file string) (*Policy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *Policy) validate() error {
+	for i, rule := range p.Rules {
+		if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+			return fmt.Errorf("policy rule %d applies to no users or groups", i)
+		}
+		if len(rule.Repositories) == 0 {
+			return fmt.Errorf("policy rule %d applies to no repositories", i)
+		}
+		for _, repository := range rule.Repositories {
+			if err := ValidateRepositoryGlob(repository); err != nil {
+				return fmt.Errorf("policy rule %d has an invalid repository glob: %q", i, repository)
+			}
+		}
+		for _, action := range rule.Actions {
+			if action != ActionPull && action != ActionPush && action != ActionDelete && action != "*" {
+				return fmt.Errorf("policy rule %d has an invalid action: %q", i, action)
+			}
+		}
+	}
+	return nil
+}
+
+// Actions returns the actions of all rules that apply to user and the
+// repository. Anonymous users, those without a name, are granted nothing.
+func (p *Policy) Actions(user User, repository string) []string {
+	if user.Name == "" {
+		return nil
+	}
+
+	var actions []string
+	for _, rule := range p.Rules {
+		if !p.applies(rule, user) || !MatchAnyRepository(rule.Repositories, repository) {
+			continue
+		}
+		for _, action := range rule.Actions {
+			if action == "*" {
+				return []string{ActionPull, ActionPush, ActionDelete}
+			}
+			if !slices.Contains(actions, action) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return actions
+}
+
+func (p *Policy) applies(rule PolicyRule, user User) bool {
+	if slices.Contains(rule.Users, "*") || slices.Contains(rule.Users, user.Name) {
+		return true
+	}
+	for _, group := range rule.Groups {
+		if slices.Contains(user.Groups, group) || slices.Contains(p.Groups[group], user.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package access
+
+import "context"
+
+// User is an authenticated user. Groups are those the authentication backend
+// puts the user in, such as the groups of an LDAP directory, and add to the
+// groups a policy defines.
+type User struct {
+	Name   string
+	Groups []string
+	// Token limits the user to the actions it grants, for users authenticated
+	// with an access token rather than their credentials, and anonymous users
+	// allowed to pull public repositories.
+	Token Authorizer
+}
+
+type contextKey struct{}
+
+// WithUser returns a context of a request authenticated as user.
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// UserFromContext returns the user a request is authenticated as. Requests
+// without one are anonymous.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(contextKey{}).(User)
+	return user, ok
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/dvjn/sorcerer/internal/logger"
+	"github.com/dvjn/sorcerer/internal/metrics"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -12,10 +13,12 @@ import (
 type Api struct {
 	distribution http.Handler
 	auth         http.Handler
+	admin        http.Handler
 }
 
-func New(distribution, auth http.Handler) *Api {
-	return &Api{distribution: distribution, auth: auth}
+// New creates the api, serving admin endpoints under /admin if admin is set.
+func New(distribution, auth, admin http.Handler) *Api {
+	return &Api{distribution: distribution, auth: auth, admin: admin}
 }
 
 func (a *Api) Router() *chi.Mux {
@@ -26,9 +29,13 @@ func (a *Api) Router() *chi.Mux {
 
 	r.Get("/", a.index)
 	r.Get("/healthz", a.heartbeat)
+	r.Handle("/metrics", metrics.Handler())
 
 	r.Mount("/v2", a.distribution)
 	r.Mount("/auth", a.auth)
+	if a.admin != nil {
+		r.Mount("/admin", a.admin)
+	}
 
 	return r
 }
@@ -1,12 +1,18 @@
 package auth
 
 import (
+	"context"
 	_ "embed"
 	"fmt"
 	"net/http"
 
+	"github.com/dvjn/sorcerer/internal/access"
 	"github.com/dvjn/sorcerer/internal/auth/htpasswd"
+	"github.com/dvjn/sorcerer/internal/auth/ldap"
 	"github.com/dvjn/sorcerer/internal/auth/no_auth"
+	"github.com/dvjn/sorcerer/internal/auth/oidc"
+	"github.com/dvjn/sorcerer/internal/auth/pat"
+	"github.com/dvjn/sorcerer/internal/auth/token"
 	"github.com/dvjn/sorcerer/internal/config"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
@@ -17,12 +23,31 @@ type Auth interface {
 	DistributionMiddleware() func(http.Handler) http.Handler
 }
 
-func New(c *config.AuthConfig, logger *zerolog.Logger) (Auth, error) {
+// New returns the authentication of the configured mode. Modes issuing
+// credentials that carry permissions, like tokens, only grant those allowed
+// by authorizer, if it is not nil. Access tokens are accepted on top of the
+// credentials of the mode if configured. Files of credentials are watched for
+// changes until ctx is done.
+func New(ctx context.Context, c *config.AuthConfig, authorizer access.Authorizer, logger *zerolog.Logger) (Auth, error) {
+	auth, err := newMode(ctx, c, authorizer, logger)
+	if err != nil || c.PAT.File == "" {
+		return auth, err
+	}
+	return pat.New(&c.PAT, auth, logger)
+}
+
+func newMode(ctx context.Context, c *config.AuthConfig, authorizer access.Authorizer, logger *zerolog.Logger) (Auth, error) {
 	switch c.Mode {
 	case config.AuthModeNone:
 		return no_auth.New(&c.NoAuth), nil
 	case config.AuthModeHtpasswd:
-		return htpasswd.NewHtpasswdAuth(&c.Htpasswd, logger)
+		return htpasswd.NewHtpasswdAuth(ctx, &c.Htpasswd, logger)
+	case config.AuthModeToken:
+		return token.NewTokenAuth(ctx, c, authorizer, logger)
+	case config.AuthModeOIDC:
+		return oidc.New(&c.OIDC, logger)
+	case config.AuthModeLDAP:
+		return ldap.New(&c.LDAP, logger)
 	default:
 		return nil, fmt.Errorf("unknown auth mode: %s", c.Mode)
 	}
@@ -0,0 +1,62 @@
+package htpasswd
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+// publicRepositories are the globs of repositories anonymous users may pull
+// from, all repositories if there are none.
+type publicRepositories []string
+
+func parsePublicRepositories(globs string) publicRepositories {
+	var public publicRepositories
+	for glob := range strings.SplitSeq(globs, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			public = append(public, glob)
+		}
+	}
+	return public
+}
+
+// Actions grants pulling from public repositories.
+func (p publicRepositories) Actions(user access.User, repository string) []string {
+	if p.matches(repository) {
+		return []string{access.ActionPull}
+	}
+	return nil
+}
+
+func (p publicRepositories) matches(repository string) bool {
+	return len(p) == 0 || access.MatchAnyRepository(p, repository)
+}
+
+// allowsAnonymous reports whether a request without credentials may be
+// served, as a read of the manifests, blobs, tags or referrers of a public
+// repository. Uploads, the catalog and everything else still need
+// credentials.
+func (a *HtpasswdAuth) allowsAnonymous(r *http.Request) bool {
+	if !a.config.AnonymousPull || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		return false
+	}
+	name, route, ok := access.SplitRepositoryPath(rest)
+	if !ok || !a.public.matches(name) {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(route, "/blobs/uploads/"):
+		return false
+	case strings.HasPrefix(route, "/manifests/"), strings.HasPrefix(route, "/blobs/"), strings.HasPrefix(route, "/referrers/"), route == "/tags/list":
+		return true
+	default:
+		return false
+	}
+}
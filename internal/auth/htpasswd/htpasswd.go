@@ -1,8 +1,15 @@
 package htpasswd
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dvjn/sorcerer/internal/config"
 	"github.com/go-chi/chi/v5"
@@ -10,26 +17,56 @@ import (
 	htpasswdlib "github.com/tg123/go-htpasswd"
 )
 
+// watchInterval is how often the htpasswd file is checked for changes.
+const watchInterval = 2 * time.Second
+
 type HtpasswdAuth struct {
 	config *config.HtpasswdConfig
-	file   *htpasswdlib.File
+	public publicRepositories
 	logger *zerolog.Logger
+
+	mu   sync.RWMutex
+	file *htpasswdlib.File
+	// stat is the htpasswd file as last loaded, to notice changes
+	stat os.FileInfo
+
+	// interval is how often the file is checked for changes, and stopped is
+	// closed once the watcher returns
+	interval time.Duration
+	stopped  chan struct{}
 }
 
-func NewHtpasswdAuth(cfg *config.HtpasswdConfig, logger *zerolog.Logger) (*HtpasswdAuth, error) {
+// NewHtpasswdAuth loads the users of the htpasswd file or contents. A file is
+// watched for changes until ctx is done.
+func NewHtpasswdAuth(ctx context.Context, cfg *config.HtpasswdConfig, logger *zerolog.Logger) (*HtpasswdAuth, error) {
+	return newHtpasswdAuth(ctx, cfg, logger, watchInterval)
+}
+
+// newHtpasswdAuth is NewHtpasswdAuth checking the file for changes at the
+// given interval.
+func newHtpasswdAuth(ctx context.Context, cfg *config.HtpasswdConfig, logger *zerolog.Logger, interval time.Duration) (*HtpasswdAuth, error) {
 	if logger == nil {
 		return nil, fmt.Errorf("logger is required")
 	}
 
 	auth := &HtpasswdAuth{
 		config: cfg,
+		public: parsePublicRepositories(cfg.PublicRepositories),
 		logger: logger,
+
+		interval: interval,
+		stopped:  make(chan struct{}),
 	}
 
 	if err := auth.loadHtpasswdFile(); err != nil {
 		return nil, fmt.Errorf("failed to load htpasswd data: %w", err)
 	}
 
+	// Users can be added to the file without restarting
+	if cfg.Contents == "" {
+		go auth.watch(ctx)
+	}
+
 	// Log successful initialization
 	auth.logger.Info().
 		Str("auth_type", "htpasswd").
@@ -48,8 +85,7 @@ func (a *HtpasswdAuth) loadHtpasswdFile() error {
 		a.logger.Info().
 			Str("source", "inline").
 			Msg("loading htpasswd from inline contents")
-		r := strings.NewReader(a.config.Contents)
-		file, err := htpasswdlib.NewFromReader(r, htpasswdlib.DefaultSystems, nil)
+		file, err := parseContent([]byte(a.config.Contents))
 		if err != nil {
 			return fmt.Errorf("failed to parse htpasswd content: %w", err)
 		}
@@ -63,23 +99,138 @@ func (a *HtpasswdAuth) loadHtpasswdFile() error {
 			Str("file", a.config.File).
 			Msg("loading htpasswd from file")
 
-		// Load using the library
-		file, err := htpasswdlib.New(a.config.File, htpasswdlib.DefaultSystems, nil)
+		file, stat, err := parse(a.config.File)
 		if err != nil {
 			return fmt.Errorf("failed to load htpasswd file %s: %w", a.config.File, err)
 		}
 
 		a.file = file
+		a.stat = stat
 		return nil
 	}
 
 	return fmt.Errorf("neither file nor contents provided for htpasswd auth")
 }
 
+// watch reloads the htpasswd file when it changes, or the process receives
+// SIGHUP, until ctx is done.
+func (a *HtpasswdAuth) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	defer close(a.stopped)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			a.reload("signal")
+		case <-ticker.C:
+			if a.changed() {
+				a.reload("file changed")
+			}
+		}
+	}
+}
+
+// changed reports whether the htpasswd file differs from the one last
+// loaded. A missing file, like while it is being replaced, is no change.
+func (a *HtpasswdAuth) changed() bool {
+	stat, err := os.Stat(a.config.File)
+	if err != nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.stat == nil || !stat.ModTime().Equal(a.stat.ModTime()) || stat.Size() != a.stat.Size()
+}
+
+// reload reads the htpasswd file again and swaps in its users. If it cannot
+// be read or holds malformed lines, the users loaded before are kept.
+func (a *HtpasswdAuth) reload(reason string) error {
+	file, stat, err := parse(a.config.File)
+
+	a.mu.Lock()
+	// A broken file is not reloaded again until it changes
+	if stat != nil {
+		a.stat = stat
+	}
+	if err == nil {
+		a.file = file
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		a.logger.Error().
+			Err(err).
+			Str("file", a.config.File).
+			Str("reason", reason).
+			Msg("failed to reload htpasswd file, keeping previous credentials")
+		return err
+	}
+
+	a.logger.Info().
+		Str("file", a.config.File).
+		Str("reason", reason).
+		Msg("reloaded htpasswd file")
+	return nil
+}
+
+// parse loads an htpasswd file, failing on malformed lines, and on files
+// without users, as a file being written may briefly be. The stat of the file
+// is returned even if it cannot be parsed.
+func parse(name string) (*htpasswdlib.File, os.FileInfo, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, stat, err
+	}
+	file, err := parseContent(content)
+	return file, stat, err
+}
+
+// parseContent parses htpasswd content, failing on malformed lines and on
+// content without users. Lines starting with # are comments.
+func parseContent(content []byte) (*htpasswdlib.File, error) {
+	var users []byte
+	for line := range bytes.Lines(content) {
+		if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			users = append(users, line...)
+		}
+	}
+	if len(bytes.TrimSpace(users)) == 0 {
+		return nil, fmt.Errorf("htpasswd holds no users")
+	}
+
+	var malformed []error
+	file, err := htpasswdlib.NewFromReader(bytes.NewReader(users), htpasswdlib.DefaultSystems, func(err error) {
+		malformed = append(malformed, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(malformed) > 0 {
+		return nil, errors.Join(malformed...)
+	}
+	return file, nil
+}
+
 // Match checks if username and password are valid
 func (a *HtpasswdAuth) Match(username, password string) bool {
-	if a.file == nil {
+	a.mu.RLock()
+	file := a.file
+	a.mu.RUnlock()
+
+	if file == nil {
 		return false
 	}
-	return a.file.Match(username, password)
+	return file.Match(username, password)
 }
@@ -4,9 +4,13 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/dvjn/sorcerer/internal/access"
 	"github.com/dvjn/sorcerer/internal/config"
 	"github.com/rs/zerolog"
 )
@@ -25,7 +29,7 @@ func TestHtpasswdAuthNew(t *testing.T) {
 		Contents: "testuser:" + testBcryptHash,
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create htpasswd auth: %v", err)
 	}
@@ -41,7 +45,7 @@ func TestHtpasswdAuthMatch(t *testing.T) {
 		Contents: "testuser:" + testBcryptHash + "\notheruser:" + testBcryptHash,
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create htpasswd auth: %v", err)
 	}
@@ -67,7 +71,7 @@ func TestHtpasswdAuthConfigValidation(t *testing.T) {
 
 	// Test missing both file and contents
 	cfg := &config.HtpasswdConfig{}
-	_, err := NewHtpasswdAuth(cfg, &logger)
+	_, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err == nil {
 		t.Error("Should fail when neither file nor contents provided")
 	}
@@ -87,7 +91,7 @@ func TestHtpasswdAuthMultipleUsers(t *testing.T) {
 			"# This is a comment\n",
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create htpasswd auth: %v", err)
 	}
@@ -109,7 +113,7 @@ func TestBasicAuthMiddleware(t *testing.T) {
 		Contents: "testuser:" + testBcryptHash,
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create auth: %v", err)
 	}
@@ -159,7 +163,7 @@ func TestShouldSkipAuth(t *testing.T) {
 		Contents: "testuser:" + testBcryptHash,
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create auth: %v", err)
 	}
@@ -197,7 +201,7 @@ func TestInvalidCredentialsAgainstAuthSpec(t *testing.T) {
 		Contents: "testuser:" + testBcryptHash,
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err != nil {
 		t.Fatalf("Failed to create auth: %v", err)
 	}
@@ -315,7 +319,7 @@ func TestHtpasswdAuthEmptyContent(t *testing.T) {
 		Contents: "",
 	}
 
-	_, err := NewHtpasswdAuth(cfg, &logger)
+	_, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	if err == nil {
 		t.Error("Should fail with empty content")
 	}
@@ -329,7 +333,7 @@ func TestHtpasswdAuthInvalidContent(t *testing.T) {
 		Contents: "invalid content without colon",
 	}
 
-	auth, err := NewHtpasswdAuth(cfg, &logger)
+	auth, err := NewHtpasswdAuth(t.Context(), cfg, &logger)
 	// The library might accept this or reject it depending on implementation
 	// We just check that it doesn't panic
 	if err != nil {
@@ -340,3 +344,183 @@ func TestHtpasswdAuthInvalidContent(t *testing.T) {
 		t.Fatal("Expected non-nil auth even with invalid content")
 	}
 }
+
+func TestHtpasswdAuthReload(t *testing.T) {
+	logger := zerolog.Nop()
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(content string, modified time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write htpasswd file: %v", err)
+		}
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatalf("Failed to touch htpasswd file: %v", err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("alice:"+testBcryptHash, start)
+
+	auth, err := newHtpasswdAuth(t.Context(), &config.HtpasswdConfig{File: file}, &logger, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create htpasswd auth: %v", err)
+	}
+	if auth.changed() {
+		t.Error("Expected the loaded file not to be changed")
+	}
+
+	// Users added to the file are picked up by the watcher
+	write("alice:"+testBcryptHash+"\nbob:"+testBcryptHash, start.Add(time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for !auth.Match("bob", testPassword) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected bob to be added by the watcher")
+		}
+		time.Sleep(auth.interval)
+	}
+
+	// Broken files keep the previous users
+	for i, content := range []string{"alice:" + testBcryptHash + "\ninvalid content without colon", "", "\n"} {
+		write(content, start.Add(time.Duration(i+2)*time.Minute))
+		if err := auth.reload("test"); err == nil {
+			t.Errorf("Expected %q to fail to reload", content)
+		}
+		if !auth.Match("alice", testPassword) || !auth.Match("bob", testPassword) {
+			t.Errorf("Expected previous users to be kept after %q", content)
+		}
+		if auth.changed() {
+			t.Errorf("Expected %q not to be reloaded again until it changes", content)
+		}
+	}
+
+	write("bob:"+testBcryptHash, start.Add(time.Hour))
+	if err := auth.reload("test"); err != nil {
+		t.Fatalf("Expected file to reload: %v", err)
+	}
+	if auth.Match("alice", testPassword) || !auth.Match("bob", testPassword) {
+		t.Error("Expected alice to be removed")
+	}
+}
+
+func TestHtpasswdAuthMalformedFile(t *testing.T) {
+	logger := zerolog.Nop()
+
+	// Files are parsed as strictly at startup as on reload
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("alice:"+testBcryptHash+"\ninvalid content without colon"), 0o600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+	if _, err := NewHtpasswdAuth(t.Context(), &config.HtpasswdConfig{File: file}, &logger); err == nil {
+		t.Error("Expected a malformed htpasswd file to be rejected")
+	}
+}
+
+func TestHtpasswdAuthStopsWatching(t *testing.T) {
+	logger := zerolog.Nop()
+
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("alice:"+testBcryptHash), 0o600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	auth, err := newHtpasswdAuth(ctx, &config.HtpasswdConfig{File: file}, &logger, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create htpasswd auth: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-auth.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the watcher to stop once the context is done")
+	}
+
+	modified := time.Now().Add(time.Hour)
+	if err := os.WriteFile(file, []byte("alice:"+testBcryptHash+"\nbob:"+testBcryptHash), 0o600); err != nil {
+		t.Fatalf("Failed to write htpasswd file: %v", err)
+	}
+	if err := os.Chtimes(file, modified, modified); err != nil {
+		t.Fatalf("Failed to touch htpasswd file: %v", err)
+	}
+
+	if !auth.changed() || auth.Match("bob", testPassword) {
+		t.Error("Expected the file not to be watched once the context is done")
+	}
+}
+
+func TestAnonymousPull(t *testing.T) {
+	logger := zerolog.Nop()
+
+	auth, err := NewHtpasswdAuth(t.Context(), &config.HtpasswdConfig{
+		Contents:           "testuser:" + testBcryptHash,
+		AnonymousPull:      true,
+		PublicRepositories: "library/*, public",
+	}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create htpasswd auth: %v", err)
+	}
+
+	var user access.User
+	handler := auth.DistributionMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = access.UserFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{http.MethodGet, "/v2/library/alpine/manifests/latest", http.StatusOK},
+		{http.MethodHead, "/v2/library/alpine/manifests/latest", http.StatusOK},
+		{http.MethodGet, "/v2/library/alpine/blobs/sha256:abc", http.StatusOK},
+		{http.MethodGet, "/v2/library/alpine/tags/list", http.StatusOK},
+		{http.MethodGet, "/v2/public/referrers/sha256:abc", http.StatusOK},
+		{http.MethodGet, "/v2/private/manifests/latest", http.StatusUnauthorized},
+		{http.MethodGet, "/v2/library/alpine/blobs/uploads/id", http.StatusUnauthorized},
+		{http.MethodPost, "/v2/library/alpine/blobs/uploads/", http.StatusUnauthorized},
+		{http.MethodPut, "/v2/library/alpine/manifests/latest", http.StatusUnauthorized},
+		{http.MethodDelete, "/v2/library/alpine/manifests/latest", http.StatusUnauthorized},
+		{http.MethodGet, "/v2/_catalog", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.wantStatus, w.Code)
+		}
+	}
+
+	// Anonymous users may only pull public repositories, whatever a policy says
+	policy := &access.Policy{Rules: []access.PolicyRule{{Users: []string{"*"}, Repositories: []string{"*"}, Actions: []string{"*"}}}}
+	if user.Name != "" || !access.Allowed(policy, user, access.Scope{Type: "repository", Name: "public", Actions: []string{access.ActionPull}}) {
+		t.Errorf("Expected an anonymous user allowed to pull, got %+v", user)
+	}
+	if access.Allowed(policy, user, access.Scope{Type: "repository", Name: "private", Actions: []string{access.ActionPull}}) {
+		t.Error("Expected private repositories not to be pulled anonymously")
+	}
+
+	// Wrong credentials are not treated as anonymous
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	req.SetBasicAuth("testuser", "wrong")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong credentials to be rejected, got %d", w.Code)
+	}
+
+	// Without anonymous pulls, reads need credentials
+	auth, err = NewHtpasswdAuth(t.Context(), &config.HtpasswdConfig{Contents: "testuser:" + testBcryptHash}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create htpasswd auth: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest", nil)
+	w = httptest.NewRecorder()
+	auth.DistributionMiddleware()(handler).ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous reads to be rejected, got %d", w.Code)
+	}
+}
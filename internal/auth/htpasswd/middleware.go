@@ -3,6 +3,8 @@ package htpasswd
 import (
 	"context"
 	"net/http"
+
+	"github.com/dvjn/sorcerer/internal/access"
 )
 
 type contextKey string
@@ -20,6 +22,11 @@ func (a *HtpasswdAuth) DistributionMiddleware() func(http.Handler) http.Handler
 
 			// Extract Basic Auth credentials
 			username, password, ok := r.BasicAuth()
+			if !ok && a.allowsAnonymous(r) {
+				ctx := access.WithUser(r.Context(), access.User{Token: a.public})
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
 			if !ok {
 				a.logger.Debug().
 					Str("path", r.URL.Path).
@@ -48,6 +55,7 @@ func (a *HtpasswdAuth) DistributionMiddleware() func(http.Handler) http.Handler
 
 			// Set user context and continue
 			ctx := context.WithValue(r.Context(), userContextKey, username)
+			ctx = access.WithUser(ctx, access.User{Name: username})
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -0,0 +1,149 @@
+// Package jwt signs and verifies the JSON Web Tokens used by the token and
+// oidc auth modes, with the RS and ES algorithms of RFC 7518.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// algorithms are the signature algorithms supported, with their hash.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Token is a parsed token whose signature has not been verified yet.
+type Token struct {
+	Header    Header
+	signed    string
+	signature []byte
+}
+
+// Parse splits a token, decoding its claims into claims, which are not to be
+// trusted until the token is verified.
+func Parse(token string, claims any) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	t := &Token{signed: parts[0] + "." + parts[1]}
+	if err := decode(parts[0], &t.Header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if _, ok := algorithms[t.Header.Algorithm]; !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, t.Header.Algorithm)
+	}
+	if err := decode(parts[1], claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	t.signature = signature
+	return t, nil
+}
+
+// Verify checks that the token is signed with the private key of key.
+func (t *Token) Verify(key crypto.PublicKey) error {
+	hash := algorithms[t.Header.Algorithm]
+	h := hash.New()
+	h.Write([]byte(t.signed))
+	digest := h.Sum(nil)
+
+	valid := false
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		valid = strings.HasPrefix(t.Header.Algorithm, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, t.signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS signatures are the fixed size coordinates, not ASN.1
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(t.Header.Algorithm, "ES") && len(t.signature) == 2*size && hash.Size() == size {
+			r := new(big.Int).SetBytes(t.signature[:size])
+			s := new(big.Int).SetBytes(t.signature[size:])
+			valid = ecdsa.Verify(key, digest, r, s)
+		}
+	}
+	if !valid {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+	return nil
+}
+
+// Sign returns a token with the claims, signed with key, which must be an RSA
+// or ECDSA key matching the algorithm of header.
+func Sign(key crypto.Signer, header Header, claims any) (string, error) {
+	hash, ok := algorithms[header.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported algorithm %q", header.Algorithm)
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encode(h) + "." + encode(payload)
+	digester := hash.New()
+	digester.Write([]byte(signed))
+	digest := digester.Sum(nil)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signed + "." + encode(signature), nil
+}
+
+func encode(content []byte) string {
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decode(part string, v any) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
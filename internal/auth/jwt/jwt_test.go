@@ -0,0 +1,83 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256Key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	tests := []struct {
+		algorithm string
+		key       crypto.Signer
+	}{
+		{"RS256", rsaKey},
+		{"RS512", rsaKey},
+		{"ES256", p256Key},
+		{"ES384", p384Key},
+	}
+
+	for _, tt := range tests {
+		token, err := Sign(tt.key, Header{Algorithm: tt.algorithm, KeyID: "key"}, map[string]string{"sub": "alice"})
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", tt.algorithm, err)
+		}
+
+		var claims map[string]string
+		parsed, err := Parse(token, &claims)
+		if err != nil || claims["sub"] != "alice" || parsed.Header.KeyID != "key" {
+			t.Fatalf("%s: expected token to parse, got %+v, %v (%v)", tt.algorithm, parsed, claims, err)
+		}
+		if err := parsed.Verify(tt.key.Public()); err != nil {
+			t.Errorf("%s: expected token to verify, got %v", tt.algorithm, err)
+		}
+
+		// A key of another type or curve never verifies the token
+		for _, other := range tests {
+			if other.key != tt.key {
+				if err := parsed.Verify(other.key.Public()); !errors.Is(err, ErrInvalidToken) {
+					t.Errorf("%s: expected key of %s to be rejected, got %v", tt.algorithm, other.algorithm, err)
+				}
+			}
+		}
+
+		parts := strings.Split(token, ".")
+		tampered := parts[0] + "." + encode([]byte(`{"sub":"bob"}`)) + "." + parts[2]
+		if parsed, err := Parse(tampered, &claims); err != nil || parsed.Verify(tt.key.Public()) == nil {
+			t.Errorf("%s: expected tampered token to be rejected", tt.algorithm)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []string{
+		"",
+		"a.b",
+		"!.e30.",
+		encode([]byte(`{"alg":"none"}`)) + ".e30.",
+		encode([]byte(`{"alg":"HS256"}`)) + ".e30.",
+		encode([]byte(`{"alg":"RS256"}`)) + ".!.",
+		encode([]byte(`{"alg":"RS256"}`)) + ".e30.!",
+	}
+
+	for _, token := range tests {
+		var claims map[string]any
+		if _, err := Parse(token, &claims); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Parse(%q) = %v, want an invalid token error", token, err)
+		}
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := Sign(key, Header{Algorithm: "HS256"}, nil); err == nil {
+		t.Error("Expected signing with an unsupported algorithm to fail")
+	}
+}
@@ -0,0 +1,70 @@
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+// cache remembers successful binds for a while, so that clients sending
+// their credentials with every request do not bind for every request. Only
+// a keyed hash of passwords is kept.
+type cache struct {
+	ttl time.Duration
+	key []byte
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	hash    []byte
+	user    access.User
+	expires time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{ttl: ttl, key: []byte(rand.Text()), entries: map[string]cacheEntry{}}
+}
+
+func (c *cache) get(username, password string) (access.User, bool) {
+	if c.ttl <= 0 {
+		return access.User{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[username]
+	if !ok || time.Now().After(entry.expires) || !hmac.Equal(entry.hash, c.hash(password)) {
+		return access.User{}, false
+	}
+	return entry.user, true
+}
+
+func (c *cache) put(username, password string, user access.User) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for name, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, name)
+		}
+	}
+	c.entries[username] = cacheEntry{hash: c.hash(password), user: user, expires: now.Add(c.ttl)}
+}
+
+func (c *cache) hash(password string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,216 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/go-chi/chi/v5"
+	ldaplib "github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog"
+)
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// LDAPAuth authenticates users by binding to a directory with their
+// credentials, and puts them in the groups they are members of there.
+type LDAPAuth struct {
+	config *config.LDAPConfig
+	tls    *tls.Config
+	cache  *cache
+	logger *zerolog.Logger
+}
+
+func New(c *config.LDAPConfig, logger *zerolog.Logger) (*LDAPAuth, error) {
+	if logger == nil {
+		return nil, fmt.Errorf("logger is required")
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap url: %w", err)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		content, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ldap ca file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("ldap ca file %s holds no PEM encoded certificates", c.CAFile)
+		}
+	}
+
+	if u.Scheme == "ldap" && !c.StartTLS {
+		logger.Warn().Msg("ldap connection is not encrypted, passwords are sent in plain text")
+	}
+
+	logger.Info().
+		Str("auth_type", "ldap").
+		Str("url", c.URL).
+		Bool("start_tls", c.StartTLS).
+		Msg("ldap authentication initialized")
+
+	return &LDAPAuth{config: c, tls: tlsConfig, cache: newCache(c.CacheTTL), logger: logger}, nil
+}
+
+func (a *LDAPAuth) Router() *chi.Mux {
+	r := chi.NewRouter()
+	return r
+}
+
+// Authenticate checks the credentials of a user against the directory, or
+// the cache of recent successful binds, and returns the user with the groups
+// they are in.
+func (a *LDAPAuth) Authenticate(username, password string) (access.User, error) {
+	// Directories treat binds without a password as anonymous binds, which
+	// succeed for any DN
+	if username == "" || password == "" {
+		return access.User{}, errInvalidCredentials
+	}
+
+	if user, ok := a.cache.get(username, password); ok {
+		return user, nil
+	}
+
+	user, err := a.bind(username, password)
+	if err != nil {
+		return access.User{}, err
+	}
+	a.cache.put(username, password, user)
+	return user, nil
+}
+
+func (a *LDAPAuth) bind(username, password string) (access.User, error) {
+	conn, err := a.dial()
+	if err != nil {
+		return access.User{}, err
+	}
+	defer conn.Close()
+
+	// Users either bind with a DN made from their username, or are searched
+	// for by a service account to find the DN to bind with
+	var dn string
+	var memberOf []string
+	if a.config.UserDN != "" {
+		dn = strings.ReplaceAll(a.config.UserDN, "{username}", ldaplib.EscapeDN(username))
+	} else {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return access.User{}, fmt.Errorf("failed to bind with service account: %w", err)
+		}
+		entry, err := a.searchUser(conn, username)
+		if err != nil {
+			return access.User{}, err
+		}
+		dn, memberOf = entry.DN, entry.GetAttributeValues("memberOf")
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		if ldaplib.IsErrorWithCode(err, ldaplib.LDAPResultInvalidCredentials) {
+			return access.User{}, errInvalidCredentials
+		}
+		return access.User{}, fmt.Errorf("failed to bind: %w", err)
+	}
+
+	groups, err := a.groups(conn, dn, memberOf)
+	if err != nil {
+		return access.User{}, err
+	}
+	return access.User{Name: username, Groups: groups}, nil
+}
+
+func (a *LDAPAuth) dial() (*ldaplib.Conn, error) {
+	conn, err := ldaplib.DialURL(a.config.URL,
+		ldaplib.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldaplib.DialWithTLSConfig(a.tls))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to directory: %w", err)
+	}
+	conn.SetTimeout(a.config.Timeout)
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(a.tls); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start tls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuth) searchUser(conn *ldaplib.Conn, username string) (*ldaplib.Entry, error) {
+	filter := strings.ReplaceAll(a.config.UserFilter, "{username}", ldaplib.EscapeFilter(username))
+	result, err := conn.Search(a.searchRequest(a.config.UserBase, filter, []string{"memberOf"}))
+	if err != nil && !ldaplib.IsErrorWithCode(err, ldaplib.LDAPResultNoSuchObject) {
+		return nil, fmt.Errorf("failed to search user: %w", err)
+	}
+	// Usernames that are unknown or ambiguous fail like wrong passwords do
+	if result == nil || len(result.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// groups returns the names of the groups the user with the DN is a member
+// of, as found by a group search, or otherwise named by the DNs of the
+// memberOf attribute of the user.
+func (a *LDAPAuth) groups(conn *ldaplib.Conn, dn string, memberOf []string) ([]string, error) {
+	if a.config.GroupBase != "" {
+		// Groups are searched as the service account if there is one,
+		// users may not be allowed to read them
+		if a.config.BindDN != "" {
+			if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+				return nil, fmt.Errorf("failed to bind with service account: %w", err)
+			}
+		}
+
+		filter := strings.ReplaceAll(a.config.GroupFilter, "{dn}", ldaplib.EscapeFilter(dn))
+		result, err := conn.Search(a.searchRequest(a.config.GroupBase, filter, []string{a.config.GroupAttribute}))
+		if err != nil && !ldaplib.IsErrorWithCode(err, ldaplib.LDAPResultNoSuchObject) {
+			return nil, fmt.Errorf("failed to search groups: %w", err)
+		}
+
+		var groups []string
+		if result != nil {
+			for _, entry := range result.Entries {
+				if name := entry.GetAttributeValue(a.config.GroupAttribute); name != "" {
+					groups = append(groups, name)
+				}
+			}
+		}
+		return groups, nil
+	}
+
+	if a.config.UserDN != "" {
+		result, err := conn.Search(ldaplib.NewSearchRequest(dn, ldaplib.ScopeBaseObject, ldaplib.NeverDerefAliases,
+			1, int(a.config.Timeout.Seconds()), false, "(objectClass=*)", []string{"memberOf"}, nil))
+		if err != nil && !ldaplib.IsErrorWithCode(err, ldaplib.LDAPResultNoSuchObject) {
+			return nil, fmt.Errorf("failed to read user: %w", err)
+		}
+		if result != nil && len(result.Entries) == 1 {
+			memberOf = result.Entries[0].GetAttributeValues("memberOf")
+		}
+	}
+
+	var groups []string
+	for _, group := range memberOf {
+		parsed, err := ldaplib.ParseDN(group)
+		if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+			continue
+		}
+		groups = append(groups, parsed.RDNs[0].Attributes[0].Value)
+	}
+	return groups, nil
+}
+
+func (a *LDAPAuth) searchRequest(base, filter string, attributes []string) *ldaplib.SearchRequest {
+	return ldaplib.NewSearchRequest(base, ldaplib.ScopeWholeSubtree, ldaplib.NeverDerefAliases,
+		0, int(a.config.Timeout.Seconds()), false, filter, attributes, nil)
+}
@@ -0,0 +1,213 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/jimlambrt/gldap"
+	"github.com/jimlambrt/gldap/testdirectory"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testPassword = "password"
+	testUserBase = "ou=people,dc=example,dc=org"
+	testGroups   = "ou=groups,dc=example,dc=org"
+)
+
+// startDirectory starts a directory with alice in the developers group, bob
+// in no group and a service account searching them.
+func startDirectory(t *testing.T, opts ...testdirectory.Option) *testdirectory.Directory {
+	t.Helper()
+
+	users := testdirectory.NewUsers(t, []string{"alice"}, testdirectory.WithMembersOf(t, testdirectory.NewMemberOf(t, []string{"developers"})...))
+	users = append(users, testdirectory.NewUsers(t, []string{"bob", "service"})...)
+	groups := []*gldap.Entry{
+		gldap.NewEntry("cn=developers,"+testGroups, map[string][]string{"cn": {"developers"}, "member": {"cn=alice," + testUserBase}}),
+		gldap.NewEntry("cn=admins,"+testGroups, map[string][]string{"cn": {"admins"}, "member": {"cn=alice," + testUserBase}}),
+	}
+
+	opts = append(opts, testdirectory.WithDefaults(t, &testdirectory.Defaults{Users: users, Groups: groups}))
+	return testdirectory.Start(t, opts...)
+}
+
+func newTestAuth(t *testing.T, d *testdirectory.Directory, c config.LDAPConfig) *LDAPAuth {
+	t.Helper()
+
+	if c.URL == "" {
+		c.URL = fmt.Sprintf("ldaps://%s:%d", d.Host(), d.Port())
+	}
+	if c.CAFile == "" {
+		c.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(c.CAFile, []byte(d.Cert()), 0o600); err != nil {
+			t.Fatalf("Failed to write ca file: %v", err)
+		}
+	}
+	c.UserFilter = "(cn={username})"
+	c.GroupFilter = "(member={dn})"
+	c.GroupAttribute = "cn"
+	c.Timeout = 5 * time.Second
+
+	logger := zerolog.Nop()
+	a, err := New(&c, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create ldap auth: %v", err)
+	}
+	return a
+}
+
+func TestBind(t *testing.T) {
+	d := startDirectory(t)
+	a := newTestAuth(t, d, config.LDAPConfig{UserDN: "cn={username}," + testUserBase})
+
+	user, err := a.Authenticate("alice", testPassword)
+	if err != nil {
+		t.Fatalf("Expected alice to authenticate: %v", err)
+	}
+	if user.Name != "alice" {
+		t.Errorf("Expected alice, got %+v", user)
+	}
+
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"nobody", testPassword}, {"alice", ""}, {"", ""}} {
+		if _, err := a.Authenticate(credentials[0], credentials[1]); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("Expected %q with password %q to be rejected, got %v", credentials[0], credentials[1], err)
+		}
+	}
+}
+
+func TestSearchThenBind(t *testing.T) {
+	d := startDirectory(t, testdirectory.WithNoTLS(t))
+	base := config.LDAPConfig{
+		URL:          fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port()),
+		StartTLS:     true,
+		BindDN:       "cn=service," + testUserBase,
+		BindPassword: testPassword,
+		UserBase:     testUserBase,
+	}
+
+	// Groups are named by the memberOf attribute of users
+	a := newTestAuth(t, d, base)
+	user, err := a.Authenticate("alice", testPassword)
+	if err != nil {
+		t.Fatalf("Expected alice to authenticate: %v", err)
+	}
+	if user.Name != "alice" || !slices.Equal(user.Groups, []string{"developers"}) {
+		t.Errorf("Expected alice to be a developer, got %+v", user)
+	}
+
+	// or searched for
+	withGroups := base
+	withGroups.GroupBase = testGroups
+	a = newTestAuth(t, d, withGroups)
+	user, err = a.Authenticate("alice", testPassword)
+	if err != nil {
+		t.Fatalf("Expected alice to authenticate: %v", err)
+	}
+	slices.Sort(user.Groups)
+	if !slices.Equal(user.Groups, []string{"admins", "developers"}) {
+		t.Errorf("Expected alice to be a developer and admin, got %+v", user)
+	}
+
+	if user, err := a.Authenticate("bob", testPassword); err != nil || len(user.Groups) != 0 {
+		t.Errorf("Expected bob to authenticate without groups, got %+v, %v", user, err)
+	}
+	if _, err := a.Authenticate("alice", "wrong"); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("Expected wrong password to be rejected, got %v", err)
+	}
+	if _, err := a.Authenticate("nobody", testPassword); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("Expected unknown user to be rejected, got %v", err)
+	}
+
+	wrongService := base
+	wrongService.BindPassword = "wrong"
+	a = newTestAuth(t, d, wrongService)
+	if _, err := a.Authenticate("alice", testPassword); err == nil || errors.Is(err, errInvalidCredentials) {
+		t.Errorf("Expected a failing service account to be an error, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	d := startDirectory(t)
+	a := newTestAuth(t, d, config.LDAPConfig{UserDN: "cn={username}," + testUserBase, CacheTTL: time.Minute})
+
+	if _, err := a.Authenticate("alice", testPassword); err != nil {
+		t.Fatalf("Expected alice to authenticate: %v", err)
+	}
+
+	// Without users, only the cache lets alice in
+	d.SetUsers()
+	if _, err := a.Authenticate("alice", testPassword); err != nil {
+		t.Errorf("Expected cached bind to be used: %v", err)
+	}
+	if _, err := a.Authenticate("alice", "wrong"); err == nil {
+		t.Error("Expected wrong password not to be served from the cache")
+	}
+
+	a.cache.mu.Lock()
+	entry := a.cache.entries["alice"]
+	entry.expires = time.Now().Add(-time.Second)
+	a.cache.entries["alice"] = entry
+	a.cache.mu.Unlock()
+	if _, err := a.Authenticate("alice", testPassword); err == nil {
+		t.Error("Expected expired bind to be checked against the directory")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	d := startDirectory(t, testdirectory.WithNoTLS(t))
+	a := newTestAuth(t, d, config.LDAPConfig{
+		URL:          fmt.Sprintf("ldap://%s:%d", d.Host(), d.Port()),
+		BindDN:       "cn=service," + testUserBase,
+		BindPassword: testPassword,
+		UserBase:     testUserBase,
+	})
+
+	var user access.User
+	var username string
+	handler := a.DistributionMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = access.UserFromContext(r.Context())
+		username, _ = GetUsernameFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		path       string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{"base endpoint", "/v2/", "", "", http.StatusOK},
+		{"no credentials", "/v2/app/tags/list", "", "", http.StatusUnauthorized},
+		{"wrong password", "/v2/app/tags/list", "alice", "wrong", http.StatusUnauthorized},
+		{"valid credentials", "/v2/app/tags/list", "alice", testPassword, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.username != "" {
+			req.SetBasicAuth(tt.username, tt.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a challenge", tt.name)
+		}
+	}
+
+	if username != "alice" || user.Name != "alice" || !slices.Equal(user.Groups, []string{"developers"}) {
+		t.Errorf("Expected alice in her groups, got %q, %+v", username, user)
+	}
+}
@@ -0,0 +1,75 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+func (a *LDAPAuth) DistributionMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Allow unauthenticated access only to the base /v2/ endpoint for discovery
+			if r.URL.Path == "/v2/" && r.Method == http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			username, password, ok := r.BasicAuth()
+			if !ok {
+				a.logger.Debug().
+					Str("path", r.URL.Path).
+					Str("method", r.Method).
+					Msg("missing or invalid basic auth credentials")
+				a.challenge(w)
+				return
+			}
+
+			user, err := a.Authenticate(username, password)
+			if errors.Is(err, errInvalidCredentials) {
+				a.logger.Warn().
+					Str("username", username).
+					Str("path", r.URL.Path).
+					Msg("authentication failed")
+				a.challenge(w)
+				return
+			}
+			if err != nil {
+				// Always return generic "unauthorized" - don't reveal user existence
+				a.logger.Error().
+					Err(err).
+					Str("username", username).
+					Msg("ldap authentication error")
+				a.challenge(w)
+				return
+			}
+
+			a.logger.Debug().
+				Str("username", user.Name).
+				Strs("groups", user.Groups).
+				Str("path", r.URL.Path).
+				Str("method", r.Method).
+				Msg("user authenticated successfully")
+
+			ctx := context.WithValue(r.Context(), userContextKey, user.Name)
+			ctx = access.WithUser(ctx, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (a *LDAPAuth) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Sorcerer OCI Registry"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func GetUsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(userContextKey).(string)
+	return username, ok
+}
@@ -0,0 +1,213 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshInterval is how long to wait before fetching the keys of a provider
+// again for a token signed with a key that is not known, so that such tokens
+// cannot make the registry hammer the provider.
+const refreshInterval = time.Minute
+
+var errUnknownKey = errors.New("token is signed with an unknown key")
+
+// keySet holds the signing keys of a provider, as published at the JWKS URI
+// of its discovery document. Keys are fetched again when a token is signed
+// with an unknown one, as providers rotate them.
+type keySet struct {
+	discovery string
+	issuer    string
+	client    *http.Client
+
+	// Concurrent requests for unknown keys share a single fetch, which is
+	// done without holding mu so that tokens signed with known keys are not
+	// held up by a slow provider
+	refresh singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// key returns the key with the id, or the only key if id is empty.
+func (k *keySet) key(ctx context.Context, id string) (crypto.PublicKey, error) {
+	k.mu.Lock()
+	key, ok := k.lookup(id)
+	k.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	// The fetch outlives the request that started it, as it is shared with
+	// the others, and the timeout of the client bounds it
+	if _, err, _ := k.refresh.Do("", func() (any, error) {
+		return nil, k.refetch(context.WithoutCancel(ctx))
+	}); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.lookup(id); ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// refetch fetches the keys again, unless they were fetched within the
+// refresh interval.
+func (k *keySet) refetch(ctx context.Context) error {
+	k.mu.Lock()
+	recent := time.Since(k.fetched) < refreshInterval
+	k.mu.Unlock()
+	if recent {
+		return nil
+	}
+
+	keys, err := k.fetch(ctx)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Failures are also rate limited, an unreachable provider would
+	// otherwise be asked for every request
+	k.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	return nil
+}
+
+func (k *keySet) lookup(id string) (crypto.PublicKey, bool) {
+	if id == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	ID      string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k *keySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var document discoveryDocument
+	if err := k.get(ctx, k.discovery, &document); err != nil {
+		return nil, fmt.Errorf("failed to discover provider: %w", err)
+	}
+	// The issuer must be the one the discovery document was fetched for,
+	// so that a provider cannot issue tokens in the name of another
+	if document.Issuer != k.issuer {
+		return nil, fmt.Errorf("provider claims to be issuer %q", document.Issuer)
+	}
+	if document.JWKSURI == "" {
+		return nil, fmt.Errorf("provider publishes no keys")
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := k.get(ctx, document.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped, a provider may publish
+		// them next to those it signs ID tokens with
+		if public, err := key.publicKey(); err == nil {
+			keys[key.ID] = public
+		}
+	}
+	return keys, nil
+}
+
+func (k *keySet) get(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
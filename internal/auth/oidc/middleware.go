@@ -0,0 +1,71 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+func (a *OIDCAuth) DistributionMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Allow unauthenticated access only to the base /v2/ endpoint for discovery
+			if r.URL.Path == "/v2/" && r.Method == http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The username of basic auth is not checked, the token names the user
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				_, token, ok = r.BasicAuth()
+			}
+			if !ok || token == "" {
+				a.logger.Debug().
+					Str("path", r.URL.Path).
+					Str("method", r.Method).
+					Msg("missing id token")
+				a.challenge(w)
+				return
+			}
+
+			user, err := a.authenticate(r.Context(), strings.TrimSpace(token), time.Now())
+			if err != nil {
+				a.logger.Warn().
+					Err(err).
+					Str("path", r.URL.Path).
+					Msg("authentication failed")
+				a.challenge(w)
+				return
+			}
+
+			a.logger.Debug().
+				Str("username", user.Name).
+				Strs("groups", user.Groups).
+				Str("path", r.URL.Path).
+				Str("method", r.Method).
+				Msg("user authenticated successfully")
+
+			ctx := context.WithValue(r.Context(), userContextKey, user.Name)
+			ctx = access.WithUser(ctx, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (a *OIDCAuth) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Sorcerer OCI Registry"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func GetUsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(userContextKey).(string)
+	return username, ok
+}
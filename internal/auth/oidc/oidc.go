@@ -0,0 +1,132 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/auth/jwt"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// leeway is how far the clocks of the registry and providers may be apart.
+const leeway = time.Minute
+
+// OIDCAuth accepts ID tokens of OpenID providers as credentials, either as
+// the password of basic auth, which is what "docker login" sends, or as a
+// bearer token.
+type OIDCAuth struct {
+	providers []*Provider
+	logger    *zerolog.Logger
+}
+
+func New(c *config.OIDCConfig, logger *zerolog.Logger) (*OIDCAuth, error) {
+	if logger == nil {
+		return nil, fmt.Errorf("logger is required")
+	}
+
+	providers, err := loadProviders(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, provider := range providers {
+		logger.Info().
+			Str("auth_type", "oidc").
+			Str("issuer", provider.Issuer).
+			Str("audience", provider.Audience).
+			Msg("oidc provider configured")
+	}
+
+	return &OIDCAuth{providers: providers, logger: logger}, nil
+}
+
+// Router serves nothing, ID tokens are sent with every request instead of
+// being exchanged for tokens of the registry.
+func (a *OIDCAuth) Router() *chi.Mux {
+	r := chi.NewRouter()
+	return r
+}
+
+// authenticate verifies an ID token and returns the user it identifies.
+func (a *OIDCAuth) authenticate(ctx context.Context, token string, now time.Time) (access.User, error) {
+	// The issuer is read before the signature is checked to know whose keys
+	// to check it with, nothing else is trusted until then
+	var claims map[string]any
+	t, err := jwt.Parse(token, &claims)
+	if err != nil {
+		return access.User{}, err
+	}
+	issuer, _ := claims["iss"].(string)
+	i := slices.IndexFunc(a.providers, func(p *Provider) bool { return p.Issuer == issuer })
+	if i < 0 {
+		return access.User{}, fmt.Errorf("%w: unknown issuer %q", jwt.ErrInvalidToken, issuer)
+	}
+	provider := a.providers[i]
+
+	key, err := provider.keys.key(ctx, t.Header.KeyID)
+	if err != nil {
+		return access.User{}, err
+	}
+	if err := t.Verify(key); err != nil {
+		return access.User{}, err
+	}
+
+	if err := provider.validate(claims, now); err != nil {
+		return access.User{}, err
+	}
+	return provider.user(claims)
+}
+
+// validate checks that the claims of a token are meant for this registry and
+// that the token is still valid.
+func (p *Provider) validate(claims map[string]any, now time.Time) error {
+	var audiences []any
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []any{aud}
+	case []any:
+		audiences = aud
+	}
+	if !slices.Contains(audiences, any(p.Audience)) {
+		return fmt.Errorf("%w: token was issued for another audience", jwt.ErrInvalidToken)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-leeway).Unix() >= int64(exp) {
+		return fmt.Errorf("%w: token is expired", jwt.ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Unix() < int64(nbf) {
+		return fmt.Errorf("%w: token is not valid yet", jwt.ErrInvalidToken)
+	}
+	return nil
+}
+
+// user returns the user identified by the claims of a verified token.
+func (p *Provider) user(claims map[string]any) (access.User, error) {
+	name, _ := claims[p.UsernameClaim].(string)
+	if name == "" {
+		return access.User{}, fmt.Errorf("%w: token has no %s claim", jwt.ErrInvalidToken, p.UsernameClaim)
+	}
+	// Providers may let users set addresses they do not own
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && p.UsernameClaim == "email" {
+		return access.User{}, fmt.Errorf("%w: email is not verified", jwt.ErrInvalidToken)
+	}
+
+	user := access.User{Name: p.UsernamePrefix + name}
+	switch groups := claims[p.GroupsClaim].(type) {
+	case string:
+		user.Groups = []string{groups}
+	case []any:
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+	}
+	return user, nil
+}
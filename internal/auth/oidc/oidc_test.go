@@ -0,0 +1,318 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/auth/jwt"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/rs/zerolog"
+)
+
+// issuer is an OpenID provider publishing the public keys of the keys it
+// signs tokens with.
+type issuer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     map[string]crypto.Signer
+	requests int
+
+	// held, if set, holds requests for the keys until it is closed
+	held chan struct{}
+}
+
+func newIssuer(t *testing.T) *issuer {
+	t.Helper()
+
+	i := &issuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": i.URL, "jwks_uri": i.URL + "/keys"})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		if i.held != nil {
+			<-i.held
+		}
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.requests++
+
+		keys := []map[string]string{}
+		for id, key := range i.keys {
+			switch key := key.Public().(type) {
+			case *rsa.PublicKey:
+				e := big.NewInt(int64(key.E)).Bytes()
+				keys = append(keys, map[string]string{"kty": "RSA", "kid": id, "use": "sig", "n": encode(key.N.Bytes()), "e": encode(e)})
+			case *ecdsa.PublicKey:
+				keys = append(keys, map[string]string{"kty": "EC", "kid": id, "crv": "P-256", "x": encode(key.X.FillBytes(make([]byte, 32))), "y": encode(key.Y.FillBytes(make([]byte, 32)))})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	i.Server = httptest.NewServer(mux)
+	t.Cleanup(i.Close)
+	return i
+}
+
+func (i *issuer) addKey(t *testing.T, id string, rsaKey bool) {
+	t.Helper()
+
+	var key crypto.Signer
+	var err error
+	if rsaKey {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys[id] = key
+}
+
+func (i *issuer) keyRequests() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.requests
+}
+
+// sign returns a token with the claims, valid for a minute unless they say
+// otherwise, signed with the key with the id.
+func (i *issuer) sign(t *testing.T, id string, claims map[string]any) string {
+	t.Helper()
+
+	i.mu.Lock()
+	key := i.keys[id]
+	i.mu.Unlock()
+
+	payload := map[string]any{"iss": i.URL, "aud": "sorcerer", "exp": time.Now().Add(time.Minute).Unix()}
+	for name, value := range claims {
+		payload[name] = value
+	}
+
+	algorithm := "ES256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		algorithm = "RS256"
+	}
+	token, err := jwt.Sign(key, jwt.Header{Algorithm: algorithm, Type: "JWT", KeyID: id}, payload)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+func encode(content []byte) string {
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func newTestAuth(t *testing.T, providers ...map[string]string) *OIDCAuth {
+	t.Helper()
+
+	content, _ := json.Marshal(providers)
+	logger := zerolog.Nop()
+	a, err := New(&config.OIDCConfig{Providers: string(content)}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create oidc auth: %v", err)
+	}
+	return a
+}
+
+func TestMiddleware(t *testing.T) {
+	sso := newIssuer(t)
+	sso.addKey(t, "rsa", true)
+	a := newTestAuth(t, map[string]string{"issuer": sso.URL, "audience": "sorcerer"})
+
+	var user access.User
+	var username string
+	handler := a.DistributionMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = access.UserFromContext(r.Context())
+		username, _ = GetUsernameFromContext(r.Context())
+	}))
+
+	token := sso.sign(t, "rsa", map[string]any{"email": "alice@example.com", "groups": []string{"developers", "ops"}})
+
+	tests := []struct {
+		name       string
+		path       string
+		authorize  func(r *http.Request)
+		wantStatus int
+	}{
+		{"base endpoint", "/v2/", func(r *http.Request) {}, http.StatusOK},
+		{"no credentials", "/v2/app/tags/list", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic auth", "/v2/app/tags/list", func(r *http.Request) { r.SetBasicAuth("anything", token) }, http.StatusOK},
+		{"bearer token", "/v2/app/tags/list", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }, http.StatusOK},
+		{"password", "/v2/app/tags/list", func(r *http.Request) { r.SetBasicAuth("alice", "password") }, http.StatusUnauthorized},
+		{"tampered token", "/v2/app/tags/list", func(r *http.Request) { r.SetBasicAuth("alice", token[:len(token)-4]+"AAAA") }, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		tt.authorize(req)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a challenge", tt.name)
+		}
+	}
+
+	if username != "alice@example.com" || user.Name != "alice@example.com" || !slices.Equal(user.Groups, []string{"developers", "ops"}) {
+		t.Errorf("Expected alice in her groups, got %q, %+v", username, user)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	sso := newIssuer(t)
+	sso.addKey(t, "ec", false)
+	ci := newIssuer(t)
+	ci.addKey(t, "rsa", true)
+	other := newIssuer(t)
+	other.addKey(t, "rsa", true)
+
+	a := newTestAuth(t,
+		map[string]string{"issuer": sso.URL, "audience": "sorcerer"},
+		map[string]string{"issuer": ci.URL, "audience": "https://registry.example.com", "username_claim": "repository", "username_prefix": "ci:"},
+	)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantUser string
+	}{
+		{"email", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "email_verified": true}), "alice@example.com"},
+		{"audience list", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "aud": []string{"other", "sorcerer"}}), "alice@example.com"},
+		{"workload identity", ci.sign(t, "rsa", map[string]any{"repository": "team/app", "aud": "https://registry.example.com"}), "ci:team/app"},
+		{"unverified email", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "email_verified": false}), ""},
+		{"missing username claim", sso.sign(t, "ec", map[string]any{"sub": "123"}), ""},
+		{"wrong audience", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "aud": "other"}), ""},
+		{"audience of another provider", ci.sign(t, "rsa", map[string]any{"repository": "team/app"}), ""},
+		{"expired", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "exp": time.Now().Add(-2 * time.Minute).Unix()}), ""},
+		{"not valid yet", sso.sign(t, "ec", map[string]any{"email": "alice@example.com", "nbf": time.Now().Add(2 * time.Minute).Unix()}), ""},
+		{"unknown issuer", other.sign(t, "rsa", map[string]any{"email": "alice@example.com"}), ""},
+		{"forged issuer", other.sign(t, "rsa", map[string]any{"email": "alice@example.com", "iss": sso.URL}), ""},
+	}
+
+	for _, tt := range tests {
+		user, err := a.authenticate(t.Context(), tt.token, time.Now())
+		if tt.wantUser == "" && err == nil {
+			t.Errorf("%s: expected token to be rejected, got %+v", tt.name, user)
+		}
+		if tt.wantUser != "" && (err != nil || user.Name != tt.wantUser) {
+			t.Errorf("%s: expected user %q, got %+v, %v", tt.name, tt.wantUser, user, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	sso := newIssuer(t)
+	sso.addKey(t, "old", true)
+	a := newTestAuth(t, map[string]string{"issuer": sso.URL, "audience": "sorcerer"})
+
+	if _, err := a.authenticate(t.Context(), sso.sign(t, "old", map[string]any{"email": "alice@example.com"}), time.Now()); err != nil {
+		t.Fatalf("Expected token to be accepted: %v", err)
+	}
+
+	// Keys are fetched again for a new key once the refresh interval passed
+	sso.addKey(t, "new", false)
+	rotated := sso.sign(t, "new", map[string]any{"email": "alice@example.com"})
+	if _, err := a.authenticate(t.Context(), rotated, time.Now()); err == nil {
+		t.Error("Expected unknown key to be rejected within the refresh interval")
+	}
+	if requests := sso.keyRequests(); requests != 1 {
+		t.Errorf("Expected keys to be fetched once, got %d", requests)
+	}
+
+	a.providers[0].keys.fetched = time.Now().Add(-refreshInterval)
+	if _, err := a.authenticate(t.Context(), rotated, time.Now()); err != nil {
+		t.Errorf("Expected token signed with the new key to be accepted: %v", err)
+	}
+}
+
+func TestConcurrentKeyFetches(t *testing.T) {
+	sso := newIssuer(t)
+	sso.addKey(t, "old", true)
+	a := newTestAuth(t, map[string]string{"issuer": sso.URL, "audience": "sorcerer"})
+
+	if _, err := a.authenticate(t.Context(), sso.sign(t, "old", map[string]any{"email": "alice@example.com"}), time.Now()); err != nil {
+		t.Fatalf("Expected token to be accepted: %v", err)
+	}
+
+	sso.addKey(t, "new", false)
+	rotated := sso.sign(t, "new", map[string]any{"email": "alice@example.com"})
+	a.providers[0].keys.fetched = time.Now().Add(-refreshInterval)
+	sso.held = make(chan struct{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.authenticate(t.Context(), rotated, time.Now())
+			errs <- err
+		}()
+	}
+
+	// Tokens signed with known keys are accepted while keys are fetched
+	if _, err := a.authenticate(t.Context(), sso.sign(t, "old", map[string]any{"email": "bob@example.com"}), time.Now()); err != nil {
+		t.Errorf("Expected token signed with a known key to be accepted during a fetch: %v", err)
+	}
+
+	close(sso.held)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected token signed with the new key to be accepted: %v", err)
+		}
+	}
+	if requests := sso.keyRequests(); requests != 2 {
+		t.Errorf("Expected keys to be fetched once more, got %d fetches", requests)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	logger := zerolog.Nop()
+	tests := []string{
+		``,
+		`[]`,
+		`[{"issuer":"sso.example.com","audience":"sorcerer"}]`,
+		`[{"issuer":"https://sso.example.com"}]`,
+		`[{"issuer":"https://sso.example.com","audience":"a"},{"issuer":"https://sso.example.com","audience":"b"}]`,
+	}
+
+	for _, providers := range tests {
+		if _, err := New(&config.OIDCConfig{Providers: providers}, &logger); err == nil {
+			t.Errorf("Expected providers %s to be rejected", providers)
+		}
+	}
+
+	a, err := New(&config.OIDCConfig{Providers: fmt.Sprintf(`[{"issuer":%q,"audience":"sorcerer"}]`, "https://sso.example.com")}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create oidc auth: %v", err)
+	}
+	if p := a.providers[0]; p.UsernameClaim != "email" || p.GroupsClaim != "groups" {
+		t.Errorf("Expected default claims, got %q and %q", p.UsernameClaim, p.GroupsClaim)
+	}
+}
@@ -0,0 +1,79 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+)
+
+// Provider is an OpenID provider whose ID tokens are accepted for the
+// audience. Users are named by the username claim, prefixed with the username
+// prefix to keep apart users of different providers, and are in the groups
+// listed by the groups claim.
+type Provider struct {
+	Issuer         string `json:"issuer"`
+	Audience       string `json:"audience"`
+	UsernameClaim  string `json:"username_claim"`
+	UsernamePrefix string `json:"username_prefix"`
+	GroupsClaim    string `json:"groups_claim"`
+
+	keys *keySet
+}
+
+// loadProviders reads the providers from the configuration, inline or from a
+// file. Their keys are fetched when first needed, so that the registry starts
+// while a provider is unreachable.
+func loadProviders(c *config.OIDCConfig) ([]*Provider, error) {
+	content := []byte(c.Providers)
+	if c.ProvidersFile != "" {
+		var err error
+		if content, err = os.ReadFile(c.ProvidersFile); err != nil {
+			return nil, fmt.Errorf("failed to read oidc providers: %w", err)
+		}
+	}
+
+	var providers []*Provider
+	if err := json.Unmarshal(content, &providers); err != nil {
+		return nil, fmt.Errorf("failed to parse oidc providers: %w", err)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no oidc providers configured")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	issuers := map[string]bool{}
+	for i, provider := range providers {
+		issuer, err := url.Parse(provider.Issuer)
+		if err != nil || (issuer.Scheme != "http" && issuer.Scheme != "https") || issuer.Host == "" {
+			return nil, fmt.Errorf("oidc provider %d has an invalid issuer: %q", i, provider.Issuer)
+		}
+		if issuers[provider.Issuer] {
+			return nil, fmt.Errorf("oidc provider %s is defined twice", provider.Issuer)
+		}
+		issuers[provider.Issuer] = true
+
+		if provider.Audience == "" {
+			return nil, fmt.Errorf("oidc provider %s has no audience", provider.Issuer)
+		}
+		if provider.UsernameClaim == "" {
+			provider.UsernameClaim = "email"
+		}
+		if provider.GroupsClaim == "" {
+			provider.GroupsClaim = "groups"
+		}
+
+		provider.keys = &keySet{
+			discovery: strings.TrimSuffix(provider.Issuer, "/") + "/.well-known/openid-configuration",
+			issuer:    provider.Issuer,
+			client:    client,
+		}
+	}
+
+	return providers, nil
+}
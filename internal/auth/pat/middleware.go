@@ -0,0 +1,73 @@
+package pat
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// DistributionMiddleware authenticates requests with an access token as the
+// basic auth password, and leaves all others to the other authentication.
+// Users authenticated with a token may only do what it grants them.
+func (a *PATAuth) DistributionMiddleware() func(http.Handler) http.Handler {
+	inner := a.inner.DistributionMiddleware()
+	return func(next http.Handler) http.Handler {
+		fallback := inner(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || !strings.HasPrefix(password, Prefix) {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+
+			// Tokens only grant access to repositories, not to the admin API
+			if !strings.HasPrefix(r.URL.Path, "/v2/") {
+				a.logger.Debug().
+					Str("username", username).
+					Str("path", r.URL.Path).
+					Msg("access token used outside the distribution api")
+				a.challenge(w)
+				return
+			}
+
+			token, err := a.store.authenticate(username, password, time.Now())
+			if err != nil {
+				a.logger.Warn().
+					Err(err).
+					Str("username", username).
+					Str("path", r.URL.Path).
+					Msg("authentication failed")
+				a.challenge(w)
+				return
+			}
+
+			a.logger.Debug().
+				Str("username", token.Owner).
+				Str("token", token.ID).
+				Str("path", r.URL.Path).
+				Str("method", r.Method).
+				Msg("user authenticated with access token")
+
+			ctx := context.WithValue(r.Context(), userContextKey, token.Owner)
+			ctx = access.WithUser(ctx, access.User{Name: token.Owner, Groups: token.Groups, Token: grant{token.Repositories, token.Actions}})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func (a *PATAuth) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Sorcerer OCI Registry"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func GetUsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(userContextKey).(string)
+	return username, ok
+}
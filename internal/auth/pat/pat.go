@@ -0,0 +1,270 @@
+package pat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// robotRegexp matches the name of a robot account.
+var robotRegexp = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+// Authenticator is the authentication of the configured mode, which users
+// authenticate with to manage their tokens.
+type Authenticator interface {
+	Router() *chi.Mux
+	DistributionMiddleware() func(http.Handler) http.Handler
+}
+
+// PATAuth accepts access tokens as the basic auth password of their owner,
+// on top of the credentials accepted by another authentication.
+type PATAuth struct {
+	inner  Authenticator
+	admins []string
+	store  *store
+	logger *zerolog.Logger
+}
+
+func New(c *config.PATConfig, inner Authenticator, logger *zerolog.Logger) (*PATAuth, error) {
+	if logger == nil {
+		return nil, fmt.Errorf("logger is required")
+	}
+
+	store, err := openStore(c.File, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var admins []string
+	for admin := range strings.SplitSeq(c.Admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+
+	logger.Info().
+		Str("file", c.File).
+		Int("tokens", len(store.tokens)).
+		Msg("access tokens initialized")
+
+	return &PATAuth{inner: inner, admins: admins, store: store, logger: logger}, nil
+}
+
+// Router serves the router of the other authentication, and the API to
+// manage tokens under /tokens. Tokens cannot be managed with tokens, users
+// authenticate with their credentials.
+func (a *PATAuth) Router() *chi.Mux {
+	r := a.inner.Router()
+	r.Route("/tokens", func(r chi.Router) {
+		r.Use(a.inner.DistributionMiddleware())
+		r.Get("/", a.listTokens)
+		r.Post("/", a.createToken)
+		r.Delete("/", a.revokeOwnerTokens)
+		r.Delete("/{id}", a.revokeToken)
+	})
+	return r
+}
+
+type createRequest struct {
+	Name         string     `json:"name"`
+	Robot        string     `json:"robot"`
+	Repositories []string   `json:"repositories"`
+	Actions      []string   `json:"actions"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+type createResponse struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// createToken creates a token for the user, or for a robot account if they
+// are an admin.
+func (a *PATAuth) createToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := access.UserFromContext(r.Context())
+
+	var request createRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON request body")
+		return
+	}
+	now := time.Now()
+	if err := request.validate(now); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	// Robots are in no groups but those of the policy
+	owner, groups := user.Name, user.Groups
+	if request.Robot != "" {
+		if !a.admin(user) {
+			sendError(w, http.StatusForbidden, "DENIED", "Only admins may create tokens for robot accounts")
+			return
+		}
+		owner, groups = RobotPrefix+request.Robot, nil
+	}
+
+	token, secret, err := a.store.create(Token{
+		Name:         request.Name,
+		Owner:        owner,
+		CreatedBy:    user.Name,
+		Groups:       groups,
+		Repositories: request.Repositories,
+		Actions:      request.Actions,
+		CreatedAt:    now.UTC(),
+		ExpiresAt:    request.ExpiresAt,
+	})
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to create access token")
+		sendError(w, http.StatusInternalServerError, "UNKNOWN", "Failed to create token")
+		return
+	}
+
+	a.logger.Info().
+		Str("id", token.ID).
+		Str("owner", token.Owner).
+		Str("created_by", token.CreatedBy).
+		Strs("repositories", token.Repositories).
+		Strs("actions", token.Actions).
+		Msg("created access token")
+
+	token.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createResponse{Token: token, Secret: secret})
+}
+
+// listTokens lists the tokens of the user, or all tokens for admins, with
+// when they were last used.
+func (a *PATAuth) listTokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := access.UserFromContext(r.Context())
+
+	tokens := a.store.list(a.visible(user))
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Tokens []Token `json:"tokens"`
+	}{tokens})
+}
+
+func (a *PATAuth) revokeToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := access.UserFromContext(r.Context())
+
+	token, err := a.store.revoke(chi.URLParam(r, "id"), a.visible(user))
+	if errors.Is(err, errNotFound) {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown token")
+		return
+	}
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to revoke access token")
+		sendError(w, http.StatusInternalServerError, "UNKNOWN", "Failed to revoke token")
+		return
+	}
+
+	a.logger.Info().
+		Str("id", token.ID).
+		Str("owner", token.Owner).
+		Str("revoked_by", user.Name).
+		Msg("revoked access token")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOwnerTokens revokes all tokens of the owner given as a query
+// parameter, for admins to clean up after users removed from the other
+// authentication.
+func (a *PATAuth) revokeOwnerTokens(w http.ResponseWriter, r *http.Request) {
+	user, _ := access.UserFromContext(r.Context())
+	if !a.admin(user) {
+		sendError(w, http.StatusForbidden, "DENIED", "Only admins may revoke the tokens of a user")
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "owner is required")
+		return
+	}
+
+	revoked, err := a.store.revokeOwner(owner)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to revoke access tokens")
+		sendError(w, http.StatusInternalServerError, "UNKNOWN", "Failed to revoke tokens")
+		return
+	}
+
+	a.logger.Info().
+		Str("owner", owner).
+		Int("tokens", revoked).
+		Str("revoked_by", user.Name).
+		Msg("revoked access tokens of owner")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Revoked int `json:"revoked"`
+	}{revoked})
+}
+
+// visible returns whether a token may be seen and revoked by user: admins
+// manage all tokens, other users their own.
+func (a *PATAuth) visible(user access.User) func(Token) bool {
+	return func(token Token) bool {
+		return a.admin(user) || token.Owner == user.Name
+	}
+}
+
+func (a *PATAuth) admin(user access.User) bool {
+	return user.Name != "" && slices.Contains(a.admins, user.Name)
+}
+
+func (c createRequest) validate(now time.Time) error {
+	if c.Name == "" {
+		return fmt.Errorf("token name is required")
+	}
+	if c.Robot != "" && !robotRegexp.MatchString(c.Robot) {
+		return fmt.Errorf("invalid robot name: %s", c.Robot)
+	}
+	if len(c.Repositories) == 0 {
+		return fmt.Errorf("token requires repositories")
+	}
+	for _, glob := range c.Repositories {
+		if err := access.ValidateRepositoryGlob(glob); err != nil {
+			return err
+		}
+	}
+	if len(c.Actions) == 0 {
+		return fmt.Errorf("token requires actions")
+	}
+	for _, action := range c.Actions {
+		if action != access.ActionPull && action != access.ActionPush && action != access.ActionDelete {
+			return fmt.Errorf("invalid action: %s", action)
+		}
+	}
+	if c.ExpiresAt != nil && !c.ExpiresAt.After(now) {
+		return fmt.Errorf("token expiry must be in the future")
+	}
+	return nil
+}
+
+func sendError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,319 @@
+package pat
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/auth/htpasswd"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+const (
+	testPassword   = "password"
+	testBcryptHash = "$2b$12$1PqeG8v5YfoxsyW5gAyHcOq6RCgY71kIt6qtLnEUqaddiuNGTGepe"
+)
+
+func newTestAuth(t *testing.T, file string) *PATAuth {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	inner, err := htpasswd.NewHtpasswdAuth(t.Context(), &config.HtpasswdConfig{
+		Contents: "alice:" + testBcryptHash + "\nbob:" + testBcryptHash + "\nadmin:" + testBcryptHash,
+	}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create htpasswd auth: %v", err)
+	}
+	a, err := New(&config.PATConfig{File: file, Admins: "admin"}, inner, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create access token auth: %v", err)
+	}
+	return a
+}
+
+// request sends a request to the token API as username.
+func request(t *testing.T, a *PATAuth, method, path, username string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var content []byte
+	if body != nil {
+		content, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(content))
+	req.SetBasicAuth(username, testPassword)
+	w := httptest.NewRecorder()
+	a.Router().ServeHTTP(w, req)
+	return w
+}
+
+func create(t *testing.T, a *PATAuth, username string, body createRequest) createResponse {
+	t.Helper()
+
+	w := request(t, a, http.MethodPost, "/tokens", username, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected token to be created, got %d: %s", w.Code, w.Body)
+	}
+	var response createResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response
+}
+
+func list(t *testing.T, a *PATAuth, username string) []Token {
+	t.Helper()
+
+	w := request(t, a, http.MethodGet, "/tokens", username, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected tokens to be listed, got %d", w.Code)
+	}
+	var response struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response.Tokens
+}
+
+func TestMiddleware(t *testing.T) {
+	a := newTestAuth(t, filepath.Join(t.TempDir(), "tokens.json"))
+	created := create(t, a, "alice", createRequest{Name: "ci", Repositories: []string{"team/*"}, Actions: []string{access.ActionPull}})
+
+	var user access.User
+	handler := a.DistributionMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = access.UserFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		path       string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{"token", "/v2/team/app/tags/list", "alice", created.Secret, http.StatusOK},
+		{"password", "/v2/team/app/tags/list", "alice", testPassword, http.StatusOK},
+		{"token of another user", "/v2/team/app/tags/list", "bob", created.Secret, http.StatusUnauthorized},
+		{"unknown token", "/v2/team/app/tags/list", "alice", Prefix + "unknown", http.StatusUnauthorized},
+		{"admin api", "/admin/replication/", "alice", created.Secret, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		user = access.User{}
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.SetBasicAuth(tt.username, tt.password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, w.Code)
+		}
+		if tt.name == "token" {
+			if user.Name != "alice" || user.Token == nil {
+				t.Fatalf("Expected alice limited by her token, got %+v", user)
+			}
+			if !access.Allowed(nil, user, access.Scope{Type: "repository", Name: "team/app", Actions: []string{access.ActionPull}}) {
+				t.Error("Expected the token to grant pull")
+			}
+			if access.Allowed(nil, user, access.Scope{Type: "repository", Name: "team/app", Actions: []string{access.ActionPush}}) {
+				t.Error("Expected the token not to grant push")
+			}
+		}
+	}
+
+	// Tokens cannot be used to manage tokens
+	req := httptest.NewRequest(http.MethodGet, "/tokens", nil)
+	req.SetBasicAuth("alice", created.Secret)
+	w := httptest.NewRecorder()
+	a.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected tokens not to manage tokens, got %d", w.Code)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	a := newTestAuth(t, filepath.Join(t.TempDir(), "tokens.json"))
+	expires := time.Now().Add(time.Hour)
+	created := create(t, a, "alice", createRequest{Name: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}, ExpiresAt: &expires})
+
+	if _, err := a.store.authenticate("alice", created.Secret, time.Now()); err != nil {
+		t.Errorf("Expected token to be valid: %v", err)
+	}
+	if _, err := a.store.authenticate("alice", created.Secret, expires); err != errExpiredToken {
+		t.Errorf("Expected token to be expired, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	w := request(t, a, http.MethodPost, "/tokens", "alice", createRequest{Name: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}, ExpiresAt: &past})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an expired token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestManagement(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	a := newTestAuth(t, file)
+
+	own := create(t, a, "alice", createRequest{Name: "laptop", Repositories: []string{"*"}, Actions: []string{access.ActionPull, access.ActionPush}})
+	robot := create(t, a, "admin", createRequest{Name: "deploy", Robot: "ci", Repositories: []string{"team/*"}, Actions: []string{access.ActionPull}})
+	if robot.Owner != "robot$ci" || robot.CreatedBy != "admin" {
+		t.Errorf("Expected a token of the ci robot created by admin, got %+v", robot.Token)
+	}
+	if own.Hash != "" || robot.Hash != "" {
+		t.Error("Expected hashes not to be served")
+	}
+
+	invalid := []createRequest{
+		{Name: "", Repositories: []string{"*"}, Actions: []string{access.ActionPull}},
+		{Name: "ci", Actions: []string{access.ActionPull}},
+		{Name: "ci", Repositories: []string{"["}, Actions: []string{access.ActionPull}},
+		{Name: "ci", Repositories: []string{"*"}, Actions: []string{"admin"}},
+		{Name: "ci", Robot: "CI!", Repositories: []string{"*"}, Actions: []string{access.ActionPull}},
+	}
+	for _, body := range invalid {
+		if w := request(t, a, http.MethodPost, "/tokens", "admin", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %+v to be rejected, got %d", body, w.Code)
+		}
+	}
+	if w := request(t, a, http.MethodPost, "/tokens", "alice", createRequest{Name: "ci", Robot: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected users not to create robot tokens, got %d", w.Code)
+	}
+
+	if _, err := a.store.authenticate("robot$ci", robot.Secret, time.Now()); err != nil {
+		t.Errorf("Expected robot token to be valid: %v", err)
+	}
+
+	if tokens := list(t, a, "alice"); len(tokens) != 1 || tokens[0].ID != own.ID {
+		t.Errorf("Expected alice to see her token, got %+v", tokens)
+	}
+	if tokens := list(t, a, "bob"); len(tokens) != 0 {
+		t.Errorf("Expected bob to see no tokens, got %+v", tokens)
+	}
+	tokens := list(t, a, "admin")
+	if len(tokens) != 2 {
+		t.Fatalf("Expected admin to see all tokens, got %+v", tokens)
+	}
+	if tokens[1].LastUsedAt == nil || tokens[0].LastUsedAt != nil {
+		t.Errorf("Expected only the robot token to be used, got %+v", tokens)
+	}
+
+	// Tokens survive restarts, hashed
+	a = newTestAuth(t, file)
+	if _, err := a.store.authenticate("alice", own.Secret, time.Now()); err != nil {
+		t.Errorf("Expected token to be valid after a restart: %v", err)
+	}
+	for _, token := range a.store.tokens {
+		if token.Hash == "" || token.Hash == own.Secret || token.Hash == robot.Secret {
+			t.Errorf("Expected tokens to be stored hashed, got %q", token.Hash)
+		}
+	}
+
+	if w := request(t, a, http.MethodDelete, "/tokens/"+own.ID, "bob", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected bob not to revoke the token of alice, got %d", w.Code)
+	}
+	if w := request(t, a, http.MethodDelete, "/tokens/"+own.ID, "alice", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected alice to revoke her token, got %d", w.Code)
+	}
+	if w := request(t, a, http.MethodDelete, "/tokens/"+robot.ID, "admin", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected admin to revoke the robot token, got %d", w.Code)
+	}
+	if _, err := a.store.authenticate("alice", own.Secret, time.Now()); err != errInvalidToken {
+		t.Errorf("Expected revoked token to be invalid, got %v", err)
+	}
+
+	a = newTestAuth(t, file)
+	if len(a.store.tokens) != 0 {
+		t.Errorf("Expected revoked tokens to stay revoked, got %+v", a.store.tokens)
+	}
+}
+
+func TestRevokeOwner(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	a := newTestAuth(t, file)
+
+	laptop := create(t, a, "alice", createRequest{Name: "laptop", Repositories: []string{"*"}, Actions: []string{access.ActionPull}})
+	create(t, a, "alice", createRequest{Name: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}})
+	kept := create(t, a, "bob", createRequest{Name: "laptop", Repositories: []string{"*"}, Actions: []string{access.ActionPull}})
+
+	if w := request(t, a, http.MethodDelete, "/tokens?owner=alice", "alice", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected users not to revoke tokens by owner, got %d", w.Code)
+	}
+	if w := request(t, a, http.MethodDelete, "/tokens", "admin", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an owner to be required, got %d", w.Code)
+	}
+
+	w := request(t, a, http.MethodDelete, "/tokens?owner=alice", "admin", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "{\"revoked\":2}\n" {
+		t.Errorf("Expected both tokens of alice to be revoked, got %d: %s", w.Code, w.Body)
+	}
+	if _, err := a.store.authenticate("alice", laptop.Secret, time.Now()); err != errInvalidToken {
+		t.Errorf("Expected revoked token to be invalid, got %v", err)
+	}
+
+	a = newTestAuth(t, file)
+	if len(a.store.tokens) != 1 || a.store.tokens[0].ID != kept.ID {
+		t.Errorf("Expected only the token of bob to remain, got %+v", a.store.tokens)
+	}
+}
+
+// groupsAuth authenticates every user with the test password and puts them
+// in the developers group.
+type groupsAuth struct{}
+
+func (groupsAuth) Router() *chi.Mux {
+	return chi.NewRouter()
+}
+
+func (groupsAuth) DistributionMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || password != testPassword {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(access.WithUser(r.Context(), access.User{Name: username, Groups: []string{"developers"}})))
+		})
+	}
+}
+
+func TestTokensKeepGroups(t *testing.T) {
+	logger := zerolog.Nop()
+	a, err := New(&config.PATConfig{File: filepath.Join(t.TempDir(), "tokens.json"), Admins: "admin"}, groupsAuth{}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create access token auth: %v", err)
+	}
+
+	own := create(t, a, "alice", createRequest{Name: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}})
+	robot := create(t, a, "admin", createRequest{Name: "deploy", Robot: "ci", Repositories: []string{"*"}, Actions: []string{access.ActionPull}})
+
+	var user access.User
+	handler := a.DistributionMiddleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ = access.UserFromContext(r.Context())
+	}))
+	for _, tt := range []struct {
+		username   string
+		secret     string
+		wantGroups []string
+	}{
+		{"alice", own.Secret, []string{"developers"}},
+		{"robot$ci", robot.Secret, nil},
+	} {
+		user = access.User{}
+		req := httptest.NewRequest(http.MethodGet, "/v2/app/tags/list", nil)
+		req.SetBasicAuth(tt.username, tt.secret)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if user.Name != tt.username || !slices.Equal(user.Groups, tt.wantGroups) {
+			t.Errorf("Expected %s in groups %v, got %+v", tt.username, tt.wantGroups, user)
+		}
+	}
+}
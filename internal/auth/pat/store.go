@@ -0,0 +1,240 @@
+package pat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/rs/zerolog"
+)
+
+// Prefix starts every access token, telling them apart from passwords.
+const Prefix = "sorcerer_pat_"
+
+// RobotPrefix starts the names of robot accounts, which only exist as the
+// owners of their tokens.
+const RobotPrefix = "robot$"
+
+// lastUsedResolution is how often the last use of a token is written to
+// disk, which is precise enough to find stale tokens.
+const lastUsedResolution = time.Minute
+
+var (
+	errInvalidToken = errors.New("invalid access token")
+	errExpiredToken = errors.New("expired access token")
+	errNotFound     = errors.New("access token not found")
+)
+
+// Token is an access token of a user or robot account, granting actions on
+// the repositories matching its globs until it expires. Only a hash of the
+// token itself is kept.
+//
+// Tokens are not checked against the other authentication when they are
+// used: a token stays valid after its owner is removed from the htpasswd
+// file or the directory, and keeps the groups they were in when it was
+// created. Their tokens have to be revoked along with them.
+type Token struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Owner        string     `json:"owner"`
+	CreatedBy    string     `json:"created_by"`
+	Groups       []string   `json:"groups,omitempty"` // Groups of the owner in the other authentication
+	Repositories []string   `json:"repositories"`
+	Actions      []string   `json:"actions"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	Hash         string     `json:"hash,omitempty"`
+}
+
+// grant is the authorizer limiting the owner of a token to what it grants.
+type grant struct {
+	repositories []string
+	actions      []string
+}
+
+// Actions returns the actions the token grants on the repository.
+func (g grant) Actions(user access.User, repository string) []string {
+	if access.MatchAnyRepository(g.repositories, repository) {
+		return g.actions
+	}
+	return nil
+}
+
+func (t Token) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// store keeps the tokens in a JSON file, rewritten on every change.
+type store struct {
+	file   string
+	logger *zerolog.Logger
+
+	mu     sync.Mutex
+	tokens []*Token
+}
+
+func openStore(file string, logger *zerolog.Logger) (*store, error) {
+	s := &store{file: file, logger: logger}
+
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access tokens: %w", err)
+	}
+
+	var stored struct {
+		Tokens []*Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse access tokens %s: %w", file, err)
+	}
+	s.tokens = stored.Tokens
+	return s, nil
+}
+
+// save writes the tokens to a temporary file renamed over the file, so that
+// it is never left partially written. The lock must be held.
+func (s *store) save() error {
+	content, err := json.MarshalIndent(struct {
+		Tokens []*Token `json:"tokens"`
+	}{s.tokens}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o700); err != nil {
+		return fmt.Errorf("failed to create access token directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), ".tokens-*")
+	if err != nil {
+		return fmt.Errorf("failed to write access tokens: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write access tokens: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write access tokens: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		return fmt.Errorf("failed to write access tokens: %w", err)
+	}
+	return nil
+}
+
+// create stores token and returns the secret to hand to its owner, which
+// cannot be recovered later.
+func (s *store) create(token Token) (Token, string, error) {
+	secret := Prefix + rand.Text() + rand.Text()
+	token.ID = rand.Text()
+	token.Hash = hash(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens = append(s.tokens, &token)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return Token{}, "", err
+	}
+	return token, secret, nil
+}
+
+// list returns the tokens visible for which is true, in order of creation.
+func (s *store) list(visible func(Token) bool) []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []Token{}
+	for _, token := range s.tokens {
+		if visible(*token) {
+			tokens = append(tokens, *token)
+		}
+	}
+	return tokens
+}
+
+// revoke deletes the token with the id if it is visible.
+func (s *store) revoke(id string, visible func(Token) bool) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.tokens, func(token *Token) bool { return token.ID == id && visible(*token) })
+	if i < 0 {
+		return Token{}, errNotFound
+	}
+
+	token := s.tokens[i]
+	s.tokens = slices.Delete(s.tokens, i, i+1)
+	if err := s.save(); err != nil {
+		s.tokens = slices.Insert(s.tokens, i, token)
+		return Token{}, err
+	}
+	return *token, nil
+}
+
+// revokeOwner deletes all tokens of the owner and returns how many there
+// were.
+func (s *store) revokeOwner(owner string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := s.tokens
+	s.tokens = slices.DeleteFunc(slices.Clone(tokens), func(token *Token) bool { return token.Owner == owner })
+	revoked := len(tokens) - len(s.tokens)
+	if revoked == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		s.tokens = tokens
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// authenticate returns the token of username with the secret, recording
+// that it was used.
+func (s *store) authenticate(username, secret string, now time.Time) (Token, error) {
+	h := hash(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.tokens, func(token *Token) bool { return token.Hash == h })
+	if i < 0 || s.tokens[i].Owner != username {
+		return Token{}, errInvalidToken
+	}
+	token := s.tokens[i]
+	if token.expired(now) {
+		return Token{}, errExpiredToken
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedResolution {
+		used := now.UTC()
+		token.LastUsedAt = &used
+		// Failing to record the use does not fail the authentication
+		if err := s.save(); err != nil {
+			s.logger.Error().Err(err).Str("id", token.ID).Msg("failed to record access token use")
+		}
+	}
+	return *token, nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
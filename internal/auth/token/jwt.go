@@ -0,0 +1,105 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/auth/jwt"
+)
+
+// claims are the claims of tokens as described by the docker token spec.
+type claims struct {
+	Issuer    string         `json:"iss"`
+	Subject   string         `json:"sub"`
+	Audience  string         `json:"aud"`
+	ExpiresAt int64          `json:"exp"`
+	NotBefore int64          `json:"nbf"`
+	IssuedAt  int64          `json:"iat"`
+	ID        string         `json:"jti"`
+	Access    []access.Scope `json:"access"`
+}
+
+// signer signs and verifies JWTs with ES256 or RS256, depending on its key.
+type signer struct {
+	key       crypto.Signer
+	algorithm string
+}
+
+// loadSigner reads the private key tokens are signed with, or generates one
+// if path is empty.
+func loadSigner(path string) (*signer, error) {
+	if path == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &signer{key: key, algorithm: "ES256"}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token key: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("token key %s is not PEM encoded", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("token key must use the P-256 curve")
+		}
+		return &signer{key: key, algorithm: "ES256"}, nil
+	case *rsa.PrivateKey:
+		return &signer{key: key, algorithm: "RS256"}, nil
+	default:
+		return nil, fmt.Errorf("token key must be an EC or RSA key, got %T", key)
+	}
+}
+
+func (s *signer) sign(c claims) (string, error) {
+	return jwt.Sign(s.key, jwt.Header{Algorithm: s.algorithm, Type: "JWT"}, c)
+}
+
+// verify checks the signature and lifetime of a token and returns its claims.
+func (s *signer) verify(token string, now time.Time) (*claims, error) {
+	var c claims
+	t, err := jwt.Parse(token, &c)
+	if err != nil {
+		return nil, err
+	}
+	if t.Header.Algorithm != s.algorithm {
+		return nil, jwt.ErrInvalidToken
+	}
+	if err := t.Verify(s.key.Public()); err != nil {
+		return nil, err
+	}
+
+	if now.Unix() >= c.ExpiresAt || now.Unix() < c.NotBefore {
+		return nil, fmt.Errorf("%w: token is expired or not valid yet", jwt.ErrInvalidToken)
+	}
+	return &c, nil
+}
@@ -0,0 +1,112 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+)
+
+// DistributionMiddleware lets requests through that present a token granting
+// the scopes their route requires, and challenges clients to fetch one from
+// the token endpoint otherwise.
+func (a *TokenAuth) DistributionMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			required := access.Required(r)
+
+			value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				a.challenge(w, r, required, "")
+				return
+			}
+
+			claims, err := a.signer.verify(strings.TrimSpace(value), time.Now())
+			if err == nil && (claims.Issuer != a.config.Issuer || claims.Audience != a.config.Service) {
+				err = errors.New("token was issued for another service")
+			}
+			if err != nil {
+				a.logger.Debug().Err(err).Str("path", r.URL.Path).Msg("invalid token")
+				a.challenge(w, r, required, "invalid_token")
+				return
+			}
+
+			// Anonymous tokens carry no scopes, but would still pass for
+			// routes that need none, which outside of the base endpoint of
+			// the distribution API only admins may use
+			if claims.Subject == "" && !strings.HasPrefix(r.URL.Path, "/v2/") {
+				a.challenge(w, r, required, "insufficient_scope")
+				return
+			}
+
+			for _, scope := range required {
+				if !allows(claims.Access, scope) {
+					a.logger.Debug().
+						Str("username", claims.Subject).
+						Str("scope", scope.String()).
+						Msg("token lacks scope")
+					a.challenge(w, r, required, "insufficient_scope")
+					return
+				}
+			}
+
+			ctx := access.WithUser(r.Context(), access.User{Name: claims.Subject})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func allows(granted []access.Scope, required access.Scope) bool {
+	for _, scope := range granted {
+		if scope.Allows(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge asks the client to authenticate at the token endpoint for the
+// scopes of the request.
+func (a *TokenAuth) challenge(w http.ResponseWriter, r *http.Request, scopes []access.Scope, reason string) {
+	// Clients mounting a blob ask for a token that also lets them pull it
+	// from the repository it is mounted from
+	if from, ok := access.MountSource(r); ok {
+		scopes = append(scopes, access.Scope{Type: "repository", Name: from, Actions: []string{access.ActionPull}})
+	}
+
+	challenge := fmt.Sprintf(`Bearer realm=%q,service=%q`, a.realm(r), a.config.Service)
+	if len(scopes) > 0 {
+		names := make([]string, len(scopes))
+		for i, scope := range scopes {
+			names[i] = scope.String()
+		}
+		// Several scopes are separated by spaces, as in OAuth 2
+		challenge += fmt.Sprintf(`,scope=%q`, strings.Join(names, " "))
+	}
+	if reason != "" {
+		challenge += fmt.Sprintf(`,error=%q`, reason)
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication required")
+}
+
+// realm returns the configured URL of the token endpoint, or the one of this
+// server as the client reached it.
+func (a *TokenAuth) realm(r *http.Request) string {
+	if a.config.Realm != "" {
+		return a.config.Realm
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + "/auth/token"
+}
@@ -0,0 +1,168 @@
+package token
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/auth/htpasswd"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// TokenAuth implements the docker token flow: clients exchange their htpasswd
+// credentials for a short lived token at /auth/token, and present the token
+// to the registry instead of their password.
+//
+// If authorizer is not nil, tokens only grant the actions it allows users.
+type TokenAuth struct {
+	config     *config.TokenConfig
+	htpasswd   *htpasswd.HtpasswdAuth
+	signer     *signer
+	authorizer access.Authorizer
+	logger     *zerolog.Logger
+}
+
+func NewTokenAuth(ctx context.Context, c *config.AuthConfig, authorizer access.Authorizer, logger *zerolog.Logger) (*TokenAuth, error) {
+	if logger == nil {
+		return nil, fmt.Errorf("logger is required")
+	}
+
+	users, err := htpasswd.NewHtpasswdAuth(ctx, &c.Htpasswd, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := loadSigner(c.Token.Key)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token.Key == "" {
+		logger.Warn().Msg("no token key configured, tokens are signed with a generated key and invalidated by restarts")
+	}
+
+	logger.Info().
+		Str("auth_type", "token").
+		Str("service", c.Token.Service).
+		Msg("token authentication initialized")
+
+	return &TokenAuth{config: &c.Token, htpasswd: users, signer: signer, authorizer: authorizer, logger: logger}, nil
+}
+
+func (a *TokenAuth) Router() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/token", a.issueToken)
+	return r
+}
+
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// issueToken grants the scopes requested to the user authenticated with
+// basic auth. Clients without credentials get a token granting nothing.
+func (a *TokenAuth) issueToken(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if service := query.Get("service"); service != "" && service != a.config.Service {
+		sendError(w, http.StatusBadRequest, "UNSUPPORTED", fmt.Sprintf("Unknown service: %s", service))
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if ok && !a.htpasswd.Match(username, password) {
+		a.logger.Warn().Str("username", username).Msg("token request with invalid credentials")
+		sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid credentials")
+		return
+	}
+	if !ok {
+		username = ""
+	}
+
+	granted := []access.Scope{}
+	for _, requested := range query["scope"] {
+		scope, valid := access.ParseScope(requested)
+		if !valid {
+			sendError(w, http.StatusBadRequest, "INVALID_SCOPE", fmt.Sprintf("Invalid scope: %s", requested))
+			return
+		}
+		if actions := a.grant(username, scope); len(actions) > 0 {
+			granted = append(granted, access.Scope{Type: scope.Type, Name: scope.Name, Actions: actions})
+		}
+	}
+
+	now := time.Now()
+	token, err := a.signer.sign(claims{
+		Issuer:    a.config.Issuer,
+		Subject:   username,
+		Audience:  a.config.Service,
+		ExpiresAt: now.Add(a.config.Expiry).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        rand.Text(),
+		Access:    granted,
+	})
+	if err != nil {
+		a.logger.Error().Err(err).Msg("failed to sign token")
+		sendError(w, http.StatusInternalServerError, "UNKNOWN", "Failed to issue token")
+		return
+	}
+
+	a.logger.Debug().Str("username", username).Interface("access", granted).Msg("issued token")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(a.config.Expiry.Seconds()),
+		IssuedAt:    now.UTC(),
+	})
+}
+
+// grant returns the actions of a requested scope a user may perform. Users
+// with valid credentials may do anything the authorizer allows them, or
+// anything at all without one, like they may with htpasswd auth, and
+// anonymous users nothing.
+func (a *TokenAuth) grant(username string, scope access.Scope) []string {
+	if username == "" {
+		return nil
+	}
+
+	switch {
+	case scope.Type == "repository":
+		allowed := []string{access.ActionPull, access.ActionPush, access.ActionDelete}
+		if a.authorizer != nil {
+			allowed = a.authorizer.Actions(access.User{Name: username}, scope.Name)
+		}
+
+		var actions []string
+		for _, action := range scope.Actions {
+			if slices.Contains(allowed, action) {
+				actions = append(actions, action)
+			}
+		}
+		return actions
+	case scope.Type == access.CatalogScope.Type && scope.Name == access.CatalogScope.Name:
+		return access.CatalogScope.Actions
+	default:
+		return nil
+	}
+}
+
+func sendError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
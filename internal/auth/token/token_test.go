@@ -0,0 +1,324 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/remote"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// Valid bcrypt hash for "password" generated with htpasswd -B
+const (
+	testPassword   = "password"
+	testBcryptHash = "$2b$12$1PqeG8v5YfoxsyW5gAyHcOq6RCgY71kIt6qtLnEUqaddiuNGTGepe"
+)
+
+func newTestAuth(t *testing.T, key string) *TokenAuth {
+	t.Helper()
+
+	logger := zerolog.Nop()
+	a, err := NewTokenAuth(t.Context(), &config.AuthConfig{
+		Htpasswd: config.HtpasswdConfig{Contents: "testuser:" + testBcryptHash},
+		Token:    config.TokenConfig{Service: "sorcerer", Issuer: "sorcerer", Key: key, Expiry: time.Minute},
+	}, nil, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create token auth: %v", err)
+	}
+	return a
+}
+
+func newTestServer(t *testing.T, a *TokenAuth) *httptest.Server {
+	t.Helper()
+
+	s, err := mem_store.New(&config.StoreConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Mount("/v2", distribution.New(s, a.DistributionMiddleware(), nil).Router())
+	r.Mount("/auth", a.Router())
+	admin := chi.NewRouter()
+	admin.Use(a.DistributionMiddleware())
+	admin.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.Mount("/admin", admin)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func request(t *testing.T, method, url, token string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), method, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func fetchToken(t *testing.T, server *httptest.Server, username, password string, scopes ...string) (string, int) {
+	t.Helper()
+
+	query := url.Values{"service": {"sorcerer"}, "scope": scopes}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL+"/auth/token?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body tokenResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	return body.Token, resp.StatusCode
+}
+
+func TestChallenges(t *testing.T) {
+	server := newTestServer(t, newTestAuth(t, ""))
+	realm := server.URL + "/auth/token"
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/v2/", `Bearer realm="` + realm + `",service="sorcerer"`},
+		{"GET", "/v2/team/app/tags/list", `Bearer realm="` + realm + `",service="sorcerer",scope="repository:team/app:pull"`},
+		{"PUT", "/v2/team/app/manifests/latest", `Bearer realm="` + realm + `",service="sorcerer",scope="repository:team/app:pull,push"`},
+		{"POST", "/v2/team/app/blobs/uploads/?mount=sha256:abc&from=base", `Bearer realm="` + realm + `",service="sorcerer",scope="repository:team/app:pull,push repository:base:pull"`},
+		{"DELETE", "/v2/team/app/manifests/latest", `Bearer realm="` + realm + `",service="sorcerer",scope="repository:team/app:delete"`},
+		{"GET", "/v2/_catalog", `Bearer realm="` + realm + `",service="sorcerer",scope="registry:catalog:*"`},
+	}
+
+	for _, tt := range tests {
+		resp := request(t, tt.method, server.URL+tt.path, "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401, got %d", tt.method, tt.path, resp.StatusCode)
+		}
+		if got := resp.Header.Get("WWW-Authenticate"); got != tt.want {
+			t.Errorf("%s %s: expected challenge %s, got %s", tt.method, tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestTokenFlow(t *testing.T) {
+	server := newTestServer(t, newTestAuth(t, ""))
+
+	if _, status := fetchToken(t, server, "testuser", "wrongpassword", "repository:app:pull"); status != http.StatusUnauthorized {
+		t.Errorf("Expected invalid credentials to be rejected, got %d", status)
+	}
+
+	token, status := fetchToken(t, server, "testuser", testPassword, "repository:app:pull,push", "repository:other:pull")
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("Expected token, got %d", status)
+	}
+
+	if resp := request(t, http.MethodGet, server.URL+"/v2/", token); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected token to be accepted at the base endpoint, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodPost, server.URL+"/v2/app/blobs/uploads/", token); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected push to be allowed, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodPost, server.URL+"/v2/other/blobs/uploads/", token); resp.StatusCode != http.StatusUnauthorized ||
+		!strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="insufficient_scope"`) {
+		t.Errorf("Expected push to a repository only pulled from to be rejected, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodDelete, server.URL+"/v2/app/manifests/latest", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected delete without the scope to be rejected, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodGet, server.URL+"/admin/", token); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected users to reach admin endpoints, got %d", resp.StatusCode)
+	}
+
+	tampered := token[:len(token)-4] + "AAAA"
+	if resp := request(t, http.MethodGet, server.URL+"/v2/", tampered); resp.StatusCode != http.StatusUnauthorized ||
+		!strings.Contains(resp.Header.Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Errorf("Expected tampered token to be rejected, got %d", resp.StatusCode)
+	}
+
+	// Tokens signed by another instance are not accepted
+	other, _ := fetchToken(t, newTestServer(t, newTestAuth(t, "")), "testuser", testPassword, "repository:app:pull")
+	if resp := request(t, http.MethodGet, server.URL+"/v2/app/tags/list", other); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected foreign token to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	a := newTestAuth(t, "")
+	a.authorizer = &access.Policy{Rules: []access.PolicyRule{
+		{Users: []string{"testuser"}, Repositories: []string{"team/*"}, Actions: []string{access.ActionPull, access.ActionPush}},
+		{Users: []string{"*"}, Repositories: []string{"base"}, Actions: []string{access.ActionPull}},
+	}}
+	server := newTestServer(t, a)
+
+	token, status := fetchToken(t, server, "testuser", testPassword, "repository:team/app:pull,push,delete", "repository:base:pull,push")
+	if status != http.StatusOK {
+		t.Fatalf("Expected token, got %d", status)
+	}
+
+	if resp := request(t, http.MethodPost, server.URL+"/v2/team/app/blobs/uploads/", token); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected push allowed by the policy to be granted, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodDelete, server.URL+"/v2/team/app/manifests/latest", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected delete not allowed by the policy not to be granted, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodGet, server.URL+"/v2/base/tags/list", token); resp.StatusCode == http.StatusUnauthorized {
+		t.Errorf("Expected pull allowed by the policy to be granted, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodPost, server.URL+"/v2/base/blobs/uploads/", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected push not allowed by the policy not to be granted, got %d", resp.StatusCode)
+	}
+}
+
+func TestAnonymousToken(t *testing.T) {
+	server := newTestServer(t, newTestAuth(t, ""))
+
+	token, status := fetchToken(t, server, "", "", "repository:app:pull")
+	if status != http.StatusOK {
+		t.Fatalf("Expected anonymous token, got %d", status)
+	}
+
+	if resp := request(t, http.MethodGet, server.URL+"/v2/", token); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected anonymous token to be accepted at the base endpoint, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodGet, server.URL+"/v2/app/tags/list", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous token to grant nothing, got %d", resp.StatusCode)
+	}
+	if resp := request(t, http.MethodGet, server.URL+"/admin/", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous token to be rejected at admin endpoints, got %d", resp.StatusCode)
+	}
+}
+
+// TestRemoteClient checks the flow against the client replication and the
+// pull-through cache talk to registries with, which follows docker's.
+func TestRemoteClient(t *testing.T) {
+	server := newTestServer(t, newTestAuth(t, ""))
+	endpoint, _ := url.Parse(server.URL)
+	client := remote.NewClient(endpoint, "testuser", testPassword)
+
+	for range 2 {
+		req, _ := http.NewRequestWithContext(t.Context(), http.MethodPost, client.URL("team/app", "blobs/uploads/"), nil)
+		resp, err := client.Do(req, "team/app", true)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("Expected upload to be started with a token, got %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	a := newTestAuth(t, "")
+	now := time.Now()
+	token, err := a.signer.sign(claims{Issuer: "sorcerer", Audience: "sorcerer", Subject: "testuser", NotBefore: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	if _, err := a.signer.verify(token, now); err != nil {
+		t.Errorf("Expected token to be valid, got %v", err)
+	}
+	if _, err := a.signer.verify(token, now.Add(time.Minute)); err == nil {
+		t.Error("Expected expired token to be rejected")
+	}
+	if _, err := a.signer.verify(token, now.Add(-time.Minute)); err == nil {
+		t.Error("Expected token not valid yet to be rejected")
+	}
+}
+
+func TestWrongAudience(t *testing.T) {
+	a := newTestAuth(t, "")
+	server := newTestServer(t, a)
+
+	now := time.Now()
+	token, _ := a.signer.sign(claims{
+		Issuer: "sorcerer", Audience: "other", Subject: "testuser", NotBefore: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(),
+		Access: []access.Scope{{Type: "repository", Name: "app", Actions: []string{"pull"}}},
+	})
+	if resp := request(t, http.MethodGet, server.URL+"/v2/app/tags/list", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected token for another service to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pkcs8DER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p384DER, _ := x509.MarshalECPrivateKey(p384Key)
+
+	tests := []struct {
+		name          string
+		block         *pem.Block
+		wantAlgorithm string
+	}{
+		{"ec", &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}, "ES256"},
+		{"rsa", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, "RS256"},
+		{"pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}, "RS256"},
+		{"p384", &pem.Block{Type: "EC PRIVATE KEY", Bytes: p384DER}, ""},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.name+".pem")
+		os.WriteFile(path, pem.EncodeToMemory(tt.block), 0o600)
+
+		s, err := loadSigner(path)
+		if tt.wantAlgorithm == "" {
+			if err == nil {
+				t.Errorf("%s: expected key to be rejected", tt.name)
+			}
+			continue
+		}
+		if err != nil || s.algorithm != tt.wantAlgorithm {
+			t.Errorf("%s: expected %s signer, got %v", tt.name, tt.wantAlgorithm, err)
+			continue
+		}
+
+		token, err := s.sign(claims{ExpiresAt: time.Now().Add(time.Minute).Unix()})
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", tt.name, err)
+		}
+		if _, err := s.verify(token, time.Now()); err != nil {
+			t.Errorf("%s: expected token to verify, got %v", tt.name, err)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/dvjn/sorcerer/internal/access"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/structs"
 	"github.com/knadh/koanf/v2"
@@ -21,30 +24,157 @@ type ServerConfig struct {
 const (
 	AuthModeNone     = "none"
 	AuthModeHtpasswd = "htpasswd"
+	AuthModeToken    = "token"
+	AuthModeOIDC     = "oidc"
+	AuthModeLDAP     = "ldap"
 )
 
 type NoAuthConfig struct{}
 
 type HtpasswdConfig struct {
-	File     string `koanf:"file"`     // Path to htpasswd file
-	Contents string `koanf:"contents"` // Inline htpasswd content
+	File               string `koanf:"file"`                // Path to htpasswd file
+	Contents           string `koanf:"contents"`            // Inline htpasswd content
+	AnonymousPull      bool   `koanf:"anonymous_pull"`      // Allow pulls without credentials
+	PublicRepositories string `koanf:"public_repositories"` // Comma separated globs of repositories anonymous users may pull, all if empty
+}
+
+// TokenConfig configures the token service, which authenticates users with
+// the htpasswd configuration.
+type TokenConfig struct {
+	Realm   string        `koanf:"realm"`   // URL of the token endpoint sent to clients, derived from the request if empty
+	Service string        `koanf:"service"` // Name of the registry in challenges and tokens
+	Issuer  string        `koanf:"issuer"`
+	Key     string        `koanf:"key"`    // Path to a PEM encoded EC P-256 or RSA private key, generated at startup if empty
+	Expiry  time.Duration `koanf:"expiry"` // How long issued tokens are valid for
+}
+
+// OIDCConfig configures the OpenID providers whose ID tokens are accepted as
+// credentials, such as a single sign-on provider or the workload identity
+// tokens of CI jobs.
+type OIDCConfig struct {
+	Providers     string `koanf:"providers"`      // Inline JSON list of OpenID providers
+	ProvidersFile string `koanf:"providers_file"` // Path to a JSON file with OpenID providers
+}
+
+// LDAPConfig configures the directory users authenticate against. Users
+// either bind with a DN made from their username, or are searched for with a
+// service account first.
+type LDAPConfig struct {
+	URL            string        `koanf:"url"`             // ldap:// or ldaps:// URL of the directory
+	StartTLS       bool          `koanf:"start_tls"`       // Upgrade ldap:// connections with StartTLS
+	CAFile         string        `koanf:"ca_file"`         // PEM encoded certificates to verify the directory with, the system's if empty
+	UserDN         string        `koanf:"user_dn"`         // DN users bind with, "{username}" is replaced with their username
+	BindDN         string        `koanf:"bind_dn"`         // DN of the service account searching users, if there is no user DN
+	BindPassword   string        `koanf:"bind_password"`   // Password of the service account
+	UserBase       string        `koanf:"user_base"`       // DN users are searched in
+	UserFilter     string        `koanf:"user_filter"`     // Filter finding a user, "{username}" is replaced with their username
+	GroupBase      string        `koanf:"group_base"`      // DN groups are searched in, the memberOf attribute of users is read if empty
+	GroupFilter    string        `koanf:"group_filter"`    // Filter finding the groups of a user, "{dn}" is replaced with the DN of the user
+	GroupAttribute string        `koanf:"group_attribute"` // Attribute of groups holding their name
+	CacheTTL       time.Duration `koanf:"cache_ttl"`       // How long successful binds are cached, disabled if zero
+	Timeout        time.Duration `koanf:"timeout"`         // How long to wait for the directory to respond
+}
+
+// PolicyConfig configures which actions users may perform on repositories.
+// Without a policy, authenticated users may do anything.
+type PolicyConfig struct {
+	File string `koanf:"file"` // Path to a JSON file with the policy
+}
+
+// PATConfig configures personal access tokens and the tokens of robot
+// accounts, accepted as the password of their owner.
+type PATConfig struct {
+	File   string `koanf:"file"`   // Path to the JSON file tokens are stored in, disabled if empty
+	Admins string `koanf:"admins"` // Comma separated users who manage robot accounts and all tokens
 }
 
 type AuthConfig struct {
 	Mode     string          `koanf:"mode"`
 	NoAuth   NoAuthConfig    `koanf:"no_auth"`
 	Htpasswd HtpasswdConfig  `koanf:"htpasswd"`
+	Token    TokenConfig     `koanf:"token"`
+	OIDC     OIDCConfig      `koanf:"oidc"`
+	LDAP     LDAPConfig      `koanf:"ldap"`
+	Policy   PolicyConfig    `koanf:"policy"`
+	PAT      PATConfig       `koanf:"pat"`
+}
+
+const (
+	StoreBackendFS     = "fs"
+	StoreBackendS3     = "s3"
+	StoreBackendMemory = "memory"
+)
+
+type MemoryConfig struct {
+	MaxBytes int64 `koanf:"max_bytes"` // Most bytes of content to hold, unlimited if zero
+}
+
+type S3Config struct {
+	Endpoint       string        `koanf:"endpoint"` // Host and optional port of the S3 API
+	Region         string        `koanf:"region"`
+	Bucket         string        `koanf:"bucket"`
+	Prefix         string        `koanf:"prefix"` // Prefix for all keys, to share a bucket
+	AccessKey      string        `koanf:"access_key"`
+	SecretKey      string        `koanf:"secret_key"`
+	Insecure       bool          `koanf:"insecure"`        // Use plain HTTP
+	PathStyle      bool          `koanf:"path_style"`      // Address the bucket in the path instead of the host name
+	PartSize       int64         `koanf:"part_size"`       // Size of the parts uploads are split into
+	Redirect       bool          `koanf:"redirect"`        // Redirect blob downloads to presigned URLs
+	RedirectExpiry time.Duration `koanf:"redirect_expiry"` // How long presigned URLs are valid for
 }
 
 type StoreConfig struct {
-	Path string `koanf:"path"`
+	Backend         string        `koanf:"backend"`
+	Path            string        `koanf:"path"`
+	UploadTTL       time.Duration `koanf:"upload_ttl"`       // Uploads idle for longer are removed, disabled if zero
+	VerifyManifests bool          `koanf:"verify_manifests"` // Re-hash manifests on read to detect corruption
+	S3              S3Config      `koanf:"s3"`
+	Memory          MemoryConfig  `koanf:"memory"`
+}
+
+type GCConfig struct {
+	Interval       time.Duration `koanf:"interval"`        // How often to run garbage collection, disabled if zero
+	GracePeriod    time.Duration `koanf:"grace_period"`    // Content younger than this is never collected
+	DeleteUntagged bool          `koanf:"delete_untagged"` // Also collect manifests that are not reachable from a tag
+	DryRun         bool          `koanf:"dry_run"`         // Only report what would be collected
+}
+
+type ProxyConfig struct {
+	Upstream string        `koanf:"upstream"` // URL of the registry to mirror, proxy mode is disabled if empty
+	Username string        `koanf:"username"`
+	Password string        `koanf:"password"`
+	TagTTL   time.Duration `koanf:"tag_ttl"` // How long a tag is served from the cache before it is checked upstream again
+}
+
+type ReplicationConfig struct {
+	Rules       string        `koanf:"rules"`        // Inline JSON list of replication rules
+	RulesFile   string        `koanf:"rules_file"`   // Path to a JSON file with replication rules
+	QueuePath   string        `koanf:"queue_path"`   // Directory holding pending replications
+	Workers     int           `koanf:"workers"`      // Number of replications run at once
+	MaxAttempts int           `koanf:"max_attempts"` // Replications are dropped after failing this many times
+	MaxBackoff  time.Duration `koanf:"max_backoff"`  // Longest wait between attempts
+	Admins      string        `koanf:"admins"`       // Comma separated users who may read the state of replication
+}
+
+type WebhooksConfig struct {
+	Endpoints     string        `koanf:"endpoints"`      // Inline JSON list of webhook endpoints
+	EndpointsFile string        `koanf:"endpoints_file"` // Path to a JSON file with webhook endpoints
+	QueuePath     string        `koanf:"queue_path"`     // Directory holding undelivered events, one queue per endpoint
+	MaxEvents     int           `koanf:"max_events"`     // Most undelivered events kept per endpoint, further ones are dropped
+	MaxAttempts   int           `koanf:"max_attempts"`   // Events are dropped after failing to be delivered this many times
+	MaxBackoff    time.Duration `koanf:"max_backoff"`    // Longest wait between attempts
+	Timeout       time.Duration `koanf:"timeout"`        // How long to wait for an endpoint to respond
 }
 
 type Config struct {
-	Log    LogConfig    `koanf:"log"`
-	Server ServerConfig `koanf:"server"`
-	Auth   AuthConfig   `koanf:"auth"`
-	Store  StoreConfig  `koanf:"store"`
+	Log         LogConfig         `koanf:"log"`
+	Server      ServerConfig      `koanf:"server"`
+	Auth        AuthConfig        `koanf:"auth"`
+	Store       StoreConfig       `koanf:"store"`
+	GC          GCConfig          `koanf:"gc"`
+	Proxy       ProxyConfig       `koanf:"proxy"`
+	Replication ReplicationConfig `koanf:"replication"`
+	Webhooks    WebhooksConfig    `koanf:"webhooks"`
 }
 
 func Load() (*Config, error) {
@@ -62,9 +192,47 @@ func Load() (*Config, error) {
 			Mode:     AuthModeNone,
 			NoAuth:   NoAuthConfig{},
 			Htpasswd: HtpasswdConfig{},
+			Token: TokenConfig{
+				Service: "sorcerer",
+				Issuer:  "sorcerer",
+				Expiry:  5 * time.Minute,
+			},
+			LDAP: LDAPConfig{
+				UserFilter:     "(uid={username})",
+				GroupFilter:    "(member={dn})",
+				GroupAttribute: "cn",
+				CacheTTL:       time.Minute,
+				Timeout:        10 * time.Second,
+			},
 		},
 		Store: StoreConfig{
-			Path: "data",
+			Backend:   StoreBackendFS,
+			Path:      "data",
+			UploadTTL: 24 * time.Hour,
+			S3: S3Config{
+				Region:         "us-east-1",
+				PartSize:       16 << 20,
+				RedirectExpiry: 20 * time.Minute,
+			},
+		},
+		GC: GCConfig{
+			GracePeriod: time.Hour,
+		},
+		Proxy: ProxyConfig{
+			TagTTL: 10 * time.Minute,
+		},
+		Replication: ReplicationConfig{
+			QueuePath:   "queues/replication",
+			Workers:     2,
+			MaxAttempts: 10,
+			MaxBackoff:  10 * time.Minute,
+		},
+		Webhooks: WebhooksConfig{
+			QueuePath:   "queues/webhooks",
+			MaxEvents:   10000,
+			MaxAttempts: 10,
+			MaxBackoff:  10 * time.Minute,
+			Timeout:     10 * time.Second,
 		},
 	}, "koanf"), nil)
 
@@ -82,14 +250,169 @@ func Load() (*Config, error) {
 func (c *Config) Validate() []error {
 	errors := []error{}
 
-	if c.Auth.Mode != AuthModeNone && c.Auth.Mode != AuthModeHtpasswd {
+	if c.Auth.Mode != AuthModeNone && c.Auth.Mode != AuthModeHtpasswd && c.Auth.Mode != AuthModeToken && c.Auth.Mode != AuthModeOIDC && c.Auth.Mode != AuthModeLDAP {
 		errors = append(errors, fmt.Errorf("invalid auth mode: %s", c.Auth.Mode))
 	}
 
-	// Additional validation for htpasswd mode
-	if c.Auth.Mode == AuthModeHtpasswd {
+	// Additional validation for htpasswd mode, which token mode authenticates with
+	if c.Auth.Mode == AuthModeHtpasswd || c.Auth.Mode == AuthModeToken {
 		if c.Auth.Htpasswd.File == "" && c.Auth.Htpasswd.Contents == "" {
-			errors = append(errors, fmt.Errorf("htpasswd auth mode requires either file or contents to be specified"))
+			errors = append(errors, fmt.Errorf("%s auth mode requires either htpasswd file or contents to be specified", c.Auth.Mode))
+		}
+	}
+
+	if c.Auth.Htpasswd.AnonymousPull && c.Auth.Mode != AuthModeHtpasswd {
+		errors = append(errors, fmt.Errorf("anonymous pulls require the htpasswd auth mode"))
+	}
+	if c.Auth.Htpasswd.PublicRepositories != "" && !c.Auth.Htpasswd.AnonymousPull {
+		errors = append(errors, fmt.Errorf("public repositories require anonymous pulls to be enabled"))
+	}
+	for glob := range strings.SplitSeq(c.Auth.Htpasswd.PublicRepositories, ",") {
+		if glob = strings.TrimSpace(glob); glob == "" {
+			continue
+		}
+		if err := access.ValidateRepositoryGlob(glob); err != nil {
+			errors = append(errors, fmt.Errorf("invalid public repository pattern: %w", err))
+		}
+	}
+
+	if c.Auth.Mode == AuthModeToken {
+		if c.Auth.Token.Realm != "" {
+			if u, err := url.Parse(c.Auth.Token.Realm); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errors = append(errors, fmt.Errorf("invalid token realm: %s, must be an http or https url", c.Auth.Token.Realm))
+			}
+		}
+		if c.Auth.Token.Service == "" || c.Auth.Token.Issuer == "" {
+			errors = append(errors, fmt.Errorf("token auth mode requires a service and an issuer"))
+		}
+		if c.Auth.Token.Expiry <= 0 {
+			errors = append(errors, fmt.Errorf("invalid token expiry: %s", c.Auth.Token.Expiry))
+		}
+	}
+
+	if c.Auth.Mode == AuthModeOIDC {
+		if c.Auth.OIDC.Providers == "" && c.Auth.OIDC.ProvidersFile == "" {
+			errors = append(errors, fmt.Errorf("oidc auth mode requires providers to be specified"))
+		}
+		if c.Auth.OIDC.Providers != "" && c.Auth.OIDC.ProvidersFile != "" {
+			errors = append(errors, fmt.Errorf("oidc providers must be given either inline or as a file, not both"))
+		}
+	}
+
+	if c.Auth.Mode == AuthModeLDAP {
+		if u, err := url.Parse(c.Auth.LDAP.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			errors = append(errors, fmt.Errorf("invalid ldap url: %s, must be an ldap or ldaps url", c.Auth.LDAP.URL))
+		} else if c.Auth.LDAP.StartTLS && u.Scheme == "ldaps" {
+			errors = append(errors, fmt.Errorf("ldap start tls is only supported with ldap urls"))
+		}
+		if c.Auth.LDAP.UserDN != "" && !strings.Contains(c.Auth.LDAP.UserDN, "{username}") {
+			errors = append(errors, fmt.Errorf("invalid ldap user dn: %s, must contain {username}", c.Auth.LDAP.UserDN))
+		}
+		if c.Auth.LDAP.UserDN == "" && (c.Auth.LDAP.BindDN == "" || c.Auth.LDAP.UserBase == "") {
+			errors = append(errors, fmt.Errorf("ldap auth mode requires either a user dn or a bind dn and user base to search users with"))
+		}
+		if c.Auth.LDAP.GroupBase != "" && c.Auth.LDAP.GroupAttribute == "" {
+			errors = append(errors, fmt.Errorf("ldap group search requires a group attribute"))
+		}
+		if c.Auth.LDAP.CacheTTL < 0 {
+			errors = append(errors, fmt.Errorf("invalid ldap cache ttl: %s", c.Auth.LDAP.CacheTTL))
+		}
+		if c.Auth.LDAP.Timeout <= 0 {
+			errors = append(errors, fmt.Errorf("invalid ldap timeout: %s", c.Auth.LDAP.Timeout))
+		}
+	}
+
+	if c.Auth.Policy.File != "" && c.Auth.Mode == AuthModeNone {
+		errors = append(errors, fmt.Errorf("an access policy requires an auth mode that authenticates users"))
+	}
+
+	// Tokens are sent as basic auth passwords, which the token mode only
+	// accepts at its token endpoint
+	if c.Auth.PAT.File != "" && c.Auth.Mode != AuthModeHtpasswd && c.Auth.Mode != AuthModeOIDC && c.Auth.Mode != AuthModeLDAP {
+		errors = append(errors, fmt.Errorf("access tokens require the htpasswd, oidc or ldap auth mode"))
+	}
+	if c.Auth.PAT.Admins != "" && c.Auth.PAT.File == "" {
+		errors = append(errors, fmt.Errorf("access token admins require an access token file"))
+	}
+
+	switch c.Store.Backend {
+	case StoreBackendFS:
+	case StoreBackendS3:
+		if c.Store.S3.Endpoint == "" || c.Store.S3.Bucket == "" {
+			errors = append(errors, fmt.Errorf("s3 store backend requires endpoint and bucket to be specified"))
+		}
+		// S3 rejects multipart uploads with parts smaller than 5 MiB
+		if c.Store.S3.PartSize < 5<<20 {
+			errors = append(errors, fmt.Errorf("invalid s3 part size: %d, must be at least 5 MiB", c.Store.S3.PartSize))
+		}
+		if c.Store.S3.RedirectExpiry <= 0 {
+			errors = append(errors, fmt.Errorf("invalid s3 redirect expiry: %s", c.Store.S3.RedirectExpiry))
+		}
+	case StoreBackendMemory:
+		if c.Store.Memory.MaxBytes < 0 {
+			errors = append(errors, fmt.Errorf("invalid memory max bytes: %d", c.Store.Memory.MaxBytes))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("invalid store backend: %s", c.Store.Backend))
+	}
+
+	if c.Store.UploadTTL < 0 {
+		errors = append(errors, fmt.Errorf("invalid upload ttl: %s", c.Store.UploadTTL))
+	}
+
+	if c.GC.Interval < 0 {
+		errors = append(errors, fmt.Errorf("invalid gc interval: %s", c.GC.Interval))
+	}
+
+	if c.GC.GracePeriod < 0 {
+		errors = append(errors, fmt.Errorf("invalid gc grace period: %s", c.GC.GracePeriod))
+	}
+
+	if c.Proxy.Upstream != "" {
+		if u, err := url.Parse(c.Proxy.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errors = append(errors, fmt.Errorf("invalid proxy upstream: %s, must be an http or https url", c.Proxy.Upstream))
+		}
+		if c.Proxy.TagTTL < 0 {
+			errors = append(errors, fmt.Errorf("invalid proxy tag ttl: %s", c.Proxy.TagTTL))
+		}
+	}
+
+	if c.Replication.Rules != "" || c.Replication.RulesFile != "" {
+		if c.Replication.Rules != "" && c.Replication.RulesFile != "" {
+			errors = append(errors, fmt.Errorf("replication rules must be given either inline or as a file, not both"))
+		}
+		if c.Replication.QueuePath == "" {
+			errors = append(errors, fmt.Errorf("replication requires a queue path"))
+		}
+		if c.Replication.Workers < 1 {
+			errors = append(errors, fmt.Errorf("invalid replication workers: %d", c.Replication.Workers))
+		}
+		if c.Replication.MaxAttempts < 1 {
+			errors = append(errors, fmt.Errorf("invalid replication max attempts: %d", c.Replication.MaxAttempts))
+		}
+		if c.Replication.MaxBackoff <= 0 {
+			errors = append(errors, fmt.Errorf("invalid replication max backoff: %s", c.Replication.MaxBackoff))
+		}
+	}
+
+	if c.Webhooks.Endpoints != "" || c.Webhooks.EndpointsFile != "" {
+		if c.Webhooks.Endpoints != "" && c.Webhooks.EndpointsFile != "" {
+			errors = append(errors, fmt.Errorf("webhook endpoints must be given either inline or as a file, not both"))
+		}
+		if c.Webhooks.QueuePath == "" {
+			errors = append(errors, fmt.Errorf("webhooks require a queue path"))
+		}
+		if c.Webhooks.MaxEvents < 1 {
+			errors = append(errors, fmt.Errorf("invalid webhook max events: %d", c.Webhooks.MaxEvents))
+		}
+		if c.Webhooks.MaxAttempts < 1 {
+			errors = append(errors, fmt.Errorf("invalid webhook max attempts: %d", c.Webhooks.MaxAttempts))
+		}
+		if c.Webhooks.MaxBackoff <= 0 {
+			errors = append(errors, fmt.Errorf("invalid webhook max backoff: %s", c.Webhooks.MaxBackoff))
+		}
+		if c.Webhooks.Timeout <= 0 {
+			errors = append(errors, fmt.Errorf("invalid webhook timeout: %s", c.Webhooks.Timeout))
 		}
 	}
 
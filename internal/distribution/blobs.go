@@ -1,6 +1,7 @@
 package distribution
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,15 +10,24 @@ import (
 	"github.com/go-chi/chi/v5"
 )
 
+// blobRedirector is implemented by stores that can serve blobs to clients
+// directly, such as object storage through presigned URLs. An empty URL means
+// the blob is served by the registry.
+type blobRedirector interface {
+	BlobURL(ctx context.Context, name, digest string) (string, error)
+}
+
 func (d *Distribution) checkBlobExists(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	digest := chi.URLParam(r, "digest")
 
-	exists, size, err := d.store.HasBlob(name, digest)
+	if !checkDigest(w, digest) {
+		return
+	}
+
+	exists, size, err := d.store.HasBlob(r.Context(), name, digest)
 	if err != nil {
-		sendError(w, http.StatusInternalServerError, errBlobUnknown, err.Error())
+		sendStoreError(w, r, err, errBlobUnknown)
 		return
 	}
 
@@ -28,46 +38,86 @@ func (d *Distribution) checkBlobExists(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.WriteHeader(http.StatusOK)
 }
 
 func (d *Distribution) getBlob(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	digest := chi.URLParam(r, "digest")
 
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" {
-		logger.Get(r.Context()).Warn().Str("range", rangeHeader).Msg("range header for blob not fully implemented")
+	if !checkDigest(w, digest) {
+		return
 	}
 
-	blob, size, err := d.store.GetBlob(name, digest)
+	if redirector, ok := d.store.(blobRedirector); ok {
+		url, err := redirector.BlobURL(r.Context(), name, digest)
+		if err != nil {
+			sendStoreError(w, r, err, errBlobUnknown)
+			return
+		}
+
+		if url != "" {
+			w.Header().Set("Docker-Content-Digest", digest)
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	blob, size, err := d.store.GetBlob(r.Context(), name, digest)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errBlobUnknown, err.Error())
+		sendStoreError(w, r, err, errBlobUnknown)
 		return
 	}
 	defer blob.Close()
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Docker-Content-Digest", digest)
-	w.WriteHeader(http.StatusOK)
 
-	if _, err := io.Copy(w, blob); err != nil {
-		logger.Get(r.Context()).Error().Err(err).Msg("error streaming blob")
+	byteRange, partial, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		sendError(w, http.StatusRequestedRangeNotSatisfiable, errRangeInvalid, fmt.Sprintf("Range %q not satisfiable", r.Header.Get("Range")))
+		return
+	}
+
+	if !partial {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		w.WriteHeader(http.StatusOK)
+
+		if _, err := io.Copy(w, blob); err != nil {
+			logger.Get(r.Context()).Error().Err(err).Msg("error streaming blob")
+		}
+		return
+	}
+
+	if _, err := blob.Seek(byteRange.start, io.SeekStart); err != nil {
+		sendError(w, http.StatusInternalServerError, errBlobUnknown, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", byteRange.length()))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", byteRange.start, byteRange.end, size))
+	w.WriteHeader(http.StatusPartialContent)
+
+	if _, err := io.CopyN(w, blob, byteRange.length()); err != nil {
+		logger.Get(r.Context()).Error().Err(err).Msg("error streaming blob range")
 	}
 }
 
 func (d *Distribution) deleteBlob(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	digest := chi.URLParam(r, "digest")
 
-	err := d.store.DeleteBlob(name, digest)
+	if !checkDigest(w, digest) {
+		return
+	}
+
+	err := d.store.DeleteBlob(r.Context(), name, digest)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errBlobUnknown, err.Error())
+		sendStoreError(w, r, err, errBlobUnknown)
 		return
 	}
 
@@ -0,0 +1,33 @@
+package distribution
+
+import (
+	"encoding/json"
+	"net/http"
+
+	spec_v1 "github.com/opencontainers/distribution-spec/specs-go/v1"
+)
+
+func (d *Distribution) getCatalog(w http.ResponseWriter, r *http.Request) {
+	repositories, err := d.store.ListRepositories(r.Context())
+	if err != nil {
+		sendStoreError(w, r, err, errNameUnknown)
+		return
+	}
+
+	// Users only see the repositories they may pull from
+	allowed := []string{}
+	for _, name := range repositories {
+		if d.canPull(r, name) {
+			allowed = append(allowed, name)
+		}
+	}
+	repositories = allowed
+
+	response := spec_v1.RepositoryList{
+		Repositories: paginate(w, r, repositories),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,46 @@
+package distribution
+
+import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// tagRegexp matches a tag as defined by the distribution spec.
+var tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// isDigest reports whether a manifest reference is a digest. Tags cannot
+// contain colons, so anything that does is treated as a digest and must
+// parse as one.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// checkDigest validates a digest taken from the request with any of the
+// registered algorithms, sending DIGEST_INVALID if it is malformed.
+func checkDigest(w http.ResponseWriter, digest string) bool {
+	if _, err := godigest.Parse(digest); err != nil {
+		sendError(w, http.StatusBadRequest, errDigestInvalid, fmt.Sprintf("Invalid digest %q: %s", digest, err))
+		return false
+	}
+	return true
+}
+
+// checkReference validates a manifest reference, which is either a digest
+// or a tag.
+func checkReference(w http.ResponseWriter, reference string) bool {
+	if isDigest(reference) {
+		return checkDigest(w, reference)
+	}
+
+	if !tagRegexp.MatchString(reference) {
+		sendError(w, http.StatusBadRequest, errManifestInvalid, fmt.Sprintf("Invalid tag %q", reference))
+		return false
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package distribution
 import (
 	"net/http"
 
+	"github.com/dvjn/sorcerer/internal/access"
 	"github.com/dvjn/sorcerer/internal/store"
 	"github.com/go-chi/chi/v5"
 )
@@ -10,10 +11,15 @@ import (
 type Distribution struct {
 	store          store.Store
 	authMiddleware func(http.Handler) http.Handler
+	authorizer     access.Authorizer
+	listeners      []Listener
 }
 
-func New(store store.Store, authMiddleware func(http.Handler) http.Handler) *Distribution {
-	return &Distribution{store: store, authMiddleware: authMiddleware}
+// New returns the distribution API serving content from store. Requests are
+// authenticated by authMiddleware, and only allowed the actions authorizer, if
+// not nil, and the token of the authenticated user, if any, grant them.
+func New(store store.Store, authMiddleware func(http.Handler) http.Handler, authorizer access.Authorizer, listeners ...Listener) *Distribution {
+	return &Distribution{store: store, authMiddleware: authMiddleware, authorizer: authorizer, listeners: listeners}
 }
 
 func (d *Distribution) Router() *chi.Mux {
@@ -21,39 +27,47 @@ func (d *Distribution) Router() *chi.Mux {
 	r.Use(d.authMiddleware)
 
 	r.Get("/", d.apiVersionCheck)
+	r.Get("/_catalog", d.getCatalog)
+	r.Handle("/*", d.resolveRepository(d.repositoryRouter()))
 
-	r.Route("/{owner}/{repository}", func(r chi.Router) {
-		r.Route("/blobs", func(r chi.Router) {
-			r.Head("/{digest}", d.checkBlobExists)
-			r.Get("/{digest}", d.getBlob)
-			r.Delete("/{digest}", d.deleteBlob)
-
-			r.Route("/uploads", func(r chi.Router) {
-				r.Post("/", d.initiateUpload)
-				r.Patch("/{reference}", d.uploadBlobChunk)
-				r.Put("/{reference}", d.completeUpload)
-				r.Get("/{reference}", d.getBlobUploadStatus)
-			})
-		})
+	return r
+}
 
-		r.Route("/manifests", func(r chi.Router) {
-			r.Route("/{reference}", func(r chi.Router) {
-				r.Head("/", d.checkManifestExists)
-				r.Get("/", d.getManifest)
-				r.Put("/", d.putManifest)
-				r.Delete("/", d.deleteManifest)
-			})
-		})
+func (d *Distribution) repositoryRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(d.authorize)
+
+	r.Route("/blobs", func(r chi.Router) {
+		r.Head("/{digest}", d.checkBlobExists)
+		r.Get("/{digest}", d.getBlob)
+		r.Delete("/{digest}", d.deleteBlob)
 
-		r.Route("/tags", func(r chi.Router) {
-			r.Get("/list", d.listTags)
+		r.Route("/uploads", func(r chi.Router) {
+			r.Post("/", d.initiateUpload)
+			r.Patch("/{reference}", d.uploadBlobChunk)
+			r.Put("/{reference}", d.completeUpload)
+			r.Get("/{reference}", d.getBlobUploadStatus)
+			r.Delete("/{reference}", d.cancelUpload)
 		})
+	})
 
-		r.Route("/referrers", func(r chi.Router) {
-			r.Get("/{digest}", d.listReferrers)
+	r.Route("/manifests", func(r chi.Router) {
+		r.Route("/{reference}", func(r chi.Router) {
+			r.Head("/", d.checkManifestExists)
+			r.Get("/", d.getManifest)
+			r.Put("/", d.putManifest)
+			r.Delete("/", d.deleteManifest)
 		})
 	})
 
+	r.Route("/tags", func(r chi.Router) {
+		r.Get("/list", d.listTags)
+	})
+
+	r.Route("/referrers", func(r chi.Router) {
+		r.Get("/{digest}", d.listReferrers)
+	})
+
 	return r
 }
 
@@ -0,0 +1,375 @@
+package distribution
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
+	"github.com/go-chi/chi/v5"
+	spec_v1 "github.com/opencontainers/distribution-spec/specs-go/v1"
+)
+
+// step is a request sent to the registry along with the response expected
+// for it. Steps run in order against the same registry, and "{location}" in
+// a path is replaced with the Location header of the last response that set
+// one.
+type step struct {
+	name        string
+	method      string
+	path        string
+	header      map[string]string
+	body        string
+	wantStatus  int
+	wantCode    string
+	wantHeader  map[string]string
+	wantBody    string
+	wantContain string
+}
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newTestStore(t *testing.T, maxBytes int64) store.Store {
+	t.Helper()
+
+	s, err := mem_store.New(&config.StoreConfig{Memory: config.MemoryConfig{MaxBytes: maxBytes}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return s
+}
+
+func newTestRegistry(t *testing.T, maxBytes int64) *httptest.Server {
+	t.Helper()
+	return newTestServer(t, newTestStore(t, maxBytes))
+}
+
+func newTestServer(t *testing.T, s store.Store) *httptest.Server {
+	t.Helper()
+
+	d := New(s, func(next http.Handler) http.Handler { return next }, nil)
+	r := chi.NewRouter()
+	r.Mount("/v2", d.Router())
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func run(t *testing.T, server *httptest.Server, steps []step) {
+	t.Helper()
+
+	client := server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	location := ""
+	for _, s := range steps {
+		path := strings.ReplaceAll(s.path, "{location}", location)
+
+		req, err := http.NewRequest(s.method, server.URL+path, strings.NewReader(s.body))
+		if err != nil {
+			t.Fatalf("%s: failed to create request: %v", s.name, err)
+		}
+		for key, value := range s.header {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", s.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != s.wantStatus {
+			t.Errorf("%s: expected status %d, got %d: %s", s.name, s.wantStatus, resp.StatusCode, body)
+			continue
+		}
+
+		if s.wantCode != "" {
+			var errorResponse spec_v1.ErrorResponse
+			if err := json.Unmarshal(body, &errorResponse); err != nil || len(errorResponse.Errors) == 0 || errorResponse.Errors[0].Code != s.wantCode {
+				t.Errorf("%s: expected error code %s, got %s", s.name, s.wantCode, body)
+			}
+		}
+
+		for key, want := range s.wantHeader {
+			if got := resp.Header.Get(key); got != want {
+				t.Errorf("%s: expected header %s %q, got %q", s.name, key, want, got)
+			}
+		}
+
+		if s.wantBody != "" && string(body) != s.wantBody {
+			t.Errorf("%s: expected body %q, got %q", s.name, s.wantBody, body)
+		}
+		if s.wantContain != "" && !strings.Contains(string(body), s.wantContain) {
+			t.Errorf("%s: expected body to contain %q, got %q", s.name, s.wantContain, body)
+		}
+
+		if l := resp.Header.Get("Location"); l != "" {
+			location = l
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	server := newTestRegistry(t, 0)
+	blob := digestOf("blob")
+
+	run(t, server, []step{
+		{name: "version check", method: http.MethodGet, path: "/v2/", wantStatus: http.StatusOK},
+		{name: "empty catalog", method: http.MethodGet, path: "/v2/_catalog", wantStatus: http.StatusOK, wantContain: `"repositories":[]`},
+		{name: "unknown route", method: http.MethodGet, path: "/v2/app/unknown", wantStatus: http.StatusNotFound},
+		{name: "invalid name", method: http.MethodGet, path: "/v2/Team/App/tags/list", wantStatus: http.StatusBadRequest, wantCode: errNameInvalid},
+		{name: "invalid digest", method: http.MethodGet, path: "/v2/app/blobs/sha256:nope", wantStatus: http.StatusBadRequest, wantCode: errDigestInvalid},
+		{name: "invalid tag", method: http.MethodGet, path: "/v2/app/manifests/-tag", wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "unknown blob", method: http.MethodGet, path: "/v2/app/blobs/" + blob, wantStatus: http.StatusNotFound, wantCode: errBlobUnknown},
+		{name: "unknown manifest", method: http.MethodGet, path: "/v2/app/manifests/latest", wantStatus: http.StatusNotFound, wantCode: errManifestUnknown},
+		{name: "unknown upload", method: http.MethodGet, path: "/v2/app/blobs/uploads/nope", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+		{name: "nested name with route keywords", method: http.MethodPost, path: "/v2/team/blobs/manifests/app/blobs/uploads/?digest=" + blob, body: "blob", wantStatus: http.StatusCreated, wantHeader: map[string]string{"Location": "/v2/team/blobs/manifests/app/blobs/" + blob}},
+		{name: "upload without trailing slash", method: http.MethodPost, path: "/v2/app/blobs/uploads", wantStatus: http.StatusAccepted, wantHeader: map[string]string{"Range": "0-0"}},
+		{name: "nested name blob", method: http.MethodGet, path: "/v2/team/blobs/manifests/app/blobs/" + blob, wantStatus: http.StatusOK, wantBody: "blob"},
+		{name: "parent of nested name", method: http.MethodHead, path: "/v2/team/blobs/blobs/" + blob, wantStatus: http.StatusNotFound},
+	})
+}
+
+func TestBlobs(t *testing.T) {
+	server := newTestRegistry(t, 0)
+	content := "0123456789abcdefghij"
+	digest := digestOf(content)
+	chunked := digestOf("chunked blob")
+
+	run(t, server, []step{
+		{name: "monolithic upload", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digest, body: content, wantStatus: http.StatusCreated, wantHeader: map[string]string{"Docker-Content-Digest": digest}},
+		{name: "monolithic upload with wrong digest", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digestOf("other"), body: content, wantStatus: http.StatusBadRequest, wantCode: errDigestInvalid},
+		{name: "head blob", method: http.MethodHead, path: "/v2/app/blobs/" + digest, wantStatus: http.StatusOK, wantHeader: map[string]string{"Content-Length": "20", "Docker-Content-Digest": digest}},
+		{name: "get blob", method: http.MethodGet, path: "/v2/app/blobs/" + digest, wantStatus: http.StatusOK, wantBody: content},
+		{name: "get range", method: http.MethodGet, path: "/v2/app/blobs/" + digest, header: map[string]string{"Range": "bytes=10-14"}, wantStatus: http.StatusPartialContent, wantHeader: map[string]string{"Content-Range": "bytes 10-14/20"}, wantBody: "abcde"},
+		{name: "get suffix range", method: http.MethodGet, path: "/v2/app/blobs/" + digest, header: map[string]string{"Range": "bytes=-3"}, wantStatus: http.StatusPartialContent, wantBody: "hij"},
+		{name: "get unsatisfiable range", method: http.MethodGet, path: "/v2/app/blobs/" + digest, header: map[string]string{"Range": "bytes=30-40"}, wantStatus: http.StatusRequestedRangeNotSatisfiable, wantCode: errRangeInvalid},
+		{name: "get range of other unit", method: http.MethodGet, path: "/v2/app/blobs/" + digest, header: map[string]string{"Range": "items=0-4"}, wantStatus: http.StatusOK, wantBody: content},
+		{name: "get malformed range", method: http.MethodGet, path: "/v2/app/blobs/" + digest, header: map[string]string{"Range": "bytes=14-10"}, wantStatus: http.StatusOK, wantBody: content},
+
+		{name: "mount blob", method: http.MethodPost, path: "/v2/other/blobs/uploads/?mount=" + digest + "&from=app", wantStatus: http.StatusCreated, wantHeader: map[string]string{"Location": "/v2/other/blobs/" + digest}},
+		{name: "mount unknown blob falls back to upload", method: http.MethodPost, path: "/v2/other/blobs/uploads/?mount=" + chunked + "&from=app", wantStatus: http.StatusAccepted},
+		{name: "cancel upload", method: http.MethodDelete, path: "{location}", wantStatus: http.StatusNoContent},
+		{name: "cancelled upload is gone", method: http.MethodGet, path: "{location}", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+
+		{name: "initiate upload", method: http.MethodPost, path: "/v2/app/blobs/uploads/", wantStatus: http.StatusAccepted, wantHeader: map[string]string{"Range": "0-0"}},
+		{name: "first chunk", method: http.MethodPatch, path: "{location}", header: map[string]string{"Content-Range": "0-6"}, body: "chunked", wantStatus: http.StatusAccepted, wantHeader: map[string]string{"Range": "0-6"}},
+		{name: "chunk out of order", method: http.MethodPatch, path: "{location}", header: map[string]string{"Content-Range": "0-4"}, body: " blob", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantCode: errRangeInvalid},
+		{name: "second chunk", method: http.MethodPatch, path: "{location}", body: " bl", wantStatus: http.StatusAccepted, wantHeader: map[string]string{"Range": "0-9"}},
+		{name: "upload status", method: http.MethodGet, path: "{location}", wantStatus: http.StatusNoContent, wantHeader: map[string]string{"Range": "0-9"}},
+		{name: "complete without digest", method: http.MethodPut, path: "{location}", wantStatus: http.StatusBadRequest, wantCode: errDigestInvalid},
+		{name: "complete with wrong digest", method: http.MethodPut, path: "{location}?digest=" + digest, wantStatus: http.StatusBadRequest, wantCode: errDigestInvalid},
+		{name: "complete with last chunk", method: http.MethodPut, path: "{location}?digest=" + chunked, body: "ob", wantStatus: http.StatusCreated, wantHeader: map[string]string{"Location": "/v2/app/blobs/" + chunked}},
+		{name: "get chunked blob", method: http.MethodGet, path: "/v2/app/blobs/" + chunked, wantStatus: http.StatusOK, wantBody: "chunked blob"},
+
+		{name: "delete blob", method: http.MethodDelete, path: "/v2/app/blobs/" + digest, wantStatus: http.StatusAccepted},
+		{name: "deleted blob is gone", method: http.MethodHead, path: "/v2/app/blobs/" + digest, wantStatus: http.StatusNotFound},
+		{name: "mounted blob remains", method: http.MethodGet, path: "/v2/other/blobs/" + digest, wantStatus: http.StatusOK, wantBody: content},
+		{name: "delete unknown blob", method: http.MethodDelete, path: "/v2/app/blobs/" + digest, wantStatus: http.StatusNotFound, wantCode: errBlobUnknown},
+	})
+}
+
+func TestCancelUpload(t *testing.T) {
+	server := newTestRegistry(t, 0)
+	blob := digestOf("blob")
+
+	run(t, server, []step{
+		{name: "initiate upload", method: http.MethodPost, path: "/v2/app/blobs/uploads/", wantStatus: http.StatusAccepted},
+		{name: "upload chunk", method: http.MethodPatch, path: "{location}", body: "bl", wantStatus: http.StatusAccepted},
+		{name: "cancel upload", method: http.MethodDelete, path: "{location}", wantStatus: http.StatusNoContent},
+		{name: "chunk after cancel", method: http.MethodPatch, path: "{location}", body: "ob", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+		{name: "complete after cancel", method: http.MethodPut, path: "{location}?digest=" + blob, body: "ob", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+		{name: "cancel twice", method: http.MethodDelete, path: "{location}", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+		{name: "cancel unknown upload", method: http.MethodDelete, path: "/v2/app/blobs/uploads/nope", wantStatus: http.StatusNotFound, wantCode: errBlobUploadUnknown},
+		{name: "blob was not stored", method: http.MethodHead, path: "/v2/app/blobs/" + blob, wantStatus: http.StatusNotFound},
+
+		{name: "upload again", method: http.MethodPost, path: "/v2/app/blobs/uploads/", wantStatus: http.StatusAccepted},
+		{name: "complete new upload", method: http.MethodPut, path: "{location}?digest=" + blob, body: "blob", wantStatus: http.StatusCreated},
+		{name: "get blob", method: http.MethodGet, path: "/v2/app/blobs/" + blob, wantStatus: http.StatusOK, wantBody: "blob"},
+	})
+}
+
+func TestManifests(t *testing.T) {
+	server := newTestRegistry(t, 0)
+	config, layer := "{}", "layer"
+	configDigest, layerDigest := digestOf(config), digestOf(layer)
+
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":2},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":5}]}`, configDigest, layerDigest)
+	imageDigest := digestOf(image)
+	wrongSize := strings.Replace(image, `"size":5`, `"size":6`, 1)
+	missingLayer := strings.Replace(image, layerDigest, digestOf("missing"), 1)
+	signature := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/example.signature","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}}`, configDigest, imageDigest, len(image))
+	signatureDigest := digestOf(signature)
+	manifestType := map[string]string{"Content-Type": "application/vnd.oci.image.manifest.v1+json"}
+
+	run(t, server, []step{
+		{name: "push config", method: http.MethodPost, path: "/v2/team/app/blobs/uploads/?digest=" + configDigest, body: config, wantStatus: http.StatusCreated},
+		{name: "push layer", method: http.MethodPost, path: "/v2/team/app/blobs/uploads/?digest=" + layerDigest, body: layer, wantStatus: http.StatusCreated},
+
+		{name: "invalid json", method: http.MethodPut, path: "/v2/team/app/manifests/v1", header: manifestType, body: "{", wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "missing layer", method: http.MethodPut, path: "/v2/team/app/manifests/v1", header: manifestType, body: missingLayer, wantStatus: http.StatusBadRequest, wantCode: errManifestBlobUnknown},
+		{name: "wrong layer size", method: http.MethodPut, path: "/v2/team/app/manifests/v1", header: manifestType, body: wrongSize, wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "mismatched content type", method: http.MethodPut, path: "/v2/team/app/manifests/v1", header: map[string]string{"Content-Type": "application/vnd.oci.image.index.v1+json"}, body: image, wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "wrong digest", method: http.MethodPut, path: "/v2/team/app/manifests/" + digestOf("other"), header: manifestType, body: image, wantStatus: http.StatusBadRequest, wantCode: errDigestInvalid},
+
+		{name: "push by tag", method: http.MethodPut, path: "/v2/team/app/manifests/v1", header: manifestType, body: image, wantStatus: http.StatusCreated, wantHeader: map[string]string{"Docker-Content-Digest": imageDigest}},
+		{name: "push another tag", method: http.MethodPut, path: "/v2/team/app/manifests/v2", header: manifestType, body: image, wantStatus: http.StatusCreated},
+		{name: "push by digest", method: http.MethodPut, path: "/v2/team/app/manifests/" + imageDigest, header: manifestType, body: image, wantStatus: http.StatusCreated},
+		{name: "head by tag", method: http.MethodHead, path: "/v2/team/app/manifests/v1", wantStatus: http.StatusOK, wantHeader: map[string]string{"Docker-Content-Digest": imageDigest, "Content-Type": "application/vnd.oci.image.manifest.v1+json"}},
+		{name: "get by digest", method: http.MethodGet, path: "/v2/team/app/manifests/" + imageDigest, wantStatus: http.StatusOK, wantBody: image},
+
+		{name: "list tags", method: http.MethodGet, path: "/v2/team/app/tags/list", wantStatus: http.StatusOK, wantContain: `"tags":["v1","v2"]`},
+		{name: "first page of tags", method: http.MethodGet, path: "/v2/team/app/tags/list?n=1", wantStatus: http.StatusOK, wantContain: `"tags":["v1"]`, wantHeader: map[string]string{"Link": `</v2/team/app/tags/list?last=v1&n=1>; rel="next"`}},
+		{name: "last page of tags", method: http.MethodGet, path: "/v2/team/app/tags/list?n=1&last=v1", wantStatus: http.StatusOK, wantContain: `"tags":["v2"]`, wantHeader: map[string]string{"Link": ""}},
+		{name: "catalog", method: http.MethodGet, path: "/v2/_catalog", wantStatus: http.StatusOK, wantContain: `"repositories":["team/app"]`},
+
+		{name: "push referrer", method: http.MethodPut, path: "/v2/team/app/manifests/" + signatureDigest, header: manifestType, body: signature, wantStatus: http.StatusCreated, wantHeader: map[string]string{"OCI-Subject": imageDigest}},
+		{name: "list referrers", method: http.MethodGet, path: "/v2/team/app/referrers/" + imageDigest, wantStatus: http.StatusOK, wantContain: signatureDigest},
+		{name: "filter referrers", method: http.MethodGet, path: "/v2/team/app/referrers/" + imageDigest + "?artifactType=application/example.sbom", wantStatus: http.StatusOK, wantHeader: map[string]string{"OCI-Filters-Applied": "artifactType"}, wantContain: `"manifests":[]`},
+		{name: "delete referrer", method: http.MethodDelete, path: "/v2/team/app/manifests/" + signatureDigest, wantStatus: http.StatusAccepted},
+		{name: "referrer removed", method: http.MethodGet, path: "/v2/team/app/referrers/" + imageDigest, wantStatus: http.StatusOK, wantContain: `"manifests":[]`},
+
+		{name: "delete tag", method: http.MethodDelete, path: "/v2/team/app/manifests/v2", wantStatus: http.StatusAccepted},
+		{name: "deleted tag is gone", method: http.MethodGet, path: "/v2/team/app/manifests/v2", wantStatus: http.StatusNotFound, wantCode: errManifestUnknown},
+		{name: "delete manifest", method: http.MethodDelete, path: "/v2/team/app/manifests/" + imageDigest, wantStatus: http.StatusAccepted},
+		{name: "tags of deleted manifest are gone", method: http.MethodGet, path: "/v2/team/app/manifests/v1", wantStatus: http.StatusNotFound},
+		{name: "delete unknown manifest", method: http.MethodDelete, path: "/v2/team/app/manifests/" + imageDigest, wantStatus: http.StatusNotFound, wantCode: errManifestUnknown},
+	})
+}
+
+func TestManifestValidation(t *testing.T) {
+	server := newTestRegistry(t, 0)
+	config := "{}"
+	configDigest := digestOf(config)
+
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":2},"layers":[]}`, configDigest)
+	imageDigest := digestOf(image)
+	foreignLayer := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":2},"layers":[{"mediaType":"application/vnd.oci.image.layer.nondistributable.v1.tar","digest":%q,"size":7,"urls":["https://example.com/layer"]}]}`, configDigest, digestOf("foreign"))
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}]}`, imageDigest, len(image))
+	manifestType := map[string]string{"Content-Type": "application/vnd.oci.image.manifest.v1+json"}
+	indexType := map[string]string{"Content-Type": "application/vnd.oci.image.index.v1+json"}
+
+	run(t, server, []step{
+		{name: "missing config", method: http.MethodPut, path: "/v2/app/manifests/v1", header: manifestType, body: image, wantStatus: http.StatusBadRequest, wantCode: errManifestBlobUnknown},
+		{name: "push config", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + configDigest, body: config, wantStatus: http.StatusCreated},
+		{name: "config in another repository", method: http.MethodPut, path: "/v2/other/manifests/v1", header: manifestType, body: image, wantStatus: http.StatusBadRequest, wantCode: errManifestBlobUnknown},
+
+		{name: "schema version 1", method: http.MethodPut, path: "/v2/app/manifests/v1", header: manifestType, body: strings.Replace(image, `"schemaVersion":2`, `"schemaVersion":1`, 1), wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "no config", method: http.MethodPut, path: "/v2/app/manifests/v1", header: manifestType, body: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`, wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "invalid layer digest", method: http.MethodPut, path: "/v2/app/manifests/v1", header: manifestType, body: strings.Replace(image, `"layers":[]`, `"layers":[{"digest":"sha256:nope","size":1}]`, 1), wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "unsupported media type", method: http.MethodPut, path: "/v2/app/manifests/v1", header: map[string]string{"Content-Type": "application/json"}, body: `{"schemaVersion":2,"config":{}}`, wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "foreign layer is not required", method: http.MethodPut, path: "/v2/app/manifests/foreign", header: manifestType, body: foreignLayer, wantStatus: http.StatusCreated},
+
+		{name: "index of missing manifest", method: http.MethodPut, path: "/v2/app/manifests/multi", header: indexType, body: index, wantStatus: http.StatusBadRequest, wantCode: errManifestBlobUnknown},
+		{name: "push image", method: http.MethodPut, path: "/v2/app/manifests/" + imageDigest, header: manifestType, body: image, wantStatus: http.StatusCreated},
+		{name: "index with wrong size", method: http.MethodPut, path: "/v2/app/manifests/multi", header: indexType, body: strings.Replace(index, fmt.Sprintf(`"size":%d`, len(image)), `"size":1`, 1), wantStatus: http.StatusBadRequest, wantCode: errManifestInvalid},
+		{name: "push index", method: http.MethodPut, path: "/v2/app/manifests/multi", header: indexType, body: index, wantStatus: http.StatusCreated},
+		{name: "index keeps its media type", method: http.MethodGet, path: "/v2/app/manifests/multi", wantStatus: http.StatusOK, wantHeader: map[string]string{"Content-Type": "application/vnd.oci.image.index.v1+json"}},
+	})
+}
+
+func TestStoreLimit(t *testing.T) {
+	server := newTestRegistry(t, 16)
+	small, large := "small blob", strings.Repeat("x", 32)
+
+	run(t, server, []step{
+		{name: "blob within limit", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digestOf(small), body: small, wantStatus: http.StatusCreated},
+		{name: "same blob in another repository", method: http.MethodPost, path: "/v2/other/blobs/uploads/?digest=" + digestOf(small), body: small, wantStatus: http.StatusCreated},
+		{name: "blob over limit", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digestOf(large), body: large, wantStatus: http.StatusInsufficientStorage, wantCode: errBlobUploadInvalid},
+		{name: "initiate upload", method: http.MethodPost, path: "/v2/app/blobs/uploads/", wantStatus: http.StatusAccepted},
+		{name: "chunk over limit", method: http.MethodPatch, path: "{location}", body: large[:8], wantStatus: http.StatusInsufficientStorage, wantCode: errBlobUploadInvalid},
+		{name: "failed chunk is not stored", method: http.MethodGet, path: "{location}", wantStatus: http.StatusNoContent},
+		{name: "chunk within limit", method: http.MethodPatch, path: "{location}", body: large[:6], wantStatus: http.StatusAccepted},
+		{name: "cancel frees the chunk", method: http.MethodDelete, path: "{location}", wantStatus: http.StatusNoContent},
+		{name: "delete frees the blob", method: http.MethodDelete, path: "/v2/app/blobs/" + digestOf(small), wantStatus: http.StatusAccepted},
+		{name: "blob still linked elsewhere is kept", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digestOf(large[:8]), body: large[:8], wantStatus: http.StatusInsufficientStorage},
+		{name: "delete last link", method: http.MethodDelete, path: "/v2/other/blobs/" + digestOf(small), wantStatus: http.StatusAccepted},
+		{name: "space is available again", method: http.MethodPost, path: "/v2/app/blobs/uploads/?digest=" + digestOf(large[:16]), body: large[:16], wantStatus: http.StatusCreated},
+	})
+}
+
+// failingStore fails every blob read, the way a store with a broken disk
+// would.
+type failingStore struct {
+	store.Store
+}
+
+func (s failingStore) HasBlob(ctx context.Context, name, digest string) (bool, int64, error) {
+	return false, 0, errors.New("input/output error")
+}
+
+func (s failingStore) GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error) {
+	return nil, 0, errors.New("input/output error")
+}
+
+func TestStoreFailure(t *testing.T) {
+	server := newTestServer(t, failingStore{newTestStore(t, 0)})
+	blob := digestOf("blob")
+
+	run(t, server, []step{
+		{name: "head blob", method: http.MethodHead, path: "/v2/app/blobs/" + blob, wantStatus: http.StatusInternalServerError},
+		{name: "get blob", method: http.MethodGet, path: "/v2/app/blobs/" + blob, wantStatus: http.StatusInternalServerError, wantCode: errBlobUnknown},
+		{name: "get manifest", method: http.MethodGet, path: "/v2/app/manifests/latest", wantStatus: http.StatusNotFound, wantCode: errManifestUnknown},
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	policy := &access.Policy{Rules: []access.PolicyRule{
+		{Users: []string{"*"}, Repositories: []string{"base"}, Actions: []string{access.ActionPull}},
+		{Users: []string{"dev"}, Repositories: []string{"team/*"}, Actions: []string{access.ActionPull, access.ActionPush}},
+		{Users: []string{"admin"}, Repositories: []string{"*", "*/*"}, Actions: []string{"*"}},
+	}}
+
+	// Users are named by a header in place of credentials
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := access.WithUser(r.Context(), access.User{Name: r.Header.Get("X-User")})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	r := chi.NewRouter()
+	r.Mount("/v2", New(newTestStore(t, 0), authenticate, policy).Router())
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	blob := digestOf("{}")
+	image := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":2},"layers":[]}`, blob)
+	admin := map[string]string{"X-User": "admin", "Content-Type": "application/vnd.oci.image.manifest.v1+json"}
+	dev := map[string]string{"X-User": "dev"}
+	other := map[string]string{"X-User": "other"}
+
+	run(t, server, []step{
+		{name: "push to base", method: http.MethodPost, path: "/v2/base/blobs/uploads/?digest=" + blob, header: admin, body: "{}", wantStatus: http.StatusCreated},
+		{name: "push to secret", method: http.MethodPost, path: "/v2/secret/blobs/uploads/?digest=" + blob, header: admin, body: "{}", wantStatus: http.StatusCreated},
+		{name: "tag base", method: http.MethodPut, path: "/v2/base/manifests/latest", header: admin, body: image, wantStatus: http.StatusCreated},
+		{name: "tag secret", method: http.MethodPut, path: "/v2/secret/manifests/latest", header: admin, body: image, wantStatus: http.StatusCreated},
+		{name: "pull allowed to everyone", method: http.MethodGet, path: "/v2/base/blobs/" + blob, header: other, wantStatus: http.StatusOK},
+		{name: "pull denied", method: http.MethodGet, path: "/v2/secret/blobs/" + blob, header: dev, wantStatus: http.StatusForbidden, wantCode: errDenied},
+		{name: "push denied", method: http.MethodPost, path: "/v2/base/blobs/uploads/", header: dev, wantStatus: http.StatusForbidden, wantCode: errDenied},
+		{name: "delete denied", method: http.MethodDelete, path: "/v2/team/app/manifests/" + blob, header: dev, wantStatus: http.StatusForbidden, wantCode: errDenied},
+		{name: "anonymous denied", method: http.MethodGet, path: "/v2/base/tags/list", wantStatus: http.StatusForbidden, wantCode: errDenied},
+		{name: "mount from pullable", method: http.MethodPost, path: "/v2/team/app/blobs/uploads/?mount=" + blob + "&from=base", header: dev, wantStatus: http.StatusCreated},
+		{name: "tag team", method: http.MethodPut, path: "/v2/team/app/manifests/latest", header: map[string]string{"X-User": "dev", "Content-Type": "application/vnd.oci.image.manifest.v1+json"}, body: image, wantStatus: http.StatusCreated},
+		{name: "mount from denied uploads", method: http.MethodPost, path: "/v2/team/other/blobs/uploads/?mount=" + blob + "&from=secret", header: dev, wantStatus: http.StatusAccepted},
+		{name: "catalog filtered", method: http.MethodGet, path: "/v2/_catalog", header: dev, wantStatus: http.StatusOK, wantBody: `{"repositories":["base","team/app"]}` + "\n"},
+		{name: "catalog unfiltered", method: http.MethodGet, path: "/v2/_catalog", header: admin, wantStatus: http.StatusOK, wantBody: `{"repositories":["base","secret","team/app"]}` + "\n"},
+	})
+}
@@ -1,9 +1,13 @@
 package distribution
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"github.com/dvjn/sorcerer/internal/logger"
+	"github.com/dvjn/sorcerer/internal/store/model"
 	spec_v1 "github.com/opencontainers/distribution-spec/specs-go/v1"
 )
 
@@ -26,11 +30,16 @@ const (
 )
 
 func sendError(w http.ResponseWriter, status int, code string, message string) {
+	sendErrorWithDetail(w, status, code, message, "")
+}
+
+func sendErrorWithDetail(w http.ResponseWriter, status int, code string, message string, detail string) {
 	response := spec_v1.ErrorResponse{
 		Errors: []spec_v1.ErrorInfo{
 			{
 				Code:    code,
 				Message: message,
+				Detail:  detail,
 			},
 		},
 	}
@@ -39,3 +48,31 @@ func sendError(w http.ResponseWriter, status int, code string, message string) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 }
+
+// sendStoreError responds to a failed store operation. Errors the store
+// reports for content that does not exist or cannot be accepted map to their
+// OCI error codes, anything else is a server error sent with code.
+func sendStoreError(w http.ResponseWriter, r *http.Request, err error, code string) {
+	switch {
+	case errors.Is(err, model.ErrBlobUnknown):
+		sendError(w, http.StatusNotFound, errBlobUnknown, err.Error())
+	case errors.Is(err, model.ErrManifestUnknown):
+		sendError(w, http.StatusNotFound, errManifestUnknown, err.Error())
+	case errors.Is(err, model.ErrUploadUnknown):
+		sendError(w, http.StatusNotFound, errBlobUploadUnknown, err.Error())
+	case errors.Is(err, model.ErrDigestMismatch):
+		sendError(w, http.StatusBadRequest, errDigestInvalid, err.Error())
+	case errors.Is(err, model.ErrRangeInvalid):
+		sendError(w, http.StatusRequestedRangeNotSatisfiable, errRangeInvalid, err.Error())
+	case errors.Is(err, model.ErrStoreFull):
+		sendError(w, http.StatusInsufficientStorage, code, err.Error())
+	case errors.Is(err, model.ErrUnsupported):
+		sendError(w, http.StatusMethodNotAllowed, errUnsupported, err.Error())
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		// The client went away, there is no one left to respond to
+		logger.Get(r.Context()).Debug().Err(err).Msg("request cancelled")
+	default:
+		logger.Get(r.Context()).Error().Err(err).Msg("store error")
+		sendError(w, http.StatusInternalServerError, code, "Internal server error")
+	}
+}
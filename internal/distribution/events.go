@@ -0,0 +1,98 @@
+package distribution
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Actions of the events sent to listeners.
+const (
+	ActionManifestPush   = "manifest.push"
+	ActionManifestDelete = "manifest.delete"
+	ActionTagDelete      = "tag.delete"
+	ActionBlobPush       = "blob.push"
+	ActionBlobMount      = "blob.mount"
+	ActionReferrerAdd    = "referrer.add"
+)
+
+// Actions lists every action events are sent for.
+var Actions = []string{
+	ActionManifestPush,
+	ActionManifestDelete,
+	ActionTagDelete,
+	ActionBlobPush,
+	ActionBlobMount,
+	ActionReferrerAdd,
+}
+
+// Event describes a change made through the distribution API.
+type Event struct {
+	Action     string
+	Timestamp  time.Time
+	Repository string
+	Digest     string // Unset for deleted tags
+	Tag        string // Set for manifests pushed by tag and deleted tags
+	MediaType  string
+	Size       int64
+	Subject    string // Digest of the manifest a pushed referrer refers to
+	From       string // Repository a mounted blob was mounted from
+	Request    RequestInfo
+}
+
+// RequestInfo describes the request that made a change.
+type RequestInfo struct {
+	ID        string
+	Addr      string
+	Host      string
+	Method    string
+	UserAgent string
+}
+
+// Listener is notified of events once the change they describe is stored.
+// Listeners are called while the request is handled, so anything slow
+// belongs in a queue.
+type Listener interface {
+	Notify(event Event)
+}
+
+func newEvent(r *http.Request, action, name string) Event {
+	return Event{
+		Action:     action,
+		Timestamp:  time.Now().UTC(),
+		Repository: name,
+		Request: RequestInfo{
+			ID:        middleware.GetReqID(r.Context()),
+			Addr:      r.RemoteAddr,
+			Host:      r.Host,
+			Method:    r.Method,
+			UserAgent: r.UserAgent(),
+		},
+	}
+}
+
+func (d *Distribution) notify(event Event) {
+	for _, listener := range d.listeners {
+		listener.Notify(event)
+	}
+}
+
+// notifyBlob notifies listeners of a blob stored in a repository, looking up
+// its size only if anyone is listening.
+func (d *Distribution) notifyBlob(r *http.Request, action, name, digest string) {
+	if len(d.listeners) == 0 {
+		return
+	}
+
+	event := newEvent(r, action, name)
+	event.Digest = digest
+	event.MediaType = "application/octet-stream"
+	if _, size, err := d.store.HasBlob(r.Context(), name, digest); err == nil {
+		event.Size = size
+	}
+	if action == ActionBlobMount {
+		event.From = r.URL.Query().Get("from")
+	}
+	d.notify(event)
+}
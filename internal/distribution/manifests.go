@@ -12,25 +12,16 @@ import (
 )
 
 func (d *Distribution) checkManifestExists(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 
-	exists, _, digest, err := d.store.HasManifest(name, reference)
-	if err != nil {
-		sendError(w, http.StatusInternalServerError, errManifestUnknown, err.Error())
-		return
-	}
-
-	if !exists {
-		sendError(w, http.StatusNotFound, errManifestUnknown, "Manifest not found")
+	if !checkReference(w, reference) {
 		return
 	}
 
-	content, _, err := d.store.GetManifest(name, digest)
+	content, digest, err := d.store.GetManifest(r.Context(), name, reference)
 	if err != nil {
-		sendError(w, http.StatusInternalServerError, errManifestUnknown, err.Error())
+		sendStoreError(w, r, err, errManifestUnknown)
 		return
 	}
 
@@ -54,14 +45,16 @@ func (d *Distribution) checkManifestExists(w http.ResponseWriter, r *http.Reques
 }
 
 func (d *Distribution) getManifest(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 
-	content, digest, err := d.store.GetManifest(name, reference)
+	if !checkReference(w, reference) {
+		return
+	}
+
+	content, digest, err := d.store.GetManifest(r.Context(), name, reference)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errManifestUnknown, err.Error())
+		sendStoreError(w, r, err, errManifestUnknown)
 		return
 	}
 
@@ -81,55 +74,76 @@ func (d *Distribution) getManifest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d *Distribution) putManifest(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 
+	if !checkReference(w, reference) {
+		return
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		sendError(w, http.StatusBadRequest, errManifestInvalid, "Failed to read manifest")
 		return
 	}
 
-	digest, err := d.store.PutManifest(name, reference, body)
+	manifest, merr := d.validateManifest(r.Context(), name, r.Header.Get("Content-Type"), body)
+	if merr != nil {
+		sendErrorWithDetail(w, merr.status, merr.code, merr.message, merr.detail)
+		return
+	}
+
+	digest, err := d.store.PutManifest(r.Context(), name, reference, body)
 	if err != nil {
-		sendError(w, http.StatusBadRequest, errManifestInvalid, err.Error())
+		sendStoreError(w, r, err, errManifestInvalid)
 		return
 	}
 
-	var manifest map[string]any
-	if err := json.Unmarshal(body, &manifest); err == nil {
-		if subject, ok := manifest["subject"].(map[string]any); ok {
-			if subjectDigest, ok := subject["digest"].(string); ok {
-				if err := d.store.UpdateReferrers(name, subjectDigest, body); err != nil {
-					logger.Get(r.Context()).Error().Err(err).Msg("error updating referrers")
-				}
-				w.Header().Set("OCI-Subject", subjectDigest)
-			}
+	event := newEvent(r, ActionManifestPush, name)
+	event.Digest = digest
+	event.MediaType = manifest.mediaType
+	event.Size = int64(len(body))
+	if !isDigest(reference) {
+		event.Tag = reference
+	}
+
+	if manifest.subject != nil {
+		subjectDigest := manifest.subject.Digest.String()
+		if err := d.store.UpdateReferrers(r.Context(), name, digest, body); err != nil {
+			logger.Get(r.Context()).Error().Err(err).Msg("error updating referrers")
 		}
+		w.Header().Set("OCI-Subject", subjectDigest)
+		event.Subject = subjectDigest
+	}
+
+	d.notify(event)
+	if event.Subject != "" {
+		event.Action = ActionReferrerAdd
+		d.notify(event)
 	}
 
-	location := fmt.Sprintf("/v2/%s/%s/manifests/%s", owner, repository, reference)
+	location := fmt.Sprintf("/v2/%s/manifests/%s", name, reference)
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", digest)
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (d *Distribution) deleteManifest(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 
-	if strings.HasPrefix(reference, "sha256:") {
-		content, _, err := d.store.GetManifest(name, reference)
+	if !checkReference(w, reference) {
+		return
+	}
+
+	if isDigest(reference) {
+		content, _, err := d.store.GetManifest(r.Context(), name, reference)
 		if err == nil {
 			var manifest map[string]any
 			if err := json.Unmarshal(content, &manifest); err == nil {
 				if subject, ok := manifest["subject"].(map[string]any); ok {
 					if subjectDigest, ok := subject["digest"].(string); ok {
-						if err := d.store.RemoveReferrer(name, subjectDigest, reference); err != nil {
+						if err := d.store.RemoveReferrer(r.Context(), name, subjectDigest, reference); err != nil {
 							logger.Get(r.Context()).Error().Err(err).Msg("error removing from referrers")
 						}
 					}
@@ -138,11 +152,21 @@ func (d *Distribution) deleteManifest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err := d.store.DeleteManifest(name, reference)
+	err := d.store.DeleteManifest(r.Context(), name, reference)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errManifestUnknown, err.Error())
+		sendStoreError(w, r, err, errManifestUnknown)
 		return
 	}
 
+	if isDigest(reference) {
+		event := newEvent(r, ActionManifestDelete, name)
+		event.Digest = reference
+		d.notify(event)
+	} else {
+		event := newEvent(r, ActionTagDelete, name)
+		event.Tag = reference
+		d.notify(event)
+	}
+
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -0,0 +1,38 @@
+package distribution
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// paginate applies the "n" and "last" query parameters to a lexically sorted
+// list. If more entries are available after the returned page, a Link header
+// pointing to the next page is set on the response.
+func paginate(w http.ResponseWriter, r *http.Request, items []string) []string {
+	last := r.URL.Query().Get("last")
+	limit, _ := strconv.Atoi(r.URL.Query().Get("n"))
+
+	if last != "" {
+		start := len(items)
+		for i, item := range items {
+			if item > last {
+				start = i
+				break
+			}
+		}
+		items = items[start:]
+	}
+
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+
+		next := url.Values{}
+		next.Set("last", items[len(items)-1])
+		next.Set("n", strconv.Itoa(limit))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+
+	return items
+}
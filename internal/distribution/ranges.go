@@ -0,0 +1,81 @@
+package distribution
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+)
+
+// byteRange is an inclusive range of bytes within a blob.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// parseRange parses a Range header with a single byte range against a blob
+// of the given size. Suffix ranges ("bytes=-500") and open ended ranges
+// ("bytes=500-") are supported. It returns false if the header should be
+// ignored and the whole blob served instead, which RFC 9110 requires for
+// other units and invalid syntax, and an error only for ranges that cannot be
+// satisfied.
+func parseRange(header string, size int64) (byteRange, bool, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return byteRange{}, false, nil
+	}
+
+	// Multiple ranges would require a multipart response, the whole blob is
+	// served instead as permitted by RFC 9110.
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false, nil
+	}
+
+	if first == "" {
+		suffix, ok := parsePosition(last)
+		if !ok {
+			return byteRange{}, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return byteRange{}, false, model.ErrRangeInvalid
+		}
+		return byteRange{start: max(size-suffix, 0), end: size - 1}, true, nil
+	}
+
+	start, ok := parsePosition(first)
+	if !ok {
+		return byteRange{}, false, nil
+	}
+
+	end := size - 1
+	if last != "" {
+		if end, ok = parsePosition(last); !ok || end < start {
+			return byteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+
+	if start >= size {
+		return byteRange{}, false, model.ErrRangeInvalid
+	}
+
+	return byteRange{start: start, end: end}, true, nil
+}
+
+// parsePosition parses a position of a byte range, which only has digits.
+func parsePosition(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	position, err := strconv.ParseInt(s, 10, 64)
+	return position, err == nil
+}
@@ -7,15 +7,17 @@ import (
 )
 
 func (d *Distribution) listReferrers(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	digest := chi.URLParam(r, "digest")
 	artifactType := r.URL.Query().Get("artifactType")
 
-	content, err := d.store.GetReferrers(name, digest, artifactType)
+	if !checkDigest(w, digest) {
+		return
+	}
+
+	content, err := d.store.GetReferrers(r.Context(), name, digest, artifactType)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errManifestUnknown, err.Error())
+		sendStoreError(w, r, err, errManifestUnknown)
 		return
 	}
 
@@ -0,0 +1,63 @@
+package distribution
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/logger"
+	"github.com/go-chi/chi/v5"
+)
+
+// nameRegexp matches a repository name as defined by the distribution spec.
+var nameRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+// resolveRepository extracts the repository name from the wildcard part of the
+// path, exposes it as the "name" URL parameter and hands the remaining route
+// over to the repository router.
+func (d *Distribution) resolveRepository(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, route, ok := access.SplitRepositoryPath(chi.URLParam(r, "*"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !nameRegexp.MatchString(name) {
+			sendError(w, http.StatusBadRequest, errNameInvalid, "Invalid repository name")
+			return
+		}
+
+		rctx := chi.RouteContext(r.Context())
+		rctx.URLParams.Add("name", name)
+		rctx.RoutePath = route
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize denies requests for actions on the repository that the
+// authenticated user is not allowed to perform.
+func (d *Distribution) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := access.UserFromContext(r.Context())
+		for _, scope := range access.Required(r) {
+			if !access.Allowed(d.authorizer, user, scope) {
+				logger.Get(r.Context()).Debug().
+					Str("username", user.Name).
+					Str("scope", scope.String()).
+					Msg("access denied")
+				sendError(w, http.StatusForbidden, errDenied, "Requested access to the resource is denied")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canPull reports whether the user of a request may pull from a repository.
+func (d *Distribution) canPull(r *http.Request, name string) bool {
+	user, _ := access.UserFromContext(r.Context())
+	return access.Allowed(d.authorizer, user, access.Scope{Type: "repository", Name: name, Actions: []string{access.ActionPull}})
+}
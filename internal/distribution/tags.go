@@ -2,7 +2,6 @@ package distribution
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -10,45 +9,17 @@ import (
 )
 
 func (d *Distribution) listTags(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 
-	tags, err := d.store.ListTags(name)
+	tags, err := d.store.ListTags(r.Context(), name)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errNameUnknown, err.Error())
+		sendStoreError(w, r, err, errNameUnknown)
 		return
 	}
 
-	n := r.URL.Query().Get("n")
-	last := r.URL.Query().Get("last")
-
-	var limit int
-	if n != "" {
-		fmt.Sscanf(n, "%d", &limit)
-	}
-
-	if last != "" {
-		filteredTags := []string{}
-		pastLast := false
-		for _, tag := range tags {
-			if pastLast {
-				filteredTags = append(filteredTags, tag)
-				if limit > 0 && len(filteredTags) >= limit {
-					break
-				}
-			} else if tag == last {
-				pastLast = true
-			}
-		}
-		tags = filteredTags
-	} else if limit > 0 && len(tags) > limit {
-		tags = tags[:limit]
-	}
-
 	response := spec_v1.TagList{
 		Name: name,
-		Tags: tags,
+		Tags: paginate(w, r, tags),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1,27 +1,31 @@
 package distribution
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
 
+	"github.com/dvjn/sorcerer/internal/store/model"
 	"github.com/go-chi/chi/v5"
 )
 
 func (d *Distribution) initiateUpload(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 
 	if digest := r.URL.Query().Get("digest"); digest != "" {
-		err := d.store.PutBlob(name, digest, r.Body)
+		if !checkDigest(w, digest) {
+			return
+		}
+
+		err := d.store.PutBlob(r.Context(), name, digest, r.Body)
 		if err != nil {
-			sendError(w, http.StatusBadRequest, errBlobUploadInvalid, err.Error())
+			sendStoreError(w, r, err, errBlobUploadInvalid)
 			return
 		}
+		d.notifyBlob(r, ActionBlobPush, name, digest)
 
-		location := fmt.Sprintf("/v2/%s/%s/blobs/%s", owner, repository, digest)
+		location := fmt.Sprintf("/v2/%s/blobs/%s", name, digest)
 		w.Header().Set("Location", location)
 		w.Header().Set("Docker-Content-Digest", digest)
 		w.WriteHeader(http.StatusCreated)
@@ -29,38 +33,38 @@ func (d *Distribution) initiateUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if digest := r.URL.Query().Get("mount"); digest != "" {
+		if !checkDigest(w, digest) {
+			return
+		}
+
+		// Blobs are only mounted from repositories the user may pull from,
+		// others are uploaded like any other blob
 		from := r.URL.Query().Get("from")
-		if from != "" {
-			err := d.store.MountBlob(from, name, digest)
-			if err != nil {
-				uploadID, err := d.store.InitiateUpload(name)
-				if err != nil {
-					sendError(w, http.StatusBadRequest, errBlobUploadInvalid, err.Error())
-					return
-				}
-
-				location := fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", owner, repository, uploadID)
+		if nameRegexp.MatchString(from) && d.canPull(r, from) {
+			err := d.store.MountBlob(r.Context(), from, name, digest)
+			if err == nil {
+				d.notifyBlob(r, ActionBlobMount, name, digest)
+				location := fmt.Sprintf("/v2/%s/blobs/%s", name, digest)
 				w.Header().Set("Location", location)
-				w.Header().Set("Range", "0-0")
-				w.WriteHeader(http.StatusAccepted)
+				w.Header().Set("Docker-Content-Digest", digest)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			// Only a blob unknown to the source falls back to a regular upload
+			if !errors.Is(err, model.ErrBlobUnknown) {
+				sendStoreError(w, r, err, errBlobUploadInvalid)
 				return
 			}
-
-			location := fmt.Sprintf("/v2/%s/%s/blobs/%s", owner, repository, digest)
-			w.Header().Set("Location", location)
-			w.Header().Set("Docker-Content-Digest", digest)
-			w.WriteHeader(http.StatusCreated)
-			return
 		}
 	}
 
-	uploadID, err := d.store.InitiateUpload(name)
+	uploadID, err := d.store.InitiateUpload(r.Context(), name)
 	if err != nil {
-		sendError(w, http.StatusBadRequest, errBlobUploadInvalid, err.Error())
+		sendStoreError(w, r, err, errBlobUploadInvalid)
 		return
 	}
 
-	location := fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", owner, repository, uploadID)
+	location := fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uploadID)
 	w.Header().Set("Location", location)
 	w.Header().Set("Range", "0-0")
 	w.Header().Set("Oci-Chunk-Min-Length", "1024")
@@ -68,15 +72,13 @@ func (d *Distribution) initiateUpload(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d *Distribution) uploadBlobChunk(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 	contentRange := r.Header.Get("Content-Range")
 
-	info, err := d.store.GetUploadInfo(name, reference)
+	info, err := d.store.GetUploadInfo(r.Context(), name, reference)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errBlobUploadUnknown, err.Error())
+		sendStoreError(w, r, err, errBlobUploadUnknown)
 		return
 	}
 
@@ -103,27 +105,20 @@ func (d *Distribution) uploadBlobChunk(w http.ResponseWriter, r *http.Request) {
 		end = start + r.ContentLength - 1
 	}
 
-	newOffset, err := d.store.UploadChunk(name, reference, r.Body, start, end)
+	newOffset, err := d.store.UploadChunk(r.Context(), name, reference, r.Body, start, end)
 	if err != nil {
-		if strings.Contains(err.Error(), "invalid range") {
-			sendError(w, http.StatusRequestedRangeNotSatisfiable, errRangeInvalid, err.Error())
-			return
-		} else {
-			sendError(w, http.StatusBadRequest, errBlobUploadInvalid, err.Error())
-			return
-		}
+		sendStoreError(w, r, err, errBlobUploadInvalid)
+		return
 	}
 
-	location := fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", owner, repository, reference)
+	location := fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, reference)
 	w.Header().Set("Location", location)
 	w.Header().Set("Range", fmt.Sprintf("0-%d", newOffset-1))
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (d *Distribution) completeUpload(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 	digest := r.URL.Query().Get("digest")
 
@@ -132,37 +127,52 @@ func (d *Distribution) completeUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkDigest(w, digest) {
+		return
+	}
+
 	var content io.Reader
 	if r.ContentLength > 0 {
 		content = r.Body
 	}
 
-	err := d.store.CompleteUpload(name, reference, digest, content)
+	err := d.store.CompleteUpload(r.Context(), name, reference, digest, content)
 	if err != nil {
-		sendError(w, http.StatusBadRequest, errBlobUploadInvalid, err.Error())
+		sendStoreError(w, r, err, errBlobUploadInvalid)
 		return
 	}
+	d.notifyBlob(r, ActionBlobPush, name, digest)
 
-	location := fmt.Sprintf("/v2/%s/%s/blobs/%s", owner, repository, digest)
+	location := fmt.Sprintf("/v2/%s/blobs/%s", name, digest)
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", digest)
 	w.WriteHeader(http.StatusCreated)
 }
 
 func (d *Distribution) getBlobUploadStatus(w http.ResponseWriter, r *http.Request) {
-	owner := chi.URLParam(r, "owner")
-	repository := chi.URLParam(r, "repository")
-	name := owner + "/" + repository
+	name := chi.URLParam(r, "name")
 	reference := chi.URLParam(r, "reference")
 
-	info, err := d.store.GetUploadInfo(name, reference)
+	info, err := d.store.GetUploadInfo(r.Context(), name, reference)
 	if err != nil {
-		sendError(w, http.StatusNotFound, errBlobUploadUnknown, err.Error())
+		sendStoreError(w, r, err, errBlobUploadUnknown)
 		return
 	}
 
-	location := fmt.Sprintf("/v2/%s/%s/blobs/uploads/%s", owner, repository, reference)
+	location := fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, reference)
 	w.Header().Set("Location", location)
 	w.Header().Set("Range", fmt.Sprintf("0-%d", info.Offset-1))
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (d *Distribution) cancelUpload(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	reference := chi.URLParam(r, "reference")
+
+	if err := d.store.CancelUpload(r.Context(), name, reference); err != nil {
+		sendStoreError(w, r, err, errBlobUploadUnknown)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,203 @@
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	mediaTypeNonDistributablePrefix = "application/vnd.oci.image.layer.nondistributable."
+)
+
+// manifestError describes why a manifest was rejected, in terms of the
+// error response that should be sent to the client.
+type manifestError struct {
+	status  int
+	code    string
+	message string
+	detail  string
+}
+
+func invalidManifest(format string, args ...any) *manifestError {
+	return &manifestError{status: http.StatusBadRequest, code: errManifestInvalid, message: fmt.Sprintf(format, args...)}
+}
+
+// parsedManifest holds the parts of a validated manifest that are needed
+// after it has been stored.
+type parsedManifest struct {
+	mediaType string
+	subject   *image_v1.Descriptor
+}
+
+// validateManifest parses a manifest pushed to the repository and checks it
+// against the content type it was pushed with and the content it references.
+// Image manifests must only reference blobs, and indexes only manifests,
+// that exist in the repository with the size given in the descriptor.
+func (d *Distribution) validateManifest(ctx context.Context, name, contentType string, body []byte) (*parsedManifest, *manifestError) {
+	var probe struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Config        json.RawMessage `json:"config"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, invalidManifest("Manifest is not valid JSON: %s", err)
+	}
+
+	if probe.SchemaVersion != 2 {
+		return nil, invalidManifest("Unsupported manifest schema version %d", probe.SchemaVersion)
+	}
+
+	if contentType != "" {
+		if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+			contentType = parsed
+		}
+	}
+
+	mediaType := probe.MediaType
+	switch {
+	case mediaType != "" && contentType != "" && mediaType != contentType:
+		return nil, invalidManifest("Content-Type %q does not match manifest media type %q", contentType, mediaType)
+	case mediaType == "" && contentType != "":
+		mediaType = contentType
+	case mediaType == "" && probe.Manifests != nil:
+		mediaType = image_v1.MediaTypeImageIndex
+	case mediaType == "" && probe.Config != nil:
+		mediaType = image_v1.MediaTypeImageManifest
+	}
+
+	switch mediaType {
+	case image_v1.MediaTypeImageManifest, mediaTypeDockerManifest:
+		var manifest image_v1.Manifest
+		if err := json.Unmarshal(body, &manifest); err != nil {
+			return nil, invalidManifest("Invalid image manifest: %s", err)
+		}
+
+		if merr := d.validateImageManifest(ctx, name, &manifest); merr != nil {
+			return nil, merr
+		}
+
+		return &parsedManifest{mediaType: mediaType, subject: manifest.Subject}, nil
+
+	case image_v1.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var index image_v1.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, invalidManifest("Invalid image index: %s", err)
+		}
+
+		if merr := d.validateIndex(ctx, name, &index); merr != nil {
+			return nil, merr
+		}
+
+		return &parsedManifest{mediaType: mediaType, subject: index.Subject}, nil
+
+	default:
+		return nil, invalidManifest("Unsupported manifest media type %q", mediaType)
+	}
+}
+
+func (d *Distribution) validateImageManifest(ctx context.Context, name string, manifest *image_v1.Manifest) *manifestError {
+	if manifest.Config.Digest == "" {
+		return invalidManifest("Manifest has no config")
+	}
+
+	if merr := d.validateBlobDescriptor(ctx, name, "config", manifest.Config); merr != nil {
+		return merr
+	}
+
+	for i, layer := range manifest.Layers {
+		// Foreign layers are fetched from their URLs and never pushed to the
+		// registry.
+		if len(layer.URLs) > 0 && isNonDistributable(layer.MediaType) {
+			continue
+		}
+
+		if merr := d.validateBlobDescriptor(ctx, name, fmt.Sprintf("layers[%d]", i), layer); merr != nil {
+			return merr
+		}
+	}
+
+	if manifest.Subject != nil {
+		if err := manifest.Subject.Digest.Validate(); err != nil {
+			return invalidManifest("Invalid subject digest %q: %s", manifest.Subject.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Distribution) validateIndex(ctx context.Context, name string, index *image_v1.Index) *manifestError {
+	for i, descriptor := range index.Manifests {
+		field := fmt.Sprintf("manifests[%d]", i)
+		if err := descriptor.Digest.Validate(); err != nil {
+			return invalidManifest("Invalid digest %q in %s: %s", descriptor.Digest, field, err)
+		}
+
+		exists, size, _, err := d.store.HasManifest(ctx, name, descriptor.Digest.String())
+		if err != nil {
+			return &manifestError{status: http.StatusInternalServerError, code: errManifestInvalid, message: err.Error()}
+		}
+
+		if !exists {
+			return &manifestError{
+				status:  http.StatusBadRequest,
+				code:    errManifestBlobUnknown,
+				message: fmt.Sprintf("Manifest referenced by %s is unknown to the repository", field),
+				detail:  descriptor.Digest.String(),
+			}
+		}
+
+		if size != descriptor.Size {
+			return invalidManifest("Size of %s is %d, but the manifest is %d bytes", field, descriptor.Size, size)
+		}
+	}
+
+	if index.Subject != nil {
+		if err := index.Subject.Digest.Validate(); err != nil {
+			return invalidManifest("Invalid subject digest %q: %s", index.Subject.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Distribution) validateBlobDescriptor(ctx context.Context, name, field string, descriptor image_v1.Descriptor) *manifestError {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return invalidManifest("Invalid digest %q in %s: %s", descriptor.Digest, field, err)
+	}
+
+	exists, size, err := d.store.HasBlob(ctx, name, descriptor.Digest.String())
+	if err != nil {
+		return &manifestError{status: http.StatusInternalServerError, code: errManifestInvalid, message: err.Error()}
+	}
+
+	if !exists {
+		return &manifestError{
+			status:  http.StatusBadRequest,
+			code:    errManifestBlobUnknown,
+			message: fmt.Sprintf("Blob referenced by %s is unknown to the repository", field),
+			detail:  descriptor.Digest.String(),
+		}
+	}
+
+	if size != descriptor.Size {
+		return invalidManifest("Size of %s is %d, but the blob is %d bytes", field, descriptor.Size, size)
+	}
+
+	return nil
+}
+
+func isNonDistributable(mediaType string) bool {
+	return mediaType == mediaTypeDockerForeignLayer ||
+		strings.HasPrefix(mediaType, mediaTypeNonDistributablePrefix)
+}
@@ -0,0 +1,369 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/rs/zerolog"
+)
+
+// Options controls a garbage collection run.
+type Options struct {
+	// GracePeriod protects content younger than this from collection, so
+	// that blobs and manifests of a push in progress are never removed
+	// before the manifest referencing them lands.
+	GracePeriod time.Duration
+	// DeleteUntagged also collects manifests that are not reachable from
+	// any tag. Otherwise every manifest is treated as a root.
+	DeleteUntagged bool
+	// DryRun only reports what would be collected.
+	DryRun bool
+}
+
+func OptionsFromConfig(c *config.GCConfig) Options {
+	return Options{
+		GracePeriod:    c.GracePeriod,
+		DeleteUntagged: c.DeleteUntagged,
+		DryRun:         c.DryRun,
+	}
+}
+
+// Item is a single piece of content that was (or, in a dry run, would be)
+// collected.
+type Item struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+}
+
+// Report describes a garbage collection run. For stores with a blob pool,
+// Blobs lists the blobs unlinked from repositories and PoolBlobs the content
+// removed from the pool, and only the latter counts towards BytesFreed.
+type Report struct {
+	DryRun       bool   `json:"dry_run"`
+	Repositories int    `json:"repositories"`
+	Manifests    []Item `json:"manifests"`
+	Blobs        []Item `json:"blobs"`
+	PoolBlobs    []Item `json:"pool_blobs"`
+	BytesFreed   int64  `json:"bytes_freed"`
+}
+
+// BlobPool is implemented by stores that keep blob content once in a pool
+// shared by all repositories. Deleting a blob from a repository only unlinks
+// it, the content is freed by purging blobs no repository links to.
+type BlobPool interface {
+	PurgeBlobPool(ctx context.Context, before time.Time, dryRun bool) ([]model.ContentInfo, error)
+}
+
+type collector struct {
+	store  store.Store
+	pool   BlobPool
+	opts   Options
+	cutoff time.Time
+	logger *zerolog.Logger
+	report *Report
+}
+
+// Run performs a mark and sweep over every repository in the store. Tags
+// (and, unless DeleteUntagged is set, all manifests) are the roots; from
+// there indexes, config, layer and subject descriptors are followed, as are
+// referrers of reachable manifests. Everything that remains unmarked and is
+// older than the grace period is removed.
+func Run(ctx context.Context, s store.Store, opts Options, logger *zerolog.Logger) (*Report, error) {
+	c := &collector{
+		store:  s,
+		opts:   opts,
+		cutoff: time.Now().Add(-opts.GracePeriod),
+		logger: logger,
+		report: &Report{DryRun: opts.DryRun, Manifests: []Item{}, Blobs: []Item{}, PoolBlobs: []Item{}},
+	}
+	c.pool, _ = s.(BlobPool)
+
+	repositories, err := s.ListRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repositories without manifests, because they were all deleted or
+	// never pushed, hold blobs nothing marks
+	linked, err := s.ListLinkedRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	repositories = append(repositories, linked...)
+	slices.Sort(repositories)
+	repositories = slices.Compact(repositories)
+
+	for _, name := range repositories {
+		if err := ctx.Err(); err != nil {
+			return c.report, err
+		}
+
+		if err := c.collect(ctx, name); err != nil {
+			return c.report, err
+		}
+		c.report.Repositories++
+	}
+
+	if c.pool != nil {
+		if err := c.purgePool(ctx); err != nil {
+			return c.report, err
+		}
+	}
+
+	return c.report, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Blobs     []descriptor `json:"blobs"`
+	Manifests []descriptor `json:"manifests"`
+	Subject   *descriptor  `json:"subject"`
+}
+
+func (c *collector) collect(ctx context.Context, name string) error {
+	infos, err := c.store.ListManifests(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// A manifest that cannot be parsed may reference any blob, in which case
+	// no blob of the repository is safe to collect.
+	sweepBlobs := true
+
+	manifests := map[string]*manifest{}
+	load := func(digest string) {
+		content, _, err := c.store.GetManifest(ctx, name, digest)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("repository", name).Str("digest", digest).Msg("unreadable manifest, not collecting blobs")
+			sweepBlobs = false
+			return
+		}
+
+		var m manifest
+		if err := json.Unmarshal(content, &m); err != nil {
+			c.logger.Warn().Err(err).Str("repository", name).Str("digest", digest).Msg("unparsable manifest, not collecting blobs")
+			sweepBlobs = false
+		}
+		manifests[digest] = &m
+	}
+
+	for _, info := range infos {
+		load(info.Digest)
+	}
+
+	markedManifests := map[string]bool{}
+	markedBlobs := map[string]bool{}
+
+	var mark func(digest string)
+	mark = func(digest string) {
+		if markedManifests[digest] {
+			return
+		}
+		markedManifests[digest] = true
+
+		m, ok := manifests[digest]
+		if !ok {
+			return
+		}
+
+		if m.Config != nil {
+			markedBlobs[m.Config.Digest] = true
+		}
+		for _, layer := range m.Layers {
+			markedBlobs[layer.Digest] = true
+		}
+		for _, blob := range m.Blobs {
+			markedBlobs[blob.Digest] = true
+		}
+		for _, child := range m.Manifests {
+			mark(child.Digest)
+		}
+		if m.Subject != nil {
+			mark(m.Subject.Digest)
+		}
+	}
+
+	if err := c.markTags(ctx, name, mark); err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if !c.opts.DeleteUntagged || info.ModTime.After(c.cutoff) {
+			mark(info.Digest)
+		}
+	}
+
+	// A push can complete while the repository is being marked, after a
+	// client found that the blobs it references already exist and skipped
+	// uploading them. Manifests and tags that appeared since they were first
+	// listed are marked as well, so that their blobs are not swept.
+	current, err := c.store.ListManifests(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, info := range current {
+		if _, ok := manifests[info.Digest]; !ok {
+			// Its tag may already have been marked before it was loaded
+			load(info.Digest)
+			delete(markedManifests, info.Digest)
+			mark(info.Digest)
+		}
+	}
+
+	if err := c.markTags(ctx, name, mark); err != nil {
+		return err
+	}
+
+	// Referrers are usually untagged, they are kept as long as the manifest
+	// they refer to is reachable. Marking one can make others reachable, so
+	// repeat until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for digest, m := range manifests {
+			if !markedManifests[digest] && m.Subject != nil && markedManifests[m.Subject.Digest] {
+				mark(digest)
+				changed = true
+			}
+		}
+	}
+
+	for _, info := range infos {
+		if markedManifests[info.Digest] || manifests[info.Digest] == nil {
+			continue
+		}
+
+		if err := c.sweepManifest(ctx, name, info, manifests[info.Digest]); err != nil {
+			return err
+		}
+	}
+
+	if !sweepBlobs {
+		return nil
+	}
+
+	blobs, err := c.store.ListBlobs(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range blobs {
+		if markedBlobs[info.Digest] || info.ModTime.After(c.cutoff) {
+			continue
+		}
+
+		if err := c.sweepBlob(ctx, name, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markTags marks the manifests tags of the repository currently point to.
+func (c *collector) markTags(ctx context.Context, name string, mark func(digest string)) error {
+	tags, err := c.store.ListTags(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		exists, _, digest, err := c.store.HasManifest(ctx, name, tag)
+		if err != nil {
+			return err
+		}
+		if exists {
+			mark(digest)
+		}
+	}
+
+	return nil
+}
+
+func (c *collector) sweepManifest(ctx context.Context, name string, info model.ContentInfo, m *manifest) error {
+	c.report.Manifests = append(c.report.Manifests, Item{Repository: name, Digest: info.Digest, Size: info.Size})
+	c.report.BytesFreed += info.Size
+
+	c.logger.Debug().Str("repository", name).Str("digest", info.Digest).Bool("dry_run", c.opts.DryRun).Msg("collecting manifest")
+	if c.opts.DryRun {
+		return nil
+	}
+
+	if m.Subject != nil {
+		if err := c.store.RemoveReferrer(ctx, name, m.Subject.Digest, info.Digest); err != nil {
+			return err
+		}
+	}
+
+	return c.store.DeleteManifest(ctx, name, info.Digest)
+}
+
+func (c *collector) sweepBlob(ctx context.Context, name string, info model.ContentInfo) error {
+	c.report.Blobs = append(c.report.Blobs, Item{Repository: name, Digest: info.Digest, Size: info.Size})
+	if c.pool == nil {
+		c.report.BytesFreed += info.Size
+	}
+
+	c.logger.Debug().Str("repository", name).Str("digest", info.Digest).Bool("dry_run", c.opts.DryRun).Msg("collecting blob")
+	if c.opts.DryRun {
+		return nil
+	}
+
+	return c.store.DeleteBlob(ctx, name, info.Digest)
+}
+
+// purgePool removes pooled content that is no longer linked into any
+// repository. In a dry run nothing has been unlinked, so only content that
+// was already unreferenced before the run is reported.
+func (c *collector) purgePool(ctx context.Context) error {
+	purged, err := c.pool.PurgeBlobPool(ctx, c.cutoff, c.opts.DryRun)
+	for _, info := range purged {
+		c.logger.Debug().Str("digest", info.Digest).Bool("dry_run", c.opts.DryRun).Msg("collecting pooled blob")
+		c.report.PoolBlobs = append(c.report.PoolBlobs, Item{Digest: info.Digest, Size: info.Size})
+		c.report.BytesFreed += info.Size
+	}
+	return err
+}
+
+// Schedule runs garbage collection every interval until ctx is cancelled.
+func Schedule(ctx context.Context, s store.Store, opts Options, interval time.Duration, logger *zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := Run(ctx, s, opts, logger)
+			if err != nil {
+				logger.Error().Err(err).Msg("garbage collection failed")
+				continue
+			}
+			LogReport(logger, report)
+		}
+	}
+}
+
+func LogReport(logger *zerolog.Logger, report *Report) {
+	logger.Info().
+		Bool("dry_run", report.DryRun).
+		Int("repositories", report.Repositories).
+		Int("manifests", len(report.Manifests)).
+		Int("blobs", len(report.Blobs)).
+		Int("pool_blobs", len(report.PoolBlobs)).
+		Int64("bytes_freed", report.BytesFreed).
+		Msg("garbage collection finished")
+}
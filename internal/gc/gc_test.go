@@ -0,0 +1,308 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/rs/zerolog"
+)
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func putBlob(t *testing.T, s store.Store, name string, content []byte) string {
+	t.Helper()
+	digest := digestOf(content)
+	if err := s.PutBlob(t.Context(), name, digest, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	return digest
+}
+
+func putManifest(t *testing.T, s store.Store, name, reference, configDigest string, layers ...string) string {
+	t.Helper()
+	content := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"digest":%q},"layers":[`, configDigest)
+	for i, layer := range layers {
+		if i > 0 {
+			content += ","
+		}
+		content += fmt.Sprintf(`{"digest":%q}`, layer)
+	}
+	content += "]}"
+
+	if reference == "" {
+		reference = digestOf([]byte(content))
+	}
+
+	digest, err := s.PutManifest(t.Context(), name, reference, []byte(content))
+	if err != nil {
+		t.Fatalf("Failed to put manifest: %v", err)
+	}
+	return digest
+}
+
+func newStore(t *testing.T) store.Store {
+	t.Helper()
+	s, err := store.New(&config.StoreConfig{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return s
+}
+
+func hasBlob(t *testing.T, s store.Store, name, digest string) bool {
+	t.Helper()
+	exists, _, err := s.HasBlob(t.Context(), name, digest)
+	if err != nil {
+		t.Fatalf("Failed to check blob: %v", err)
+	}
+	return exists
+}
+
+func TestRunCollectsUnreferencedBlobs(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+	name := "team/app"
+
+	configBlob := putBlob(t, s, name, []byte("{}"))
+	kept := putBlob(t, s, name, []byte("kept layer"))
+	dropped := putBlob(t, s, name, []byte("dropped layer"))
+	putManifest(t, s, name, "v1", configBlob, kept)
+	old := putManifest(t, s, name, "v0", configBlob, dropped)
+
+	if err := s.DeleteManifest(t.Context(), name, "v0"); err != nil {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+
+	// Untagged manifests are kept by default, and with them their layers
+	report, err := Run(context.Background(), s, Options{}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Blobs) != 0 || len(report.Manifests) != 0 {
+		t.Errorf("Expected nothing to be collected, got %+v", report)
+	}
+
+	report, err = Run(context.Background(), s, Options{DeleteUntagged: true, DryRun: true}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Manifests) != 1 || report.Manifests[0].Digest != old {
+		t.Errorf("Expected untagged manifest to be reported, got %+v", report.Manifests)
+	}
+	if len(report.Blobs) != 1 || report.Blobs[0].Digest != dropped {
+		t.Errorf("Expected dropped layer to be reported, got %+v", report.Blobs)
+	}
+	if !hasBlob(t, s, name, dropped) {
+		t.Error("Dry run should not remove blobs")
+	}
+
+	if _, err := Run(context.Background(), s, Options{DeleteUntagged: true}, &logger); err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if hasBlob(t, s, name, dropped) {
+		t.Error("Expected dropped layer to be collected")
+	}
+	if !hasBlob(t, s, name, kept) || !hasBlob(t, s, name, configBlob) {
+		t.Error("Expected referenced blobs to be kept")
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), name, old); exists {
+		t.Error("Expected untagged manifest to be collected")
+	}
+}
+
+func TestRunKeepsIndexChildrenAndReferrers(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+	name := "team/app"
+
+	configBlob := putBlob(t, s, name, []byte("{}"))
+	layer := putBlob(t, s, name, []byte("layer"))
+	child := putManifest(t, s, name, "", configBlob, layer)
+
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"digest":%q}]}`, child)
+	if _, err := s.PutManifest(t.Context(), name, "latest", []byte(index)); err != nil {
+		t.Fatalf("Failed to put index: %v", err)
+	}
+
+	signature := putBlob(t, s, name, []byte("signature"))
+	referrer := fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":%q},"layers":[{"digest":%q}],"subject":{"digest":%q}}`, configBlob, signature, child)
+	referrerDigest, err := s.PutManifest(t.Context(), name, digestOf([]byte(referrer)), []byte(referrer))
+	if err != nil {
+		t.Fatalf("Failed to put referrer: %v", err)
+	}
+
+	report, err := Run(context.Background(), s, Options{DeleteUntagged: true}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Manifests) != 0 || len(report.Blobs) != 0 {
+		t.Errorf("Expected nothing to be collected, got %+v", report)
+	}
+
+	for _, digest := range []string{child, referrerDigest} {
+		if exists, _, _, _ := s.HasManifest(t.Context(), name, digest); !exists {
+			t.Errorf("Expected manifest %s to be kept", digest)
+		}
+	}
+	if !hasBlob(t, s, name, signature) {
+		t.Error("Expected referrer blob to be kept")
+	}
+}
+
+func TestRunHonorsGracePeriod(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+	name := "team/app"
+
+	configBlob := putBlob(t, s, name, []byte("{}"))
+	putManifest(t, s, name, "v1", configBlob)
+	pending := putBlob(t, s, name, []byte("pushed before its manifest"))
+
+	report, err := Run(context.Background(), s, Options{GracePeriod: time.Hour}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Blobs) != 0 {
+		t.Errorf("Expected young blob to be kept, got %+v", report.Blobs)
+	}
+	if !hasBlob(t, s, name, pending) {
+		t.Error("Expected young blob to be kept")
+	}
+}
+
+func TestRunPurgesUnlinkedPoolBlobs(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+
+	shared := putBlob(t, s, "team/app", []byte("shared layer"))
+	putBlob(t, s, "team/other", []byte("shared layer"))
+	putManifest(t, s, "team/other", "v1", shared)
+
+	if err := s.DeleteBlob(t.Context(), "team/app", shared); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	if !hasBlob(t, s, "team/other", shared) {
+		t.Fatal("Expected blob to remain linked into the other repository")
+	}
+
+	report, err := Run(context.Background(), s, Options{}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.PoolBlobs) != 0 {
+		t.Errorf("Expected linked blob to stay in the pool, got %+v", report.PoolBlobs)
+	}
+
+	if err := s.DeleteBlob(t.Context(), "team/other", shared); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+
+	report, err = Run(context.Background(), s, Options{}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.PoolBlobs) != 1 || report.PoolBlobs[0].Digest != shared {
+		t.Errorf("Expected unlinked blob to be purged from the pool, got %+v", report.PoolBlobs)
+	}
+	if report.BytesFreed != int64(len("shared layer")) {
+		t.Errorf("Expected %d bytes freed, got %d", len("shared layer"), report.BytesFreed)
+	}
+
+	// Linking the blob again requires the content to be pushed again
+	if err := s.MountBlob(t.Context(), "team/other", "team/app", shared); err == nil {
+		t.Error("Expected mount of purged blob to fail")
+	}
+}
+
+func TestRunCollectsRepositoriesWithoutManifests(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+
+	configBlob := putBlob(t, s, "team/app", []byte("{}"))
+	layer := putBlob(t, s, "team/app", []byte("layer"))
+	digest := putManifest(t, s, "team/app", "v1", configBlob, layer)
+	if err := s.DeleteManifest(t.Context(), "team/app", "v1"); err != nil {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+	if err := s.DeleteManifest(t.Context(), "team/app", digest); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+
+	orphan := putBlob(t, s, "never/manifested", []byte("orphan layer"))
+
+	// Nothing is collected while the grace period protects the blobs
+	report, err := Run(context.Background(), s, Options{GracePeriod: time.Hour, DeleteUntagged: true}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Blobs) != 0 || len(report.PoolBlobs) != 0 {
+		t.Errorf("Expected young blobs to be kept, got %+v", report)
+	}
+
+	report, err = Run(context.Background(), s, Options{DeleteUntagged: true}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if report.Repositories != 2 || len(report.Blobs) != 3 || len(report.PoolBlobs) != 3 {
+		t.Errorf("Expected all blobs of both repositories to be collected, got %+v", report)
+	}
+	if hasBlob(t, s, "team/app", configBlob) || hasBlob(t, s, "team/app", layer) || hasBlob(t, s, "never/manifested", orphan) {
+		t.Error("Expected blobs of repositories without manifests to be collected")
+	}
+}
+
+// pushingStore pushes a manifest the first time the tags of a repository are
+// listed, as a client that found its blobs already present would while a
+// collection is marking the repository.
+type pushingStore struct {
+	store.Store
+	push func()
+}
+
+func (s *pushingStore) ListTags(ctx context.Context, name string) ([]string, error) {
+	if s.push != nil {
+		push := s.push
+		s.push = nil
+		push()
+	}
+	return s.Store.ListTags(ctx, name)
+}
+
+func TestRunKeepsBlobsOfManifestsPushedDuringMark(t *testing.T) {
+	logger := zerolog.Nop()
+	s := newStore(t)
+	name := "team/app"
+
+	configBlob := putBlob(t, s, name, []byte("{}"))
+	putManifest(t, s, name, "v1", configBlob)
+	layer := putBlob(t, s, name, []byte("layer found by a HEAD request"))
+
+	var pushed string
+	wrapped := &pushingStore{Store: s, push: func() {
+		pushed = putManifest(t, s, name, "v2", configBlob, layer)
+	}}
+
+	report, err := Run(context.Background(), wrapped, Options{DeleteUntagged: true}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to run gc: %v", err)
+	}
+	if len(report.Blobs) != 0 || len(report.Manifests) != 0 {
+		t.Errorf("Expected nothing to be collected, got %+v", report)
+	}
+	if !hasBlob(t, s, name, layer) {
+		t.Error("Expected layer of the manifest pushed during the run to be kept")
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), name, pushed); !exists {
+		t.Error("Expected manifest pushed during the run to be kept")
+	}
+}
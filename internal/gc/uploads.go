@@ -0,0 +1,44 @@
+package gc
+
+import (
+	"context"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/metrics"
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/rs/zerolog"
+)
+
+var (
+	expiredUploads     = metrics.NewCounter("sorcerer_expired_uploads_total", "Number of abandoned uploads removed by the janitor.")
+	expiredUploadBytes = metrics.NewCounter("sorcerer_expired_upload_bytes_total", "Number of bytes of abandoned uploads removed by the janitor.")
+)
+
+// ScheduleUploadJanitor periodically removes uploads that have been idle for
+// longer than ttl, until ctx is cancelled.
+func ScheduleUploadJanitor(ctx context.Context, s store.Store, ttl time.Duration, logger *zerolog.Logger) {
+	ticker := time.NewTicker(min(ttl, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.PurgeUploads(ctx, time.Now().Add(-ttl))
+			for _, upload := range purged {
+				expiredUploads.Inc()
+				expiredUploadBytes.Add(upload.Size)
+				logger.Info().
+					Str("repository", upload.Name).
+					Str("upload", upload.ID).
+					Int64("size", upload.Size).
+					Time("updated_at", upload.UpdatedAt).
+					Msg("removed expired upload")
+			}
+			if err != nil {
+				logger.Error().Err(err).Msg("failed to remove expired uploads")
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/rs/zerolog"
+)
+
+func TestPurgeUploadsKeepsFreshUploads(t *testing.T) {
+	s := newStore(t)
+
+	stale, err := s.InitiateUpload(t.Context(), "team/app")
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+	if _, err := s.UploadChunk(t.Context(), "team/app", stale, bytes.NewReader([]byte("stale")), 0, 4); err != nil {
+		t.Fatalf("Failed to upload chunk: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	fresh, err := s.InitiateUpload(t.Context(), "team/app")
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+
+	purged, err := s.PurgeUploads(t.Context(), cutoff)
+	if err != nil {
+		t.Fatalf("Failed to purge uploads: %v", err)
+	}
+	if len(purged) != 1 || purged[0].ID != stale || purged[0].Size != int64(len("stale")) {
+		t.Errorf("Expected only the stale upload to be purged, got %+v", purged)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "team/app", stale); err == nil {
+		t.Error("Expected stale upload to be gone")
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "team/app", fresh); err != nil {
+		t.Errorf("Expected fresh upload to be kept, got %v", err)
+	}
+}
+
+// purgingStore reports every purge on a channel and purges a fixed upload.
+type purgingStore struct {
+	store.Store
+	purges chan time.Time
+}
+
+func (s *purgingStore) PurgeUploads(ctx context.Context, before time.Time) ([]model.UploadInfo, error) {
+	select {
+	case s.purges <- before:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return []model.UploadInfo{{Name: "team/app", ID: "abandoned", Size: 42}}, nil
+}
+
+func TestScheduleUploadJanitor(t *testing.T) {
+	logger := zerolog.Nop()
+	s := &purgingStore{purges: make(chan time.Time)}
+	ttl := 20 * time.Millisecond
+
+	uploads, size := expiredUploads.Value(), expiredUploadBytes.Value()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		ScheduleUploadJanitor(ctx, s, ttl, &logger)
+		close(done)
+	}()
+
+	for range 2 {
+		select {
+		case before := <-s.purges:
+			if age := time.Since(before); age < ttl || age > time.Second {
+				t.Errorf("Expected uploads idle for %v to be purged, got cutoff %v ago", ttl, age)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the janitor to purge uploads")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the janitor to stop when its context is cancelled")
+	}
+
+	if n := expiredUploads.Value() - uploads; n != 2 {
+		t.Errorf("Expected purged uploads to be counted, got %d", n)
+	}
+	if n := expiredUploadBytes.Value() - size; n != 84 {
+		t.Errorf("Expected purged bytes to be counted, got %d", n)
+	}
+}
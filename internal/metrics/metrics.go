@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value exposed in the Prometheus text
+// format.
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+var (
+	mu       sync.Mutex
+	counters = map[string]*Counter{}
+)
+
+// NewCounter registers a counter with the given name. Registering the same
+// name twice returns the existing counter.
+func NewCounter(name, help string) *Counter {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := counters[name]; ok {
+		return c
+	}
+
+	c := &Counter{name: name, help: help}
+	counters[name] = c
+	return c
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(counters))
+		for name := range counters {
+			names = append(names, name)
+		}
+		mu.Unlock()
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+
+		for _, name := range names {
+			mu.Lock()
+			c := counters[name]
+			mu.Unlock()
+
+			fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+			fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+			fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	second := NewCounter("test_second_total", "Second counter.")
+	first := NewCounter("test_first_total", "First counter.")
+	first.Inc()
+	first.Add(41)
+
+	if again := NewCounter("test_first_total", "Ignored."); again != first {
+		t.Error("Expected registering a name twice to return the existing counter")
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4" {
+		t.Errorf("Expected text exposition format, got %q", contentType)
+	}
+
+	body, _ := io.ReadAll(w.Body)
+	expected := "# HELP test_first_total First counter.\n" +
+		"# TYPE test_first_total counter\n" +
+		"test_first_total 42\n" +
+		"# HELP test_second_total Second counter.\n" +
+		"# TYPE test_second_total counter\n" +
+		"test_second_total 0\n"
+	if !strings.Contains(string(body), expected) {
+		t.Errorf("Expected counters sorted by name in the text format\n%s\ngot\n%s", expected, body)
+	}
+
+	second.Inc()
+	w = httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\ntest_second_total 1\n") {
+		t.Errorf("Expected current counter value to be served, got\n%s", w.Body.String())
+	}
+}
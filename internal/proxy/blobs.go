@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/rs/zerolog"
+)
+
+func (p *Proxy) HasBlob(ctx context.Context, name, digest string) (bool, int64, error) {
+	exists, size, err := p.Store.HasBlob(ctx, name, digest)
+	if err != nil || exists {
+		return exists, size, err
+	}
+
+	resp, err := p.do(ctx, http.MethodHead, name, "blobs/"+digest, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	resp.Body.Close()
+
+	if err := upstreamError(resp, model.ErrBlobUnknown); errors.Is(err, model.ErrBlobUnknown) {
+		return false, 0, nil
+	} else if err != nil {
+		return false, 0, err
+	}
+	return true, resp.ContentLength, nil
+}
+
+// GetBlob serves blobs missing from the store straight from the upstream,
+// writing them into the store as they are read. Only blobs read to the end
+// are kept.
+func (p *Proxy) GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error) {
+	blob, size, err := p.Store.GetBlob(ctx, name, digest)
+	if !errors.Is(err, model.ErrBlobUnknown) {
+		return blob, size, err
+	}
+
+	resp, err := p.do(ctx, http.MethodGet, name, "blobs/"+digest, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := upstreamError(resp, model.ErrBlobUnknown); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	if resp.ContentLength < 0 {
+		// Without a size the blob cannot be streamed, so it is stored first
+		defer resp.Body.Close()
+		if err := p.Store.PutBlob(ctx, name, digest, resp.Body); err != nil {
+			return nil, 0, err
+		}
+		return p.Store.GetBlob(ctx, name, digest)
+	}
+
+	p.logger.Debug().Str("repository", name).Str("digest", digest).Int64("size", resp.ContentLength).Msg("fetching blob from upstream")
+	return p.newCachingReader(ctx, name, digest, resp.Body), resp.ContentLength, nil
+}
+
+var errIncomplete = errors.New("blob was not read to the end")
+
+// cachingReader reads a blob from the upstream, copying what is read into
+// the store. Reading carries on if storing fails, so that the client still
+// gets the blob.
+type cachingReader struct {
+	body     io.ReadCloser
+	pipe     *io.PipeWriter
+	caching  bool
+	done     chan error
+	offset   int64
+	complete bool
+	logger   zerolog.Logger
+}
+
+func (p *Proxy) newCachingReader(ctx context.Context, name, digest string, body io.ReadCloser) *cachingReader {
+	pr, pw := io.Pipe()
+	r := &cachingReader{
+		body:    body,
+		pipe:    pw,
+		caching: true,
+		done:    make(chan error, 1),
+		logger:  p.logger.With().Str("repository", name).Str("digest", digest).Logger(),
+	}
+
+	go func() {
+		err := p.Store.PutBlob(ctx, name, digest, pr)
+		// Unblock the reader if storing stopped early
+		pr.CloseWithError(err)
+		r.done <- err
+	}()
+
+	return r
+}
+
+func (r *cachingReader) Read(b []byte) (int, error) {
+	n, err := r.body.Read(b)
+	if n > 0 && r.caching {
+		if _, err := r.pipe.Write(b[:n]); err != nil {
+			r.caching = false
+		}
+	}
+	r.offset += int64(n)
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+// Seek only supports moving forward from the start, which is all serving a
+// byte range needs. The skipped content is still stored.
+func (r *cachingReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset < r.offset {
+		return r.offset, fmt.Errorf("blob fetched from upstream can only be read forward")
+	}
+	_, err := io.CopyN(io.Discard, r, offset-r.offset)
+	return r.offset, err
+}
+
+func (r *cachingReader) Close() error {
+	if r.complete {
+		r.pipe.Close()
+	} else {
+		r.pipe.CloseWithError(errIncomplete)
+	}
+
+	if err := <-r.done; err != nil && r.complete {
+		r.logger.Error().Err(err).Msg("failed to cache blob from upstream")
+	} else if err == nil {
+		r.logger.Debug().Msg("cached blob from upstream")
+	}
+
+	return r.body.Close()
+}
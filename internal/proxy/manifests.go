@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/remote"
+	"github.com/dvjn/sorcerer/internal/store/model"
+)
+
+// Manifests larger than this are refused, the same limit docker applies.
+const maxManifestSize = 4 << 20
+
+func (p *Proxy) HasManifest(ctx context.Context, name, reference string) (bool, int64, string, error) {
+	if err := p.cacheManifest(ctx, name, reference); errors.Is(err, model.ErrManifestUnknown) {
+		return false, 0, "", nil
+	} else if err != nil {
+		return false, 0, "", err
+	}
+	return p.Store.HasManifest(ctx, name, reference)
+}
+
+func (p *Proxy) GetManifest(ctx context.Context, name, reference string) ([]byte, string, error) {
+	if err := p.cacheManifest(ctx, name, reference); err != nil {
+		return nil, "", err
+	}
+	return p.Store.GetManifest(ctx, name, reference)
+}
+
+// cacheManifest makes sure the store holds the manifest, fetching it from the
+// upstream if it is missing or, for tags, if it has not been checked for
+// longer than the tag TTL. A stale tag is still served while the upstream is
+// unavailable.
+func (p *Proxy) cacheManifest(ctx context.Context, name, reference string) error {
+	isTag := !strings.Contains(reference, ":")
+
+	exists, _, digest, err := p.Store.HasManifest(ctx, name, reference)
+	if err != nil {
+		return err
+	}
+	if exists && (!isTag || p.fresh(name, reference)) {
+		return nil
+	}
+
+	if exists {
+		// Checking a tag with a HEAD request does not count towards the pull
+		// rate limits of registries such as Docker Hub
+		upstreamDigest, err := p.headManifest(ctx, name, reference)
+		if err == nil && upstreamDigest == digest {
+			p.checked(name, reference)
+			return nil
+		}
+		if err != nil && !errors.Is(err, model.ErrManifestUnknown) {
+			p.logger.Warn().Err(err).Str("repository", name).Str("tag", reference).Msg("failed to check tag upstream, serving cached manifest")
+			return nil
+		}
+	}
+
+	content, err := p.fetchManifest(ctx, name, reference)
+	if err != nil {
+		if exists && !errors.Is(err, model.ErrManifestUnknown) {
+			p.logger.Warn().Err(err).Str("repository", name).Str("tag", reference).Msg("failed to fetch tag upstream, serving cached manifest")
+			return nil
+		}
+		return err
+	}
+
+	// The store verifies manifests fetched by digest against it
+	digest, err = p.Store.PutManifest(ctx, name, reference, content)
+	if err != nil {
+		return err
+	}
+	if err := p.Store.UpdateReferrers(ctx, name, digest, content); err != nil {
+		p.logger.Error().Err(err).Str("repository", name).Str("digest", digest).Msg("failed to update referrers of cached manifest")
+	}
+	if isTag {
+		p.checked(name, reference)
+	}
+
+	p.logger.Debug().Str("repository", name).Str("reference", reference).Str("digest", digest).Msg("cached manifest from upstream")
+	return nil
+}
+
+func (p *Proxy) fresh(name, tag string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	checkedAt, ok := p.checkedAt[name+":"+tag]
+	return ok && time.Since(checkedAt) < p.tagTTL
+}
+
+func (p *Proxy) checked(name, tag string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkedAt[name+":"+tag] = time.Now()
+}
+
+func (p *Proxy) headManifest(ctx context.Context, name, reference string) (string, error) {
+	resp, err := p.do(ctx, http.MethodHead, name, "manifests/"+reference, manifestHeader())
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if err := upstreamError(resp, model.ErrManifestUnknown); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+func (p *Proxy) fetchManifest(ctx context.Context, name, reference string) ([]byte, error) {
+	resp, err := p.do(ctx, http.MethodGet, name, "manifests/"+reference, manifestHeader())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := upstreamError(resp, model.ErrManifestUnknown); err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream manifest: %w", err)
+	}
+	if len(content) > maxManifestSize {
+		return nil, fmt.Errorf("upstream manifest is larger than %d bytes", maxManifestSize)
+	}
+	return content, nil
+}
+
+func manifestHeader() http.Header {
+	return http.Header{"Accept": {strings.Join(remote.ManifestTypes, ", ")}}
+}
+
+// upstreamError turns an unsuccessful upstream response into an error, with
+// unknown wrapped for content the upstream does not have.
+func upstreamError(resp *http.Response, unknown error) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("upstream %w", unknown)
+	default:
+		return fmt.Errorf("unexpected upstream response: %s", resp.Status)
+	}
+}
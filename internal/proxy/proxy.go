@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/remote"
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/rs/zerolog"
+)
+
+// Proxy turns a store into a pull-through cache of an upstream registry.
+// Manifests and blobs missing from the store are fetched from the upstream
+// and kept, tags are checked upstream again once they are older than the tag
+// TTL. The cache mirrors the upstream, so pushes and deletes are rejected.
+type Proxy struct {
+	store.Store
+	client *remote.Client
+	tagTTL time.Duration
+	logger *zerolog.Logger
+
+	// Times at which tags were last checked upstream, by repository and tag.
+	// Tags cached before a restart are checked again on first use.
+	mu        sync.Mutex
+	checkedAt map[string]time.Time
+}
+
+func New(s store.Store, c *config.ProxyConfig, logger *zerolog.Logger) (*Proxy, error) {
+	upstream, err := url.Parse(c.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %w", err)
+	}
+
+	return &Proxy{
+		Store:     s,
+		client:    remote.NewClient(upstream, c.Username, c.Password),
+		tagTTL:    c.TagTTL,
+		logger:    logger,
+		checkedAt: map[string]time.Time{},
+	}, nil
+}
+
+// do sends a request for a path of the repository to the upstream.
+func (p *Proxy) do(ctx context.Context, method, name, path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.client.URL(name, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return p.client.Do(req, name, false)
+}
+
+func (p *Proxy) PutBlob(ctx context.Context, name, digest string, content io.Reader) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) DeleteBlob(ctx context.Context, name, digest string) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) MountBlob(ctx context.Context, fromName, toName, digest string) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) PutManifest(ctx context.Context, name, reference string, content []byte) (string, error) {
+	return "", model.ErrUnsupported
+}
+
+func (p *Proxy) DeleteManifest(ctx context.Context, name, reference string) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) UpdateReferrers(ctx context.Context, name, manifestDigest string, manifest []byte) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) RemoveReferrer(ctx context.Context, name, digest, manifestDigest string) error {
+	return model.ErrUnsupported
+}
+
+func (p *Proxy) InitiateUpload(ctx context.Context, name string) (string, error) {
+	return "", model.ErrUnsupported
+}
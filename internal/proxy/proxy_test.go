@@ -0,0 +1,323 @@
+package proxy_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/proxy"
+	"github.com/dvjn/sorcerer/internal/store"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func imageManifest(layer string) string {
+	return fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":%d}]}`,
+		digestOf("{}"), digestOf(layer), len(layer))
+}
+
+func newStore(t *testing.T) store.Store {
+	t.Helper()
+	s, err := mem_store.New(&config.StoreConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return s
+}
+
+// newRegistry serves the distribution API of a store, wrapped by middleware.
+func newRegistry(t *testing.T, s store.Store, middleware func(http.Handler) http.Handler) *httptest.Server {
+	t.Helper()
+
+	r := chi.NewRouter()
+	r.Mount("/v2", distribution.New(s, func(next http.Handler) http.Handler { return next }, nil).Router())
+
+	server := httptest.NewServer(middleware(r))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func noMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+// push puts an image with a single layer into the upstream store.
+func push(t *testing.T, s store.Store, name, tag, layer string) string {
+	t.Helper()
+
+	if err := s.PutBlob(t.Context(), name, digestOf("{}"), strings.NewReader("{}")); err != nil {
+		t.Fatalf("Failed to put config: %v", err)
+	}
+	if err := s.PutBlob(t.Context(), name, digestOf(layer), strings.NewReader(layer)); err != nil {
+		t.Fatalf("Failed to put layer: %v", err)
+	}
+	digest, err := s.PutManifest(t.Context(), name, tag, []byte(imageManifest(layer)))
+	if err != nil {
+		t.Fatalf("Failed to put manifest: %v", err)
+	}
+	return digest
+}
+
+// newCache serves a pull-through cache of upstream, returning the store
+// underneath it along with the server.
+func newCache(t *testing.T, upstream string, c config.ProxyConfig) (store.Store, *httptest.Server) {
+	t.Helper()
+
+	c.Upstream = upstream
+	logger := zerolog.Nop()
+	s := newStore(t)
+	p, err := proxy.New(s, &c, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	return s, newRegistry(t, p, noMiddleware)
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp, string(body)
+}
+
+// eventually waits for content streamed to a client to land in the store,
+// which happens as the request finishes.
+func eventually(t *testing.T, condition func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPullThrough(t *testing.T) {
+	upstreamStore := newStore(t)
+	digest := push(t, upstreamStore, "library/app", "latest", "layer content")
+	push(t, upstreamStore, "library/app", "ranged", "ranged layer content")
+
+	var manifestRequests atomic.Int32
+	upstream := newRegistry(t, upstreamStore, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+				manifestRequests.Add(1)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	local, cache := newCache(t, upstream.URL, config.ProxyConfig{TagTTL: time.Hour})
+
+	for range 2 {
+		resp, body := get(t, cache.URL+"/v2/library/app/manifests/latest", nil)
+		if resp.StatusCode != http.StatusOK || body != imageManifest("layer content") || resp.Header.Get("Docker-Content-Digest") != digest {
+			t.Fatalf("Expected manifest from upstream, got %d %s", resp.StatusCode, body)
+		}
+	}
+	if n := manifestRequests.Load(); n != 1 {
+		t.Errorf("Expected manifest to be fetched from upstream once, got %d requests", n)
+	}
+	if resp, _ := get(t, cache.URL+"/v2/library/app/manifests/"+digest, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected manifest fetched by tag to be cached by digest, got %d", resp.StatusCode)
+	}
+
+	if resp, body := get(t, cache.URL+"/v2/library/app/blobs/"+digestOf("layer content"), nil); resp.StatusCode != http.StatusOK || body != "layer content" {
+		t.Fatalf("Expected blob from upstream, got %d %q", resp.StatusCode, body)
+	}
+	if !eventually(t, func() bool {
+		exists, _, _ := local.HasBlob(t.Context(), "library/app", digestOf("layer content"))
+		return exists
+	}) {
+		t.Error("Expected blob read from upstream to be cached")
+	}
+
+	resp, body := get(t, cache.URL+"/v2/library/app/blobs/"+digestOf("ranged layer content"), map[string]string{"Range": "bytes=7-11"})
+	if resp.StatusCode != http.StatusPartialContent || body != "layer" {
+		t.Errorf("Expected range of blob from upstream, got %d %q", resp.StatusCode, body)
+	}
+
+	if resp, _ := get(t, cache.URL+"/v2/library/app/manifests/unknown", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected manifest unknown upstream to be unknown, got %d", resp.StatusCode)
+	}
+	if resp, _ := get(t, cache.URL+"/v2/library/app/blobs/"+digestOf("unknown"), nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected blob unknown upstream to be unknown, got %d", resp.StatusCode)
+	}
+
+	push, err := http.Post(cache.URL+"/v2/library/app/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	push.Body.Close()
+	if push.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected pushes to the cache to be rejected, got %d", push.StatusCode)
+	}
+
+	// Cached content is served once the upstream is gone
+	upstream.Close()
+	if resp, body := get(t, cache.URL+"/v2/library/app/blobs/"+digestOf("layer content"), nil); resp.StatusCode != http.StatusOK || body != "layer content" {
+		t.Errorf("Expected cached blob, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestTagTTL(t *testing.T) {
+	upstreamStore := newStore(t)
+	push(t, upstreamStore, "app", "latest", "v1")
+	upstream := newRegistry(t, upstreamStore, noMiddleware)
+
+	_, cached := newCache(t, upstream.URL, config.ProxyConfig{TagTTL: time.Hour})
+	_, expiring := newCache(t, upstream.URL, config.ProxyConfig{TagTTL: 0})
+
+	for _, cache := range []*httptest.Server{cached, expiring} {
+		if _, body := get(t, cache.URL+"/v2/app/manifests/latest", nil); body != imageManifest("v1") {
+			t.Fatalf("Expected first manifest, got %s", body)
+		}
+	}
+
+	push(t, upstreamStore, "app", "latest", "v2")
+	if _, body := get(t, cached.URL+"/v2/app/manifests/latest", nil); body != imageManifest("v1") {
+		t.Errorf("Expected tag within its TTL to be served from the cache, got %s", body)
+	}
+	if _, body := get(t, expiring.URL+"/v2/app/manifests/latest", nil); body != imageManifest("v2") {
+		t.Errorf("Expected expired tag to be fetched again, got %s", body)
+	}
+
+	// An expired tag is still served while the upstream is unavailable
+	upstream.Close()
+	if resp, body := get(t, expiring.URL+"/v2/app/manifests/latest", nil); resp.StatusCode != http.StatusOK || body != imageManifest("v2") {
+		t.Errorf("Expected stale tag to be served, got %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	upstreamStore := newStore(t)
+	push(t, upstreamStore, "app", "latest", "layer")
+
+	basic := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	// bearer issues tokens the way Docker Hub does, scoped to a repository
+	var realm string
+	bearer := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintf(w, `{"token":%q,"expires_in":300}`, r.URL.Query().Get("service")+" "+r.URL.Query().Get("scope"))
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer test repository:app:pull" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="test",scope="repository:app:pull"`, realm+"/token"))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	for _, test := range []struct {
+		name       string
+		middleware func(http.Handler) http.Handler
+	}{
+		{"basic", basic},
+		{"bearer", bearer},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := newRegistry(t, upstreamStore, test.middleware)
+			realm = upstream.URL
+
+			_, cache := newCache(t, upstream.URL, config.ProxyConfig{Username: "user", Password: "secret"})
+			for _, path := range []string{"/v2/app/manifests/latest", "/v2/app/blobs/" + digestOf("layer")} {
+				if resp, body := get(t, cache.URL+path, nil); resp.StatusCode != http.StatusOK {
+					t.Errorf("Expected %s with credentials, got %d %s", path, resp.StatusCode, body)
+				}
+			}
+
+			_, denied := newCache(t, upstream.URL, config.ProxyConfig{Username: "user", Password: "wrong"})
+			if resp, _ := get(t, denied.URL+"/v2/app/manifests/latest", nil); resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("Expected wrong credentials to fail, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestConcurrentPulls(t *testing.T) {
+	upstreamStore := newStore(t)
+	layer := strings.Repeat("layer", 64<<10)
+	push(t, upstreamStore, "app", "latest", layer)
+	upstream := newRegistry(t, upstreamStore, noMiddleware)
+	local, cache := newCache(t, upstream.URL, config.ProxyConfig{})
+
+	done := make(chan string)
+	for range 4 {
+		go func() {
+			resp, err := http.Get(cache.URL + "/v2/app/blobs/" + digestOf(layer))
+			if err != nil {
+				done <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			done <- string(body)
+		}()
+	}
+	for range 4 {
+		if body := <-done; body != layer {
+			t.Errorf("Expected blob of %d bytes, got %d bytes", len(layer), len(body))
+		}
+	}
+
+	if !eventually(t, func() bool {
+		blob, _, err := local.GetBlob(t.Context(), "app", digestOf(layer))
+		if err != nil {
+			return false
+		}
+		defer blob.Close()
+		content, _ := io.ReadAll(blob)
+		return bytes.Equal(content, []byte(layer))
+	}) {
+		t.Error("Expected blob pulled concurrently to be cached intact")
+	}
+}
@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned when pushing to a queue that holds as many jobs as it
+// may.
+var ErrFull = errors.New("queue is full")
+
+// Job is a unit of work in a queue, along with the state of its attempts.
+type Job struct {
+	ID        string          `json:"id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+	Attempts  int             `json:"attempts"`
+	NextAt    time.Time       `json:"next_at"`
+	LastError string          `json:"last_error,omitempty"`
+}
+
+// Handler processes a job. Returning an error retries the job later, unless
+// it has been attempted as often as it may.
+type Handler func(ctx context.Context, job Job) error
+
+type Options struct {
+	MaxJobs     int           // Most jobs held at once, unbounded if zero
+	MaxAttempts int           // Jobs are dropped after failing this many times, retried forever if zero
+	MinBackoff  time.Duration // Wait before the first retry, doubled for every further one
+	MaxBackoff  time.Duration // Longest wait between attempts
+}
+
+// Queue is a queue of jobs kept in a directory, one file per job, so that
+// jobs survive restarts. Jobs are handled in the order they were pushed,
+// failed jobs wait for their backoff to pass without holding up the others.
+type Queue struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	jobs     []*Job // Ordered by ID, which sorts by creation time
+	inFlight map[string]bool
+	wake     chan struct{}
+	seq      uint64
+}
+
+// Open opens the queue in dir, creating the directory if it does not exist
+// and loading the jobs left in it.
+func Open(dir string, opts Options) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory %s: %w", dir, err)
+	}
+
+	q := &Queue{
+		dir:      dir,
+		opts:     opts,
+		inFlight: map[string]bool{},
+		wake:     make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			// Left behind by a crash while a job was saved
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job %s: %w", entry.Name(), err)
+		}
+
+		var job Job
+		if err := json.Unmarshal(content, &job); err != nil || job.ID+".json" != entry.Name() {
+			// A job that cannot be read would block nothing but would never
+			// be handled either, so it is set aside
+			os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(dir, entry.Name()+".corrupt"))
+			continue
+		}
+		q.jobs = append(q.jobs, &job)
+	}
+
+	slices.SortFunc(q.jobs, func(a, b *Job) int { return strings.Compare(a.ID, b.ID) })
+	return q, nil
+}
+
+// Push adds a job with the payload, encoded as JSON, to the end of the queue.
+func (q *Queue) Push(payload any) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.opts.MaxJobs > 0 && len(q.jobs) >= q.opts.MaxJobs {
+		return ErrFull
+	}
+
+	now := time.Now()
+	q.seq++
+	job := &Job{
+		ID:        fmt.Sprintf("%020d-%06d", now.UnixNano(), q.seq%1000000),
+		Payload:   content,
+		CreatedAt: now,
+		NextAt:    now,
+	}
+	if err := q.save(job); err != nil {
+		return err
+	}
+
+	q.jobs = append(q.jobs, job)
+	q.notify()
+	return nil
+}
+
+// Jobs returns a copy of the jobs in the queue.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Run handles jobs with the given number of workers until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context, workers int, handle Handler) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, handle)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, handle Handler) {
+	for {
+		job, wait := q.next()
+		if job == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+			continue
+		}
+
+		err := handle(ctx, *job)
+		if ctx.Err() != nil {
+			// Jobs interrupted by shutting down are not counted as failed
+			q.release(job)
+			return
+		}
+		q.finish(job, err)
+	}
+}
+
+// next claims the first job that is due, or reports how long to wait for
+// one.
+func (q *Queue) next() (*Job, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wait := time.Minute
+	now := time.Now()
+	for _, job := range q.jobs {
+		if q.inFlight[job.ID] {
+			continue
+		}
+		if !job.NextAt.After(now) {
+			q.inFlight[job.ID] = true
+			// Let another worker pick up the next job, if there is one
+			q.notify()
+			return job, 0
+		}
+		wait = min(wait, job.NextAt.Sub(now))
+	}
+	return nil, wait
+}
+
+func (q *Queue) release(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, job.ID)
+}
+
+func (q *Queue) finish(job *Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, job.ID)
+
+	if err == nil || q.IsLastAttempt(*job) {
+		q.remove(job)
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	job.NextAt = time.Now().Add(q.backoff(job.Attempts))
+	if err := q.save(job); err != nil {
+		// The job is retried from memory, only a restart loses its attempts
+		return
+	}
+	q.notify()
+}
+
+// IsLastAttempt reports whether the job is dropped if the attempt being made
+// fails.
+func (q *Queue) IsLastAttempt(job Job) bool {
+	return q.opts.MaxAttempts > 0 && job.Attempts+1 >= q.opts.MaxAttempts
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	backoff := q.opts.MinBackoff
+	for range attempts - 1 {
+		if backoff >= q.opts.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	return min(backoff, q.opts.MaxBackoff)
+}
+
+func (q *Queue) remove(job *Job) {
+	os.Remove(q.path(job))
+	q.jobs = slices.DeleteFunc(q.jobs, func(j *Job) bool { return j.ID == job.ID })
+}
+
+// save writes a job by renaming a temporary file into place, so that a crash
+// never leaves a partially written job behind.
+func (q *Queue) save(job *Job) error {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(q.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), q.path(job))
+}
+
+func (q *Queue) path(job *Job) string {
+	return filepath.Join(q.dir, job.ID+".json")
+}
+
+// notify wakes a waiting worker.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,153 @@
+package queue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/queue"
+)
+
+func open(t *testing.T, dir string, opts queue.Options) *queue.Queue {
+	t.Helper()
+	q, err := queue.Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open queue: %v", err)
+	}
+	return q
+}
+
+// run handles jobs in the background until the test ends.
+func run(t *testing.T, q *queue.Queue, handle queue.Handler) {
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx, 2, handle)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	q := open(t, dir, queue.Options{})
+	for _, payload := range []string{"first", "second"} {
+		if err := q.Push(payload); err != nil {
+			t.Fatalf("Failed to push: %v", err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o644)
+
+	q = open(t, dir, queue.Options{})
+	jobs := q.Jobs()
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs after reopening, got %d", len(jobs))
+	}
+
+	var mu sync.Mutex
+	var handled []string
+	run(t, q, func(ctx context.Context, job queue.Job) error {
+		var payload string
+		json.Unmarshal(job.Payload, &payload)
+		mu.Lock()
+		handled = append(handled, payload)
+		mu.Unlock()
+		return nil
+	})
+
+	eventually(t, func() bool { return len(q.Jobs()) == 0 })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 2 {
+		t.Errorf("Expected both jobs to be handled, got %v", handled)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "broken.json.corrupt" {
+		t.Errorf("Expected only the corrupt job to be left, got %v", entries)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	q := open(t, t.TempDir(), queue.Options{MaxAttempts: 3, MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	if err := q.Push("job"); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	var mu sync.Mutex
+	var attempts []int
+	var lastAttempt []bool
+	run(t, q, func(ctx context.Context, job queue.Job) error {
+		mu.Lock()
+		attempts = append(attempts, job.Attempts)
+		lastAttempt = append(lastAttempt, q.IsLastAttempt(job))
+		mu.Unlock()
+		return errors.New("destination is down")
+	})
+
+	eventually(t, func() bool { return len(q.Jobs()) == 0 })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 || attempts[0] != 0 || attempts[2] != 2 {
+		t.Errorf("Expected 3 attempts, got %v", attempts)
+	}
+	if lastAttempt[0] || !lastAttempt[2] {
+		t.Errorf("Expected only the third attempt to be the last, got %v", lastAttempt)
+	}
+}
+
+func TestBackoffIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir, queue.Options{MinBackoff: time.Hour, MaxBackoff: time.Hour})
+	q.Push("job")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx, 1, func(ctx context.Context, job queue.Job) error {
+			return errors.New("destination is down")
+		})
+		close(done)
+	}()
+	eventually(t, func() bool { return q.Jobs()[0].Attempts == 1 })
+	cancel()
+	<-done
+
+	jobs := open(t, dir, queue.Options{}).Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("Expected the job to be kept, got %d jobs", len(jobs))
+	}
+	if jobs[0].Attempts != 1 || jobs[0].LastError != "destination is down" || time.Until(jobs[0].NextAt) < 59*time.Minute {
+		t.Errorf("Expected the failed attempt to be saved, got %+v", jobs[0])
+	}
+}
+
+func TestFull(t *testing.T) {
+	q := open(t, t.TempDir(), queue.Options{MaxJobs: 1})
+	if err := q.Push("first"); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+	if err := q.Push("second"); !errors.Is(err, queue.ErrFull) {
+		t.Errorf("Expected ErrFull, got %v", err)
+	}
+}
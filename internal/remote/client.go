@@ -0,0 +1,221 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestTypes are the manifest media types accepted from remote registries.
+var ManifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// Client talks to a remote registry. It answers authentication challenges
+// the way docker does: with the configured credentials for basic auth, or by
+// fetching a token for the repository from the realm of a bearer challenge.
+type Client struct {
+	endpoint *url.URL
+	username string
+	password string
+	http     *http.Client
+
+	mu     sync.Mutex
+	basic  bool
+	tokens map[string]token
+}
+
+type token struct {
+	value   string
+	expires time.Time
+}
+
+func NewClient(endpoint *url.URL, username, password string) *Client {
+	return &Client{
+		endpoint: endpoint,
+		username: username,
+		password: password,
+		http:     &http.Client{},
+		tokens:   map[string]token{},
+	}
+}
+
+// URL returns the URL of a path of a repository, such as "manifests/latest".
+func (c *Client) URL(name, path string) string {
+	return c.endpoint.JoinPath("v2", name, path).String()
+}
+
+// Resolve returns the URL a Location header of the remote points to.
+func (c *Client) Resolve(location string) (*url.URL, error) {
+	u, err := c.endpoint.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location %q: %w", location, err)
+	}
+	return u, nil
+}
+
+// Do sends a request concerning a repository, authenticating with the remote
+// if it asks to, for pushing to the repository if push is set. A request is
+// sent again after a challenge only if its body can be replayed, so pushes
+// of blobs are best preceded by a request without one.
+func (c *Client) Do(req *http.Request, name string, push bool) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:pull", name)
+	if push {
+		scope += ",push"
+	}
+
+	c.authorize(req, scope)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(req, challenge, scope); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(retry, scope)
+	return c.http.Do(retry)
+}
+
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.tokens[scope]; ok && time.Now().Before(t.expires) {
+		req.Header.Set("Authorization", "Bearer "+t.value)
+	} else if c.basic {
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+func (c *Client) authenticate(req *http.Request, challenge, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("remote requires credentials")
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+		t, err := c.fetchToken(req, params, scope)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[scope] = t
+		c.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+}
+
+func (c *Client) fetchToken(r *http.Request, params map[string]string, scope string) (token, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return token{}, fmt.Errorf("invalid token realm: %q", params["realm"])
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return token{}, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return token{}, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token{}, fmt.Errorf("failed to fetch token: %s", resp.Status)
+	}
+
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&response); err != nil {
+		return token{}, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	value := response.Token
+	if value == "" {
+		value = response.AccessToken
+	}
+	if value == "" {
+		return token{}, fmt.Errorf("token response holds no token")
+	}
+
+	// Tokens without an expiry are valid for at least 60 seconds
+	expiresIn := max(response.ExpiresIn, 60)
+	// Renew a little early, so a token does not expire in flight
+	return token{value: value, expires: time.Now().Add(time.Duration(expiresIn)*time.Second - 10*time.Second)}, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its lowercase scheme
+// and parameters, such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values may hold commas, such as a scope with several actions
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+	}
+
+	return strings.ToLower(scheme), params
+}
@@ -0,0 +1,226 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dvjn/sorcerer/internal/remote"
+	"github.com/dvjn/sorcerer/internal/store"
+)
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Blobs     []descriptor `json:"blobs"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// copier copies a manifest of a repository to a destination registry. Blobs
+// and the manifests of an index are copied before the manifest referencing
+// them, the way a client pushes, and referrers after it.
+type copier struct {
+	store  store.Store
+	client *remote.Client
+	name   string
+	copied map[string]bool
+}
+
+func (c *copier) copyManifest(ctx context.Context, reference string) error {
+	if c.copied[reference] {
+		return nil
+	}
+	c.copied[reference] = true
+
+	content, digest, err := c.store.GetManifest(ctx, c.name, reference)
+	if err != nil {
+		return err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", digest, err)
+	}
+
+	var blobs []descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	blobs = append(blobs, m.Layers...)
+	blobs = append(blobs, m.Blobs...)
+	for _, blob := range blobs {
+		if err := c.copyBlob(ctx, blob.Digest); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range m.Manifests {
+		if err := c.copyManifest(ctx, child.Digest); err != nil {
+			return err
+		}
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = "application/vnd.oci.image.manifest.v1+json"
+		if m.Manifests != nil {
+			mediaType = "application/vnd.oci.image.index.v1+json"
+		}
+	}
+
+	if err := c.putManifest(ctx, reference, mediaType, content); err != nil {
+		return err
+	}
+	c.copied[digest] = true
+
+	return c.copyReferrers(ctx, digest)
+}
+
+func (c *copier) copyReferrers(ctx context.Context, digest string) error {
+	content, err := c.store.GetReferrers(ctx, c.name, digest, "")
+	if err != nil {
+		return err
+	}
+
+	var index manifest
+	if err := json.Unmarshal(content, &index); err != nil {
+		return fmt.Errorf("failed to parse referrers of %s: %w", digest, err)
+	}
+
+	for _, referrer := range index.Manifests {
+		if err := c.copyManifest(ctx, referrer.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) putManifest(ctx context.Context, reference, mediaType string, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.client.URL(c.name, "manifests/"+reference), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := c.client.Do(req, c.name, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return expectStatus(resp, http.StatusCreated, "push manifest "+reference)
+}
+
+// hasManifest reports whether the destination has a manifest.
+func (c *copier) hasManifest(ctx context.Context, reference string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.client.URL(c.name, "manifests/"+reference), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", strings.Join(remote.ManifestTypes, ", "))
+
+	resp, err := c.client.Do(req, c.name, true)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return true, expectStatus(resp, http.StatusOK, "check manifest "+reference)
+}
+
+// copyBlob pushes a blob the destination does not have yet in a single
+// request, after opening an upload for it.
+func (c *copier) copyBlob(ctx context.Context, digest string) error {
+	if c.copied[digest] {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.client.URL(c.name, "blobs/"+digest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req, c.name, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		c.copied[digest] = true
+		return nil
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.client.URL(c.name, "blobs/uploads/"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = c.client.Do(req, c.name, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusAccepted, "start upload of "+digest); err != nil {
+		return err
+	}
+
+	u, err := c.client.Resolve(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+
+	blob, size, err := c.store.GetBlob(ctx, c.name, digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var body io.Reader = blob
+	if size == 0 {
+		body = http.NoBody
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = c.client.Do(req, c.name, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := expectStatus(resp, http.StatusCreated, "upload "+digest); err != nil {
+		return err
+	}
+	c.copied[digest] = true
+	return nil
+}
+
+// expectStatus fails with the error the destination responded with, if the
+// response does not have the status expected.
+func expectStatus(resp *http.Response, status int, action string) error {
+	if resp.StatusCode == status {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("failed to %s: %s %s", action, resp.Status, bytes.TrimSpace(body))
+}
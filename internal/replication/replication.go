@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/metrics"
+	"github.com/dvjn/sorcerer/internal/queue"
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/rs/zerolog"
+)
+
+var (
+	replications       = metrics.NewCounter("sorcerer_replications_total", "Number of manifests replicated to destination registries.")
+	replicationRetries = metrics.NewCounter("sorcerer_replication_retries_total", "Number of failed replication attempts that are retried.")
+	replicationsFailed = metrics.NewCounter("sorcerer_replications_failed_total", "Number of replications dropped after failing too often.")
+)
+
+// Replicator pushes manifests to destination registries after they are pushed
+// to sorcerer, along with their blobs and referrers. Replications are queued
+// on disk and retried with backoff until they succeed or have failed as often
+// as they may.
+type Replicator struct {
+	store   store.Store
+	rules   []*Rule
+	queue   *queue.Queue
+	workers int
+	admins  []string
+	logger  *zerolog.Logger
+
+	mu     sync.Mutex
+	status map[string]*ruleStatus
+}
+
+// task is a replication waiting in the queue. Tags are resolved when the
+// task runs, so a retried task never moves a tag back to an older manifest.
+type task struct {
+	Rule       string `json:"rule"`
+	Repository string `json:"repository"`
+	Reference  string `json:"reference"`
+	Subject    string `json:"subject,omitempty"`
+}
+
+// errSkipped is returned for referrers whose subject the destination does
+// not have. They are copied along with their subject if it is replicated.
+var errSkipped = errors.New("subject is not replicated")
+
+func New(s store.Store, c *config.ReplicationConfig, logger *zerolog.Logger) (*Replicator, error) {
+	rules, err := loadRules(c)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := queue.Open(c.QueuePath, queue.Options{
+		MaxAttempts: c.MaxAttempts,
+		MinBackoff:  time.Second,
+		MaxBackoff:  c.MaxBackoff,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var admins []string
+	for admin := range strings.SplitSeq(c.Admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+
+	r := &Replicator{
+		store:   s,
+		rules:   rules,
+		queue:   q,
+		workers: c.Workers,
+		admins:  admins,
+		logger:  logger,
+		status:  map[string]*ruleStatus{},
+	}
+	for _, rule := range rules {
+		r.status[rule.Name] = &ruleStatus{}
+	}
+	return r, nil
+}
+
+// Notify queues replications of a pushed manifest for every rule it matches.
+// Tags are replicated along with the manifests they reference, so manifests
+// pushed by digest are only replicated on their own if they are referrers.
+func (r *Replicator) Notify(event distribution.Event) {
+	if event.Action != distribution.ActionManifestPush {
+		return
+	}
+
+	reference := event.Tag
+	if reference == "" {
+		if event.Subject == "" {
+			return
+		}
+		reference = event.Digest
+	}
+
+	for _, rule := range r.rules {
+		if !rule.matchesRepository(event.Repository) || (event.Tag != "" && !rule.matchesTag(event.Tag)) {
+			continue
+		}
+
+		t := task{Rule: rule.Name, Repository: event.Repository, Reference: reference}
+		if event.Tag == "" {
+			t.Subject = event.Subject
+		}
+		if err := r.queue.Push(t); err != nil {
+			r.logger.Error().Err(err).Str("rule", rule.Name).Str("repository", event.Repository).Str("reference", reference).Msg("failed to queue replication")
+		}
+	}
+}
+
+// Run replicates queued manifests until ctx is cancelled.
+func (r *Replicator) Run(ctx context.Context) {
+	r.queue.Run(ctx, r.workers, r.handle)
+}
+
+func (r *Replicator) handle(ctx context.Context, job queue.Job) error {
+	var t task
+	if err := json.Unmarshal(job.Payload, &t); err != nil {
+		r.logger.Error().Err(err).Str("job", job.ID).Msg("dropping unreadable replication")
+		return nil
+	}
+
+	rule := r.rule(t.Rule)
+	if rule == nil {
+		r.logger.Warn().Str("rule", t.Rule).Str("repository", t.Repository).Msg("dropping replication of removed rule")
+		return nil
+	}
+
+	logger := r.logger.With().Str("rule", rule.Name).Str("repository", t.Repository).Str("reference", t.Reference).Int("attempt", job.Attempts+1).Logger()
+
+	err := r.replicate(ctx, rule, t)
+	if errors.Is(err, model.ErrManifestUnknown) {
+		logger.Info().Msg("manifest is gone, skipping replication")
+		return nil
+	}
+	if errors.Is(err, errSkipped) {
+		logger.Debug().Msg("subject of referrer is not replicated, skipping replication")
+		return nil
+	}
+	if err != nil && ctx.Err() == nil {
+		r.failed(rule, err, r.queue.IsLastAttempt(job))
+		if r.queue.IsLastAttempt(job) {
+			logger.Error().Err(err).Msg("replication failed, giving up")
+		} else {
+			logger.Warn().Err(err).Msg("replication failed, retrying")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	r.succeeded(rule)
+	logger.Info().Str("destination", rule.Destination).Msg("replicated manifest")
+	return nil
+}
+
+func (r *Replicator) rule(name string) *Rule {
+	for _, rule := range r.rules {
+		if rule.Name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) replicate(ctx context.Context, rule *Rule, t task) error {
+	c := &copier{store: r.store, client: rule.client, name: t.Repository, copied: map[string]bool{}}
+
+	if t.Subject != "" {
+		exists, err := c.hasManifest(ctx, t.Subject)
+		if err != nil {
+			return fmt.Errorf("failed to replicate to %s: %w", rule.Destination, err)
+		}
+		if !exists {
+			return errSkipped
+		}
+	}
+
+	if err := c.copyManifest(ctx, t.Reference); err != nil {
+		return fmt.Errorf("failed to replicate to %s: %w", rule.Destination, err)
+	}
+	return nil
+}
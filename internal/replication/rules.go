@@ -0,0 +1,82 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/remote"
+)
+
+// Rule replicates tags of the repositories it matches to a destination
+// registry. Repository is a glob in which "*" does not match across slashes
+// and "**" matches any number of components, and Tag a regular expression
+// that must match the whole tag. An empty tag pattern matches every tag.
+type Rule struct {
+	Name        string `json:"name"`
+	Repository  string `json:"repository"`
+	Tag         string `json:"tag"`
+	Destination string `json:"destination"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+
+	tag    *regexp.Regexp
+	client *remote.Client
+}
+
+// loadRules reads the rules from the configuration, inline or from a file.
+func loadRules(c *config.ReplicationConfig) ([]*Rule, error) {
+	content := []byte(c.Rules)
+	if c.RulesFile != "" {
+		var err error
+		if content, err = os.ReadFile(c.RulesFile); err != nil {
+			return nil, fmt.Errorf("failed to read replication rules: %w", err)
+		}
+	}
+
+	var rules []*Rule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse replication rules: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("replication rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("replication rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := access.ValidateRepositoryGlob(rule.Repository); err != nil {
+			return nil, fmt.Errorf("replication rule %s has an invalid repository glob: %q", rule.Name, rule.Repository)
+		}
+
+		tag, err := regexp.Compile("^(?:" + rule.Tag + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("replication rule %s has an invalid tag pattern: %w", rule.Name, err)
+		}
+		rule.tag = tag
+
+		destination, err := url.Parse(rule.Destination)
+		if err != nil || (destination.Scheme != "http" && destination.Scheme != "https") || destination.Host == "" {
+			return nil, fmt.Errorf("replication rule %s has an invalid destination: %q", rule.Name, rule.Destination)
+		}
+		rule.client = remote.NewClient(destination, rule.Username, rule.Password)
+	}
+
+	return rules, nil
+}
+
+func (r *Rule) matchesRepository(name string) bool {
+	return access.MatchRepository(r.Repository, name)
+}
+
+func (r *Rule) matchesTag(tag string) bool {
+	return r.Tag == "" || r.tag.MatchString(tag)
+}
@@ -0,0 +1,118 @@
+package replication
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/go-chi/chi/v5"
+)
+
+// ruleStatus counts the outcomes of replications of a rule since startup.
+type ruleStatus struct {
+	replicated  int64
+	failed      int64
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// RuleStatus is the state of replication to the destination of a rule.
+// Failed counts replications given up on, retries only show in LastError.
+type RuleStatus struct {
+	Name        string     `json:"name"`
+	Destination string     `json:"destination"`
+	Pending     int        `json:"pending"`
+	Replicated  int64      `json:"replicated"`
+	Failed      int64      `json:"failed"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (r *Replicator) succeeded(rule *Rule) {
+	replications.Inc()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status[rule.Name]
+	status.replicated++
+	status.lastSuccess = time.Now()
+}
+
+func (r *Replicator) failed(rule *Rule, err error, final bool) {
+	if final {
+		replicationsFailed.Inc()
+	} else {
+		replicationRetries.Inc()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status[rule.Name]
+	if final {
+		status.failed++
+	}
+	status.lastError = err.Error()
+	status.lastErrorAt = time.Now()
+}
+
+// Status reports the state of every rule, in the order they are configured.
+func (r *Replicator) Status() []RuleStatus {
+	pending := map[string]int{}
+	for _, job := range r.queue.Jobs() {
+		var t task
+		if json.Unmarshal(job.Payload, &t) == nil {
+			pending[t.Rule]++
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]RuleStatus, len(r.rules))
+	for i, rule := range r.rules {
+		status := r.status[rule.Name]
+		statuses[i] = RuleStatus{
+			Name:        rule.Name,
+			Destination: rule.Destination,
+			Pending:     pending[rule.Name],
+			Replicated:  status.replicated,
+			Failed:      status.failed,
+			LastError:   status.lastError,
+		}
+		if lastSuccess := status.lastSuccess; !lastSuccess.IsZero() {
+			statuses[i].LastSuccess = &lastSuccess
+		}
+		if lastErrorAt := status.lastErrorAt; !lastErrorAt.IsZero() {
+			statuses[i].LastErrorAt = &lastErrorAt
+		}
+	}
+	return statuses
+}
+
+// Router serves the status of replication as JSON. The status reveals the
+// destinations of rules and the errors they returned, so only admins may
+// read it.
+func (r *Replicator) Router() *chi.Mux {
+	router := chi.NewRouter()
+	router.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		if user, _ := access.UserFromContext(req.Context()); user.Name == "" || !slices.Contains(r.admins, user.Name) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{
+				"errors": []map[string]string{{"code": "DENIED", "message": "Only admins may read the state of replication"}},
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Rules []RuleStatus `json:"rules"`
+		}{r.Status()})
+	})
+	return router
+}
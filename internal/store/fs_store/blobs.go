@@ -1,25 +1,91 @@
 package fs_store
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
 )
 
-func (s *FS) blobDir(name string) string {
-	return filepath.Join(s.root, blobsBaseDir, name)
+// Blobs are stored once in a content addressable pool shared by all
+// repositories, at blobs/<algorithm>/<first two characters>/<encoded>. A
+// repository has access to a blob if it holds a link to it under
+// repositories/<name>/_links/<digest>.
+
+func (s *FS) poolPath(digest godigest.Digest) string {
+	encoded := digest.Encoded()
+	return filepath.Join(s.root, blobsBaseDir, digest.Algorithm().String(), encoded[:2], encoded)
 }
 
-func (s *FS) blobPath(name, digest string) string {
-	return filepath.Join(s.blobDir(name), digest)
+func (s *FS) linkDir(name string) string {
+	return filepath.Join(s.repositoryDir(name), linksDir)
 }
 
-func (s *FS) HasBlob(name, digest string) (bool, int64, error) {
-	path := s.blobPath(name, digest)
+func (s *FS) linkPath(name string, digest godigest.Digest) string {
+	return filepath.Join(s.linkDir(name), digest.String())
+}
+
+// linkedBlob resolves the pool path of a blob linked into the repository.
+func (s *FS) linkedBlob(name, digest string) (string, os.FileInfo, error) {
+	parsed, err := godigest.Parse(digest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := os.Stat(s.linkPath(name, parsed)); err != nil {
+		return "", nil, err
+	}
+
+	path := s.poolPath(parsed)
 	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return path, info, nil
+}
+
+// link makes a blob in the pool available to the repository. The pool file
+// is touched so that a concurrent sweep of the pool treats it as recent.
+func (s *FS) link(name string, digest godigest.Digest) error {
+	now := time.Now()
+	if err := os.Chtimes(s.poolPath(digest), now, now); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.linkDir(name), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.linkPath(name, digest), []byte(digest.String()), 0o644)
+}
+
+// addToPool moves a verified file into the pool and links it into the
+// repository. If the pool already holds the blob, the file is discarded.
+func (s *FS) addToPool(name string, digest godigest.Digest, path string) error {
+	poolPath := s.poolPath(digest)
+	if err := os.MkdirAll(filepath.Dir(poolPath), 0o755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(poolPath); err == nil {
+		os.Remove(path)
+	} else if err := os.Rename(path, poolPath); err != nil {
+		return err
+	}
+
+	return s.link(name, digest)
+}
+
+func (s *FS) HasBlob(ctx context.Context, name, digest string) (bool, int64, error) {
+	_, info, err := s.linkedBlob(name, digest)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, 0, nil
@@ -29,12 +95,19 @@ func (s *FS) HasBlob(name, digest string) (bool, int64, error) {
 	return true, info.Size(), nil
 }
 
-func (s *FS) GetBlob(name, digest string) (io.ReadCloser, int64, error) {
-	path := s.blobPath(name, digest)
+func (s *FS) GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error) {
+	path, _, err := s.linkedBlob(name, digest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, model.ErrBlobUnknown
+		}
+		return nil, 0, err
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, 0, fmt.Errorf("blob not found")
+			return nil, 0, model.ErrBlobUnknown
 		}
 		return nil, 0, err
 	}
@@ -48,15 +121,13 @@ func (s *FS) GetBlob(name, digest string) (io.ReadCloser, int64, error) {
 	return file, info.Size(), nil
 }
 
-func (s *FS) PutBlob(name, digest string, content io.Reader) error {
-	dir := s.blobDir(name)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+func (s *FS) PutBlob(ctx context.Context, name, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
 		return err
 	}
 
-	path := s.blobPath(name, digest)
-
-	tempFile, err := os.CreateTemp(dir, "temp-blob-*")
+	tempFile, err := os.CreateTemp(filepath.Join(s.root, blobsBaseDir), "temp-blob-*")
 	if err != nil {
 		return err
 	}
@@ -67,74 +138,159 @@ func (s *FS) PutBlob(name, digest string, content io.Reader) error {
 		os.Remove(tempPath)
 	}()
 
-	hasher := sha256.New()
-	writer := io.MultiWriter(tempFile, hasher)
+	digester := expected.Algorithm().Digester()
+	writer := io.MultiWriter(tempFile, digester.Hash())
 
-	if _, err := io.Copy(writer, content); err != nil {
+	if _, err := io.Copy(writer, model.ContextReader(ctx, content)); err != nil {
 		return err
 	}
 
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-	if actualDigest != digest {
-		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actualDigest)
+	if actualDigest := digester.Digest(); actualDigest != expected {
+		return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
 	}
 
 	if err := tempFile.Close(); err != nil {
 		return err
 	}
 
-	if err := os.Rename(tempPath, path); err != nil {
-		return err
+	return s.addToPool(name, expected, tempPath)
+}
+
+func (s *FS) ListBlobs(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	links, err := listContent(s.linkDir(name))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	blobs := make([]model.ContentInfo, 0, len(links))
+	for _, link := range links {
+		_, info, err := s.linkedBlob(name, link.Digest)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		blobs = append(blobs, model.ContentInfo{
+			Digest:  link.Digest,
+			Size:    info.Size(),
+			ModTime: link.ModTime,
+		})
+	}
+
+	return blobs, nil
 }
 
-func (s *FS) DeleteBlob(name, digest string) error {
-	path := s.blobPath(name, digest)
-	if err := os.Remove(path); err != nil {
+// DeleteBlob removes the blob from the repository. The content stays in the
+// pool until garbage collection finds it unreferenced by any repository.
+func (s *FS) DeleteBlob(ctx context.Context, name, digest string) error {
+	parsed, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.linkPath(name, parsed)); err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("blob not found")
+			return model.ErrBlobUnknown
 		}
 		return err
 	}
 	return nil
 }
 
-func (s *FS) MountBlob(fromName, toName, digest string) error {
-	sourcePath := s.blobPath(fromName, digest)
-	if _, err := os.Stat(sourcePath); err != nil {
+// MountBlob links a blob of one repository into another, without copying
+// any content.
+func (s *FS) MountBlob(ctx context.Context, fromName, toName, digest string) error {
+	if _, _, err := s.linkedBlob(fromName, digest); err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("source blob not found")
+			return fmt.Errorf("source %w", model.ErrBlobUnknown)
 		}
 		return err
 	}
 
-	destDir := s.blobDir(toName)
-	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return err
-	}
+	return s.link(toName, godigest.Digest(digest))
+}
 
-	destPath := s.blobPath(toName, digest)
+// PurgeBlobPool removes blobs from the pool that are not linked into any
+// repository and have not been added or linked since the given time. With
+// dryRun set, the blobs are only reported.
+func (s *FS) PurgeBlobPool(ctx context.Context, before time.Time, dryRun bool) ([]model.ContentInfo, error) {
+	linked := map[string]bool{}
+	err := s.walkRepositories(linksDir, func(name, path string, entry fs.DirEntry) error {
+		if isDigest(entry.Name()) {
+			linked[entry.Name()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	if err := os.Link(sourcePath, destPath); err != nil {
-		sourceFile, err := os.Open(sourcePath)
+	purged := []model.ContentInfo{}
+	poolRoot := filepath.Join(s.root, blobsBaseDir)
+	err = filepath.WalkDir(poolRoot, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		defer sourceFile.Close()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
 
-		destFile, err := os.Create(destPath)
+		// Anything that is not at <algorithm>/<prefix>/<encoded> is a
+		// temporary file of a blob being written
+		rel, err := filepath.Rel(poolRoot, path)
 		if err != nil {
 			return err
 		}
-		defer destFile.Close()
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+
+		digest := godigest.NewDigestFromEncoded(godigest.Algorithm(parts[0]), parts[2])
+		if linked[digest.String()] {
+			return nil
+		}
 
-		if _, err := io.Copy(destFile, sourceFile); err != nil {
-			os.Remove(destPath)
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
 			return err
 		}
+
+		if !info.ModTime().Before(before) {
+			return nil
+		}
+
+		if !dryRun {
+			// The blob may have been linked since the links were listed
+			if info, err := os.Stat(path); err != nil || !info.ModTime().Before(before) {
+				return nil
+			}
+
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		purged = append(purged, model.ContentInfo{
+			Digest:  digest.String(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return purged, err
 	}
 
-	return nil
+	return purged, nil
 }
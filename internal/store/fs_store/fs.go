@@ -1,9 +1,13 @@
 package fs_store
 
 import (
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/dvjn/sorcerer/internal/config"
@@ -11,34 +15,151 @@ import (
 )
 
 type FS struct {
-	root      string
-	uploadsMu sync.RWMutex
-	uploads   map[string]*model.UploadInfo
+	root            string
+	verifyManifests bool
+	uploadsMu       sync.RWMutex
+	uploads         map[string]*model.UploadInfo
+	referrersMu     sync.Mutex // Guards updates to the referrers indexes
 }
 
 const (
-	blobsBaseDir     = "blobs"
-	manifestsBaseDir = "manifests"
-	uploadsBaseDir   = "uploads"
-	tagsBaseDir      = "tags"
-	referrersBaseDir = "referrers"
+	blobsBaseDir        = "blobs"
+	repositoriesBaseDir = "repositories"
+)
+
+// The data of a repository lives in directories under
+// repositories/<name>/ that start with an underscore. Components of
+// repository names cannot, so they never collide with nested repositories.
+const (
+	linksDir     = "_links"
+	manifestsDir = "_manifests"
+	uploadsDir   = "_uploads"
+	tagsDir      = "_tags"
+	referrersDir = "_referrers"
 )
 
 func New(c *config.StoreConfig) (*FS, error) {
 	for _, dir := range []string{
 		filepath.Join(c.Path, blobsBaseDir),
-		filepath.Join(c.Path, manifestsBaseDir),
-		filepath.Join(c.Path, uploadsBaseDir),
-		filepath.Join(c.Path, tagsBaseDir),
-		filepath.Join(c.Path, referrersBaseDir),
+		filepath.Join(c.Path, repositoriesBaseDir),
 	} {
 		if err := os.MkdirAll(dir, 0o755); err != nil {
 			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
-	return &FS{
-		root:    c.Path,
-		uploads: make(map[string]*model.UploadInfo),
-	}, nil
+	s := &FS{
+		root:            c.Path,
+		verifyManifests: c.VerifyManifests,
+		uploads:         make(map[string]*model.UploadInfo),
+	}
+
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate data directory: %w", err)
+	}
+
+	if err := s.loadUploads(); err != nil {
+		return nil, fmt.Errorf("failed to load uploads: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *FS) repositoryDir(name string) string {
+	return filepath.Join(s.root, repositoriesBaseDir, name)
+}
+
+// walkRepositories calls fn for every file in a data directory of any
+// repository, with the name of the repository. Directories of other kinds of
+// data are not walked into.
+func (s *FS) walkRepositories(dataDir string, fn func(name, path string, entry fs.DirEntry) error) error {
+	root := filepath.Join(s.root, repositoriesBaseDir)
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), "_") && entry.Name() != dataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		if filepath.Base(dir) != dataDir {
+			return nil
+		}
+		name, err := filepath.Rel(root, filepath.Dir(dir))
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(name), path, entry)
+	})
+}
+
+// isDigest reports whether a manifest reference is a digest. Tags cannot
+// contain colons, so anything that does is treated as a digest.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// writeFile writes a file by renaming a temporary file into place, so that
+// concurrent readers never see it partially written. The temporary file is
+// hidden, which keeps it out of listings.
+func writeFile(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0o644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// listContent returns the content addressed files stored directly in dir.
+// Temporary files that are not named by a digest are skipped.
+func listContent(dir string) ([]model.ContentInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []model.ContentInfo{}, nil
+		}
+		return nil, err
+	}
+
+	contents := make([]model.ContentInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.Contains(entry.Name(), ":") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		contents = append(contents, model.ContentInfo{
+			Digest:  entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return contents, nil
 }
@@ -0,0 +1,20 @@
+package fs_store_test
+
+import (
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store"
+	fs_store "github.com/dvjn/sorcerer/internal/store/fs_store"
+	"github.com/dvjn/sorcerer/internal/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := fs_store.New(&config.StoreConfig{Path: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		return s
+	})
+}
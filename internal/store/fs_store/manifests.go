@@ -1,29 +1,26 @@
 package fs_store
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog/log"
 )
 
 func (s *FS) manifestDir(name string) string {
-	return filepath.Join(s.root, manifestsBaseDir, name)
+	return filepath.Join(s.repositoryDir(name), manifestsDir)
 }
 
 func (s *FS) manifestPath(name, reference string) string {
 	return filepath.Join(s.manifestDir(name), reference)
 }
 
-func (s *FS) HasManifest(name, reference string) (bool, int64, string, error) {
-	isDigest := strings.HasPrefix(reference, "sha256:")
-
-	if isDigest {
+func (s *FS) HasManifest(ctx context.Context, name, reference string) (bool, int64, string, error) {
+	if isDigest(reference) {
 		path := s.manifestPath(name, reference)
 		info, err := os.Stat(path)
 		if err != nil {
@@ -56,93 +53,58 @@ func (s *FS) HasManifest(name, reference string) (bool, int64, string, error) {
 	}
 }
 
-// GetManifest retrieves a manifest
-func (s *FS) GetManifest(name, reference string) ([]byte, string, error) {
-	if strings.HasPrefix(reference, "sha256:") {
-		manifestDir := s.manifestDir(name)
-
-		if err := os.MkdirAll(manifestDir, 0o755); err != nil {
-			return nil, "", err
-		}
-
-		var manifestPath string
-		var content []byte
-
-		err := filepath.Walk(manifestDir, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return nil
-			}
-
-			hasher := sha256.New()
-			hasher.Write(data)
-			digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-
-			if digest == reference {
-				manifestPath = path
-				content = data
-				return filepath.SkipAll
-			}
-
-			return nil
-		})
-		if err != nil {
+// GetManifest retrieves a manifest. Manifests are stored under their digest,
+// so both digests and tags resolve to a single file read.
+func (s *FS) GetManifest(ctx context.Context, name, reference string) ([]byte, string, error) {
+	digest := reference
+	if isDigest(reference) {
+		if err := godigest.Digest(reference).Validate(); err != nil {
 			return nil, "", err
 		}
-
-		if manifestPath == "" {
-			return nil, "", fmt.Errorf("manifest not found")
-		}
-
-		return content, reference, nil
-	}
-
-	// Try to resolve tag to manifest
-	tagPath := s.tagPath(name, reference)
-	digestBytes, err := os.ReadFile(tagPath)
-	if err == nil {
-		// Tag exists, resolve to manifest
-		digestStr := string(digestBytes)
-		manifestPath := s.manifestPath(name, digestStr)
-		content, err := os.ReadFile(manifestPath)
+	} else {
+		digestBytes, err := os.ReadFile(s.tagPath(name, reference))
 		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, "", model.ErrManifestUnknown
+			}
 			return nil, "", err
 		}
-		return content, digestStr, nil
+		digest = string(digestBytes)
 	}
 
-	// Try direct manifest path
-	manifestPath := s.manifestPath(name, reference)
-	content, err := os.ReadFile(manifestPath)
+	content, err := os.ReadFile(s.manifestPath(name, digest))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, "", fmt.Errorf("manifest not found")
+			return nil, "", model.ErrManifestUnknown
 		}
 		return nil, "", err
 	}
 
-	// Calculate digest
-	hasher := sha256.New()
-	hasher.Write(content)
-	digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+	if s.verifyManifests {
+		expected := godigest.Digest(digest)
+		if actualDigest := expected.Algorithm().FromBytes(content); actualDigest != expected {
+			return nil, "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", expected, actualDigest)
+		}
+	}
 
 	return content, digest, nil
 }
 
 // PutManifest stores a manifest
-func (s *FS) PutManifest(name, reference string, content []byte) (string, error) {
-	// Calculate digest
-	hasher := sha256.New()
-	hasher.Write(content)
-	digest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
+func (s *FS) PutManifest(ctx context.Context, name, reference string, content []byte) (string, error) {
+	// Calculate digest, with the algorithm of the reference if pushed by digest
+	digest := godigest.Canonical.FromBytes(content)
+	if isDigest(reference) {
+		expected, err := godigest.Parse(reference)
+		if err != nil {
+			return "", err
+		}
+
+		digest = expected.Algorithm().FromBytes(content)
+		if digest != expected {
+			return "", fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, digest)
+		}
+	}
 
 	// Create manifest directory
 	manifestDir := s.manifestDir(name)
@@ -151,62 +113,60 @@ func (s *FS) PutManifest(name, reference string, content []byte) (string, error)
 	}
 
 	// Store by digest
-	digestPath := s.manifestPath(name, digest)
-	if err := os.WriteFile(digestPath, content, 0o644); err != nil {
+	digestPath := s.manifestPath(name, digest.String())
+	if err := writeFile(digestPath, content); err != nil {
 		return "", err
 	}
 
 	// If reference is a tag, create/update tag
-	if !strings.HasPrefix(reference, "sha256:") {
+	if !isDigest(reference) {
 		tagDir := s.tagDir(name)
 		if err := os.MkdirAll(tagDir, 0o755); err != nil {
 			return "", err
 		}
 
 		tagPath := s.tagPath(name, reference)
-		if err := os.WriteFile(tagPath, []byte(digest), 0o644); err != nil {
+		if err := writeFile(tagPath, []byte(digest)); err != nil {
 			return "", err
 		}
 	}
 
-	return digest, nil
+	return digest.String(), nil
 }
 
-func (s *FS) DeleteManifest(name, reference string) error {
-	isDigest := strings.HasPrefix(reference, "sha256:")
+func (s *FS) ListManifests(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	return listContent(s.manifestDir(name))
+}
 
-	if isDigest {
+func (s *FS) DeleteManifest(ctx context.Context, name, reference string) error {
+	if isDigest(reference) {
 		path := s.manifestPath(name, reference)
 		if err := os.Remove(path); err != nil {
 			if os.IsNotExist(err) {
-				return fmt.Errorf("manifest not found")
+				return model.ErrManifestUnknown
 			}
 			return err
 		}
 
-		tagDir := s.tagDir(name)
-		err := filepath.Walk(tagDir, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return nil
-			}
+		entries, err := os.ReadDir(s.tagDir(name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("error cleaning up tags")
+		}
 
-			if info.IsDir() {
-				return nil
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
 			}
 
-			tagDigest, err := os.ReadFile(path)
+			tagPath := s.tagPath(name, entry.Name())
+			tagDigest, err := os.ReadFile(tagPath)
 			if err != nil {
-				return nil
+				continue
 			}
 
 			if string(tagDigest) == reference {
-				os.Remove(path)
+				os.Remove(tagPath)
 			}
-
-			return nil
-		})
-		if err != nil {
-			log.Warn().Err(err).Msg("error cleaning up tags")
 		}
 
 		return nil
@@ -215,7 +175,7 @@ func (s *FS) DeleteManifest(name, reference string) error {
 		_, err := os.ReadFile(tagPath)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return fmt.Errorf("tag not found")
+				return fmt.Errorf("%w: tag %s", model.ErrManifestUnknown, reference)
 			}
 			return err
 		}
@@ -0,0 +1,60 @@
+package fs_store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/config"
+)
+
+func newBenchmarkStore(b *testing.B, manifests int) (*FS, []string) {
+	b.Helper()
+
+	s, err := New(&config.StoreConfig{Path: b.TempDir()})
+	if err != nil {
+		b.Fatalf("Failed to create store: %v", err)
+	}
+
+	digests := make([]string, manifests)
+	for i := range manifests {
+		content := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","annotations":{"index":"%d"}}`, i)
+		sum := sha256.Sum256(content)
+		digests[i] = "sha256:" + hex.EncodeToString(sum[:])
+
+		if _, err := s.PutManifest(b.Context(), "bench/repo", digests[i], content); err != nil {
+			b.Fatalf("Failed to put manifest: %v", err)
+		}
+	}
+
+	if _, err := s.PutManifest(b.Context(), "bench/repo", "latest", fmt.Appendf(nil, `{"schemaVersion":2,"annotations":{"index":"%d"}}`, manifests)); err != nil {
+		b.Fatalf("Failed to put manifest: %v", err)
+	}
+
+	return s, digests
+}
+
+func BenchmarkGetManifestByDigest(b *testing.B) {
+	for _, manifests := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("manifests=%d", manifests), func(b *testing.B) {
+			s, digests := newBenchmarkStore(b, manifests)
+
+			for i := 0; b.Loop(); i++ {
+				if _, _, err := s.GetManifest(b.Context(), "bench/repo", digests[i%len(digests)]); err != nil {
+					b.Fatalf("Failed to get manifest: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetManifestByTag(b *testing.B) {
+	s, _ := newBenchmarkStore(b, 5000)
+
+	for b.Loop() {
+		if _, _, err := s.GetManifest(b.Context(), "bench/repo", "latest"); err != nil {
+			b.Fatalf("Failed to get manifest: %v", err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package fs_store
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+// layoutVersion is the version of the on-disk layout written by this store.
+//
+//  1. blobs stored per repository at blobs/<name>/<digest>
+//  2. blobs stored once at blobs/<algorithm>/<prefix>/<encoded>, linked into
+//     repositories at links/<name>/<digest>
+//  3. data of repositories stored under repositories/<name>/_<kind>/, so
+//     that it cannot collide with nested repositories like tags/<name>/<tag>
+//     did with tags/<name>/<nested>/
+//  4. referrers indexes are only cached unfiltered. Those of earlier versions
+//     may hold the result of a filtered request and are rebuilt
+const layoutVersion = 4
+
+// legacyDirs are the directories that held the data of repositories before
+// layout version 3, as <dir>/<name>/<file>, and their replacements.
+var legacyDirs = map[string]string{
+	"links":     linksDir,
+	"manifests": manifestsDir,
+	"uploads":   uploadsDir,
+	"tags":      tagsDir,
+	"referrers": referrersDir,
+}
+
+const layoutVersionFile = "layout-version"
+
+func (s *FS) readLayoutVersion() (int, error) {
+	content, err := os.ReadFile(filepath.Join(s.root, layoutVersionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid layout version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate brings the data directory up to the current layout version. The
+// version is only written once the migration has finished, so an
+// interrupted migration is picked up again on the next start.
+func (s *FS) migrate() error {
+	version, err := s.readLayoutVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > layoutVersion {
+		return fmt.Errorf("data directory has layout version %d, newer than supported version %d", version, layoutVersion)
+	}
+
+	if version < 2 {
+		if err := s.migrateBlobPool(); err != nil {
+			return fmt.Errorf("failed to migrate blobs to pool: %w", err)
+		}
+	}
+
+	if version < 3 {
+		if err := s.migrateRepositories(); err != nil {
+			return fmt.Errorf("failed to migrate repositories: %w", err)
+		}
+	}
+
+	if version < 4 {
+		if err := s.migrateReferrers(); err != nil {
+			return fmt.Errorf("failed to migrate referrers: %w", err)
+		}
+	}
+
+	if version == layoutVersion {
+		return nil
+	}
+
+	return os.WriteFile(filepath.Join(s.root, layoutVersionFile), []byte(strconv.Itoa(layoutVersion)), 0o644)
+}
+
+// migrateBlobPool moves blobs stored per repository into the shared pool,
+// linking each into the repository it was stored in.
+func (s *FS) migrateBlobPool() error {
+	blobsRoot := filepath.Join(s.root, blobsBaseDir)
+
+	type legacyBlob struct {
+		name   string
+		digest godigest.Digest
+		path   string
+	}
+
+	var blobs []legacyBlob
+	var dirs []string
+	err := filepath.WalkDir(blobsRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if path != blobsRoot {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(entry.Name(), "temp-blob-") {
+			return os.Remove(path)
+		}
+
+		// Pool entries are not named by a full digest, only blobs in the
+		// old layout are
+		if !isDigest(entry.Name()) {
+			return nil
+		}
+
+		digest, err := godigest.Parse(entry.Name())
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping blob with invalid digest")
+			return nil
+		}
+
+		name, err := filepath.Rel(blobsRoot, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		blobs = append(blobs, legacyBlob{name: filepath.ToSlash(name), digest: digest, path: path})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	log.Info().Int("blobs", len(blobs)).Msg("migrating blobs to pool")
+
+	for _, blob := range blobs {
+		if err := s.addToPool(blob.name, blob.digest, blob.path); err != nil {
+			return fmt.Errorf("failed to migrate blob %s of %s: %w", blob.digest, blob.name, err)
+		}
+	}
+
+	// Remove the repository directories left empty, deepest first
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err == nil && len(entries) == 0 {
+			os.Remove(dir)
+		}
+	}
+
+	log.Info().Int("blobs", len(blobs)).Msg("migrated blobs to pool")
+
+	return nil
+}
+
+// migrateRepositories moves the data of repositories from the directories of
+// each kind of data into the directories of the repositories.
+func (s *FS) migrateRepositories() error {
+	moved := 0
+	for legacy, dataDir := range legacyDirs {
+		legacyRoot := filepath.Join(s.root, legacy)
+		if _, err := os.Stat(legacyRoot); os.IsNotExist(err) {
+			continue
+		}
+
+		err := filepath.WalkDir(legacyRoot, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Hidden files are temporary files of interrupted writes
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				return nil
+			}
+
+			name, err := filepath.Rel(legacyRoot, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			if name == "." {
+				return nil
+			}
+
+			dir := filepath.Join(s.repositoryDir(filepath.ToSlash(name)), dataDir)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+			moved++
+			return os.Rename(path, filepath.Join(dir, entry.Name()))
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := os.RemoveAll(legacyRoot); err != nil {
+			return err
+		}
+	}
+
+	if moved > 0 {
+		log.Info().Int("files", moved).Msg("migrated repositories")
+	}
+
+	return nil
+}
+
+// migrateReferrers removes the cached referrers indexes of all repositories,
+// so that they are built again from the manifests when next read.
+func (s *FS) migrateReferrers() error {
+	var indexes []string
+	err := s.walkRepositories(referrersDir, func(name, path string, entry fs.DirEntry) error {
+		indexes = append(indexes, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range indexes {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(indexes) > 0 {
+		log.Info().Int("indexes", len(indexes)).Msg("removed cached referrers indexes")
+	}
+
+	return nil
+}
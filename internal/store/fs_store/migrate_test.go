@@ -0,0 +1,181 @@
+package fs_store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/config"
+)
+
+func TestMigrateBlobPool(t *testing.T) {
+	root := t.TempDir()
+
+	content := []byte("layer")
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	// Lay out the same blob in two repositories, the way it used to be stored
+	for _, name := range []string{"team/app", "other"} {
+		dir := filepath.Join(root, blobsBaseDir, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, digest), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, blobsBaseDir, "team/app", "temp-blob-123"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(&config.StoreConfig{Path: root})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	for _, name := range []string{"team/app", "other"} {
+		reader, size, err := s.GetBlob(t.Context(), name, digest)
+		if err != nil {
+			t.Fatalf("Failed to get migrated blob of %s: %v", name, err)
+		}
+		got, _ := io.ReadAll(reader)
+		reader.Close()
+		if size != int64(len(content)) || string(got) != string(content) {
+			t.Errorf("Unexpected content of migrated blob of %s: %q", name, got)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, blobsBaseDir, "team")); !os.IsNotExist(err) {
+		t.Errorf("Expected old repository directory to be removed, got %v", err)
+	}
+
+	version, err := s.readLayoutVersion()
+	if err != nil || version != layoutVersion {
+		t.Errorf("Expected layout version %d, got %d (%v)", layoutVersion, version, err)
+	}
+}
+
+func TestMigrateRepositories(t *testing.T) {
+	root := t.TempDir()
+
+	manifest := []byte(`{"schemaVersion":2}`)
+	manifestSum := sha256.Sum256(manifest)
+	manifestDigest := "sha256:" + hex.EncodeToString(manifestSum[:])
+	blob := []byte("layer")
+	blobSum := sha256.Sum256(blob)
+	blobDigest := "sha256:" + hex.EncodeToString(blobSum[:])
+	referrers := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+
+	// Lay out a repository the way it was stored in layout version 2
+	files := map[string][]byte{
+		layoutVersionFile: []byte("2"),
+		filepath.Join("manifests", "team/app", manifestDigest):                 manifest,
+		filepath.Join("tags", "team/app", "latest"):                            []byte(manifestDigest),
+		filepath.Join("tags", "team/app", ".tmp-123"):                          []byte("partial"),
+		filepath.Join("links", "team/app", blobDigest):                         []byte(blobDigest),
+		filepath.Join(blobsBaseDir, "sha256", blobDigest[7:9], blobDigest[7:]): blob,
+		filepath.Join("uploads", "team/app", "1a2b"):                           []byte("part"),
+		filepath.Join("referrers", "team/app", manifestDigest):                 referrers,
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(&config.StoreConfig{Path: root})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	if content, _, err := s.GetManifest(t.Context(), "team/app", "latest"); err != nil || string(content) != string(manifest) {
+		t.Errorf("Expected migrated tag to resolve, got %q (%v)", content, err)
+	}
+	if exists, _, err := s.HasBlob(t.Context(), "team/app", blobDigest); err != nil || !exists {
+		t.Errorf("Expected migrated link to resolve, got %v (%v)", exists, err)
+	}
+	if upload, err := s.GetUploadInfo(t.Context(), "team/app", "1a2b"); err != nil || upload.Offset != 4 {
+		t.Errorf("Expected migrated upload, got %+v (%v)", upload, err)
+	}
+	if content, err := s.GetReferrers(t.Context(), "team/app", manifestDigest, ""); err != nil || string(content) != string(referrers) {
+		t.Errorf("Expected migrated referrers, got %q (%v)", content, err)
+	}
+	if tags, err := s.ListTags(t.Context(), "team/app"); err != nil || len(tags) != 1 {
+		t.Errorf("Expected only the migrated tag, got %v (%v)", tags, err)
+	}
+
+	for legacy := range legacyDirs {
+		if _, err := os.Stat(filepath.Join(root, legacy)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", legacy, err)
+		}
+	}
+
+	version, err := s.readLayoutVersion()
+	if err != nil || version != layoutVersion {
+		t.Errorf("Expected layout version %d, got %d (%v)", layoutVersion, version, err)
+	}
+}
+
+func TestMigrateReferrers(t *testing.T) {
+	root := t.TempDir()
+	name := "team/app"
+
+	subject := `sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a`
+	referrer := func(artifactType string) ([]byte, string) {
+		manifest := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":%q,"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":2}}`, artifactType, subject, subject)
+		sum := sha256.Sum256(manifest)
+		return manifest, "sha256:" + hex.EncodeToString(sum[:])
+	}
+	signature, signatureDigest := referrer("application/example.signature")
+	sbom, sbomDigest := referrer("application/example.sbom")
+
+	// An index cached by a request filtered by artifact type
+	filtered := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/example.sbom","digest":%q,"size":%d}]}`, sbomDigest, len(sbom))
+
+	repository := filepath.Join(root, repositoriesBaseDir, name)
+	files := map[string][]byte{
+		filepath.Join(root, layoutVersionFile):                   []byte("3"),
+		filepath.Join(repository, manifestsDir, signatureDigest): signature,
+		filepath.Join(repository, manifestsDir, sbomDigest):      sbom,
+		filepath.Join(repository, referrersDir, subject):         filtered,
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(&config.StoreConfig{Path: root})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	// The rebuilt index is cached in full, even by a filtered request
+	for _, artifactType := range []string{"application/example.signature", "", "application/example.sbom"} {
+		content, err := s.GetReferrers(t.Context(), name, subject, artifactType)
+		if err != nil {
+			t.Fatalf("Failed to get referrers: %v", err)
+		}
+
+		want := 2
+		if artifactType != "" {
+			want = 1
+		}
+		if count := strings.Count(string(content), `"digest":"sha256:`); count != want {
+			t.Errorf("Expected %d referrers of type %q, got %s", want, artifactType, content)
+		}
+	}
+}
@@ -1,331 +1,166 @@
 package fs_store
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
-	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 
+	"github.com/dvjn/sorcerer/internal/store/model"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog/log"
 )
 
+// Referrers of a manifest are kept in an index at _referrers/<digest> in the
+// repository, which is updated as manifests with a subject are pushed and
+// deleted. An index that does not exist is built from the manifests of the
+// repository when it is first read.
+
 func (s *FS) referrerDir(name string) string {
-	return filepath.Join(s.root, referrersBaseDir, name)
+	return filepath.Join(s.repositoryDir(name), referrersDir)
 }
 
 func (s *FS) referrerPath(name, digest string) string {
 	return filepath.Join(s.referrerDir(name), digest)
 }
 
-func (s *FS) GetReferrers(name, digest string, artifactType string) ([]byte, error) {
-	referrerDir := s.referrerDir(name)
-	if err := os.MkdirAll(referrerDir, 0o755); err != nil {
-		return nil, err
-	}
-
-	referrerPath := s.referrerPath(name, digest)
-	content, err := os.ReadFile(referrerPath)
-
+// readReferrers returns the referrers index of the manifest, which is always
+// the full index, unfiltered.
+func (s *FS) readReferrers(name, digest string) (*image_v1.Index, error) {
+	content, err := os.ReadFile(s.referrerPath(name, digest))
 	if err != nil {
-		index := map[string]any{
-			"schemaVersion": 2,
-			"mediaType":     "application/vnd.oci.image.index.v1+json",
-			"manifests":     []any{},
+		if os.IsNotExist(err) {
+			return s.buildReferrers(name, digest)
 		}
+		return nil, err
+	}
 
-		manifestDir := s.manifestDir(name)
-		manifests := []any{}
-
-		err := filepath.Walk(manifestDir, func(path string, info fs.FileInfo, err error) error {
-			if err != nil {
-				return nil
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return nil
-			}
-
-			var manifest map[string]any
-			if err := json.Unmarshal(data, &manifest); err != nil {
-				return nil
-			}
-
-			subject, ok := manifest["subject"].(map[string]any)
-			if !ok {
-				return nil
-			}
-
-			subjectDigest, ok := subject["digest"].(string)
-			if !ok || subjectDigest != digest {
-				return nil
-			}
-
-			hasher := sha256.New()
-			hasher.Write(data)
-			manifestDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-
-			mediaType, _ := manifest["mediaType"].(string)
-			if mediaType == "" {
-				mediaType = "application/vnd.oci.image.manifest.v1+json"
-			}
-
-			artifactType := ""
-			if m, ok := manifest["artifactType"].(string); ok && m != "" {
-				artifactType = m
-			} else if config, ok := manifest["config"].(map[string]any); ok {
-				if configMediaType, ok := config["mediaType"].(string); ok {
-					artifactType = configMediaType
-				}
-			}
-
-			annotations := map[string]string{}
-			if annots, ok := manifest["annotations"].(map[string]any); ok {
-				for k, v := range annots {
-					if strVal, ok := v.(string); ok {
-						annotations[k] = strVal
-					}
-				}
-			}
-
-			descriptor := map[string]any{
-				"mediaType": mediaType,
-				"size":      len(data),
-				"digest":    manifestDigest,
-			}
-
-			if artifactType != "" {
-				descriptor["artifactType"] = artifactType
-			}
-
-			if len(annotations) > 0 {
-				descriptor["annotations"] = annotations
-			}
+	index := emptyReferrers()
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
 
-			manifests = append(manifests, descriptor)
+// buildReferrers builds the referrers index of the manifest by reading every
+// manifest of the repository, and caches it.
+func (s *FS) buildReferrers(name, digest string) (*image_v1.Index, error) {
+	index := emptyReferrers()
 
-			return nil
-		})
-		if err != nil {
-			return nil, err
-		}
+	manifestDir := s.manifestDir(name)
+	entries, err := os.ReadDir(manifestDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 
-		if artifactType != "" {
-			filtered := []any{}
-			for _, m := range manifests {
-				descriptor := m.(map[string]any)
-				if at, ok := descriptor["artifactType"].(string); ok && at == artifactType {
-					filtered = append(filtered, descriptor)
-				}
-			}
-			manifests = filtered
+	for _, entry := range entries {
+		if entry.IsDir() || !isDigest(entry.Name()) {
+			continue
 		}
 
-		index["manifests"] = manifests
-
-		content, err = json.Marshal(index)
+		content, err := os.ReadFile(filepath.Join(manifestDir, entry.Name()))
 		if err != nil {
-			return nil, err
-		}
-
-		if err := os.WriteFile(referrerPath, content, 0o644); err != nil {
-			log.Error().Err(err).Msg("failed to cache referrers")
-		}
-	} else if artifactType != "" {
-		var index map[string]any
-		if err := json.Unmarshal(content, &index); err != nil {
-			return nil, err
-		}
-
-		manifests, ok := index["manifests"].([]any)
-		if !ok {
-			return nil, fmt.Errorf("invalid referrers index format")
+			continue
 		}
 
-		filtered := []any{}
-		for _, m := range manifests {
-			descriptor, ok := m.(map[string]any)
-			if !ok {
-				continue
-			}
-
-			if at, ok := descriptor["artifactType"].(string); ok && at == artifactType {
-				filtered = append(filtered, descriptor)
-			}
+		// Manifests are stored under their digest
+		subject, descriptor, ok, err := model.Referrer(entry.Name(), content)
+		if err != nil || !ok || subject != digest {
+			continue
 		}
 
-		index["manifests"] = filtered
+		index.Manifests = append(index.Manifests, descriptor)
+	}
 
-		content, err = json.Marshal(index)
-		if err != nil {
-			return nil, err
+	if len(entries) > 0 {
+		if err := s.writeReferrers(name, digest, index); err != nil {
+			log.Error().Err(err).Msg("failed to cache referrers")
 		}
 	}
 
-	return content, nil
+	return index, nil
 }
 
-func (s *FS) UpdateReferrers(name, digest string, manifest []byte) error {
-	var m map[string]any
-	if err := json.Unmarshal(manifest, &m); err != nil {
+func (s *FS) writeReferrers(name, digest string, index *image_v1.Index) error {
+	content, err := json.Marshal(index)
+	if err != nil {
 		return err
 	}
 
-	subject, ok := m["subject"].(map[string]any)
-	if !ok {
-		return nil
-	}
-
-	subjectDigest, ok := subject["digest"].(string)
-	if !ok {
-		return nil
-	}
-
-	hasher := sha256.New()
-	hasher.Write(manifest)
-	manifestDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-
-	referrerDir := s.referrerDir(name)
-	if err := os.MkdirAll(referrerDir, 0o755); err != nil {
+	if err := os.MkdirAll(s.referrerDir(name), 0o755); err != nil {
 		return err
 	}
 
-	referrerPath := s.referrerPath(name, subjectDigest)
-
-	var index map[string]any
-	content, err := os.ReadFile(referrerPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			index = map[string]any{
-				"schemaVersion": 2,
-				"mediaType":     "application/vnd.oci.image.index.v1+json",
-				"manifests":     []any{},
-			}
-		} else {
-			return err
-		}
-	} else {
-		if err := json.Unmarshal(content, &index); err != nil {
-			return err
-		}
-	}
-
-	manifests, ok := index["manifests"].([]any)
-	if !ok {
-		manifests = []any{}
-	}
-
-	mediaType, _ := m["mediaType"].(string)
-	if mediaType == "" {
-		mediaType = "application/vnd.oci.image.manifest.v1+json"
-	}
+	return os.WriteFile(s.referrerPath(name, digest), content, 0o644)
+}
 
-	artifactType := ""
-	if at, ok := m["artifactType"].(string); ok && at != "" {
-		artifactType = at
-	} else if config, ok := m["config"].(map[string]any); ok {
-		if configMediaType, ok := config["mediaType"].(string); ok {
-			artifactType = configMediaType
-		}
-	}
+func emptyReferrers() *image_v1.Index {
+	index := &image_v1.Index{MediaType: image_v1.MediaTypeImageIndex, Manifests: []image_v1.Descriptor{}}
+	index.SchemaVersion = 2
+	return index
+}
 
-	annotations := map[string]string{}
-	if annots, ok := m["annotations"].(map[string]any); ok {
-		for k, v := range annots {
-			if strVal, ok := v.(string); ok {
-				annotations[k] = strVal
-			}
-		}
+func (s *FS) GetReferrers(ctx context.Context, name, digest string, artifactType string) ([]byte, error) {
+	s.referrersMu.Lock()
+	index, err := s.readReferrers(name, digest)
+	s.referrersMu.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	descriptor := map[string]any{
-		"mediaType": mediaType,
-		"size":      len(manifest),
-		"digest":    manifestDigest,
-	}
+	index.Manifests = model.FilterReferrers(index.Manifests, artifactType)
+	return json.Marshal(index)
+}
 
-	if artifactType != "" {
-		descriptor["artifactType"] = artifactType
+func (s *FS) UpdateReferrers(ctx context.Context, name, manifestDigest string, manifest []byte) error {
+	subject, descriptor, ok, err := model.Referrer(manifestDigest, manifest)
+	if err != nil || !ok {
+		return err
 	}
+	s.referrersMu.Lock()
+	defer s.referrersMu.Unlock()
 
-	if len(annotations) > 0 {
-		descriptor["annotations"] = annotations
+	index, err := s.readReferrers(name, subject)
+	if err != nil {
+		return err
 	}
 
 	found := false
-	for i, m := range manifests {
-		desc, ok := m.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		if desc["digest"] == manifestDigest {
-			manifests[i] = descriptor
+	for i, existing := range index.Manifests {
+		if existing.Digest == descriptor.Digest {
+			index.Manifests[i] = descriptor
 			found = true
 			break
 		}
 	}
 
 	if !found {
-		manifests = append(manifests, descriptor)
-	}
-
-	index["manifests"] = manifests
-
-	updatedContent, err := json.Marshal(index)
-	if err != nil {
-		return err
+		index.Manifests = append(index.Manifests, descriptor)
 	}
 
-	return os.WriteFile(referrerPath, updatedContent, 0o644)
+	return s.writeReferrers(name, subject, index)
 }
 
-func (s *FS) RemoveReferrer(name, digest, manifestDigest string) error {
-	referrerPath := s.referrerPath(name, digest)
+func (s *FS) RemoveReferrer(ctx context.Context, name, digest, manifestDigest string) error {
+	s.referrersMu.Lock()
+	defer s.referrersMu.Unlock()
 
-	content, err := os.ReadFile(referrerPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+	if _, err := os.Stat(s.referrerPath(name, digest)); os.IsNotExist(err) {
+		return nil
 	}
 
-	var index map[string]any
-	if err := json.Unmarshal(content, &index); err != nil {
+	index, err := s.readReferrers(name, digest)
+	if err != nil {
 		return err
 	}
 
-	manifests, ok := index["manifests"].([]any)
-	if !ok {
-		return nil
-	}
-
-	newManifests := []any{}
-	for _, m := range manifests {
-		desc, ok := m.(map[string]any)
-		if !ok {
-			continue
-		}
-
-		if digest, ok := desc["digest"].(string); ok && digest != manifestDigest {
-			newManifests = append(newManifests, desc)
+	manifests := []image_v1.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest.String() != manifestDigest {
+			manifests = append(manifests, descriptor)
 		}
 	}
+	index.Manifests = manifests
 
-	index["manifests"] = newManifests
-
-	updatedContent, err := json.Marshal(index)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(referrerPath, updatedContent, 0o644)
+	return s.writeReferrers(name, digest, index)
 }
@@ -0,0 +1,46 @@
+package fs_store
+
+import (
+	"context"
+	"io/fs"
+	"slices"
+)
+
+// ListRepositories returns the names of all repositories that hold at least
+// one manifest, sorted lexically.
+func (s *FS) ListRepositories(ctx context.Context) ([]string, error) {
+	repositories := []string{}
+
+	err := s.walkRepositories(manifestsDir, func(name, path string, entry fs.DirEntry) error {
+		if isDigest(entry.Name()) {
+			repositories = append(repositories, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(repositories)
+	return slices.Compact(repositories), nil
+}
+
+// ListLinkedRepositories returns the names of all repositories that hold at
+// least one blob, whether or not any manifest references it, sorted
+// lexically.
+func (s *FS) ListLinkedRepositories(ctx context.Context) ([]string, error) {
+	repositories := []string{}
+
+	err := s.walkRepositories(linksDir, func(name, path string, entry fs.DirEntry) error {
+		if isDigest(entry.Name()) {
+			repositories = append(repositories, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(repositories)
+	return slices.Compact(repositories), nil
+}
@@ -1,19 +1,21 @@
 package fs_store
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func (s *FS) tagDir(name string) string {
-	return filepath.Join(s.root, tagsBaseDir, name)
+	return filepath.Join(s.repositoryDir(name), tagsDir)
 }
 
 func (s *FS) tagPath(name, tag string) string {
 	return filepath.Join(s.tagDir(name), tag)
 }
 
-func (s *FS) ListTags(name string) ([]string, error) {
+func (s *FS) ListTags(ctx context.Context, name string) ([]string, error) {
 	tagDir := s.tagDir(name)
 
 	if err := os.MkdirAll(tagDir, 0o755); err != nil {
@@ -27,7 +29,7 @@ func (s *FS) ListTags(name string) ([]string, error) {
 
 	tags := make([]string, 0, len(files))
 	for _, file := range files {
-		if !file.IsDir() {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
 			tags = append(tags, file.Name())
 		}
 	}
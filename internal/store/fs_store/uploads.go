@@ -1,72 +1,164 @@
 package fs_store
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
 )
 
+const uploadInfoExt = ".json"
+
 func (s *FS) uploadDir(name string) string {
-	return filepath.Join(s.root, uploadsBaseDir, name)
+	return filepath.Join(s.repositoryDir(name), uploadsDir)
 }
 
 func (s *FS) uploadPath(name, id string) string {
 	return filepath.Join(s.uploadDir(name), id)
 }
 
-func (s *FS) InitiateUpload(name string) (string, error) {
-	uploadID := fmt.Sprintf("%x", time.Now().UnixNano())
+func (s *FS) uploadInfoPath(name, id string) string {
+	return s.uploadPath(name, id) + uploadInfoExt
+}
+
+// saveUploadInfo persists the state of an upload next to its data, so that
+// the upload can be resumed after a restart.
+func (s *FS) saveUploadInfo(upload *model.UploadInfo) error {
+	s.uploadsMu.RLock()
+	content, err := json.Marshal(upload)
+	s.uploadsMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	path := s.uploadInfoPath(upload.Name, upload.ID)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, content, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// loadUploads rebuilds the in-memory upload state from the uploads
+// directory. The size of the upload file is authoritative for the offset, as
+// the process may have stopped between writing a chunk and saving its info.
+func (s *FS) loadUploads() error {
+	return s.walkRepositories(uploadsDir, func(name, path string, entry fs.DirEntry) error {
+		if filepath.Ext(path) != "" {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		upload := &model.UploadInfo{}
+		if content, err := os.ReadFile(path + uploadInfoExt); err == nil {
+			if err := json.Unmarshal(content, upload); err != nil {
+				log.Warn().Err(err).Str("path", path).Msg("ignoring corrupt upload info")
+				upload = &model.UploadInfo{}
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		if upload.ID == "" {
+			upload.Name = name
+			upload.ID = entry.Name()
+			upload.StartedAt = stat.ModTime()
+		}
+
+		if upload.UpdatedAt.IsZero() {
+			upload.UpdatedAt = stat.ModTime()
+		}
+
+		upload.Path = path
+		upload.Offset = stat.Size()
+		upload.Size = stat.Size()
+
+		s.uploadsMu.Lock()
+		s.uploads[upload.ID] = upload
+		s.uploadsMu.Unlock()
+
+		return nil
+	})
+}
+
+// upload returns an upload of the repository that is still in progress.
+func (s *FS) upload(name, id string) (*model.UploadInfo, error) {
+	s.uploadsMu.RLock()
+	upload, exists := s.uploads[id]
+	s.uploadsMu.RUnlock()
+
+	if !exists || upload.Name != name || upload.Completed {
+		return nil, model.ErrUploadUnknown
+	}
+
+	return upload, nil
+}
+
+func (s *FS) InitiateUpload(ctx context.Context, name string) (string, error) {
+	now := time.Now()
+	uploadID := rand.Text()
 
 	uploadDir := s.uploadDir(name)
 	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		return "", err
 	}
 
+	// Never share the file of another upload, even if the ids collided
 	uploadPath := s.uploadPath(name, uploadID)
-	file, err := os.Create(uploadPath)
+	file, err := os.OpenFile(uploadPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	s.uploadsMu.Lock()
-	s.uploads[uploadID] = &model.UploadInfo{
+	upload := &model.UploadInfo{
 		Name:      name,
 		ID:        uploadID,
 		Path:      uploadPath,
 		Size:      0,
 		Offset:    0,
 		Completed: false,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := s.saveUploadInfo(upload); err != nil {
+		os.Remove(uploadPath)
+		return "", err
 	}
+
+	s.uploadsMu.Lock()
+	s.uploads[uploadID] = upload
 	s.uploadsMu.Unlock()
 
 	return uploadID, nil
 }
 
-func (s *FS) UploadChunk(name, id string, content io.Reader, start int64, end int64) (int64, error) {
-	s.uploadsMu.RLock()
-	upload, exists := s.uploads[id]
-	s.uploadsMu.RUnlock()
-
-	if !exists {
-		return 0, fmt.Errorf("upload not found")
-	}
-
-	if upload.Completed {
-		return 0, fmt.Errorf("upload already completed")
+func (s *FS) UploadChunk(ctx context.Context, name, id string, content io.Reader, start int64, end int64) (int64, error) {
+	upload, err := s.upload(name, id)
+	if err != nil {
+		return 0, err
 	}
 
 	if start != upload.Offset {
 		if start < upload.Offset {
-			return 0, fmt.Errorf("invalid range: start position %d has already been uploaded, current offset is %d", start, upload.Offset)
+			return 0, fmt.Errorf("%w: start position %d has already been uploaded, current offset is %d", model.ErrRangeInvalid, start, upload.Offset)
 		}
-		return 0, fmt.Errorf("invalid range: start position %d does not match current offset %d", start, upload.Offset)
+		return 0, fmt.Errorf("%w: start position %d does not match current offset %d", model.ErrRangeInvalid, start, upload.Offset)
 	}
 
 	file, err := os.OpenFile(upload.Path, os.O_WRONLY, 0o644)
@@ -79,7 +171,7 @@ func (s *FS) UploadChunk(name, id string, content io.Reader, start int64, end in
 		return 0, err
 	}
 
-	written, err := io.Copy(file, content)
+	written, err := io.Copy(file, model.ContextReader(ctx, content))
 	if err != nil {
 		return 0, err
 	}
@@ -87,22 +179,25 @@ func (s *FS) UploadChunk(name, id string, content io.Reader, start int64, end in
 	s.uploadsMu.Lock()
 	upload.Offset += written
 	upload.Size += written
+	upload.UpdatedAt = time.Now()
 	s.uploadsMu.Unlock()
 
+	if err := s.saveUploadInfo(upload); err != nil {
+		return 0, err
+	}
+
 	return upload.Offset, nil
 }
 
-func (s *FS) CompleteUpload(name, id, digest string, content io.Reader) error {
-	s.uploadsMu.RLock()
-	upload, exists := s.uploads[id]
-	s.uploadsMu.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("upload not found")
+func (s *FS) CompleteUpload(ctx context.Context, name, id, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
+		return err
 	}
 
-	if upload.Completed {
-		return fmt.Errorf("upload already completed")
+	upload, err := s.upload(name, id)
+	if err != nil {
+		return err
 	}
 
 	if content != nil {
@@ -116,7 +211,7 @@ func (s *FS) CompleteUpload(name, id, digest string, content io.Reader) error {
 			return err
 		}
 
-		written, err := io.Copy(file, content)
+		written, err := io.Copy(file, model.ContextReader(ctx, content))
 		if err != nil {
 			file.Close()
 			return err
@@ -136,41 +231,83 @@ func (s *FS) CompleteUpload(name, id, digest string, content io.Reader) error {
 	}
 	defer uploadFile.Close()
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, uploadFile); err != nil {
+	actualDigest, err := expected.Algorithm().FromReader(model.ContextReader(ctx, uploadFile))
+	if err != nil {
 		return err
 	}
 
-	actualDigest := "sha256:" + hex.EncodeToString(hasher.Sum(nil))
-	if actualDigest != digest {
-		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actualDigest)
+	if actualDigest != expected {
+		return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
 	}
 
-	blobDir := s.blobDir(name)
-	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+	uploadFile.Close()
+	if err := s.addToPool(name, expected, upload.Path); err != nil {
 		return err
 	}
 
-	blobPath := s.blobPath(name, digest)
-	if err := os.Rename(upload.Path, blobPath); err != nil {
-		return err
+	if err := os.Remove(s.uploadInfoPath(upload.Name, upload.ID)); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("upload", upload.ID).Msg("failed to remove upload info")
 	}
 
 	s.uploadsMu.Lock()
 	upload.Completed = true
+	delete(s.uploads, id)
 	s.uploadsMu.Unlock()
 
 	return nil
 }
 
-func (s *FS) GetUploadInfo(name, id string) (*model.UploadInfo, error) {
-	s.uploadsMu.RLock()
+func (s *FS) GetUploadInfo(ctx context.Context, name, id string) (*model.UploadInfo, error) {
+	return s.upload(name, id)
+}
+
+func (s *FS) CancelUpload(ctx context.Context, name, id string) error {
+	s.uploadsMu.Lock()
 	upload, exists := s.uploads[id]
-	s.uploadsMu.RUnlock()
+	if !exists || upload.Name != name || upload.Completed {
+		s.uploadsMu.Unlock()
+		return model.ErrUploadUnknown
+	}
+	delete(s.uploads, id)
+	s.uploadsMu.Unlock()
 
-	if !exists {
-		return nil, fmt.Errorf("upload not found")
+	for _, path := range []string{upload.Path, s.uploadInfoPath(upload.Name, upload.ID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
-	return upload, nil
+	return nil
+}
+
+// PurgeUploads removes all uploads that have not been written to since the
+// given time and returns the incomplete ones that were removed.
+func (s *FS) PurgeUploads(ctx context.Context, before time.Time) ([]model.UploadInfo, error) {
+	expired := []*model.UploadInfo{}
+
+	s.uploadsMu.Lock()
+	for id, upload := range s.uploads {
+		if upload.UpdatedAt.Before(before) {
+			expired = append(expired, upload)
+			delete(s.uploads, id)
+		}
+	}
+	s.uploadsMu.Unlock()
+
+	purged := make([]model.UploadInfo, 0, len(expired))
+	for _, upload := range expired {
+		if upload.Completed {
+			continue
+		}
+
+		for _, path := range []string{upload.Path, s.uploadInfoPath(upload.Name, upload.ID)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return purged, err
+			}
+		}
+
+		purged = append(purged, *upload)
+	}
+
+	return purged, nil
 }
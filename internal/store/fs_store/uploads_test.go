@@ -0,0 +1,83 @@
+package fs_store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/config"
+)
+
+func TestUploadsSurviveRestart(t *testing.T) {
+	root := t.TempDir()
+	name := "team/app"
+
+	s, err := New(&config.StoreConfig{Path: root})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	id, err := s.InitiateUpload(t.Context(), name)
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+	if _, err := s.UploadChunk(t.Context(), name, id, bytes.NewReader([]byte("first ")), 0, 5); err != nil {
+		t.Fatalf("Failed to upload chunk: %v", err)
+	}
+	started, err := s.GetUploadInfo(t.Context(), name, id)
+	if err != nil {
+		t.Fatalf("Failed to get upload info: %v", err)
+	}
+
+	// The process stops after writing a chunk but before saving its info
+	file, err := os.OpenFile(s.uploadPath(name, id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("second ")); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	restarted, err := New(&config.StoreConfig{Path: root})
+	if err != nil {
+		t.Fatalf("Failed to restart store: %v", err)
+	}
+
+	upload, err := restarted.GetUploadInfo(t.Context(), name, id)
+	if err != nil {
+		t.Fatalf("Expected upload to survive a restart, got %v", err)
+	}
+	if upload.Offset != int64(len("first second ")) {
+		t.Errorf("Expected offset to follow the upload file, got %d", upload.Offset)
+	}
+	if !upload.StartedAt.Equal(started.StartedAt) {
+		t.Errorf("Expected start time %v to be kept, got %v", started.StartedAt, upload.StartedAt)
+	}
+	if _, err := restarted.GetUploadInfo(t.Context(), "other", id); err == nil {
+		t.Error("Expected restored upload to only belong to its repository")
+	}
+
+	content := []byte("first second third")
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if err := restarted.CompleteUpload(t.Context(), name, id, digest, bytes.NewReader([]byte("third"))); err != nil {
+		t.Fatalf("Failed to complete resumed upload: %v", err)
+	}
+
+	blob, _, err := restarted.GetBlob(t.Context(), name, digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %v", err)
+	}
+	defer blob.Close()
+	if got, _ := io.ReadAll(blob); !bytes.Equal(got, content) {
+		t.Errorf("Expected blob %q, got %q", content, got)
+	}
+
+	if _, err := os.Stat(s.uploadInfoPath(name, id)); !os.IsNotExist(err) {
+		t.Errorf("Expected info of completed upload to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package mem_store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// readLimited reads content into memory, failing early once it holds more
+// than limit bytes. A negative limit means no limit.
+func readLimited(ctx context.Context, content io.Reader, limit int64) ([]byte, error) {
+	content = model.ContextReader(ctx, content)
+	if limit < 0 {
+		return io.ReadAll(content)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(content, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: %d bytes available", model.ErrStoreFull, limit)
+	}
+	return data, nil
+}
+
+// addBlob stores verified content in the pool, unless it is there already,
+// and links it into the repository. Quota is reserved for content that is
+// new to the pool. Callers must hold the write lock.
+func (s *Mem) addBlob(name string, digest godigest.Digest, content []byte) error {
+	key := digest.String()
+	if _, exists := s.blobs[key]; !exists {
+		if err := s.reserve(int64(len(content))); err != nil {
+			return err
+		}
+		s.blobs[key] = &blob{content: content}
+	}
+
+	s.link(name, key)
+	return nil
+}
+
+// link links a blob in the pool into the repository. Callers must hold the
+// write lock.
+func (s *Mem) link(name, digest string) {
+	repo := s.repository(name, true)
+	if _, linked := repo.links[digest]; !linked {
+		s.blobs[digest].links++
+	}
+	repo.links[digest] = time.Now()
+}
+
+// linkedBlob returns a blob linked into the repository. Callers must hold
+// the lock.
+func (s *Mem) linkedBlob(name, digest string) *blob {
+	repo := s.repository(name, false)
+	if repo == nil {
+		return nil
+	}
+	if _, linked := repo.links[digest]; !linked {
+		return nil
+	}
+	return s.blobs[digest]
+}
+
+func (s *Mem) HasBlob(ctx context.Context, name, digest string) (bool, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b := s.linkedBlob(name, digest); b != nil {
+		return true, int64(len(b.content)), nil
+	}
+	return false, 0, nil
+}
+
+func (s *Mem) GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b := s.linkedBlob(name, digest)
+	if b == nil {
+		return nil, 0, model.ErrBlobUnknown
+	}
+	return blobReader{bytes.NewReader(b.content)}, int64(len(b.content)), nil
+}
+
+func (s *Mem) PutBlob(ctx context.Context, name, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	// Content already in the pool takes no more room, so pushing it again
+	// must not fail when the store is full
+	limit := s.available()
+	s.mu.RLock()
+	if b, exists := s.blobs[expected.String()]; exists && limit >= 0 {
+		limit = max(limit, int64(len(b.content)))
+	}
+	s.mu.RUnlock()
+
+	data, err := readLimited(ctx, content, limit)
+	if err != nil {
+		return err
+	}
+
+	if actualDigest := expected.Algorithm().FromBytes(data); actualDigest != expected {
+		return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addBlob(name, expected, data)
+}
+
+func (s *Mem) ListBlobs(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	repo := s.repository(name, false)
+	if repo == nil {
+		return []model.ContentInfo{}, nil
+	}
+
+	blobs := make([]model.ContentInfo, 0, len(repo.links))
+	for digest, modTime := range repo.links {
+		blobs = append(blobs, model.ContentInfo{
+			Digest:  digest,
+			Size:    int64(len(s.blobs[digest].content)),
+			ModTime: modTime,
+		})
+	}
+	return blobs, nil
+}
+
+// DeleteBlob unlinks the blob from the repository, and frees it if no other
+// repository links to it.
+func (s *Mem) DeleteBlob(ctx context.Context, name, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.linkedBlob(name, digest)
+	if b == nil {
+		return model.ErrBlobUnknown
+	}
+
+	delete(s.repositories[name].links, digest)
+	b.links--
+	if b.links == 0 {
+		delete(s.blobs, digest)
+		s.release(int64(len(b.content)))
+	}
+
+	return nil
+}
+
+func (s *Mem) MountBlob(ctx context.Context, fromName, toName, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.linkedBlob(fromName, digest) == nil {
+		return fmt.Errorf("source %w", model.ErrBlobUnknown)
+	}
+
+	s.link(toName, digest)
+	return nil
+}
@@ -0,0 +1,219 @@
+package mem_store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// resolve returns the digest a reference points to. Callers must hold the
+// lock.
+func (s *Mem) resolve(name, reference string) (string, bool) {
+	if isDigest(reference) {
+		return reference, true
+	}
+
+	repo := s.repository(name, false)
+	if repo == nil {
+		return "", false
+	}
+
+	digest, exists := repo.tags[reference]
+	return digest, exists
+}
+
+// manifest returns the manifest a reference points to, along with its
+// digest. Callers must hold the lock.
+func (s *Mem) manifest(name, reference string) (*manifest, string) {
+	digest, exists := s.resolve(name, reference)
+	if !exists {
+		return nil, ""
+	}
+
+	repo := s.repository(name, false)
+	if repo == nil {
+		return nil, digest
+	}
+	return repo.manifests[digest], digest
+}
+
+func (s *Mem) HasManifest(ctx context.Context, name, reference string) (bool, int64, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, digest := s.manifest(name, reference)
+	if m == nil {
+		return false, 0, digest, nil
+	}
+	return true, int64(len(m.content)), digest, nil
+}
+
+func (s *Mem) GetManifest(ctx context.Context, name, reference string) ([]byte, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, digest := s.manifest(name, reference)
+	if m == nil {
+		return nil, "", model.ErrManifestUnknown
+	}
+	return m.content, digest, nil
+}
+
+func (s *Mem) PutManifest(ctx context.Context, name, reference string, content []byte) (string, error) {
+	// Calculate digest, with the algorithm of the reference if pushed by digest
+	digest := godigest.Canonical.FromBytes(content)
+	if isDigest(reference) {
+		expected, err := godigest.Parse(reference)
+		if err != nil {
+			return "", err
+		}
+
+		digest = expected.Algorithm().FromBytes(content)
+		if digest != expected {
+			return "", fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, digest)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo := s.repository(name, true)
+	if existing, exists := repo.manifests[digest.String()]; exists {
+		s.release(int64(len(existing.content)))
+	}
+	if err := s.reserve(int64(len(content))); err != nil {
+		return "", err
+	}
+
+	repo.manifests[digest.String()] = &manifest{content: slices.Clone(content), modTime: time.Now()}
+
+	if !isDigest(reference) {
+		repo.tags[reference] = digest.String()
+	}
+
+	return digest.String(), nil
+}
+
+func (s *Mem) ListManifests(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	repo := s.repository(name, false)
+	if repo == nil {
+		return []model.ContentInfo{}, nil
+	}
+
+	manifests := make([]model.ContentInfo, 0, len(repo.manifests))
+	for digest, m := range repo.manifests {
+		manifests = append(manifests, model.ContentInfo{
+			Digest:  digest,
+			Size:    int64(len(m.content)),
+			ModTime: m.modTime,
+		})
+	}
+	return manifests, nil
+}
+
+func (s *Mem) DeleteManifest(ctx context.Context, name, reference string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo := s.repository(name, false)
+
+	if !isDigest(reference) {
+		if repo == nil || repo.tags[reference] == "" {
+			return fmt.Errorf("%w: tag %s", model.ErrManifestUnknown, reference)
+		}
+		delete(repo.tags, reference)
+		return nil
+	}
+
+	if repo == nil || repo.manifests[reference] == nil {
+		return model.ErrManifestUnknown
+	}
+
+	s.release(int64(len(repo.manifests[reference].content)))
+	delete(repo.manifests, reference)
+
+	for tag, digest := range repo.tags {
+		if digest == reference {
+			delete(repo.tags, tag)
+		}
+	}
+
+	return nil
+}
+
+func (s *Mem) ListTags(ctx context.Context, name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tags := []string{}
+	if repo := s.repository(name, false); repo != nil {
+		for tag := range repo.tags {
+			tags = append(tags, tag)
+		}
+	}
+
+	slices.Sort(tags)
+	return tags, nil
+}
+
+func (s *Mem) GetReferrers(ctx context.Context, name, digest string, artifactType string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	index := image_v1.Index{MediaType: image_v1.MediaTypeImageIndex, Manifests: []image_v1.Descriptor{}}
+	index.SchemaVersion = 2
+
+	if repo := s.repository(name, false); repo != nil && repo.referrers[digest] != nil {
+		index.Manifests = model.FilterReferrers(repo.referrers[digest], artifactType)
+	}
+
+	return json.Marshal(index)
+}
+
+func (s *Mem) UpdateReferrers(ctx context.Context, name, manifestDigest string, manifest []byte) error {
+	subject, descriptor, ok, err := model.Referrer(manifestDigest, manifest)
+	if err != nil || !ok {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo := s.repository(name, true)
+	referrers := slices.Clone(repo.referrers[subject])
+	if i := slices.IndexFunc(referrers, func(existing image_v1.Descriptor) bool {
+		return existing.Digest == descriptor.Digest
+	}); i >= 0 {
+		referrers[i] = descriptor
+	} else {
+		referrers = append(referrers, descriptor)
+	}
+	repo.referrers[subject] = referrers
+
+	return nil
+}
+
+func (s *Mem) RemoveReferrer(ctx context.Context, name, digest, manifestDigest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo := s.repository(name, false)
+	if repo == nil {
+		return nil
+	}
+
+	repo.referrers[digest] = slices.DeleteFunc(slices.Clone(repo.referrers[digest]), func(existing image_v1.Descriptor) bool {
+		return existing.Digest.String() == manifestDigest
+	})
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package mem_store
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Mem keeps all registry content in memory, for tests and throwaway
+// registries. Like the other stores, blobs are held once and linked into the
+// repositories that have them; unlike them, a blob is freed as soon as the
+// last link to it is removed.
+type Mem struct {
+	mu           sync.RWMutex
+	maxBytes     int64
+	usedBytes    int64
+	blobs        map[string]*blob
+	repositories map[string]*repository
+	uploads      map[string]*upload
+}
+
+type blob struct {
+	content []byte
+	links   int
+}
+
+type manifest struct {
+	content []byte
+	modTime time.Time
+}
+
+type repository struct {
+	links     map[string]time.Time
+	manifests map[string]*manifest
+	tags      map[string]string
+	referrers map[string][]image_v1.Descriptor
+}
+
+func New(c *config.StoreConfig) (*Mem, error) {
+	return &Mem{
+		maxBytes:     c.Memory.MaxBytes,
+		blobs:        make(map[string]*blob),
+		repositories: make(map[string]*repository),
+		uploads:      make(map[string]*upload),
+	}, nil
+}
+
+// isDigest reports whether a manifest reference is a digest. Tags cannot
+// contain colons, so anything that does is treated as a digest.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// repository returns the repository, creating it if create is set. Callers
+// must hold the lock, for writing if create is set.
+func (s *Mem) repository(name string, create bool) *repository {
+	repo, exists := s.repositories[name]
+	if !exists && create {
+		repo = &repository{
+			links:     make(map[string]time.Time),
+			manifests: make(map[string]*manifest),
+			tags:      make(map[string]string),
+			referrers: make(map[string][]image_v1.Descriptor),
+		}
+		s.repositories[name] = repo
+	}
+	return repo
+}
+
+// reserve accounts for size more bytes, failing if that would exceed the
+// limit. Callers must hold the write lock.
+func (s *Mem) reserve(size int64) error {
+	if s.maxBytes > 0 && s.usedBytes+size > s.maxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more requested", model.ErrStoreFull, s.usedBytes, s.maxBytes, size)
+	}
+	s.usedBytes += size
+	return nil
+}
+
+func (s *Mem) release(size int64) {
+	s.usedBytes -= size
+}
+
+// available returns how many more bytes may be stored, or -1 if there is no
+// limit.
+func (s *Mem) available() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.maxBytes <= 0 {
+		return -1
+	}
+	return s.maxBytes - s.usedBytes
+}
+
+func (s *Mem) ListRepositories(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	repositories := []string{}
+	for name, repo := range s.repositories {
+		if len(repo.manifests) > 0 {
+			repositories = append(repositories, name)
+		}
+	}
+
+	slices.Sort(repositories)
+	return repositories, nil
+}
+
+func (s *Mem) ListLinkedRepositories(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	repositories := []string{}
+	for name, repo := range s.repositories {
+		if len(repo.links) > 0 {
+			repositories = append(repositories, name)
+		}
+	}
+
+	slices.Sort(repositories)
+	return repositories, nil
+}
+
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error {
+	return nil
+}
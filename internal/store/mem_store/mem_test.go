@@ -0,0 +1,20 @@
+package mem_store_test
+
+import (
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
+	"github.com/dvjn/sorcerer/internal/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := mem_store.New(&config.StoreConfig{})
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		return s
+	})
+}
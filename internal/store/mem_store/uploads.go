@@ -0,0 +1,188 @@
+package mem_store
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+type upload struct {
+	info model.UploadInfo
+	data []byte
+}
+
+// upload returns an upload of the repository. Callers must hold the lock.
+func (s *Mem) upload(name, id string) (*upload, error) {
+	u, exists := s.uploads[id]
+	if !exists || u.info.Name != name {
+		return nil, model.ErrUploadUnknown
+	}
+	return u, nil
+}
+
+func checkOffset(u *upload, start int64) error {
+	if start != u.info.Offset {
+		if start < u.info.Offset {
+			return fmt.Errorf("%w: start position %d has already been uploaded, current offset is %d", model.ErrRangeInvalid, start, u.info.Offset)
+		}
+		return fmt.Errorf("%w: start position %d does not match current offset %d", model.ErrRangeInvalid, start, u.info.Offset)
+	}
+	return nil
+}
+
+// appendUpload reads content and appends it to the upload at the given
+// offset. The content is read without holding the lock, so the upload is
+// looked up again before it is changed.
+func (s *Mem) appendUpload(ctx context.Context, name, id string, start int64, content io.Reader) (*upload, error) {
+	data, err := readLimited(ctx, content, s.available())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkOffset(u, start); err != nil {
+		return nil, err
+	}
+
+	if err := s.reserve(int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	u.data = append(u.data, data...)
+	u.info.Offset += int64(len(data))
+	u.info.Size += int64(len(data))
+	u.info.UpdatedAt = time.Now()
+
+	return u, nil
+}
+
+// removeUpload drops the upload and frees its data. Callers must hold the
+// write lock.
+func (s *Mem) removeUpload(u *upload) {
+	delete(s.uploads, u.info.ID)
+	s.release(int64(len(u.data)))
+}
+
+func (s *Mem) InitiateUpload(ctx context.Context, name string) (string, error) {
+	now := time.Now()
+	uploadID := rand.Text()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uploads[uploadID] = &upload{
+		info: model.UploadInfo{
+			Name:      name,
+			ID:        uploadID,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+	}
+
+	return uploadID, nil
+}
+
+func (s *Mem) UploadChunk(ctx context.Context, name, id string, content io.Reader, start int64, end int64) (int64, error) {
+	info, err := s.GetUploadInfo(ctx, name, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkOffset(&upload{info: *info}, start); err != nil {
+		return 0, err
+	}
+
+	u, err := s.appendUpload(ctx, name, id, start, content)
+	if err != nil {
+		return 0, err
+	}
+
+	return u.info.Offset, nil
+}
+
+func (s *Mem) CompleteUpload(ctx context.Context, name, id, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.GetUploadInfo(ctx, name, id)
+	if err != nil {
+		return err
+	}
+
+	if content != nil {
+		if _, err := s.appendUpload(ctx, name, id, info.Offset, content); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(name, id)
+	if err != nil {
+		return err
+	}
+
+	if actualDigest := expected.Algorithm().FromBytes(u.data); actualDigest != expected {
+		return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
+	}
+
+	// The data is already accounted for, hand it over to the pool
+	s.removeUpload(u)
+	return s.addBlob(name, expected, u.data)
+}
+
+func (s *Mem) GetUploadInfo(ctx context.Context, name, id string) (*model.UploadInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, err := s.upload(name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := u.info
+	return &info, nil
+}
+
+func (s *Mem) CancelUpload(ctx context.Context, name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(name, id)
+	if err != nil {
+		return err
+	}
+
+	s.removeUpload(u)
+	return nil
+}
+
+func (s *Mem) PurgeUploads(ctx context.Context, before time.Time) ([]model.UploadInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := []model.UploadInfo{}
+	for _, u := range s.uploads {
+		if u.info.UpdatedAt.Before(before) {
+			s.removeUpload(u)
+			purged = append(purged, u.info)
+		}
+	}
+
+	return purged, nil
+}
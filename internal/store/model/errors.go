@@ -0,0 +1,16 @@
+package model
+
+import "errors"
+
+// Errors returned by stores, which callers tell apart with errors.Is. Stores
+// wrap them to add detail, so the messages only need to read well as a
+// prefix.
+var (
+	ErrBlobUnknown     = errors.New("blob not found")
+	ErrManifestUnknown = errors.New("manifest not found")
+	ErrUploadUnknown   = errors.New("upload not found")
+	ErrDigestMismatch  = errors.New("digest mismatch")
+	ErrRangeInvalid    = errors.New("invalid range")
+	ErrStoreFull       = errors.New("store is full")
+	ErrUnsupported     = errors.New("operation not supported")
+)
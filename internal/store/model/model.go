@@ -1,10 +1,20 @@
 package model
 
+import "time"
+
 type UploadInfo struct {
-	Name      string
-	ID        string
-	Path      string
-	Size      int64
-	Offset    int64
-	Completed bool
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Path      string    `json:"-"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Completed bool      `json:"completed"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ContentInfo struct {
+	Digest  string
+	Size    int64
+	ModTime time.Time
 }
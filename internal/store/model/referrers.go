@@ -0,0 +1,56 @@
+package model
+
+import (
+	"encoding/json"
+
+	godigest "github.com/opencontainers/go-digest"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Referrer parses a manifest and returns the digest of its subject along
+// with the descriptor it is listed by in the referrers of the subject. ok is
+// false if the manifest has no subject.
+func Referrer(manifestDigest string, manifest []byte) (subject string, descriptor image_v1.Descriptor, ok bool, err error) {
+	var m image_v1.Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return "", image_v1.Descriptor{}, false, err
+	}
+
+	if m.Subject == nil {
+		return "", image_v1.Descriptor{}, false, nil
+	}
+
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = image_v1.MediaTypeImageManifest
+	}
+
+	artifactType := m.ArtifactType
+	if artifactType == "" {
+		artifactType = m.Config.MediaType
+	}
+
+	return m.Subject.Digest.String(), image_v1.Descriptor{
+		MediaType:    mediaType,
+		ArtifactType: artifactType,
+		Digest:       godigest.Digest(manifestDigest),
+		Size:         int64(len(manifest)),
+		Annotations:  m.Annotations,
+	}, true, nil
+}
+
+// FilterReferrers returns the descriptors with the given artifact type, or
+// all of them if it is empty.
+func FilterReferrers(descriptors []image_v1.Descriptor, artifactType string) []image_v1.Descriptor {
+	if artifactType == "" {
+		return descriptors
+	}
+
+	filtered := []image_v1.Descriptor{}
+	for _, descriptor := range descriptors {
+		if descriptor.ArtifactType == artifactType {
+			filtered = append(filtered, descriptor)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,323 @@
+package s3_store
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/minio/minio-go/v7"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// Blobs are stored once in a pool shared by all repositories, at
+// blobs/<algorithm>/<first two characters>/<encoded>, and linked into
+// repositories at repositories/<name>/_links/<digest>. Every time a blob is
+// linked, an empty object at linked/<digest> is rewritten, so that purging
+// the pool can tell recently linked blobs apart without listing the links
+// again.
+
+// maxCopySize is the largest object S3 copies in a single request.
+const maxCopySize = 5 << 30
+
+func (s *S3) poolKey(digest godigest.Digest) string {
+	encoded := digest.Encoded()
+	return s.key(blobsBaseDir, digest.Algorithm().String(), encoded[:2], encoded)
+}
+
+func (s *S3) linkDir(name string) string {
+	return s.repositoryDirKey(name, linksDir)
+}
+
+func (s *S3) linkKey(name string, digest godigest.Digest) string {
+	return s.repositoryKey(name, linksDir, digest.String())
+}
+
+func (s *S3) linkedKey(digest godigest.Digest) string {
+	return s.key(linkedBaseDir, digest.String())
+}
+
+// linkedBlob resolves the pool object of a blob linked into the repository.
+func (s *S3) linkedBlob(ctx context.Context, name, digest string) (string, minio.ObjectInfo, error) {
+	parsed, err := godigest.Parse(digest)
+	if err != nil {
+		return "", minio.ObjectInfo{}, err
+	}
+
+	if _, err := s.stat(ctx, s.linkKey(name, parsed)); err != nil {
+		return "", minio.ObjectInfo{}, err
+	}
+
+	key := s.poolKey(parsed)
+	info, err := s.stat(ctx, key)
+	if err != nil {
+		return "", minio.ObjectInfo{}, err
+	}
+
+	return key, info, nil
+}
+
+// link makes a blob in the pool available to the repository. The time it
+// was linked is recorded first, so that a concurrent purge of the pool treats
+// the blob as recent.
+func (s *S3) link(ctx context.Context, name string, digest godigest.Digest) error {
+	if _, err := s.stat(ctx, s.poolKey(digest)); err != nil {
+		return err
+	}
+
+	if err := s.write(ctx, s.linkedKey(digest), nil); err != nil {
+		return err
+	}
+
+	return s.write(ctx, s.linkKey(name, digest), []byte(digest.String()))
+}
+
+// lastLinked returns when the blob was last linked into any repository, or
+// the zero time if it never was.
+func (s *S3) lastLinked(ctx context.Context, digest godigest.Digest) (time.Time, error) {
+	info, err := s.stat(ctx, s.linkedKey(digest))
+	if err != nil {
+		if isNotFound(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return info.LastModified, nil
+}
+
+// addToPool moves a verified object into the pool and links it into the
+// repository. If the pool already holds the blob, the object is discarded.
+func (s *S3) addToPool(ctx context.Context, name string, digest godigest.Digest, key string) error {
+	poolKey := s.poolKey(digest)
+	if _, err := s.stat(ctx, poolKey); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+
+		info, err := s.stat(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := s.copy(ctx, key, minio.CopyDestOptions{Bucket: s.bucket, Object: poolKey}, info.Size); err != nil {
+			return err
+		}
+	}
+
+	if err := s.remove(ctx, key); err != nil {
+		return err
+	}
+
+	return s.link(ctx, name, digest)
+}
+
+// copy copies an object within the bucket. Objects larger than a single
+// copy request allows are copied in parts.
+func (s *S3) copy(ctx context.Context, key string, dest minio.CopyDestOptions, size int64) error {
+	source := minio.CopySrcOptions{Bucket: s.bucket, Object: key}
+
+	var err error
+	if size > maxCopySize {
+		_, err = s.client.ComposeObject(ctx, dest, source)
+	} else {
+		_, err = s.client.Client.CopyObject(ctx, dest, source)
+	}
+	return err
+}
+
+func (s *S3) HasBlob(ctx context.Context, name, digest string) (bool, int64, error) {
+	_, info, err := s.linkedBlob(ctx, name, digest)
+	if err != nil {
+		if isNotFound(err) {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	return true, info.Size, nil
+}
+
+// GetBlob returns a reader that fetches the blob lazily, seeking issues a
+// new ranged request.
+func (s *S3) GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error) {
+	key, info, err := s.linkedBlob(ctx, name, digest)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, 0, model.ErrBlobUnknown
+		}
+		return nil, 0, err
+	}
+
+	object, err := s.client.Client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return object, info.Size, nil
+}
+
+// BlobURL returns a presigned URL to download the blob from, if redirects
+// are enabled.
+func (s *S3) BlobURL(ctx context.Context, name, digest string) (string, error) {
+	if !s.redirect {
+		return "", nil
+	}
+
+	key, _, err := s.linkedBlob(ctx, name, digest)
+	if err != nil {
+		if isNotFound(err) {
+			return "", model.ErrBlobUnknown
+		}
+		return "", err
+	}
+
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, s.redirectExpiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+func (s *S3) PutBlob(ctx context.Context, name, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	key := s.repositoryKey(name, uploadsDir, tempBlobPrefix+rand.Text())
+
+	digester := expected.Algorithm().Digester()
+	_, err = s.client.Client.PutObject(ctx, s.bucket, key, io.TeeReader(content, digester.Hash()), -1, minio.PutObjectOptions{PartSize: uint64(s.partSize)})
+	if err != nil {
+		return err
+	}
+
+	if actualDigest := digester.Digest(); actualDigest != expected {
+		s.remove(ctx, key)
+		return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
+	}
+
+	return s.addToPool(ctx, name, expected, key)
+}
+
+func (s *S3) ListBlobs(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	links, err := s.listContent(ctx, s.linkDir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make([]model.ContentInfo, 0, len(links))
+	for _, link := range links {
+		_, info, err := s.linkedBlob(ctx, name, link.Digest)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		blobs = append(blobs, model.ContentInfo{
+			Digest:  link.Digest,
+			Size:    info.Size,
+			ModTime: link.ModTime,
+		})
+	}
+
+	return blobs, nil
+}
+
+// DeleteBlob removes the blob from the repository. The content stays in the
+// pool until garbage collection finds it unreferenced by any repository.
+func (s *S3) DeleteBlob(ctx context.Context, name, digest string) error {
+	parsed, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	key := s.linkKey(name, parsed)
+	if _, err := s.stat(ctx, key); err != nil {
+		if isNotFound(err) {
+			return model.ErrBlobUnknown
+		}
+		return err
+	}
+
+	return s.remove(ctx, key)
+}
+
+// MountBlob links a blob of one repository into another, without copying
+// any content.
+func (s *S3) MountBlob(ctx context.Context, fromName, toName, digest string) error {
+	if _, _, err := s.linkedBlob(ctx, fromName, digest); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("source %w", model.ErrBlobUnknown)
+		}
+		return err
+	}
+
+	return s.link(ctx, toName, godigest.Digest(digest))
+}
+
+// PurgeBlobPool removes blobs from the pool that are not linked into any
+// repository and have not been added or linked since the given time. With
+// dryRun set, the blobs are only reported.
+func (s *S3) PurgeBlobPool(ctx context.Context, before time.Time, dryRun bool) ([]model.ContentInfo, error) {
+	linked := map[string]bool{}
+	err := s.walkRepositories(ctx, linksDir, func(name, key string, object minio.ObjectInfo) error {
+		if isDigest(key) {
+			linked[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	poolDir := s.dirKey(blobsBaseDir)
+	purged := []model.ContentInfo{}
+	for object := range s.client.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: poolDir, Recursive: true}) {
+		if object.Err != nil {
+			return purged, object.Err
+		}
+
+		parts := strings.Split(strings.TrimPrefix(object.Key, poolDir), "/")
+		if len(parts) != 3 {
+			continue
+		}
+
+		digest := godigest.NewDigestFromEncoded(godigest.Algorithm(parts[0]), parts[2])
+		if linked[digest.String()] || !object.LastModified.Before(before) {
+			continue
+		}
+
+		// The blob may have been linked since the links were listed
+		lastLinked, err := s.lastLinked(ctx, digest)
+		if err != nil {
+			return purged, err
+		}
+		if !lastLinked.Before(before) {
+			continue
+		}
+
+		if !dryRun {
+			if err := s.remove(ctx, object.Key); err != nil {
+				return purged, err
+			}
+			if err := s.remove(ctx, s.linkedKey(digest)); err != nil && !isNotFound(err) {
+				return purged, err
+			}
+		}
+
+		purged = append(purged, model.ContentInfo{
+			Digest:  digest.String(),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,15 @@
+package s3_store_test
+
+import (
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	s3_store "github.com/dvjn/sorcerer/internal/store/s3_store"
+	"github.com/dvjn/sorcerer/internal/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return s3_store.NewTestStore(t, nil)
+	})
+}
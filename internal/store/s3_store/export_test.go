@@ -0,0 +1,5 @@
+package s3_store
+
+// NewTestStore exposes the store backed by a fake S3 server to the external
+// tests.
+var NewTestStore = newTestStore
@@ -0,0 +1,149 @@
+package s3_store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+func (s *S3) manifestDir(name string) string {
+	return s.repositoryDirKey(name, manifestsDir)
+}
+
+func (s *S3) manifestKey(name, digest string) string {
+	return s.repositoryKey(name, manifestsDir, digest)
+}
+
+// resolve returns the digest a reference points to.
+func (s *S3) resolve(ctx context.Context, name, reference string) (string, error) {
+	if isDigest(reference) {
+		if err := godigest.Digest(reference).Validate(); err != nil {
+			return "", err
+		}
+		return reference, nil
+	}
+
+	digest, err := s.read(ctx, s.tagKey(name, reference))
+	if err != nil {
+		return "", err
+	}
+	return string(digest), nil
+}
+
+func (s *S3) HasManifest(ctx context.Context, name, reference string) (bool, int64, string, error) {
+	digest, err := s.resolve(ctx, name, reference)
+	if err != nil {
+		if isNotFound(err) {
+			return false, 0, "", nil
+		}
+		return false, 0, "", err
+	}
+
+	info, err := s.stat(ctx, s.manifestKey(name, digest))
+	if err != nil {
+		if isNotFound(err) {
+			return false, 0, digest, nil
+		}
+		return false, 0, digest, err
+	}
+	return true, info.Size, digest, nil
+}
+
+func (s *S3) GetManifest(ctx context.Context, name, reference string) ([]byte, string, error) {
+	digest, err := s.resolve(ctx, name, reference)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", model.ErrManifestUnknown
+		}
+		return nil, "", err
+	}
+
+	content, err := s.read(ctx, s.manifestKey(name, digest))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", model.ErrManifestUnknown
+		}
+		return nil, "", err
+	}
+
+	return content, digest, nil
+}
+
+func (s *S3) PutManifest(ctx context.Context, name, reference string, content []byte) (string, error) {
+	// Calculate digest, with the algorithm of the reference if pushed by digest
+	digest := godigest.Canonical.FromBytes(content)
+	if isDigest(reference) {
+		expected, err := godigest.Parse(reference)
+		if err != nil {
+			return "", err
+		}
+
+		digest = expected.Algorithm().FromBytes(content)
+		if digest != expected {
+			return "", fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, digest)
+		}
+	}
+
+	if err := s.write(ctx, s.manifestKey(name, digest.String()), content); err != nil {
+		return "", err
+	}
+
+	if !isDigest(reference) {
+		if err := s.write(ctx, s.tagKey(name, reference), []byte(digest)); err != nil {
+			return "", err
+		}
+	}
+
+	return digest.String(), nil
+}
+
+func (s *S3) ListManifests(ctx context.Context, name string) ([]model.ContentInfo, error) {
+	return s.listContent(ctx, s.manifestDir(name))
+}
+
+func (s *S3) DeleteManifest(ctx context.Context, name, reference string) error {
+	if isDigest(reference) {
+		key := s.manifestKey(name, reference)
+		if _, err := s.stat(ctx, key); err != nil {
+			if isNotFound(err) {
+				return model.ErrManifestUnknown
+			}
+			return err
+		}
+
+		if err := s.remove(ctx, key); err != nil {
+			return err
+		}
+
+		tags, err := s.list(ctx, s.tagDir(name))
+		if err != nil {
+			log.Warn().Err(err).Msg("error cleaning up tags")
+		}
+
+		for _, tag := range tags {
+			digest, err := s.read(ctx, tag.Key)
+			if err != nil {
+				continue
+			}
+
+			if string(digest) == reference {
+				s.remove(ctx, tag.Key)
+			}
+		}
+
+		return nil
+	}
+
+	key := s.tagKey(name, reference)
+	if _, err := s.stat(ctx, key); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("%w: tag %s", model.ErrManifestUnknown, reference)
+		}
+		return err
+	}
+
+	return s.remove(ctx, key)
+}
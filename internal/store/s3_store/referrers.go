@@ -0,0 +1,102 @@
+package s3_store
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Referrers of a manifest are kept in an index at
+// repositories/<name>/_referrers/<digest>, which is updated as manifests with
+// a subject are pushed and deleted.
+
+func (s *S3) referrerKey(name, digest string) string {
+	return s.repositoryKey(name, referrersDir, digest)
+}
+
+func (s *S3) readReferrers(ctx context.Context, name, digest string) (*image_v1.Index, error) {
+	index := &image_v1.Index{MediaType: image_v1.MediaTypeImageIndex, Manifests: []image_v1.Descriptor{}}
+	index.SchemaVersion = 2
+
+	content, err := s.read(ctx, s.referrerKey(name, digest))
+	if err != nil {
+		if isNotFound(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (s *S3) writeReferrers(ctx context.Context, name, digest string, index *image_v1.Index) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, s.referrerKey(name, digest), content)
+}
+
+func (s *S3) GetReferrers(ctx context.Context, name, digest string, artifactType string) ([]byte, error) {
+	index, err := s.readReferrers(ctx, name, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	index.Manifests = model.FilterReferrers(index.Manifests, artifactType)
+	return json.Marshal(index)
+}
+
+func (s *S3) UpdateReferrers(ctx context.Context, name, manifestDigest string, manifest []byte) error {
+	subject, descriptor, ok, err := model.Referrer(manifestDigest, manifest)
+	if err != nil || !ok {
+		return err
+	}
+	s.referrersMu.Lock()
+	defer s.referrersMu.Unlock()
+
+	index, err := s.readReferrers(ctx, name, subject)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i, existing := range index.Manifests {
+		if existing.Digest == descriptor.Digest {
+			index.Manifests[i] = descriptor
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+
+	return s.writeReferrers(ctx, name, subject, index)
+}
+
+func (s *S3) RemoveReferrer(ctx context.Context, name, digest, manifestDigest string) error {
+	s.referrersMu.Lock()
+	defer s.referrersMu.Unlock()
+
+	index, err := s.readReferrers(ctx, name, digest)
+	if err != nil {
+		return err
+	}
+
+	manifests := []image_v1.Descriptor{}
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest.String() != manifestDigest {
+			manifests = append(manifests, descriptor)
+		}
+	}
+	index.Manifests = manifests
+
+	return s.writeReferrers(ctx, name, digest, index)
+}
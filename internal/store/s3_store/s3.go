@@ -0,0 +1,222 @@
+package s3_store
+
+import (
+	"bytes"
+	"context"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 stores registry content in an S3 compatible bucket, below an optional
+// prefix. Blobs live in a pool under blobs/, and everything else belonging to
+// a repository under repositories/<name>/. All state, including that of
+// uploads in progress, lives in the bucket, so an upload can be continued by
+// another instance after a restart.
+//
+// Writes to an upload and to referrers indexes are read-modify-write and only
+// serialized within one instance. Instances sharing a bucket must therefore
+// not serve concurrent requests for the same upload, or concurrent pushes of
+// referrers to the same subject.
+type S3 struct {
+	client         *minio.Core
+	bucket         string
+	prefix         string
+	partSize       int64
+	redirect       bool
+	redirectExpiry time.Duration
+	uploadLocks    sync.Map
+	referrersMu    sync.Mutex
+}
+
+const (
+	blobsBaseDir        = "blobs"
+	linkedBaseDir       = "linked"
+	repositoriesBaseDir = "repositories"
+)
+
+// The data of a repository lives under repositories/<name>/ in prefixes that
+// start with an underscore. Components of repository names cannot, so no key
+// is both an object of a repository and a prefix of a nested repository,
+// which stores like MinIO do not allow.
+const (
+	linksDir     = "_links"
+	manifestsDir = "_manifests"
+	uploadsDir   = "_uploads"
+	tagsDir      = "_tags"
+	referrersDir = "_referrers"
+)
+
+func New(c *config.StoreConfig) (*S3, error) {
+	return newWithTransport(c, nil)
+}
+
+// newWithTransport creates the store with a custom transport for the S3
+// client, the default transport is used if it is nil.
+func newWithTransport(c *config.StoreConfig, transport http.RoundTripper) (*S3, error) {
+	lookup := minio.BucketLookupAuto
+	if c.S3.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.NewCore(c.S3.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(c.S3.AccessKey, c.S3.SecretKey, ""),
+		Secure:       !c.S3.Insecure,
+		Region:       c.S3.Region,
+		BucketLookup: lookup,
+		Transport:    transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(context.Background(), c.S3.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", c.S3.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", c.S3.Bucket)
+	}
+
+	return &S3{
+		client:         client,
+		bucket:         c.S3.Bucket,
+		prefix:         strings.Trim(c.S3.Prefix, "/"),
+		partSize:       c.S3.PartSize,
+		redirect:       c.S3.Redirect,
+		redirectExpiry: c.S3.RedirectExpiry,
+	}, nil
+}
+
+// key joins the elements into an object key below the configured prefix.
+func (s *S3) key(elem ...string) string {
+	return path.Join(append([]string{s.prefix}, elem...)...)
+}
+
+// dirKey returns the prefix under which objects of a directory are listed.
+func (s *S3) dirKey(elem ...string) string {
+	return s.key(elem...) + "/"
+}
+
+// repositoryKey joins the elements into the key of an object in a data
+// directory of the repository.
+func (s *S3) repositoryKey(name, dataDir string, elem ...string) string {
+	return s.key(append([]string{repositoriesBaseDir, name, dataDir}, elem...)...)
+}
+
+// repositoryDirKey returns the prefix under which the objects of a data
+// directory of the repository are listed.
+func (s *S3) repositoryDirKey(name, dataDir string) string {
+	return s.dirKey(repositoriesBaseDir, name, dataDir)
+}
+
+// walkRepositories calls fn for every object in a data directory of any
+// repository, with the name of the repository and the key of the object
+// below the data directory.
+func (s *S3) walkRepositories(ctx context.Context, dataDir string, fn func(name, key string, object minio.ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	root := s.dirKey(repositoriesBaseDir)
+	for object := range s.client.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: root, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		name, key, ok := strings.Cut(strings.TrimPrefix(object.Key, root), "/"+dataDir+"/")
+		// The first component starting with an underscore ends the name
+		if !ok || key == "" || strings.Contains(name, "/_") {
+			continue
+		}
+		if err := fn(name, key, object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	response := minio.ToErrorResponse(err)
+	return response.Code == "NoSuchKey" || response.StatusCode == http.StatusNotFound
+}
+
+// isDigest reports whether a manifest reference is a digest. Tags cannot
+// contain colons, so anything that does is treated as a digest.
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+func (s *S3) stat(ctx context.Context, key string) (minio.ObjectInfo, error) {
+	return s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+}
+
+func (s *S3) read(ctx context.Context, key string) ([]byte, error) {
+	object, _, _, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+func (s *S3) write(ctx context.Context, key string, content []byte) error {
+	_, err := s.client.Client.PutObject(ctx, s.bucket, key, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+	return err
+}
+
+func (s *S3) remove(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// list returns the objects directly below the directory, skipping those of
+// nested repositories.
+func (s *S3) list(ctx context.Context, dir string) ([]minio.ObjectInfo, error) {
+	objects := []minio.ObjectInfo{}
+	for object := range s.client.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: dir}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// listContent returns the content addressed objects stored directly in the
+// directory.
+func (s *S3) listContent(ctx context.Context, dir string) ([]model.ContentInfo, error) {
+	objects, err := s.list(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := make([]model.ContentInfo, 0, len(objects))
+	for _, object := range objects {
+		digest := strings.TrimPrefix(object.Key, dir)
+		if !isDigest(digest) {
+			continue
+		}
+
+		contents = append(contents, model.ContentInfo{
+			Digest:  digest,
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return contents, nil
+}
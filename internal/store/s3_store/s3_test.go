@@ -0,0 +1,464 @@
+package s3_store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func newTestStore(t *testing.T, configure func(*config.S3Config)) *S3 {
+	t.Helper()
+	return newTestStoreWithTransport(t, configure, nil)
+}
+
+// newTestStoreWithTransport creates a store whose requests to the fake
+// server pass through the transport returned by wrap.
+func newTestStoreWithTransport(t *testing.T, configure func(*config.S3Config), wrap func(http.RoundTripper) http.RoundTripper) *S3 {
+	t.Helper()
+
+	backend := s3mem.New()
+	if err := backend.CreateBucket("registry"); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+
+	// Over plain HTTP, the client signs payloads in a streaming format the
+	// fake server does not understand
+	server := httptest.NewTLSServer(gofakes3.New(backend, gofakes3.WithLogger(gofakes3.DiscardLog())).Server())
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	c := &config.StoreConfig{
+		Backend: config.StoreBackendS3,
+		S3: config.S3Config{
+			Endpoint:       endpoint.Host,
+			Region:         "us-east-1",
+			Bucket:         "registry",
+			Prefix:         "sorcerer",
+			AccessKey:      "access",
+			SecretKey:      "secret",
+			PathStyle:      true,
+			PartSize:       5 << 20,
+			RedirectExpiry: time.Minute,
+		},
+	}
+	if configure != nil {
+		configure(&c.S3)
+	}
+
+	transport := server.Client().Transport
+	if wrap != nil {
+		transport = wrap(transport)
+	}
+
+	s, err := newWithTransport(c, transport)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return s
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestChunkedUpload(t *testing.T) {
+	s := newTestStore(t, nil)
+	name := "team/app"
+
+	// Chunks smaller than a part, which together span several parts
+	content := bytes.Repeat([]byte("0123456789abcdef"), 11<<20/16)
+	chunks := [][]byte{content[:3<<20], content[3<<20 : 7<<20], content[7<<20 : 10<<20]}
+	digest := digestOf(content)
+
+	id, err := s.InitiateUpload(t.Context(), name)
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+
+	var offset int64
+	for _, chunk := range chunks {
+		offset, err = s.UploadChunk(t.Context(), name, id, bytes.NewReader(chunk), offset, offset+int64(len(chunk))-1)
+		if err != nil {
+			t.Fatalf("Failed to upload chunk: %v", err)
+		}
+	}
+	if offset != 10<<20 {
+		t.Errorf("Expected offset %d, got %d", 10<<20, offset)
+	}
+
+	if _, err := s.UploadChunk(t.Context(), name, id, strings.NewReader("x"), 0, 0); err == nil || !strings.Contains(err.Error(), "invalid range") {
+		t.Errorf("Expected invalid range error for a chunk out of order, got %v", err)
+	}
+
+	info, err := s.GetUploadInfo(t.Context(), name, id)
+	if err != nil || info.Offset != offset {
+		t.Fatalf("Expected upload info with offset %d, got %+v (%v)", offset, info, err)
+	}
+
+	if err := s.CompleteUpload(t.Context(), name, id, digestOf([]byte("other")), bytes.NewReader(content[10<<20:])); err == nil {
+		t.Fatal("Expected digest mismatch")
+	}
+	if err := s.CompleteUpload(t.Context(), name, id, digest, nil); err != nil {
+		t.Fatalf("Failed to complete upload: %v", err)
+	}
+
+	if _, err := s.GetUploadInfo(t.Context(), name, id); err == nil {
+		t.Error("Expected completed upload to be gone")
+	}
+
+	blob, size, err := s.GetBlob(t.Context(), name, digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %v", err)
+	}
+	defer blob.Close()
+
+	if size != int64(len(content)) {
+		t.Errorf("Expected size %d, got %d", len(content), size)
+	}
+
+	if _, err := blob.Seek(6<<20, io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	got := make([]byte, 16)
+	if _, err := io.ReadFull(blob, got); err != nil || !bytes.Equal(got, content[6<<20:6<<20+16]) {
+		t.Errorf("Unexpected content at offset: %q (%v)", got, err)
+	}
+}
+
+// An upload assembled to check a digest of another algorithm than sha256 can
+// still be resumed when the digest does not match.
+func TestSHA512DigestMismatch(t *testing.T) {
+	s := newTestStore(t, nil)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 12<<20/16)
+	digest := godigest.SHA512.FromBytes(content).String()
+
+	id, err := s.InitiateUpload(t.Context(), "app")
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+	if _, err := s.UploadChunk(t.Context(), "app", id, bytes.NewReader(content[:7<<20]), 0, 7<<20-1); err != nil {
+		t.Fatalf("Failed to upload chunk: %v", err)
+	}
+	if err := s.CompleteUpload(t.Context(), "app", id, godigest.SHA512.FromString("other").String(), nil); !errors.Is(err, model.ErrDigestMismatch) {
+		t.Fatalf("Expected digest mismatch, got %v", err)
+	}
+
+	offset, err := s.UploadChunk(t.Context(), "app", id, bytes.NewReader(content[7<<20:]), 7<<20, int64(len(content))-1)
+	if err != nil || offset != int64(len(content)) {
+		t.Fatalf("Expected upload to resume up to %d, got %d (%v)", len(content), offset, err)
+	}
+	if err := s.CompleteUpload(t.Context(), "app", id, digest, nil); err != nil {
+		t.Fatalf("Failed to complete upload: %v", err)
+	}
+
+	blob, _, err := s.GetBlob(t.Context(), "app", digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %v", err)
+	}
+	defer blob.Close()
+	if got, err := io.ReadAll(blob); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("Expected content of %d bytes, got %d (%v)", len(content), len(got), err)
+	}
+}
+
+func TestTruncatedChunk(t *testing.T) {
+	s := newTestStore(t, nil)
+	content := []byte("chunk")
+
+	id, err := s.InitiateUpload(t.Context(), "app")
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+
+	// A client that disconnects halfway through its request body
+	dropped := io.MultiReader(bytes.NewReader(content[:2]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := s.UploadChunk(t.Context(), "app", id, dropped, 0, int64(len(content))-1); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected truncated chunk to fail, got %v", err)
+	}
+	if info, err := s.GetUploadInfo(t.Context(), "app", id); err != nil || info.Offset != 0 {
+		t.Fatalf("Expected truncated chunk to not be stored, got %+v (%v)", info, err)
+	}
+
+	if _, err := s.UploadChunk(t.Context(), "app", id, bytes.NewReader(content), 0, int64(len(content))-1); err != nil {
+		t.Fatalf("Failed to upload chunk again: %v", err)
+	}
+	if err := s.CompleteUpload(t.Context(), "app", id, digestOf(content), nil); err != nil {
+		t.Errorf("Failed to complete upload: %v", err)
+	}
+}
+
+func TestSmallAndEmptyUploads(t *testing.T) {
+	s := newTestStore(t, nil)
+
+	for _, content := range [][]byte{nil, []byte("small blob")} {
+		id, err := s.InitiateUpload(t.Context(), "app")
+		if err != nil {
+			t.Fatalf("Failed to initiate upload: %v", err)
+		}
+
+		if err := s.CompleteUpload(t.Context(), "app", id, digestOf(content), bytes.NewReader(content)); err != nil {
+			t.Fatalf("Failed to complete upload: %v", err)
+		}
+
+		exists, size, err := s.HasBlob(t.Context(), "app", digestOf(content))
+		if err != nil || !exists || size != int64(len(content)) {
+			t.Errorf("Expected blob of %d bytes, got %v %d (%v)", len(content), exists, size, err)
+		}
+	}
+}
+
+func TestCancelAndPurgeUploads(t *testing.T) {
+	s := newTestStore(t, nil)
+
+	cancelled, _ := s.InitiateUpload(t.Context(), "app")
+	if _, err := s.UploadChunk(t.Context(), "app", cancelled, bytes.NewReader(make([]byte, 6<<20)), 0, 6<<20-1); err != nil {
+		t.Fatalf("Failed to upload chunk: %v", err)
+	}
+	if err := s.CancelUpload(t.Context(), "other", cancelled); err == nil {
+		t.Error("Expected upload of another repository to be unknown")
+	}
+	if err := s.CancelUpload(t.Context(), "app", cancelled); err != nil {
+		t.Fatalf("Failed to cancel upload: %v", err)
+	}
+
+	expired, _ := s.InitiateUpload(t.Context(), "app")
+	purged, err := s.PurgeUploads(t.Context(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Failed to purge uploads: %v", err)
+	}
+	if len(purged) != 1 || purged[0].ID != expired {
+		t.Errorf("Expected upload %s to be purged, got %+v", expired, purged)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "app", expired); err == nil {
+		t.Error("Expected purged upload to be gone")
+	}
+}
+
+func TestUploadIDOf(t *testing.T) {
+	for key, want := range map[string]string{
+		"18a2b3c4/info.json":   "18a2b3c4",
+		"18a2b3c4/pending":     "",
+		"temp-blob-18a2b3c4":   "",
+		"a/b/info.json":        "",
+		"info.json":            "",
+		"/info.json":           "",
+		"18a2b3c4/info.json.x": "",
+	} {
+		id, ok := uploadIDOf(key)
+		if id != want || ok != (want != "") {
+			t.Errorf("Expected upload id %q of %s, got %q %v", want, key, id, ok)
+		}
+	}
+}
+
+func TestBlobPool(t *testing.T) {
+	s := newTestStore(t, func(c *config.S3Config) { c.Redirect = true })
+	content := []byte("shared layer")
+	digest := digestOf(content)
+
+	if err := s.PutBlob(t.Context(), "team/app", digest, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	if err := s.PutBlob(t.Context(), "team/app", digestOf([]byte("other")), bytes.NewReader(content)); err == nil {
+		t.Error("Expected digest mismatch")
+	}
+	if err := s.MountBlob(t.Context(), "team/app", "team/other", digest); err != nil {
+		t.Fatalf("Failed to mount blob: %v", err)
+	}
+	if err := s.DeleteBlob(t.Context(), "team/app", digest); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+
+	if exists, _, _ := s.HasBlob(t.Context(), "team/app", digest); exists {
+		t.Error("Expected blob to be unlinked from the repository it was deleted from")
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "team/other", digest); !exists {
+		t.Error("Expected mounted blob to remain")
+	}
+
+	blobURL, err := s.BlobURL(t.Context(), "team/other", digest)
+	if err != nil || !strings.Contains(blobURL, "X-Amz-Signature") {
+		t.Errorf("Expected presigned URL, got %q (%v)", blobURL, err)
+	}
+
+	purged, err := s.PurgeBlobPool(t.Context(), time.Now().Add(time.Second), false)
+	if err != nil || len(purged) != 0 {
+		t.Errorf("Expected linked blob to stay in the pool, got %+v (%v)", purged, err)
+	}
+
+	if err := s.DeleteBlob(t.Context(), "team/other", digest); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	purged, err = s.PurgeBlobPool(t.Context(), time.Now().Add(time.Second), false)
+	if err != nil || len(purged) != 1 || purged[0].Digest != digest {
+		t.Errorf("Expected unlinked blob to be purged, got %+v (%v)", purged, err)
+	}
+}
+
+// copyCounter counts the server side copies requested through it.
+type copyCounter struct {
+	transport http.RoundTripper
+	copies    atomic.Int64
+}
+
+func (c *copyCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		c.copies.Add(1)
+	}
+	return c.transport.RoundTrip(r)
+}
+
+func TestLinkCopiesNoContent(t *testing.T) {
+	counter := &copyCounter{}
+	s := newTestStoreWithTransport(t, nil, func(transport http.RoundTripper) http.RoundTripper {
+		counter.transport = transport
+		return counter
+	})
+	content := []byte("layer")
+	digest := digestOf(content)
+
+	if err := s.PutBlob(t.Context(), "team/app", digest, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	if n := counter.copies.Load(); n != 1 {
+		t.Errorf("Expected a new blob to be copied into the pool once, got %d copies", n)
+	}
+
+	if err := s.MountBlob(t.Context(), "team/app", "team/other", digest); err != nil {
+		t.Fatalf("Failed to mount blob: %v", err)
+	}
+	if err := s.PutBlob(t.Context(), "team/third", digest, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	if n := counter.copies.Load(); n != 1 {
+		t.Errorf("Expected linking a pooled blob to copy nothing, got %d copies", n-1)
+	}
+
+	lastLinked, err := s.lastLinked(t.Context(), godigest.Digest(digest))
+	if err != nil || lastLinked.IsZero() {
+		t.Errorf("Expected the time the blob was linked to be recorded, got %v (%v)", lastLinked, err)
+	}
+}
+
+func TestManifestsTagsAndReferrers(t *testing.T) {
+	s := newTestStore(t, nil)
+
+	image := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	imageDigest, err := s.PutManifest(t.Context(), "team/app", "v1", image)
+	if err != nil {
+		t.Fatalf("Failed to put manifest: %v", err)
+	}
+	if _, err := s.PutManifest(t.Context(), "team/app/nested", "latest", image); err != nil {
+		t.Fatalf("Failed to put manifest: %v", err)
+	}
+
+	exists, size, digest, err := s.HasManifest(t.Context(), "team/app", "v1")
+	if err != nil || !exists || size != int64(len(image)) || digest != imageDigest {
+		t.Errorf("Expected tag to resolve to %s, got %v %d %s (%v)", imageDigest, exists, size, digest, err)
+	}
+
+	if tags, _ := s.ListTags(t.Context(), "team/app"); !slices.Equal(tags, []string{"v1"}) {
+		t.Errorf("Expected tags of nested repositories to be excluded, got %v", tags)
+	}
+	if repositories, _ := s.ListRepositories(t.Context()); !slices.Equal(repositories, []string{"team/app", "team/app/nested"}) {
+		t.Errorf("Unexpected repositories: %v", repositories)
+	}
+
+	signature := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/example.signature","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}}`, imageDigest, len(image))
+	signatureDigest, err := s.PutManifest(t.Context(), "team/app", digestOf(signature), signature)
+	if err != nil {
+		t.Fatalf("Failed to put referrer: %v", err)
+	}
+	if err := s.UpdateReferrers(t.Context(), "team/app", signatureDigest, signature); err != nil {
+		t.Fatalf("Failed to update referrers: %v", err)
+	}
+
+	referrers, err := s.GetReferrers(t.Context(), "team/app", imageDigest, "application/example.signature")
+	if err != nil || !strings.Contains(string(referrers), signatureDigest) {
+		t.Errorf("Expected referrer %s, got %s (%v)", signatureDigest, referrers, err)
+	}
+	referrers, _ = s.GetReferrers(t.Context(), "team/app", imageDigest, "application/example.sbom")
+	if strings.Contains(string(referrers), signatureDigest) {
+		t.Errorf("Expected referrers to be filtered by artifact type, got %s", referrers)
+	}
+
+	if err := s.RemoveReferrer(t.Context(), "team/app", imageDigest, signatureDigest); err != nil {
+		t.Fatalf("Failed to remove referrer: %v", err)
+	}
+	if err := s.DeleteManifest(t.Context(), "team/app", imageDigest); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+	if tags, _ := s.ListTags(t.Context(), "team/app"); len(tags) != 0 {
+		t.Errorf("Expected tags of deleted manifest to be removed, got %v", tags)
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "team/app/nested", "latest"); !exists {
+		t.Error("Expected manifest of nested repository to remain")
+	}
+}
+
+// TestNoKeyIsAPrefix checks that no object is stored where another object
+// has a prefix, which stores like MinIO cannot hold.
+func TestNoKeyIsAPrefix(t *testing.T) {
+	s := newTestStore(t, nil)
+
+	image := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`)
+	for _, push := range []struct{ name, tag string }{{"a", "b"}, {"a/b", "latest"}} {
+		digest, err := s.PutManifest(t.Context(), push.name, push.tag, image)
+		if err != nil {
+			t.Fatalf("Failed to put manifest: %v", err)
+		}
+		signature := fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}}`, digest, len(image))
+		signatureDigest, err := s.PutManifest(t.Context(), push.name, digestOf(signature), signature)
+		if err != nil {
+			t.Fatalf("Failed to put referrer: %v", err)
+		}
+		if err := s.UpdateReferrers(t.Context(), push.name, signatureDigest, signature); err != nil {
+			t.Fatalf("Failed to update referrers: %v", err)
+		}
+		if err := s.PutBlob(t.Context(), push.name, digestOf([]byte(push.name)), bytes.NewReader([]byte(push.name))); err != nil {
+			t.Fatalf("Failed to put blob: %v", err)
+		}
+		if _, err := s.InitiateUpload(t.Context(), push.name); err != nil {
+			t.Fatalf("Failed to initiate upload: %v", err)
+		}
+	}
+
+	keys := []string{}
+	for object := range s.client.Client.ListObjects(t.Context(), s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if object.Err != nil {
+			t.Fatalf("Failed to list objects: %v", object.Err)
+		}
+		keys = append(keys, object.Key)
+	}
+	for _, key := range keys {
+		for _, other := range keys {
+			if strings.HasPrefix(other, key+"/") {
+				t.Errorf("Expected no object below the object %s, found %s", key, other)
+			}
+		}
+	}
+
+	if repositories, err := s.ListRepositories(t.Context()); err != nil || !slices.Equal(repositories, []string{"a", "a/b"}) {
+		t.Errorf("Expected nested repositories to be listed, got %v (%v)", repositories, err)
+	}
+}
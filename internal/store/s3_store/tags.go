@@ -0,0 +1,69 @@
+package s3_store
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func (s *S3) tagDir(name string) string {
+	return s.repositoryDirKey(name, tagsDir)
+}
+
+func (s *S3) tagKey(name, tag string) string {
+	return s.repositoryKey(name, tagsDir, tag)
+}
+
+func (s *S3) ListTags(ctx context.Context, name string) ([]string, error) {
+	dir := s.tagDir(name)
+	objects, err := s.list(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(objects))
+	for _, object := range objects {
+		tags = append(tags, strings.TrimPrefix(object.Key, dir))
+	}
+
+	return tags, nil
+}
+
+// ListRepositories returns the names of all repositories that hold at least
+// one manifest, sorted lexically.
+func (s *S3) ListRepositories(ctx context.Context) ([]string, error) {
+	repositories := []string{}
+	err := s.walkRepositories(ctx, manifestsDir, func(name, key string, object minio.ObjectInfo) error {
+		if isDigest(key) {
+			repositories = append(repositories, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(repositories)
+	return slices.Compact(repositories), nil
+}
+
+// ListLinkedRepositories returns the names of all repositories that hold at
+// least one blob, whether or not any manifest references it, sorted
+// lexically.
+func (s *S3) ListLinkedRepositories(ctx context.Context) ([]string, error) {
+	repositories := []string{}
+	err := s.walkRepositories(ctx, linksDir, func(name, key string, object minio.ObjectInfo) error {
+		if isDigest(key) {
+			repositories = append(repositories, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(repositories)
+	return slices.Compact(repositories), nil
+}
@@ -0,0 +1,438 @@
+package s3_store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store/model"
+	"github.com/minio/minio-go/v7"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+)
+
+// Uploads map onto multipart uploads. S3 requires every part but the last to
+// be at least 5 MiB, while clients may send chunks of any size, so data is
+// buffered in a pending object until a full part can be uploaded. The state
+// of the upload, including the SHA-256 state of the data received so far, is
+// kept next to it in the bucket.
+
+const (
+	uploadInfoObject    = "info.json"
+	uploadPendingObject = "pending"
+	uploadDataObject    = "data"
+)
+
+// tempBlobPrefix starts the names of the objects blobs pushed in a single
+// request are written to before they are verified.
+const tempBlobPrefix = "temp-blob-"
+
+type uploadState struct {
+	model.UploadInfo
+	MultipartID string               `json:"multipart_id,omitempty"`
+	Parts       []minio.CompletePart `json:"parts,omitempty"`
+	Pending     int64                `json:"pending"`
+	HashState   []byte               `json:"hash_state"`
+}
+
+func (s *S3) uploadKey(name, id, object string) string {
+	return s.repositoryKey(name, uploadsDir, id, object)
+}
+
+// uploadIDOf returns the id of the upload an info object belongs to, given
+// its key below the uploads directory, and false for keys of any other
+// object.
+func uploadIDOf(key string) (string, bool) {
+	id, ok := strings.CutSuffix(key, "/"+uploadInfoObject)
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+	return id, true
+}
+
+// lockUpload serializes operations on an upload within this instance.
+func (s *S3) lockUpload(id string) func() {
+	mu, _ := s.uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func (s *S3) loadUpload(ctx context.Context, name, id string) (*uploadState, error) {
+	content, err := s.read(ctx, s.uploadKey(name, id, uploadInfoObject))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, model.ErrUploadUnknown
+		}
+		return nil, err
+	}
+
+	upload := &uploadState{}
+	if err := json.Unmarshal(content, upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (s *S3) saveUpload(ctx context.Context, upload *uploadState) error {
+	content, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, s.uploadKey(upload.Name, upload.ID, uploadInfoObject), content)
+}
+
+func (s *S3) InitiateUpload(ctx context.Context, name string) (string, error) {
+	now := time.Now()
+	uploadID := rand.Text()
+
+	hashState, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	upload := &uploadState{
+		UploadInfo: model.UploadInfo{
+			Name:      name,
+			ID:        uploadID,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+		HashState: hashState,
+	}
+
+	if err := s.saveUpload(ctx, upload); err != nil {
+		return "", err
+	}
+
+	return uploadID, nil
+}
+
+// appendUpload adds content to the upload, uploading as many full parts as
+// the pending data and the content make up.
+func (s *S3) appendUpload(ctx context.Context, upload *uploadState, content io.Reader) error {
+	hash := sha256.New()
+	if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return err
+	}
+
+	counter := &countingReader{reader: io.TeeReader(content, hash)}
+	source := io.Reader(counter)
+	if upload.Pending > 0 {
+		pending, _, _, err := s.client.GetObject(ctx, s.bucket, s.uploadKey(upload.Name, upload.ID, uploadPendingObject), minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		defer pending.Close()
+		source = io.MultiReader(pending, counter)
+	}
+
+	buffer := make([]byte, s.partSize)
+	for {
+		n, err := io.ReadFull(source, buffer)
+		if counter.err != nil {
+			// A request body that ends early fails with io.ErrUnexpectedEOF
+			// as well, which must not be mistaken for a short last part
+			return counter.err
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Keep what does not fill a part for the next chunk
+			if err := s.write(ctx, s.uploadKey(upload.Name, upload.ID, uploadPendingObject), buffer[:n]); err != nil {
+				return err
+			}
+			upload.Pending = int64(n)
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.uploadPart(ctx, upload, buffer[:n]); err != nil {
+			return err
+		}
+	}
+
+	hashState, err := hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	upload.HashState = hashState
+	upload.Offset += counter.count
+	upload.Size += counter.count
+	upload.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (s *S3) uploadPart(ctx context.Context, upload *uploadState, data []byte) error {
+	key := s.uploadKey(upload.Name, upload.ID, uploadDataObject)
+
+	if upload.MultipartID == "" {
+		multipartID, err := s.client.NewMultipartUpload(ctx, s.bucket, key, minio.PutObjectOptions{})
+		if err != nil {
+			return err
+		}
+		upload.MultipartID = multipartID
+	}
+
+	number := len(upload.Parts) + 1
+	part, err := s.client.PutObjectPart(ctx, s.bucket, key, upload.MultipartID, number, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{})
+	if err != nil {
+		return err
+	}
+
+	upload.Parts = append(upload.Parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	return nil
+}
+
+func (s *S3) UploadChunk(ctx context.Context, name, id string, content io.Reader, start int64, end int64) (int64, error) {
+	defer s.lockUpload(id)()
+
+	upload, err := s.loadUpload(ctx, name, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if start != upload.Offset {
+		if start < upload.Offset {
+			return 0, fmt.Errorf("%w: start position %d has already been uploaded, current offset is %d", model.ErrRangeInvalid, start, upload.Offset)
+		}
+		return 0, fmt.Errorf("%w: start position %d does not match current offset %d", model.ErrRangeInvalid, start, upload.Offset)
+	}
+
+	if err := s.appendUpload(ctx, upload, content); err != nil {
+		return 0, err
+	}
+
+	if err := s.saveUpload(ctx, upload); err != nil {
+		return 0, err
+	}
+
+	return upload.Offset, nil
+}
+
+func (s *S3) CompleteUpload(ctx context.Context, name, id, digest string, content io.Reader) error {
+	expected, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockUpload(id)
+	defer unlock()
+
+	upload, err := s.loadUpload(ctx, name, id)
+	if err != nil {
+		return err
+	}
+
+	if content != nil {
+		if err := s.appendUpload(ctx, upload, content); err != nil {
+			return err
+		}
+	}
+
+	// The digest can be checked against the hash state before anything is
+	// assembled, unless another algorithm is used
+	if expected.Algorithm() == godigest.SHA256 {
+		hash := sha256.New()
+		if err := hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+			return err
+		}
+
+		if actualDigest := godigest.NewDigest(godigest.SHA256, hash); actualDigest != expected {
+			if err := s.saveUpload(ctx, upload); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
+		}
+	}
+
+	key, err := s.assembleUpload(ctx, upload)
+	if err != nil {
+		return err
+	}
+
+	if expected.Algorithm() != godigest.SHA256 {
+		object, _, _, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		actualDigest, err := expected.Algorithm().FromReader(object)
+		object.Close()
+		if err != nil {
+			return err
+		}
+
+		if actualDigest != expected {
+			if err := s.reopenUpload(ctx, upload, key); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: expected %s, got %s", model.ErrDigestMismatch, expected, actualDigest)
+		}
+	}
+
+	if err := s.addToPool(ctx, name, expected, key); err != nil {
+		return err
+	}
+
+	s.removeUpload(ctx, upload)
+	return nil
+}
+
+// assembleUpload turns the parts and pending data of an upload into a
+// single object and returns its key.
+func (s *S3) assembleUpload(ctx context.Context, upload *uploadState) (string, error) {
+	pendingKey := s.uploadKey(upload.Name, upload.ID, uploadPendingObject)
+
+	if upload.MultipartID == "" {
+		// Everything fits in the pending object, which may not exist yet
+		// for an empty blob
+		if upload.Pending == 0 {
+			if err := s.write(ctx, pendingKey, nil); err != nil {
+				return "", err
+			}
+		}
+		return pendingKey, nil
+	}
+
+	if upload.Pending > 0 {
+		pending, err := s.read(ctx, pendingKey)
+		if err != nil {
+			return "", err
+		}
+
+		if err := s.uploadPart(ctx, upload, pending); err != nil {
+			return "", err
+		}
+	}
+
+	key := s.uploadKey(upload.Name, upload.ID, uploadDataObject)
+	if _, err := s.client.CompleteMultipartUpload(ctx, s.bucket, key, upload.MultipartID, upload.Parts, minio.PutObjectOptions{}); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// reopenUpload keeps an upload that was assembled into the object at key
+// going, by making all of its data pending again. The next chunk uploads it
+// in new parts.
+func (s *S3) reopenUpload(ctx context.Context, upload *uploadState, key string) error {
+	pendingKey := s.uploadKey(upload.Name, upload.ID, uploadPendingObject)
+	if key != pendingKey {
+		if err := s.copy(ctx, key, minio.CopyDestOptions{Bucket: s.bucket, Object: pendingKey}, upload.Size); err != nil {
+			return err
+		}
+		if err := s.remove(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	upload.MultipartID = ""
+	upload.Parts = nil
+	upload.Pending = upload.Size
+	return s.saveUpload(ctx, upload)
+}
+
+// removeUpload aborts the multipart upload and removes every object
+// belonging to the upload.
+func (s *S3) removeUpload(ctx context.Context, upload *uploadState) {
+	if upload.MultipartID != "" {
+		err := s.client.AbortMultipartUpload(ctx, s.bucket, s.uploadKey(upload.Name, upload.ID, uploadDataObject), upload.MultipartID)
+		if err != nil && !isNotFound(err) {
+			log.Warn().Err(err).Str("upload", upload.ID).Msg("failed to abort multipart upload")
+		}
+	}
+
+	for _, object := range []string{uploadPendingObject, uploadDataObject, uploadInfoObject} {
+		if err := s.remove(ctx, s.uploadKey(upload.Name, upload.ID, object)); err != nil && !isNotFound(err) {
+			log.Warn().Err(err).Str("upload", upload.ID).Str("object", object).Msg("failed to remove upload object")
+		}
+	}
+
+	s.uploadLocks.Delete(upload.ID)
+}
+
+func (s *S3) GetUploadInfo(ctx context.Context, name, id string) (*model.UploadInfo, error) {
+	upload, err := s.loadUpload(ctx, name, id)
+	if err != nil {
+		return nil, err
+	}
+	return &upload.UploadInfo, nil
+}
+
+func (s *S3) CancelUpload(ctx context.Context, name, id string) error {
+	unlock := s.lockUpload(id)
+	defer unlock()
+
+	upload, err := s.loadUpload(ctx, name, id)
+	if err != nil {
+		return err
+	}
+
+	s.removeUpload(ctx, upload)
+	return nil
+}
+
+// PurgeUploads removes uploads that have not been written to since the given
+// time, along with blobs left behind by interrupted pushes.
+func (s *S3) PurgeUploads(ctx context.Context, before time.Time) ([]model.UploadInfo, error) {
+	purged := []model.UploadInfo{}
+
+	err := s.walkRepositories(ctx, uploadsDir, func(name, key string, object minio.ObjectInfo) error {
+		if strings.HasPrefix(key, tempBlobPrefix) {
+			if object.LastModified.Before(before) {
+				s.remove(ctx, object.Key)
+			}
+			return nil
+		}
+
+		id, ok := uploadIDOf(key)
+		if !ok {
+			return nil
+		}
+
+		unlock := s.lockUpload(id)
+		defer unlock()
+
+		upload, err := s.loadUpload(ctx, name, id)
+		if err != nil {
+			log.Warn().Err(err).Str("upload", id).Msg("failed to load upload")
+			return nil
+		}
+
+		if upload.UpdatedAt.Before(before) {
+			s.removeUpload(ctx, upload)
+			purged = append(purged, upload.UploadInfo)
+		}
+		return nil
+	})
+
+	return purged, err
+}
+
+// countingReader counts the bytes read from the reader and keeps the first
+// error it returned other than io.EOF.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
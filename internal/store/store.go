@@ -1,37 +1,61 @@
 package store
 
 import (
+	"context"
 	"io"
+	"time"
 
 	"github.com/dvjn/sorcerer/internal/config"
 	fs_store "github.com/dvjn/sorcerer/internal/store/fs_store"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
 	"github.com/dvjn/sorcerer/internal/store/model"
+	s3_store "github.com/dvjn/sorcerer/internal/store/s3_store"
 )
 
+// Store holds the content of all repositories. Methods fail with the errors
+// in the model package, wrapped, when content does not exist or a request
+// cannot be satisfied, and stop copying content once ctx is done.
 type Store interface {
-	HasBlob(name, digest string) (bool, int64, error)
-	GetBlob(name, digest string) (io.ReadCloser, int64, error)
-	PutBlob(name, digest string, content io.Reader) error
-	DeleteBlob(name, digest string) error
-	MountBlob(fromName, toName, digest string) error
-
-	HasManifest(name, reference string) (bool, int64, string, error)
-	GetManifest(name, reference string) ([]byte, string, error)
-	PutManifest(name, reference string, content []byte) (string, error)
-	DeleteManifest(name, reference string) error
-
-	ListTags(name string) ([]string, error)
-
-	GetReferrers(name, digest string, artifactType string) ([]byte, error)
-	UpdateReferrers(name, digest string, manifest []byte) error
-	RemoveReferrer(name, digest, manifestDigest string) error
-
-	InitiateUpload(name string) (string, error)
-	UploadChunk(name, id string, content io.Reader, start int64, end int64) (int64, error)
-	CompleteUpload(name, id, digest string, content io.Reader) error
-	GetUploadInfo(name, id string) (*model.UploadInfo, error)
+	HasBlob(ctx context.Context, name, digest string) (bool, int64, error)
+	// GetBlob returns a seekable reader so that byte ranges can be served.
+	GetBlob(ctx context.Context, name, digest string) (io.ReadSeekCloser, int64, error)
+	PutBlob(ctx context.Context, name, digest string, content io.Reader) error
+	DeleteBlob(ctx context.Context, name, digest string) error
+	MountBlob(ctx context.Context, fromName, toName, digest string) error
+	ListBlobs(ctx context.Context, name string) ([]model.ContentInfo, error)
+
+	HasManifest(ctx context.Context, name, reference string) (bool, int64, string, error)
+	GetManifest(ctx context.Context, name, reference string) ([]byte, string, error)
+	PutManifest(ctx context.Context, name, reference string, content []byte) (string, error)
+	DeleteManifest(ctx context.Context, name, reference string) error
+	ListManifests(ctx context.Context, name string) ([]model.ContentInfo, error)
+
+	ListTags(ctx context.Context, name string) ([]string, error)
+	// ListRepositories lists the repositories holding manifests, while
+	// ListLinkedRepositories lists those holding blobs, which a repository
+	// can do after its last manifest is deleted.
+	ListRepositories(ctx context.Context) ([]string, error)
+	ListLinkedRepositories(ctx context.Context) ([]string, error)
+
+	GetReferrers(ctx context.Context, name, digest string, artifactType string) ([]byte, error)
+	UpdateReferrers(ctx context.Context, name, manifestDigest string, manifest []byte) error
+	RemoveReferrer(ctx context.Context, name, digest, manifestDigest string) error
+
+	InitiateUpload(ctx context.Context, name string) (string, error)
+	UploadChunk(ctx context.Context, name, id string, content io.Reader, start int64, end int64) (int64, error)
+	CompleteUpload(ctx context.Context, name, id, digest string, content io.Reader) error
+	GetUploadInfo(ctx context.Context, name, id string) (*model.UploadInfo, error)
+	CancelUpload(ctx context.Context, name, id string) error
+	PurgeUploads(ctx context.Context, before time.Time) ([]model.UploadInfo, error)
 }
 
 func New(c *config.StoreConfig) (Store, error) {
-	return fs_store.New(c)
+	switch c.Backend {
+	case config.StoreBackendS3:
+		return s3_store.New(c)
+	case config.StoreBackendMemory:
+		return mem_store.New(c)
+	default:
+		return fs_store.New(c)
+	}
 }
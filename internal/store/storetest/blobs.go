@@ -0,0 +1,134 @@
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+)
+
+func testBlobs(t *testing.T, s store.Store) {
+	content := []byte("0123456789")
+	digest := digestOf(content)
+
+	if exists, _, err := s.HasBlob(t.Context(), "app", digest); err != nil || exists {
+		t.Errorf("Expected unknown blob to not exist, got %v (%v)", exists, err)
+	}
+	if _, _, err := s.GetBlob(t.Context(), "app", digest); !errors.Is(err, model.ErrBlobUnknown) {
+		t.Errorf("Expected unknown blob error, got %v", err)
+	}
+
+	if err := s.PutBlob(t.Context(), "app", digestOf([]byte("other")), bytes.NewReader(content)); !errors.Is(err, model.ErrDigestMismatch) {
+		t.Errorf("Expected digest mismatch, got %v", err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "app", digestOf([]byte("other"))); exists {
+		t.Error("Expected blob with mismatched digest to not be stored")
+	}
+
+	putBlob(t, s, "app", content)
+	// Pushing the same blob again is not an error
+	putBlob(t, s, "app", content)
+
+	exists, size, err := s.HasBlob(t.Context(), "app", digest)
+	if err != nil || !exists || size != int64(len(content)) {
+		t.Errorf("Expected blob of %d bytes, got %v %d (%v)", len(content), exists, size, err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "other", digest); exists {
+		t.Error("Expected blob to only exist in the repository it was pushed to")
+	}
+
+	if got := readBlob(t, s, "app", digest); !bytes.Equal(got, content) {
+		t.Errorf("Expected content %q, got %q", content, got)
+	}
+
+	blob, _, err := s.GetBlob(t.Context(), "app", digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %v", err)
+	}
+	if _, err := blob.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	if rest, err := io.ReadAll(blob); err != nil || string(rest) != "6789" {
+		t.Errorf("Expected content after seeking to be %q, got %q (%v)", "6789", rest, err)
+	}
+	blob.Close()
+
+	other := []byte("sha512 content")
+	otherDigest := sha512DigestOf(other)
+	if err := s.PutBlob(t.Context(), "app", otherDigest, bytes.NewReader(other)); err != nil {
+		t.Fatalf("Failed to put sha512 blob: %v", err)
+	}
+	if got := readBlob(t, s, "app", otherDigest); !bytes.Equal(got, other) {
+		t.Errorf("Expected content %q, got %q", other, got)
+	}
+
+	blobs, err := s.ListBlobs(t.Context(), "app")
+	if err != nil {
+		t.Fatalf("Failed to list blobs: %v", err)
+	}
+	for _, expected := range []model.ContentInfo{{Digest: digest, Size: int64(len(content))}, {Digest: otherDigest, Size: int64(len(other))}} {
+		if !slices.ContainsFunc(blobs, func(info model.ContentInfo) bool {
+			return info.Digest == expected.Digest && info.Size == expected.Size
+		}) {
+			t.Errorf("Expected blob %s of %d bytes to be listed, got %+v", expected.Digest, expected.Size, blobs)
+		}
+	}
+	if blobs, err := s.ListBlobs(t.Context(), "unknown"); err != nil || len(blobs) != 0 {
+		t.Errorf("Expected no blobs in unknown repository, got %+v (%v)", blobs, err)
+	}
+
+	if err := s.DeleteBlob(t.Context(), "app", digest); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "app", digest); exists {
+		t.Error("Expected deleted blob to be gone")
+	}
+	if err := s.DeleteBlob(t.Context(), "app", digest); !errors.Is(err, model.ErrBlobUnknown) {
+		t.Errorf("Expected unknown blob error deleting unknown blob, got %v", err)
+	}
+
+	// A deleted blob can be pushed again
+	putBlob(t, s, "app", content)
+	if got := readBlob(t, s, "app", digest); !bytes.Equal(got, content) {
+		t.Errorf("Expected content %q, got %q", content, got)
+	}
+}
+
+func testMounts(t *testing.T, s store.Store) {
+	content := []byte("shared layer")
+	digest := digestOf(content)
+
+	if err := s.MountBlob(t.Context(), "app", "other", digest); !errors.Is(err, model.ErrBlobUnknown) {
+		t.Errorf("Expected unknown blob error mounting unknown blob, got %v", err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "other", digest); exists {
+		t.Error("Expected failed mount to not create the blob")
+	}
+
+	putBlob(t, s, "team/app", content)
+	if err := s.MountBlob(t.Context(), "team/app", "team/other", digest); err != nil {
+		t.Fatalf("Failed to mount blob: %v", err)
+	}
+	// Mounting a blob that is already there is not an error
+	if err := s.MountBlob(t.Context(), "team/app", "team/other", digest); err != nil {
+		t.Fatalf("Failed to mount blob again: %v", err)
+	}
+
+	if exists, size, _ := s.HasBlob(t.Context(), "team/other", digest); !exists || size != int64(len(content)) {
+		t.Errorf("Expected mounted blob of %d bytes, got %v %d", len(content), exists, size)
+	}
+
+	if err := s.DeleteBlob(t.Context(), "team/app", digest); err != nil {
+		t.Fatalf("Failed to delete blob: %v", err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "team/app", digest); exists {
+		t.Error("Expected blob to be deleted from the source repository")
+	}
+	if got := readBlob(t, s, "team/other", digest); !bytes.Equal(got, content) {
+		t.Errorf("Expected mounted blob to remain with content %q, got %q", content, got)
+	}
+}
@@ -0,0 +1,131 @@
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+)
+
+const workers = 8
+
+// testConcurrentAccess pushes the same image from several clients at once,
+// the way parallel CI jobs do.
+func testConcurrentAccess(t *testing.T, s store.Store) {
+	layer := bytes.Repeat([]byte("layer"), 1024)
+	layerDigest := digestOf(layer)
+	image := imageManifest("shared")
+	imageDigest := putManifest(t, s, "shared", "base", image)
+
+	ids := make([]string, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// The same blob, both pushed directly and uploaded in chunks
+			if err := s.PutBlob(t.Context(), "shared", layerDigest, bytes.NewReader(layer)); err != nil {
+				t.Errorf("Failed to put blob: %v", err)
+			}
+
+			id, err := s.InitiateUpload(t.Context(), "shared")
+			if err != nil {
+				t.Errorf("Failed to initiate upload: %v", err)
+				return
+			}
+			ids[i] = id
+
+			offset, err := s.UploadChunk(t.Context(), "shared", id, bytes.NewReader(layer[:2048]), 0, 2047)
+			if err != nil {
+				t.Errorf("Failed to upload chunk: %v", err)
+				return
+			}
+			if err := s.CompleteUpload(t.Context(), "shared", id, layerDigest, bytes.NewReader(layer[offset:])); err != nil {
+				t.Errorf("Failed to complete upload: %v", err)
+			}
+
+			if err := s.MountBlob(t.Context(), "shared", fmt.Sprintf("mount-%d", i), layerDigest); err != nil {
+				t.Errorf("Failed to mount blob: %v", err)
+			}
+
+			if _, err := s.PutManifest(t.Context(), "shared", fmt.Sprintf("tag-%d", i), image); err != nil {
+				t.Errorf("Failed to put manifest: %v", err)
+			}
+
+			signature := artifactManifest("application/example.signature", imageDigest, fmt.Sprint(i))
+			if digest, err := s.PutManifest(t.Context(), "shared", digestOf(signature), signature); err != nil {
+				t.Errorf("Failed to put referrer: %v", err)
+			} else if err := s.UpdateReferrers(t.Context(), "shared", digest, signature); err != nil {
+				t.Errorf("Failed to update referrers: %v", err)
+			}
+
+			if content, _, err := s.GetManifest(t.Context(), "shared", "base"); err != nil || !bytes.Equal(content, image) {
+				t.Errorf("Expected to read manifest while others push, got %q (%v)", content, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		return
+	}
+
+	slices.Sort(ids)
+	if len(slices.Compact(ids)) != workers {
+		t.Errorf("Expected %d distinct upload ids, got %v", workers, ids)
+	}
+
+	if got := readBlob(t, s, "shared", layerDigest); !bytes.Equal(got, layer) {
+		t.Error("Expected blob pushed concurrently to be intact")
+	}
+	for i := range workers {
+		if exists, _, _ := s.HasBlob(t.Context(), fmt.Sprintf("mount-%d", i), layerDigest); !exists {
+			t.Errorf("Expected blob to be mounted into mount-%d", i)
+		}
+	}
+
+	tags, err := s.ListTags(t.Context(), "shared")
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	if len(tags) != workers+1 {
+		t.Errorf("Expected %d tags, got %v", workers+1, tags)
+	}
+
+	if referrers := getReferrers(t, s, "shared", imageDigest, ""); len(referrers) != workers {
+		t.Errorf("Expected %d referrers, got %d", workers, len(referrers))
+	}
+}
+
+// testCancelledContext checks that content is not stored once the context of
+// the request writing it is done.
+func testCancelledContext(t *testing.T, s store.Store) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	content := bytes.Repeat([]byte("layer"), 1024)
+	digest := digestOf(content)
+
+	if err := s.PutBlob(ctx, "app", digest, bytes.NewReader(content)); err == nil {
+		t.Error("Expected error putting blob with cancelled context")
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "app", digest); exists {
+		t.Error("Expected blob put with cancelled context to not be stored")
+	}
+
+	id := initiateUpload(t, s, "app")
+	if _, err := s.UploadChunk(ctx, "app", id, bytes.NewReader(content), 0, int64(len(content))-1); err == nil {
+		t.Error("Expected error uploading chunk with cancelled context")
+	}
+	if err := s.CompleteUpload(ctx, "app", id, digest, bytes.NewReader(content)); err == nil {
+		t.Error("Expected error completing upload with cancelled context")
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "app", digest); exists {
+		t.Error("Expected upload completed with cancelled context to not be stored")
+	}
+}
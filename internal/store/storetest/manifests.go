@@ -0,0 +1,209 @@
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+)
+
+func testManifests(t *testing.T, s store.Store) {
+	image := imageManifest("v1")
+	imageDigest := digestOf(image)
+
+	if exists, _, _, err := s.HasManifest(t.Context(), "app", "v1"); err != nil || exists {
+		t.Errorf("Expected unknown tag to not exist, got %v (%v)", exists, err)
+	}
+	if exists, _, _, err := s.HasManifest(t.Context(), "app", imageDigest); err != nil || exists {
+		t.Errorf("Expected unknown digest to not exist, got %v (%v)", exists, err)
+	}
+	for _, reference := range []string{"v1", imageDigest} {
+		if _, _, err := s.GetManifest(t.Context(), "app", reference); !errors.Is(err, model.ErrManifestUnknown) {
+			t.Errorf("Expected unknown manifest error getting %s, got %v", reference, err)
+		}
+	}
+
+	if digest := putManifest(t, s, "app", "v1", image); digest != imageDigest {
+		t.Errorf("Expected digest %s, got %s", imageDigest, digest)
+	}
+
+	// Tags and digests resolve to the same manifest
+	for _, reference := range []string{"v1", imageDigest} {
+		exists, size, digest, err := s.HasManifest(t.Context(), "app", reference)
+		if err != nil || !exists || size != int64(len(image)) || digest != imageDigest {
+			t.Errorf("Expected %s to resolve to %s of %d bytes, got %v %s %d (%v)", reference, imageDigest, len(image), exists, digest, size, err)
+		}
+
+		content, digest, err := s.GetManifest(t.Context(), "app", reference)
+		if err != nil || !bytes.Equal(content, image) || digest != imageDigest {
+			t.Errorf("Expected %s to resolve to %s, got %s %q (%v)", reference, imageDigest, digest, content, err)
+		}
+	}
+
+	if exists, _, _, _ := s.HasManifest(t.Context(), "other", imageDigest); exists {
+		t.Error("Expected manifest to only exist in the repository it was pushed to")
+	}
+
+	if _, err := s.PutManifest(t.Context(), "app", digestOf([]byte("other")), image); !errors.Is(err, model.ErrDigestMismatch) {
+		t.Errorf("Expected digest mismatch, got %v", err)
+	}
+
+	// Manifests pushed by digest keep the algorithm of the digest
+	pinned := imageManifest("pinned")
+	pinnedDigest := sha512DigestOf(pinned)
+	if digest := putManifest(t, s, "app", pinnedDigest, pinned); digest != pinnedDigest {
+		t.Errorf("Expected digest %s, got %s", pinnedDigest, digest)
+	}
+	if content, _, err := s.GetManifest(t.Context(), "app", pinnedDigest); err != nil || !bytes.Equal(content, pinned) {
+		t.Errorf("Expected manifest pushed by sha512 digest, got %q (%v)", content, err)
+	}
+	if tags, _ := s.ListTags(t.Context(), "app"); !slices.Equal(tags, []string{"v1"}) {
+		t.Errorf("Expected pushing by digest to not create a tag, got %v", tags)
+	}
+
+	// Pushing a tag again moves it
+	updated := imageManifest("v1 updated")
+	updatedDigest := putManifest(t, s, "app", "v1", updated)
+	if _, _, digest, _ := s.HasManifest(t.Context(), "app", "v1"); digest != updatedDigest {
+		t.Errorf("Expected tag to move to %s, got %s", updatedDigest, digest)
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "app", imageDigest); !exists {
+		t.Error("Expected previous manifest to remain")
+	}
+
+	manifests, err := s.ListManifests(t.Context(), "app")
+	if err != nil {
+		t.Fatalf("Failed to list manifests: %v", err)
+	}
+	for _, expected := range []model.ContentInfo{
+		{Digest: imageDigest, Size: int64(len(image))},
+		{Digest: pinnedDigest, Size: int64(len(pinned))},
+		{Digest: updatedDigest, Size: int64(len(updated))},
+	} {
+		if !slices.ContainsFunc(manifests, func(info model.ContentInfo) bool {
+			return info.Digest == expected.Digest && info.Size == expected.Size
+		}) {
+			t.Errorf("Expected manifest %s of %d bytes to be listed, got %+v", expected.Digest, expected.Size, manifests)
+		}
+	}
+	if manifests, err := s.ListManifests(t.Context(), "unknown"); err != nil || len(manifests) != 0 {
+		t.Errorf("Expected no manifests in unknown repository, got %+v (%v)", manifests, err)
+	}
+
+	// Deleting a tag leaves the manifest
+	putManifest(t, s, "app", "latest", updated)
+	if err := s.DeleteManifest(t.Context(), "app", "latest"); err != nil {
+		t.Fatalf("Failed to delete tag: %v", err)
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "app", "latest"); exists {
+		t.Error("Expected deleted tag to be gone")
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "app", updatedDigest); !exists {
+		t.Error("Expected manifest of deleted tag to remain")
+	}
+	if err := s.DeleteManifest(t.Context(), "app", "latest"); !errors.Is(err, model.ErrManifestUnknown) {
+		t.Errorf("Expected unknown manifest error deleting unknown tag, got %v", err)
+	}
+
+	// Deleting a manifest removes the tags pointing to it
+	if err := s.DeleteManifest(t.Context(), "app", updatedDigest); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "app", updatedDigest); exists {
+		t.Error("Expected deleted manifest to be gone")
+	}
+	if exists, _, _, _ := s.HasManifest(t.Context(), "app", "v1"); exists {
+		t.Error("Expected tag of deleted manifest to be gone")
+	}
+	if err := s.DeleteManifest(t.Context(), "app", updatedDigest); !errors.Is(err, model.ErrManifestUnknown) {
+		t.Errorf("Expected unknown manifest error deleting unknown manifest, got %v", err)
+	}
+}
+
+func testTags(t *testing.T, s store.Store) {
+	if tags, err := s.ListTags(t.Context(), "app"); err != nil || len(tags) != 0 {
+		t.Errorf("Expected no tags in unknown repository, got %v (%v)", tags, err)
+	}
+
+	for _, tag := range []string{"v2", "latest", "v1", "V1"} {
+		putManifest(t, s, "app", tag, imageManifest(tag))
+	}
+	putManifest(t, s, "app/nested", "nested", imageManifest("nested"))
+
+	// Tags are sorted lexically, and those of nested repositories are excluded
+	if tags, err := s.ListTags(t.Context(), "app"); err != nil || !slices.Equal(tags, []string{"V1", "latest", "v1", "v2"}) {
+		t.Errorf("Expected sorted tags, got %v (%v)", tags, err)
+	}
+	if tags, err := s.ListTags(t.Context(), "app/nested"); err != nil || !slices.Equal(tags, []string{"nested"}) {
+		t.Errorf("Expected tags of nested repository, got %v (%v)", tags, err)
+	}
+}
+
+func testRepositories(t *testing.T, s store.Store) {
+	if repositories, err := s.ListRepositories(t.Context()); err != nil || len(repositories) != 0 {
+		t.Errorf("Expected no repositories, got %v (%v)", repositories, err)
+	}
+
+	putManifest(t, s, "team/app", "latest", imageManifest("app"))
+	putManifest(t, s, "team/app/nested", "latest", imageManifest("nested"))
+	base := imageManifest("base")
+	putManifest(t, s, "base", digestOf(base), base)
+	// Repositories only holding blobs are not listed
+	putBlob(t, s, "blobs/only", []byte("layer"))
+
+	if repositories, err := s.ListRepositories(t.Context()); err != nil || !slices.Equal(repositories, []string{"base", "team/app", "team/app/nested"}) {
+		t.Errorf("Expected sorted repositories, got %v (%v)", repositories, err)
+	}
+
+	// But they are listed with those that hold blobs
+	putBlob(t, s, "team/app", []byte("layer"))
+	if repositories, err := s.ListLinkedRepositories(t.Context()); err != nil || !slices.Equal(repositories, []string{"blobs/only", "team/app"}) {
+		t.Errorf("Expected sorted repositories holding blobs, got %v (%v)", repositories, err)
+	}
+}
+
+// testNestedRepositories checks that a repository and the repositories nested
+// in it keep their content apart, even where a tag of one is named like a
+// component of the other.
+func testNestedRepositories(t *testing.T, s store.Store) {
+	// Parents are pushed first in one case and last in the other
+	pushes := []struct{ name, tag string }{{"a", "b"}, {"a/b", "latest"}, {"c/d", "latest"}, {"c", "d"}}
+
+	for _, push := range pushes {
+		digest := putManifest(t, s, push.name, push.tag, imageManifest(push.name))
+		putReferrer(t, s, push.name, artifactManifest("application/vnd.example", digest, push.name))
+		putBlob(t, s, push.name, []byte("layer of "+push.name))
+		if _, err := s.InitiateUpload(t.Context(), push.name); err != nil {
+			t.Fatalf("Failed to initiate upload in %s: %v", push.name, err)
+		}
+	}
+
+	for _, push := range pushes {
+		image := imageManifest(push.name)
+		if content, _, err := s.GetManifest(t.Context(), push.name, push.tag); err != nil || !bytes.Equal(content, image) {
+			t.Errorf("Expected %s:%s to resolve to its manifest, got %q (%v)", push.name, push.tag, content, err)
+		}
+		if tags, err := s.ListTags(t.Context(), push.name); err != nil || !slices.Equal(tags, []string{push.tag}) {
+			t.Errorf("Expected %s to only be tagged %s, got %v (%v)", push.name, push.tag, tags, err)
+		}
+		if content := readBlob(t, s, push.name, digestOf([]byte("layer of "+push.name))); string(content) != "layer of "+push.name {
+			t.Errorf("Expected blob of %s, got %q", push.name, content)
+		}
+		if blobs, err := s.ListBlobs(t.Context(), push.name); err != nil || len(blobs) != 1 {
+			t.Errorf("Expected one blob in %s, got %v (%v)", push.name, blobs, err)
+		}
+		if referrers := getReferrers(t, s, push.name, digestOf(image), ""); len(referrers) != 1 {
+			t.Errorf("Expected one referrer of the manifest of %s, got %+v", push.name, referrers)
+		}
+	}
+
+	if repositories, err := s.ListRepositories(t.Context()); err != nil || !slices.Equal(repositories, []string{"a", "a/b", "c", "c/d"}) {
+		t.Errorf("Expected nested repositories to be listed, got %v (%v)", repositories, err)
+	}
+	if repositories, err := s.ListLinkedRepositories(t.Context()); err != nil || !slices.Equal(repositories, []string{"a", "a/b", "c", "c/d"}) {
+		t.Errorf("Expected nested repositories holding blobs to be listed, got %v (%v)", repositories, err)
+	}
+}
@@ -0,0 +1,128 @@
+package storetest
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	image_v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func getReferrers(t *testing.T, s store.Store, name, digest, artifactType string) []image_v1.Descriptor {
+	t.Helper()
+
+	content, err := s.GetReferrers(t.Context(), name, digest, artifactType)
+	if err != nil {
+		t.Fatalf("Failed to get referrers: %v", err)
+	}
+
+	var index image_v1.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		t.Fatalf("Failed to parse referrers %s: %v", content, err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != image_v1.MediaTypeImageIndex || index.Manifests == nil {
+		t.Errorf("Expected referrers to be an image index with a manifests list, got %s", content)
+	}
+	return index.Manifests
+}
+
+// putReferrer pushes a manifest and updates the referrers of its subject, the
+// way the distribution API does.
+func putReferrer(t *testing.T, s store.Store, name string, manifest []byte) string {
+	t.Helper()
+	digest := putManifest(t, s, name, digestOf(manifest), manifest)
+	if err := s.UpdateReferrers(t.Context(), name, digest, manifest); err != nil {
+		t.Fatalf("Failed to update referrers: %v", err)
+	}
+	return digest
+}
+
+func digests(descriptors []image_v1.Descriptor) []string {
+	digests := make([]string, len(descriptors))
+	for i, descriptor := range descriptors {
+		digests[i] = descriptor.Digest.String()
+	}
+	return digests
+}
+
+func testReferrers(t *testing.T, s store.Store) {
+	image := imageManifest("subject")
+	subject := putManifest(t, s, "app", "latest", image)
+
+	if referrers := getReferrers(t, s, "app", subject, ""); len(referrers) != 0 {
+		t.Errorf("Expected no referrers, got %+v", referrers)
+	}
+	if referrers := getReferrers(t, s, "unknown", subject, ""); len(referrers) != 0 {
+		t.Errorf("Expected no referrers in unknown repository, got %+v", referrers)
+	}
+
+	// Manifests without a subject do not refer to anything
+	if err := s.UpdateReferrers(t.Context(), "app", subject, image); err != nil {
+		t.Errorf("Expected manifest without subject to be ignored, got %v", err)
+	}
+
+	signature := artifactManifest("application/example.signature", subject, "signature")
+	signatureDigest := putReferrer(t, s, "app", signature)
+	sbom := artifactManifest("application/example.sbom", subject, "sbom")
+	sbomDigest := putReferrer(t, s, "app", sbom)
+	// Updating with the same manifest again does not list it twice
+	putReferrer(t, s, "app", signature)
+
+	referrers := getReferrers(t, s, "app", subject, "")
+	if len(referrers) != 2 {
+		t.Fatalf("Expected 2 referrers, got %v", digests(referrers))
+	}
+	for _, referrer := range referrers {
+		switch referrer.Digest.String() {
+		case signatureDigest:
+			if referrer.ArtifactType != "application/example.signature" || referrer.Size != int64(len(signature)) ||
+				referrer.MediaType != image_v1.MediaTypeImageManifest || referrer.Annotations["value"] != "signature" {
+				t.Errorf("Unexpected descriptor for signature: %+v", referrer)
+			}
+		case sbomDigest:
+			if referrer.ArtifactType != "application/example.sbom" || referrer.Size != int64(len(sbom)) {
+				t.Errorf("Unexpected descriptor for sbom: %+v", referrer)
+			}
+		default:
+			t.Errorf("Unexpected referrer %s", referrer.Digest)
+		}
+	}
+
+	if referrers := getReferrers(t, s, "app", subject, "application/example.sbom"); len(referrers) != 1 || referrers[0].Digest.String() != sbomDigest {
+		t.Errorf("Expected referrers filtered by artifact type, got %v", digests(referrers))
+	}
+	if referrers := getReferrers(t, s, "app", subject, "application/example.unknown"); len(referrers) != 0 {
+		t.Errorf("Expected no referrers of unknown artifact type, got %v", digests(referrers))
+	}
+	if referrers := getReferrers(t, s, "other", subject, ""); len(referrers) != 0 {
+		t.Errorf("Expected referrers to only be listed in their repository, got %v", digests(referrers))
+	}
+
+	if err := s.RemoveReferrer(t.Context(), "app", subject, signatureDigest); err != nil {
+		t.Fatalf("Failed to remove referrer: %v", err)
+	}
+	if referrers := getReferrers(t, s, "app", subject, ""); len(referrers) != 1 || referrers[0].Digest.String() != sbomDigest {
+		t.Errorf("Expected removed referrer to be gone, got %v", digests(referrers))
+	}
+	if err := s.RemoveReferrer(t.Context(), "app", digestOf([]byte("unknown")), signatureDigest); err != nil {
+		t.Errorf("Expected removing from unknown subject to be ignored, got %v", err)
+	}
+}
+
+// testFilteredReferrers checks that listing the referrers of a manifest
+// filtered by artifact type does not affect later listings.
+func testFilteredReferrers(t *testing.T, s store.Store) {
+	subject := putManifest(t, s, "app", "latest", imageManifest("subject"))
+	signature := putReferrer(t, s, "app", artifactManifest("application/example.signature", subject, "signature"))
+	sbom := putReferrer(t, s, "app", artifactManifest("application/example.sbom", subject, "sbom"))
+
+	for range 2 {
+		if referrers := getReferrers(t, s, "app", subject, "application/example.sbom"); len(referrers) != 1 || referrers[0].Digest.String() != sbom {
+			t.Errorf("Expected referrers filtered by artifact type, got %v", digests(referrers))
+		}
+		if referrers := digests(getReferrers(t, s, "app", subject, "")); len(referrers) != 2 || !slices.Contains(referrers, signature) || !slices.Contains(referrers, sbom) {
+			t.Errorf("Expected all referrers after a filtered listing, got %v", referrers)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package storetest is a conformance suite for store.Store implementations.
+// A backend validates itself by calling Run from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			return newTestStore(t)
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/dvjn/sorcerer/internal/store"
+)
+
+// Run runs the suite against the stores returned by newStore, which is called
+// once for every test and must return an empty store.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s store.Store)
+	}{
+		{"Blobs", testBlobs},
+		{"Mounts", testMounts},
+		{"Manifests", testManifests},
+		{"Tags", testTags},
+		{"Repositories", testRepositories},
+		{"NestedRepositories", testNestedRepositories},
+		{"Referrers", testReferrers},
+		{"FilteredReferrers", testFilteredReferrers},
+		{"Uploads", testUploads},
+		{"UploadOffsets", testUploadOffsets},
+		{"CancelAndPurgeUploads", testCancelAndPurgeUploads},
+		{"ConcurrentAccess", testConcurrentAccess},
+		{"CancelledContext", testCancelledContext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func sha512DigestOf(content []byte) string {
+	sum := sha512.Sum512(content)
+	return "sha512:" + hex.EncodeToString(sum[:])
+}
+
+// imageManifest returns an image manifest that is unique for the given
+// annotation value.
+func imageManifest(value string) []byte {
+	return fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[],"annotations":{"value":%q}}`, value)
+}
+
+// artifactManifest returns a manifest of the given artifact type that refers
+// to the subject.
+func artifactManifest(artifactType, subject, value string) []byte {
+	return fmt.Appendf(nil, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":%q,"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":2},"annotations":{"value":%q}}`, artifactType, subject, value)
+}
+
+func putBlob(t *testing.T, s store.Store, name string, content []byte) string {
+	t.Helper()
+	digest := digestOf(content)
+	if err := s.PutBlob(t.Context(), name, digest, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Failed to put blob: %v", err)
+	}
+	return digest
+}
+
+func putManifest(t *testing.T, s store.Store, name, reference string, content []byte) string {
+	t.Helper()
+	digest, err := s.PutManifest(t.Context(), name, reference, content)
+	if err != nil {
+		t.Fatalf("Failed to put manifest: %v", err)
+	}
+	return digest
+}
+
+// readBlob reads a blob in full, checking it has the size the store reports.
+func readBlob(t *testing.T, s store.Store, name, digest string) []byte {
+	t.Helper()
+
+	blob, size, err := s.GetBlob(t.Context(), name, digest)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %v", err)
+	}
+	defer blob.Close()
+
+	content, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("Failed to read blob: %v", err)
+	}
+	if int64(len(content)) != size {
+		t.Errorf("Expected blob of %d bytes, read %d", size, len(content))
+	}
+	return content
+}
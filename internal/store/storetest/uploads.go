@@ -0,0 +1,171 @@
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/store"
+	"github.com/dvjn/sorcerer/internal/store/model"
+)
+
+func initiateUpload(t *testing.T, s store.Store, name string) string {
+	t.Helper()
+	id, err := s.InitiateUpload(t.Context(), name)
+	if err != nil {
+		t.Fatalf("Failed to initiate upload: %v", err)
+	}
+	return id
+}
+
+func uploadChunk(t *testing.T, s store.Store, name, id string, offset int64, chunk []byte) int64 {
+	t.Helper()
+	offset, err := s.UploadChunk(t.Context(), name, id, bytes.NewReader(chunk), offset, offset+int64(len(chunk))-1)
+	if err != nil {
+		t.Fatalf("Failed to upload chunk: %v", err)
+	}
+	return offset
+}
+
+func testUploads(t *testing.T, s store.Store) {
+	content := []byte("chunked upload content")
+	digest := digestOf(content)
+
+	id := initiateUpload(t, s, "team/app")
+	info, err := s.GetUploadInfo(t.Context(), "team/app", id)
+	if err != nil || info.ID != id || info.Name != "team/app" || info.Offset != 0 {
+		t.Errorf("Expected new upload at offset 0, got %+v (%v)", info, err)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "team/other", id); !errors.Is(err, model.ErrUploadUnknown) {
+		t.Errorf("Expected upload to only be known to its repository, got %v", err)
+	}
+
+	offset := uploadChunk(t, s, "team/app", id, 0, content[:7])
+	offset = uploadChunk(t, s, "team/app", id, offset, content[7:15])
+	if offset != 15 {
+		t.Errorf("Expected offset 15, got %d", offset)
+	}
+	if info, err := s.GetUploadInfo(t.Context(), "team/app", id); err != nil || info.Offset != 15 {
+		t.Errorf("Expected upload at offset 15, got %+v (%v)", info, err)
+	}
+
+	// The last chunk may come with the request completing the upload
+	if err := s.CompleteUpload(t.Context(), "team/app", id, digest, bytes.NewReader(content[15:])); err != nil {
+		t.Fatalf("Failed to complete upload: %v", err)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "team/app", id); err == nil {
+		t.Error("Expected completed upload to be gone")
+	}
+	if got := readBlob(t, s, "team/app", digest); !bytes.Equal(got, content) {
+		t.Errorf("Expected content %q, got %q", content, got)
+	}
+
+	// Or all of it
+	other := []byte("monolithic upload content")
+	id = initiateUpload(t, s, "team/app")
+	uploadChunk(t, s, "team/app", id, 0, other)
+	if err := s.CompleteUpload(t.Context(), "team/app", id, digestOf([]byte("wrong")), nil); !errors.Is(err, model.ErrDigestMismatch) {
+		t.Errorf("Expected digest mismatch, got %v", err)
+	}
+	if exists, _, _ := s.HasBlob(t.Context(), "team/app", digestOf([]byte("wrong"))); exists {
+		t.Error("Expected upload with mismatched digest to not be stored")
+	}
+	// The upload is kept for the client to retry
+	if info, err := s.GetUploadInfo(t.Context(), "team/app", id); err != nil || info.Offset != int64(len(other)) {
+		t.Errorf("Expected upload with mismatched digest to be kept, got %+v (%v)", info, err)
+	}
+	if err := s.CompleteUpload(t.Context(), "team/app", id, digestOf(other), nil); err != nil {
+		t.Fatalf("Failed to complete upload after digest mismatch: %v", err)
+	}
+
+	id = initiateUpload(t, s, "team/app")
+	uploadChunk(t, s, "team/app", id, 0, other[:9])
+	if err := s.CompleteUpload(t.Context(), "team/app", id, sha512DigestOf([]byte("wrong")), bytes.NewReader(other[9:])); !errors.Is(err, model.ErrDigestMismatch) {
+		t.Errorf("Expected sha512 digest mismatch, got %v", err)
+	}
+	if info, err := s.GetUploadInfo(t.Context(), "team/app", id); err != nil || info.Offset != int64(len(other)) {
+		t.Errorf("Expected upload with mismatched sha512 digest to be kept, got %+v (%v)", info, err)
+	}
+	if err := s.CompleteUpload(t.Context(), "team/app", id, sha512DigestOf(other), nil); err != nil {
+		t.Fatalf("Failed to complete upload with sha512 digest: %v", err)
+	}
+	if got := readBlob(t, s, "team/app", sha512DigestOf(other)); !bytes.Equal(got, other) {
+		t.Errorf("Expected content %q, got %q", other, got)
+	}
+
+	// Including none of it
+	id = initiateUpload(t, s, "team/app")
+	if err := s.CompleteUpload(t.Context(), "team/app", id, digestOf(nil), nil); err != nil {
+		t.Fatalf("Failed to complete empty upload: %v", err)
+	}
+	if exists, size, _ := s.HasBlob(t.Context(), "team/app", digestOf(nil)); !exists || size != 0 {
+		t.Errorf("Expected empty blob, got %v %d", exists, size)
+	}
+
+	if err := s.CompleteUpload(t.Context(), "team/app", "unknown", digest, nil); !errors.Is(err, model.ErrUploadUnknown) {
+		t.Errorf("Expected unknown upload error completing unknown upload, got %v", err)
+	}
+}
+
+func testUploadOffsets(t *testing.T, s store.Store) {
+	id := initiateUpload(t, s, "app")
+	offset := uploadChunk(t, s, "app", id, 0, []byte("first"))
+
+	for _, start := range []int64{0, offset - 1, offset + 1} {
+		if _, err := s.UploadChunk(t.Context(), "app", id, strings.NewReader("again"), start, start+4); !errors.Is(err, model.ErrRangeInvalid) {
+			t.Errorf("Expected invalid range error for chunk at %d, got %v", start, err)
+		}
+	}
+	if info, err := s.GetUploadInfo(t.Context(), "app", id); err != nil || info.Offset != offset {
+		t.Errorf("Expected rejected chunks to leave the upload at offset %d, got %+v (%v)", offset, info, err)
+	}
+
+	if _, err := s.UploadChunk(t.Context(), "app", "unknown", strings.NewReader("chunk"), 0, 4); !errors.Is(err, model.ErrUploadUnknown) {
+		t.Errorf("Expected unknown upload error uploading to unknown upload, got %v", err)
+	}
+	if _, err := s.UploadChunk(t.Context(), "other", id, strings.NewReader("chunk"), offset, offset+4); !errors.Is(err, model.ErrUploadUnknown) {
+		t.Errorf("Expected unknown upload error uploading to upload of another repository, got %v", err)
+	}
+
+	if offset := uploadChunk(t, s, "app", id, offset, []byte("second")); offset != 11 {
+		t.Errorf("Expected offset 11, got %d", offset)
+	}
+}
+
+func testCancelAndPurgeUploads(t *testing.T, s store.Store) {
+	cancelled := initiateUpload(t, s, "app")
+	uploadChunk(t, s, "app", cancelled, 0, []byte("cancelled"))
+
+	if err := s.CancelUpload(t.Context(), "other", cancelled); err == nil {
+		t.Error("Expected error cancelling upload of another repository")
+	}
+	if err := s.CancelUpload(t.Context(), "app", cancelled); err != nil {
+		t.Fatalf("Failed to cancel upload: %v", err)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "app", cancelled); err == nil {
+		t.Error("Expected cancelled upload to be gone")
+	}
+	if err := s.CancelUpload(t.Context(), "app", cancelled); !errors.Is(err, model.ErrUploadUnknown) {
+		t.Errorf("Expected unknown upload error cancelling unknown upload, got %v", err)
+	}
+
+	expired := initiateUpload(t, s, "app")
+	uploadChunk(t, s, "app", expired, 0, []byte("expired"))
+
+	if purged, err := s.PurgeUploads(t.Context(), time.Now().Add(-time.Hour)); err != nil || len(purged) != 0 {
+		t.Errorf("Expected recent upload to be kept, got %+v (%v)", purged, err)
+	}
+
+	purged, err := s.PurgeUploads(t.Context(), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Failed to purge uploads: %v", err)
+	}
+	if len(purged) != 1 || purged[0].ID != expired || purged[0].Name != "app" {
+		t.Errorf("Expected upload %s to be purged, got %+v", expired, purged)
+	}
+	if _, err := s.GetUploadInfo(t.Context(), "app", expired); err == nil {
+		t.Error("Expected purged upload to be gone")
+	}
+}
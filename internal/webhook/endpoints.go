@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/dvjn/sorcerer/internal/access"
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/queue"
+)
+
+// Endpoints are named after their queue directories
+var endpointNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Endpoint receives the events it matches. Events are filtered by their
+// action and by repository, with globs in which "*" does not match across
+// slashes and "**" matches any number of components. An empty filter matches
+// everything.
+type Endpoint struct {
+	Name         string            `json:"name"`
+	URL          string            `json:"url"`
+	Secret       string            `json:"secret"`  // Key deliveries are signed with, unsigned if empty
+	Headers      map[string]string `json:"headers"` // Sent along with every delivery, such as an Authorization header
+	Actions      []string          `json:"actions"`
+	Repositories []string          `json:"repositories"`
+
+	queue *queue.Queue
+}
+
+// loadEndpoints reads the endpoints from the configuration, inline or from a
+// file.
+func loadEndpoints(c *config.WebhooksConfig) ([]*Endpoint, error) {
+	content := []byte(c.Endpoints)
+	if c.EndpointsFile != "" {
+		var err error
+		if content, err = os.ReadFile(c.EndpointsFile); err != nil {
+			return nil, fmt.Errorf("failed to read webhook endpoints: %w", err)
+		}
+	}
+
+	var endpoints []*Endpoint
+	if err := json.Unmarshal(content, &endpoints); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook endpoints: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i, endpoint := range endpoints {
+		if !endpointNameRegexp.MatchString(endpoint.Name) {
+			return nil, fmt.Errorf("webhook endpoint %d has an invalid name: %q", i, endpoint.Name)
+		}
+		if names[endpoint.Name] {
+			return nil, fmt.Errorf("webhook endpoint %s is defined twice", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook endpoint %s has an invalid url: %q", endpoint.Name, endpoint.URL)
+		}
+
+		for _, action := range endpoint.Actions {
+			if !slices.Contains(distribution.Actions, action) {
+				return nil, fmt.Errorf("webhook endpoint %s has an unknown action: %q", endpoint.Name, action)
+			}
+		}
+		for _, repository := range endpoint.Repositories {
+			if err := access.ValidateRepositoryGlob(repository); err != nil {
+				return nil, fmt.Errorf("webhook endpoint %s has an invalid repository glob: %q", endpoint.Name, repository)
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
+func (e *Endpoint) matches(event distribution.Event) bool {
+	if len(e.Actions) > 0 && !slices.Contains(e.Actions, event.Action) {
+		return false
+	}
+	return len(e.Repositories) == 0 || access.MatchAnyRepository(e.Repositories, event.Repository)
+}
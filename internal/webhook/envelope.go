@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/distribution"
+)
+
+// MediaType is the content type of deliveries, the one docker distribution
+// sends its notifications with.
+const MediaType = "application/vnd.docker.distribution.events.v1+json"
+
+// Envelope is the body of a delivery. It follows the notification format of
+// docker distribution, with the actions of sorcerer's events, so that
+// receivers written for it mostly work unchanged. Every delivery holds a
+// single event.
+type Envelope struct {
+	Events []Record `json:"events"`
+}
+
+type Record struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    Target    `json:"target"`
+	Request   Request   `json:"request"`
+	Source    Source    `json:"source"`
+}
+
+type Target struct {
+	MediaType      string `json:"mediaType,omitempty"`
+	Size           int64  `json:"size,omitempty"`
+	Length         int64  `json:"length,omitempty"`
+	Digest         string `json:"digest,omitempty"`
+	Repository     string `json:"repository"`
+	Tag            string `json:"tag,omitempty"`
+	FromRepository string `json:"fromRepository,omitempty"`
+	Subject        string `json:"subject,omitempty"`
+}
+
+type Request struct {
+	ID        string `json:"id,omitempty"`
+	Addr      string `json:"addr"`
+	Host      string `json:"host"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent"`
+}
+
+// Source identifies the sorcerer instance an event happened on.
+type Source struct {
+	Addr       string `json:"addr"`
+	InstanceID string `json:"instanceID"`
+}
+
+func newRecord(id string, event distribution.Event, source Source) Record {
+	return Record{
+		ID:        id,
+		Timestamp: event.Timestamp,
+		Action:    event.Action,
+		Target: Target{
+			MediaType:      event.MediaType,
+			Size:           event.Size,
+			Length:         event.Size,
+			Digest:         event.Digest,
+			Repository:     event.Repository,
+			Tag:            event.Tag,
+			FromRepository: event.From,
+			Subject:        event.Subject,
+		},
+		Request: Request{
+			ID:        event.Request.ID,
+			Addr:      event.Request.Addr,
+			Host:      event.Request.Host,
+			Method:    event.Request.Method,
+			UserAgent: event.Request.UserAgent,
+		},
+		Source: source,
+	}
+}
@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	"github.com/dvjn/sorcerer/internal/metrics"
+	"github.com/dvjn/sorcerer/internal/queue"
+	"github.com/rs/zerolog"
+)
+
+var (
+	deliveries      = metrics.NewCounter("sorcerer_webhook_deliveries_total", "Number of events delivered to webhook endpoints.")
+	deliveryRetries = metrics.NewCounter("sorcerer_webhook_retries_total", "Number of failed webhook deliveries that are retried.")
+	eventsDropped   = metrics.NewCounter("sorcerer_webhook_events_dropped_total", "Number of events dropped because a webhook queue was full or delivery failed too often.")
+)
+
+// SignatureHeader holds the HMAC-SHA256 of the body of a delivery, keyed
+// with the secret of the endpoint, as "sha256=" followed by the hex digest.
+const SignatureHeader = "X-Sorcerer-Signature"
+
+// Dispatcher delivers events to webhook endpoints. Every endpoint has its own
+// queue on disk, so that events survive restarts and an endpoint that is down
+// does not hold up the others. Failed deliveries are retried with backoff.
+type Dispatcher struct {
+	endpoints []*Endpoint
+	source    Source
+	client    *http.Client
+	logger    *zerolog.Logger
+}
+
+func New(c *config.WebhooksConfig, logger *zerolog.Logger) (*Dispatcher, error) {
+	endpoints, err := loadEndpoints(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, endpoint := range endpoints {
+		endpoint.queue, err = queue.Open(filepath.Join(c.QueuePath, endpoint.Name), queue.Options{
+			MaxJobs:     c.MaxEvents,
+			MaxAttempts: c.MaxAttempts,
+			MinBackoff:  time.Second,
+			MaxBackoff:  c.MaxBackoff,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	return &Dispatcher{
+		endpoints: endpoints,
+		source:    Source{Addr: hostname, InstanceID: rand.Text()},
+		client:    &http.Client{Timeout: c.Timeout},
+		logger:    logger,
+	}, nil
+}
+
+// Notify queues an event for delivery to every endpoint it matches.
+func (d *Dispatcher) Notify(event distribution.Event) {
+	var body []byte
+	for _, endpoint := range d.endpoints {
+		if !endpoint.matches(event) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			body, err = json.Marshal(Envelope{Events: []Record{newRecord(rand.Text(), event, d.source)}})
+			if err != nil {
+				d.logger.Error().Err(err).Msg("failed to encode event")
+				return
+			}
+		}
+
+		err := endpoint.queue.Push(json.RawMessage(body))
+		if errors.Is(err, queue.ErrFull) {
+			eventsDropped.Inc()
+			d.logger.Warn().Str("endpoint", endpoint.Name).Str("action", event.Action).Str("repository", event.Repository).Msg("webhook queue is full, dropping event")
+		} else if err != nil {
+			d.logger.Error().Err(err).Str("endpoint", endpoint.Name).Msg("failed to queue event")
+		}
+	}
+}
+
+// Run delivers queued events until ctx is cancelled. Events are delivered to
+// an endpoint one at a time, in the order they happened unless they are
+// retried.
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, endpoint := range d.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			endpoint.queue.Run(ctx, 1, func(ctx context.Context, job queue.Job) error {
+				return d.handle(ctx, endpoint, job)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) handle(ctx context.Context, endpoint *Endpoint, job queue.Job) error {
+	logger := d.logger.With().Str("endpoint", endpoint.Name).Str("job", job.ID).Int("attempt", job.Attempts+1).Logger()
+
+	err := d.deliver(ctx, endpoint, job.Payload)
+	if err != nil && ctx.Err() == nil {
+		if endpoint.queue.IsLastAttempt(job) {
+			eventsDropped.Inc()
+			logger.Error().Err(err).Msg("webhook delivery failed, giving up")
+		} else {
+			deliveryRetries.Inc()
+			logger.Warn().Err(err).Msg("webhook delivery failed, retrying")
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	deliveries.Inc()
+	logger.Debug().Msg("delivered webhook")
+	return nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, endpoint *Endpoint, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range endpoint.Headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", MediaType)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(endpoint.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a body, as sent in SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
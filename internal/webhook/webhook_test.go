@@ -0,0 +1,290 @@
+package webhook_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvjn/sorcerer/internal/config"
+	"github.com/dvjn/sorcerer/internal/distribution"
+	mem_store "github.com/dvjn/sorcerer/internal/store/mem_store"
+	"github.com/dvjn/sorcerer/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// receiver records the events delivered to it, failing the first deliveries
+// if asked to.
+type receiver struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	failures int
+	records  []webhook.Record
+	badSigs  int
+}
+
+func newReceiver(t *testing.T, secret string, failures int) *receiver {
+	t.Helper()
+
+	rec := &receiver{secret: secret, failures: failures}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		if rec.failures > 0 {
+			rec.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("Content-Type") != webhook.MediaType || (rec.secret != "" && r.Header.Get(webhook.SignatureHeader) != webhook.Sign(rec.secret, body)) {
+			rec.badSigs++
+		}
+
+		var envelope webhook.Envelope
+		json.Unmarshal(body, &envelope)
+		rec.records = append(rec.records, envelope.Events...)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *receiver) actions() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	var actions []string
+	for _, record := range rec.records {
+		actions = append(actions, record.Action+" "+record.Target.Repository)
+	}
+	return actions
+}
+
+func newDispatcher(t *testing.T, c config.WebhooksConfig) *webhook.Dispatcher {
+	t.Helper()
+
+	if c.QueuePath == "" {
+		c.QueuePath = t.TempDir()
+	}
+	if c.MaxEvents == 0 {
+		c.MaxEvents = 100
+	}
+	c.MaxAttempts = 10
+	c.MaxBackoff = time.Second
+	c.Timeout = time.Second
+
+	logger := zerolog.Nop()
+	d, err := webhook.New(&c, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create dispatcher: %v", err)
+	}
+	return d
+}
+
+func run(t *testing.T, d *webhook.Dispatcher) {
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func newRegistry(t *testing.T, d *webhook.Dispatcher) *httptest.Server {
+	t.Helper()
+
+	s, err := mem_store.New(&config.StoreConfig{})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Mount("/v2", distribution.New(s, func(next http.Handler) http.Handler { return next }, nil, d).Router())
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func send(t *testing.T, method, url, contentType, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.Fatalf("%s %s failed with %d", method, url, resp.StatusCode)
+	}
+	return resp
+}
+
+func eventually(t *testing.T, condition func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEvents(t *testing.T) {
+	all := newReceiver(t, "secret", 0)
+	pushes := newReceiver(t, "", 0)
+	d := newDispatcher(t, config.WebhooksConfig{Endpoints: fmt.Sprintf(`[
+		{"name": "all", "url": %q, "secret": "secret"},
+		{"name": "pushes", "url": %q, "actions": ["manifest.push"], "repositories": ["team/*"]}
+	]`, all.URL, pushes.URL)})
+	run(t, d)
+	registry := newRegistry(t, d)
+
+	// A monolithic upload, a chunked upload and a mount
+	send(t, http.MethodPost, registry.URL+"/v2/team/app/blobs/uploads/?digest="+digestOf("{}"), "application/octet-stream", "{}")
+	resp := send(t, http.MethodPost, registry.URL+"/v2/team/app/blobs/uploads/", "", "")
+	send(t, http.MethodPut, registry.URL+resp.Header.Get("Location")+"?digest="+digestOf("layer"), "application/octet-stream", "layer")
+	send(t, http.MethodPost, registry.URL+"/v2/other/app/blobs/uploads/?mount="+digestOf("layer")+"&from=team/app", "", "")
+
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":5}]}`,
+		digestOf("{}"), digestOf("layer"))
+	referrer := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.example.sbom","config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2}],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":%q,"size":%d}}`,
+		digestOf("{}"), digestOf("{}"), digestOf(manifest), len(manifest))
+	send(t, http.MethodPut, registry.URL+"/v2/team/app/manifests/latest", "application/vnd.oci.image.manifest.v1+json", manifest)
+	send(t, http.MethodPut, registry.URL+"/v2/team/app/manifests/"+digestOf(referrer), "application/vnd.oci.image.manifest.v1+json", referrer)
+	send(t, http.MethodDelete, registry.URL+"/v2/team/app/manifests/latest", "", "")
+	send(t, http.MethodDelete, registry.URL+"/v2/team/app/manifests/"+digestOf(manifest), "", "")
+
+	want := []string{
+		"blob.push team/app",
+		"blob.push team/app",
+		"blob.mount other/app",
+		"manifest.push team/app",
+		"manifest.push team/app",
+		"referrer.add team/app",
+		"tag.delete team/app",
+		"manifest.delete team/app",
+	}
+	if !eventually(t, func() bool { return len(all.actions()) == len(want) }) {
+		t.Fatalf("Expected %d events, got %v", len(want), all.actions())
+	}
+	if got := all.actions(); !slices.Equal(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+
+	all.mu.Lock()
+	badSigs := all.badSigs
+	push := all.records[3]
+	mount := all.records[2]
+	referrerAdd := all.records[5]
+	all.mu.Unlock()
+	if badSigs != 0 {
+		t.Errorf("Expected deliveries to be signed, got %d bad signatures", badSigs)
+	}
+	if push.Target.Tag != "latest" || push.Target.Digest != digestOf(manifest) || push.Target.Size != int64(len(manifest)) || push.Request.Method != http.MethodPut || push.ID == "" {
+		t.Errorf("Unexpected manifest push: %+v", push)
+	}
+	if mount.Target.FromRepository != "team/app" || mount.Target.Size != 5 {
+		t.Errorf("Unexpected blob mount: %+v", mount)
+	}
+	if referrerAdd.Target.Subject != digestOf(manifest) || referrerAdd.Target.Digest != digestOf(referrer) {
+		t.Errorf("Unexpected referrer: %+v", referrerAdd)
+	}
+
+	if got := pushes.actions(); !slices.Equal(got, []string{"manifest.push team/app", "manifest.push team/app"}) {
+		t.Errorf("Expected only manifest pushes to team repositories, got %v", got)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	rec := newReceiver(t, "", 1)
+	d := newDispatcher(t, config.WebhooksConfig{Endpoints: fmt.Sprintf(`[{"name": "flaky", "url": %q}]`, rec.URL)})
+	run(t, d)
+	registry := newRegistry(t, d)
+
+	send(t, http.MethodPost, registry.URL+"/v2/app/blobs/uploads/?digest="+digestOf("{}"), "application/octet-stream", "{}")
+
+	if !eventually(t, func() bool { return len(rec.actions()) == 1 }) {
+		t.Fatal("Expected event to be delivered after a failure")
+	}
+}
+
+func TestQueueSurvivesRestarts(t *testing.T) {
+	rec := newReceiver(t, "", 0)
+	c := config.WebhooksConfig{
+		Endpoints: fmt.Sprintf(`[{"name": "hook", "url": %q}]`, rec.URL),
+		QueuePath: t.TempDir(),
+		MaxEvents: 2,
+	}
+
+	// Events are only queued while the dispatcher is not running
+	registry := newRegistry(t, newDispatcher(t, c))
+	for _, blob := range []string{"a", "b", "c"} {
+		send(t, http.MethodPost, registry.URL+"/v2/app/blobs/uploads/?digest="+digestOf(blob), "application/octet-stream", blob)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(c.QueuePath, "hook"))
+	if len(entries) != 2 {
+		t.Fatalf("Expected the queue to hold 2 events, got %d", len(entries))
+	}
+
+	run(t, newDispatcher(t, c))
+	if !eventually(t, func() bool { return len(rec.actions()) == 2 }) {
+		t.Fatalf("Expected queued events to be delivered after a restart, got %v", rec.actions())
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.records[0].Target.Digest != digestOf("a") || rec.records[1].Target.Digest != digestOf("b") {
+		t.Errorf("Expected the first events to be kept, got %+v", rec.records)
+	}
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	logger := zerolog.Nop()
+	for _, endpoints := range []string{
+		`not json`,
+		`[{"name": "", "url": "http://hooks"}]`,
+		`[{"name": "../escape", "url": "http://hooks"}]`,
+		`[{"name": "a", "url": "http://hooks"}, {"name": "a", "url": "http://hooks"}]`,
+		`[{"name": "a", "url": "hooks"}]`,
+		`[{"name": "a", "url": "http://hooks", "actions": ["manifest.pull"]}]`,
+		`[{"name": "a", "url": "http://hooks", "repositories": ["["]}]`,
+	} {
+		c := &config.WebhooksConfig{Endpoints: endpoints, QueuePath: t.TempDir()}
+		if _, err := webhook.New(c, &logger); err == nil {
+			t.Errorf("Expected endpoints %s to be rejected", endpoints)
+		}
+	}
+}